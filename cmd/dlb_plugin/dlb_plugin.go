@@ -107,10 +107,13 @@ func (dp *DevicePlugin) scan() dpapi.DeviceTree {
 }
 
 func main() {
+	frameworkOptions := dpapi.NewOptions()
+	frameworkOptions.AddFlags(flag.CommandLine)
+
 	flag.Parse()
 	klog.V(1).Infof("DLB device plugin started")
 
 	plugin := NewDevicePlugin(dlbDeviceFilePathRE, sysfsDir)
-	manager := dpapi.NewManager(namespace, plugin)
+	manager := dpapi.NewManager(namespace, plugin, frameworkOptions)
 	manager.Run()
 }
@@ -37,6 +37,10 @@ func main() {
 	var sharedDevNum int
 
 	flag.IntVar(&sharedDevNum, "shared-dev-num", 1, "number of containers sharing the same work queue")
+
+	frameworkOptions := dpapi.NewOptions()
+	frameworkOptions.AddFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	if sharedDevNum < 1 {
@@ -49,7 +53,7 @@ func main() {
 		klog.Fatal("Cannot create device plugin, please check above error messages.")
 	}
 
-	manager := dpapi.NewManager(namespace, plugin)
+	manager := dpapi.NewManager(namespace, plugin, frameworkOptions)
 
 	manager.Run()
 }
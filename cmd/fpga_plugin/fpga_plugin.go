@@ -359,6 +359,10 @@ func main() {
 	flag.StringVar(&nodename, "node-name", os.Getenv("NODE_NAME"), "node name in the cluster to query mode annotation from")
 	flag.StringVar(&mode, "mode", string(afMode),
 		fmt.Sprintf("device plugin mode: '%s' (default), '%s' or '%s'", afMode, regionMode, regionDevelMode))
+
+	frameworkOptions := dpapi.NewOptions()
+	frameworkOptions.AddFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	nodeMode, err := getModeOverrideFromCluster(nodename, kubeconfig, master, mode)
@@ -380,6 +384,6 @@ func main() {
 	}
 
 	klog.V(1).Infof("FPGA device plugin (%s) started in %s mode%s", plugin.name, mode, modeMessage)
-	manager := dpapi.NewManager(namespace, plugin)
+	manager := dpapi.NewManager(namespace, plugin, frameworkOptions)
 	manager.Run()
 }
@@ -55,9 +55,20 @@ const (
 
 type cliOptions struct {
 	preferredAllocationPolicy string
+	allowedPCIIDs             string
+	// attributeMatchers limits the advertised GPUs to the ones whose sysfs
+	// attributes match, in addition to allowedPCIIDs.
+	attributeMatchers pluginutils.AttributeMatchers
+	// rasCorrectableThreshold is the number of correctable errors above which
+	// GPUs are reported degraded, zero disables it.
+	rasCorrectableThreshold uint64
+	// rasUncorrectableThreshold is the number of uncorrectable errors at
+	// which GPUs are reported unhealthy.
+	rasUncorrectableThreshold uint64
 	sharedDevNum              int
 	enableMonitoring          bool
 	resourceManagement        bool
+	enableRAS                 bool
 }
 
 type preferredAllocationPolicyFunc func(*pluginapi.ContainerPreferredAllocationRequest) []string
@@ -154,8 +165,16 @@ type devicePlugin struct {
 
 	resMan rm.ResourceManager
 
+	// allowedIDs limits the advertised GPUs to known PCI vendor:device IDs.
+	allowedIDs pluginutils.PCIIDAllowlist
+	// rejected contains the GPUs already reported as not allowed.
+	rejected map[string]bool
+	// ras derives the GPU health from the EDAC counters, nil if disabled.
+	ras *rasMonitor
+
 	sysfsDir string
 	devfsDir string
+	vfioDir  string
 
 	// Note: If restarting the plugin with a new policy, the allocations for existing pods remain with old policy.
 	policy  preferredAllocationPolicyFunc
@@ -166,16 +185,23 @@ func newDevicePlugin(sysfsDir, devfsDir string, options cliOptions) *devicePlugi
 	dp := &devicePlugin{
 		sysfsDir:         sysfsDir,
 		devfsDir:         devfsDir,
+		vfioDir:          path.Join(path.Dir(devfsDir), "vfio"),
 		options:          options,
 		gpuDeviceReg:     regexp.MustCompile(gpuDeviceRE),
 		controlDeviceReg: regexp.MustCompile(controlDeviceRE),
 		scanTicker:       time.NewTicker(scanPeriod),
 		scanDone:         make(chan bool, 1), // buffered as we may send to it before Scan starts receiving from it
+		rejected:         make(map[string]bool),
 	}
 
-	if options.resourceManagement {
-		var err error
+	var err error
+
+	if dp.allowedIDs, err = pluginutils.ParsePCIIDAllowlist(options.allowedPCIIDs); err != nil {
+		klog.Errorf("Failed to parse allowed PCI IDs: %+v", err)
+		return nil
+	}
 
+	if options.resourceManagement {
 		dp.resMan, err = rm.NewResourceManager(monitorID, namespace+"/"+deviceType)
 		if err != nil {
 			klog.Errorf("Failed to create resource manager: %+v", err)
@@ -183,6 +209,10 @@ func newDevicePlugin(sysfsDir, devfsDir string, options cliOptions) *devicePlugi
 		}
 	}
 
+	if options.enableRAS {
+		dp.ras = newRASMonitor(sysfsEdacDirectory, options.rasCorrectableThreshold, options.rasUncorrectableThreshold)
+	}
+
 	switch options.preferredAllocationPolicy {
 	case "balanced":
 		dp.policy = balancedPolicy
@@ -197,7 +227,9 @@ func newDevicePlugin(sysfsDir, devfsDir string, options cliOptions) *devicePlugi
 
 // Implement the PreferredAllocator interface.
 func (dp *devicePlugin) GetPreferredAllocation(rqt *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	if dp.resMan != nil {
+	isMdev := isMdevPreferredAllocationRequest(rqt)
+
+	if dp.resMan != nil && !isMdev {
 		return dp.resMan.GetPreferredFractionalAllocation(rqt)
 	}
 
@@ -214,10 +246,16 @@ func (dp *devicePlugin) GetPreferredAllocation(rqt *pluginapi.PreferredAllocatio
 
 			var err = errors.Errorf("AllocationSize (%d) is greater than the number of available device IDs (%d)", req.AllocationSize, len(req.AvailableDeviceIDs))
 
-			return nil, err
+			return nil, dpapi.NewAllocationError(dpapi.ResourcesExhausted, req.AvailableDeviceIDs, err)
+		}
+
+		policy := dp.policy
+		// The policies group shared GPU device IDs by their card, mdevs are all separate.
+		if isMdev {
+			policy = nonePolicy
 		}
 
-		IDs := dp.policy(req)
+		IDs := policy(req)
 
 		resp := &pluginapi.ContainerPreferredAllocationResponse{
 			DeviceIDs: IDs,
@@ -273,7 +311,45 @@ func (dp *devicePlugin) isCompatibleDevice(name string) bool {
 		return false
 	}
 
-	return true
+	return dp.isAllowedDevice(name)
+}
+
+func (dp *devicePlugin) isAllowedDevice(name string) bool {
+	if dp.allowedIDs == nil && len(dp.options.attributeMatchers) == 0 {
+		return true
+	}
+
+	err := dp.checkAllowedDevice(path.Join(dp.sysfsDir, name, "device"))
+	if err == nil {
+		delete(dp.rejected, name)
+		return true
+	}
+
+	// Report rejections only once to not flood the log on every scan.
+	if !dp.rejected[name] {
+		klog.Warningf("Not advertising %s: %v", name, err)
+
+		dp.rejected[name] = true
+	}
+
+	return false
+}
+
+// checkAllowedDevice returns an error telling why the device in the sysfs
+// directory is not allowed by the PCI ID allowlist or the attribute matchers.
+func (dp *devicePlugin) checkAllowedDevice(sysfsDevicePath string) error {
+	if dp.allowedIDs != nil {
+		vendor, device, err := pluginutils.ReadPCIIDs(sysfsDevicePath)
+		if err != nil {
+			return errors.Wrap(err, "can't read its PCI IDs")
+		}
+
+		if !dp.allowedIDs.Allowed(vendor, device) {
+			return errors.Errorf("PCI ID %s:%s is not in the allowed list", vendor, device)
+		}
+	}
+
+	return dp.options.attributeMatchers.Match(sysfsDevicePath)
 }
 
 func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
@@ -301,6 +377,8 @@ func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
 
 		isPFwithVFs := pluginutils.IsSriovPFwithVFs(path.Join(dp.sysfsDir, f.Name()))
 
+		dp.scanMdevs(devTree, f.Name())
+
 		for _, drmFile := range drmFiles {
 			if dp.controlDeviceReg.MatchString(drmFile.Name()) {
 				//Skipping possible drm control node
@@ -333,7 +411,7 @@ func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
 		}
 
 		if len(nodes) > 0 {
-			deviceInfo := dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil, nil)
+			deviceInfo := dpapi.NewDeviceInfo(dp.health(f.Name()), nodes, nil, nil, nil)
 
 			for i := 0; i < dp.options.sharedDevNum; i++ {
 				devID := fmt.Sprintf("%s-%d", f.Name(), i)
@@ -358,8 +436,18 @@ func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
 	return devTree, nil
 }
 
+// health returns the health of the GPU, which is healthy unless the RAS
+// monitoring tells otherwise.
+func (dp *devicePlugin) health(name string) string {
+	if dp.ras == nil {
+		return pluginapi.Healthy
+	}
+
+	return dp.ras.health(name, path.Join(dp.sysfsDir, name, "device"))
+}
+
 func (dp *devicePlugin) Allocate(request *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	if dp.resMan != nil {
+	if dp.resMan != nil && !isMdevAllocateRequest(request) {
 		return dp.resMan.CreateFractionalResourceResponse(request)
 	}
 
@@ -373,6 +461,18 @@ func main() {
 	flag.BoolVar(&opts.resourceManagement, "resource-manager", false, "fractional GPU resource management")
 	flag.IntVar(&opts.sharedDevNum, "shared-dev-num", 1, "number of containers sharing the same GPU device")
 	flag.StringVar(&opts.preferredAllocationPolicy, "allocation-policy", "none", "modes of allocating GPU devices: balanced, packed and none")
+	flag.StringVar(&opts.allowedPCIIDs, "allowed-pci-ids", "", "comma separated list of vendor:device PCI IDs of GPUs allowed to be advertised, e.g. 0x8086:0x56a0 (default: all)")
+	flag.Var(&opts.attributeMatchers, "device-attribute-match",
+		"attribute=regexp advertising only the GPUs whose sysfs device attribute matches, e.g. subsystem_device=^0x1020$, "+
+			"can be given several times (default: all)")
+	flag.BoolVar(&opts.enableRAS, "enable-ras", false, "derive the GPU health from the EDAC error counters of the GPUs")
+	flag.Uint64Var(&opts.rasCorrectableThreshold, "ras-correctable-threshold", 0,
+		"number of correctable errors above which a GPU is reported degraded (default: disabled)")
+	flag.Uint64Var(&opts.rasUncorrectableThreshold, "ras-uncorrectable-threshold", 1, "number of uncorrectable errors at which a GPU is reported unhealthy")
+
+	frameworkOptions := dpapi.NewOptions()
+	frameworkOptions.AddFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	if opts.sharedDevNum < 1 {
@@ -385,6 +485,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if opts.enableRAS && opts.rasUncorrectableThreshold == 0 {
+		klog.Error("The uncorrectable error threshold must be greater than zero")
+		os.Exit(1)
+	}
+
 	var str = opts.preferredAllocationPolicy
 	if !(str == "balanced" || str == "packed" || str == "none") {
 		klog.Error("invalid value for preferredAllocationPolicy, the valid values: balanced, packed, none")
@@ -394,6 +499,10 @@ func main() {
 	klog.V(1).Infof("GPU device plugin started with %s preferred allocation policy", opts.preferredAllocationPolicy)
 
 	plugin := newDevicePlugin(sysfsDrmDirectory, devfsDriDirectory, opts)
-	manager := dpapi.NewManager(namespace, plugin)
+	if plugin == nil {
+		os.Exit(1)
+	}
+
+	manager := dpapi.NewManager(namespace, plugin, frameworkOptions)
 	manager.Run()
 }
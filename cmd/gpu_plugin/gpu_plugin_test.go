@@ -25,6 +25,7 @@ import (
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
 	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/gpu_plugin/rm"
+	"github.com/intel/intel-device-plugins-for-kubernetes/cmd/internal/pluginutils"
 	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
 )
 
@@ -37,12 +38,14 @@ type mockNotifier struct {
 	scanDone     chan bool
 	devCount     int
 	monitorCount int
+	mdevCount    int
 }
 
 // Notify stops plugin Scan.
 func (n *mockNotifier) Notify(newDeviceTree dpapi.DeviceTree) {
 	n.monitorCount = len(newDeviceTree[monitorType])
 	n.devCount = len(newDeviceTree[deviceType])
+	n.mdevCount = len(newDeviceTree[mdevType])
 	n.scanDone <- true
 }
 
@@ -90,6 +93,10 @@ func TestNewDevicePlugin(t *testing.T) {
 	if newDevicePlugin("", "", cliOptions{sharedDevNum: 2, resourceManagement: true}) != nil {
 		t.Error("Unexpectedly managed to create resource management enabled plugin inside unit tests")
 	}
+
+	if newDevicePlugin("", "", cliOptions{sharedDevNum: 1, allowedPCIIDs: "8086:56a0"}) != nil {
+		t.Error("Unexpectedly managed to create plugin with malformed allowed PCI IDs")
+	}
 }
 
 func TestGetPreferredAllocation(t *testing.T) {
@@ -157,18 +164,41 @@ func TestAllocate(t *testing.T) {
 	}
 }
 
+func newAttributeMatchers(rules ...string) pluginutils.AttributeMatchers {
+	matchers := pluginutils.AttributeMatchers{}
+
+	for _, rule := range rules {
+		if err := matchers.Set(rule); err != nil {
+			panic(err)
+		}
+	}
+
+	return matchers
+}
+
+func TestAttributeMatchersFlag(t *testing.T) {
+	for _, invalid := range []string{"subsystem_device", "=0x1020", "/sys/vendor=0x8086", "../vendor=0x8086", "vendor=(0x8086"} {
+		matchers := pluginutils.AttributeMatchers{}
+		if err := matchers.Set(invalid); err == nil {
+			t.Errorf("invalid attribute match %q was accepted", invalid)
+		}
+	}
+}
+
 func TestScan(t *testing.T) {
 	tcases := []struct {
 		name string
 		// test-case environment
 		sysfsdirs  []string
 		sysfsfiles map[string][]byte
+		sysfslinks map[string]string
 		devfsdirs  []string
 		// how plugin should interpret it
 		options cliOptions
 		// what the result should be
 		expectedDevs     int
 		expectedMonitors int
+		expectedMdevs    int
 	}{
 		{
 			name: "no sysfs mounted",
@@ -270,6 +300,109 @@ func TestScan(t *testing.T) {
 			name:      "no sysfs records",
 			sysfsdirs: []string{"non_gpu_card"},
 		},
+		{
+			name: "allowed and unknown PCI IDs",
+			sysfsdirs: []string{
+				"card0/device/drm/card0",
+				"card1/device/drm/card1",
+			},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor": []byte("0x8086"),
+				"card0/device/device": []byte("0x56a0"),
+				"card1/device/vendor": []byte("0x8086"),
+				"card1/device/device": []byte("0xbeef"),
+			},
+			devfsdirs:    []string{"card0", "card1"},
+			options:      cliOptions{allowedPCIIDs: "0x8086:0x56a0"},
+			expectedDevs: 1,
+		},
+		{
+			name:      "allowed vendor wildcard",
+			sysfsdirs: []string{"card0/device/drm/card0"},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor": []byte("0x8086"),
+				"card0/device/device": []byte("0x56a1"),
+			},
+			devfsdirs:    []string{"card0"},
+			options:      cliOptions{allowedPCIIDs: "0x8086:*"},
+			expectedDevs: 1,
+		},
+		{
+			name:      "missing device ID with allowlist",
+			sysfsdirs: []string{"card0/device/drm/card0"},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor": []byte("0x8086"),
+			},
+			devfsdirs: []string{"card0"},
+			options:   cliOptions{allowedPCIIDs: "0x8086:0x56a0"},
+		},
+		{
+			name: "attribute matches",
+			sysfsdirs: []string{
+				"card0/device/drm/card0",
+				"card1/device/drm/card1",
+				"card2/device/drm/card2",
+			},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor":           []byte("0x8086"),
+				"card0/device/subsystem_device": []byte("0x1020\n"),
+				"card1/device/vendor":           []byte("0x8086"),
+				"card1/device/subsystem_device": []byte("0x2020\n"),
+				"card2/device/vendor":           []byte("0x8086"),
+			},
+			devfsdirs:    []string{"card0", "card1", "card2"},
+			options:      cliOptions{attributeMatchers: newAttributeMatchers("subsystem_device=^0x10")},
+			expectedDevs: 1,
+		},
+		{
+			name: "attribute matches and PCI IDs combined",
+			sysfsdirs: []string{
+				"card0/device/drm/card0",
+				"card1/device/drm/card1",
+			},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor":           []byte("0x8086"),
+				"card0/device/device":           []byte("0x56a0"),
+				"card0/device/subsystem_device": []byte("0x1020"),
+				"card1/device/vendor":           []byte("0x8086"),
+				"card1/device/device":           []byte("0x56a1"),
+				"card1/device/subsystem_device": []byte("0x1020"),
+			},
+			devfsdirs: []string{"card0", "card1"},
+			options: cliOptions{
+				allowedPCIIDs:     "0x8086:0x56a0",
+				attributeMatchers: newAttributeMatchers("subsystem_device=^0x1020$", "vendor=0x8086"),
+			},
+			expectedDevs: 1,
+		},
+		{
+			name: "one device with mdevs",
+			sysfsdirs: []string{
+				"card0/device/drm/card0",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c01",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c02",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c03",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c04",
+				"card0/device/mdev_supported_types",
+			},
+			sysfsfiles: map[string][]byte{
+				"card0/device/vendor": []byte("0x8086"),
+			},
+			sysfslinks: map[string]string{
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c01/mdev_type":   "../mdev_supported_types/i915-GVTg_V5_4",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c01/iommu_group": "../../../../kernel/iommu_groups/5",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c02/mdev_type":   "../mdev_supported_types/i915-GVTg_V5_4",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c02/iommu_group": "../../../../kernel/iommu_groups/6",
+				// no VFIO group node
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c03/mdev_type":   "../mdev_supported_types/i915-GVTg_V5_4",
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c03/iommu_group": "../../../../kernel/iommu_groups/7",
+				// not an mdev
+				"card0/device/4b20d080-1b54-4048-85b3-a6a62d165c04/iommu_group": "../../../../kernel/iommu_groups/8",
+			},
+			devfsdirs:     []string{"card0", "vfio/5", "vfio/6", "vfio/8"},
+			expectedDevs:  1,
+			expectedMdevs: 2,
+		},
 	}
 
 	for _, tc := range tcases {
@@ -290,7 +423,14 @@ func TestScan(t *testing.T) {
 				t.Errorf("unexpected error: %+v", err)
 			}
 
+			for link, target := range tc.sysfslinks {
+				if err = os.Symlink(target, path.Join(sysfs, link)); err != nil {
+					t.Fatalf("unable to create fake symlink: %+v", err)
+				}
+			}
+
 			plugin := newDevicePlugin(sysfs, devfs, tc.options)
+			plugin.vfioDir = path.Join(devfs, "vfio")
 
 			notifier := &mockNotifier{
 				scanDone: plugin.scanDone,
@@ -311,6 +451,10 @@ func TestScan(t *testing.T) {
 				t.Errorf("Expected %d, discovered %d monitors",
 					tc.expectedMonitors, notifier.monitorCount)
 			}
+			if tc.expectedMdevs != notifier.mdevCount {
+				t.Errorf("Expected %d, discovered %d mdevs",
+					tc.expectedMdevs, notifier.mdevCount)
+			}
 		})
 	}
 }
@@ -0,0 +1,108 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const (
+	// mdevType is the resource of the mediated devices (e.g. GVT-g vGPUs) created on the GPUs.
+	mdevType = "i915_mdev"
+	// mdevEnvPrefix is followed by the UUID of the allocated mdev in upper case
+	// with dashes replaced by underscores. The value is the UUID.
+	mdevEnvPrefix = "INTEL_GPU_MDEV_"
+	vfioDirectory = "/dev/vfio"
+	mdevUUIDRE    = `^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`
+)
+
+var mdevUUIDReg = regexp.MustCompile(mdevUUIDRE)
+
+// isMdevRequest tells if the device IDs are mdev UUIDs.
+func isMdevRequest(deviceIDs []string) bool {
+	return len(deviceIDs) > 0 && mdevUUIDReg.MatchString(deviceIDs[0])
+}
+
+// isMdevAllocateRequest tells if the request is for the mdev resource. Such
+// requests are left to the default allocation of the framework.
+func isMdevAllocateRequest(rqt *pluginapi.AllocateRequest) bool {
+	return len(rqt.ContainerRequests) > 0 && isMdevRequest(rqt.ContainerRequests[0].DevicesIDs)
+}
+
+func isMdevPreferredAllocationRequest(rqt *pluginapi.PreferredAllocationRequest) bool {
+	return len(rqt.ContainerRequests) > 0 && isMdevRequest(rqt.ContainerRequests[0].AvailableDeviceIDs)
+}
+
+// scanMdevs adds the mediated devices created on the GPU to devTree. An mdev
+// is a directory named by its UUID in the GPU's sysfs device directory. It's
+// passed to containers with the VFIO group node of its IOMMU group.
+func (dp *devicePlugin) scanMdevs(devTree dpapi.DeviceTree, gpuName string) {
+	deviceDir := path.Join(dp.sysfsDir, gpuName, "device")
+
+	files, err := os.ReadDir(deviceDir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		uuid := f.Name()
+		if !mdevUUIDReg.MatchString(uuid) {
+			continue
+		}
+
+		if _, err := os.Lstat(path.Join(deviceDir, uuid, "mdev_type")); err != nil {
+			continue
+		}
+
+		group, err := os.Readlink(path.Join(deviceDir, uuid, "iommu_group"))
+		if err != nil {
+			klog.Warningf("Skipping mdev %s of %s, can't read its IOMMU group: %v", uuid, gpuName, err)
+			continue
+		}
+
+		groupPath := path.Join(dp.vfioDir, path.Base(group))
+		if _, err := os.Stat(groupPath); err != nil {
+			continue
+		}
+
+		klog.V(4).Infof("Adding mdev %s of GPU %s with %s", uuid, gpuName, groupPath)
+
+		nodes := []pluginapi.DeviceSpec{
+			{
+				HostPath:      path.Join(dp.vfioDir, "vfio"),
+				ContainerPath: path.Join(vfioDirectory, "vfio"),
+				Permissions:   "rw",
+			},
+			{
+				HostPath:      groupPath,
+				ContainerPath: path.Join(vfioDirectory, path.Base(group)),
+				Permissions:   "rw",
+			},
+		}
+		envs := map[string]string{
+			mdevEnvPrefix + strings.ReplaceAll(strings.ToUpper(uuid), "-", "_"): uuid,
+		}
+
+		devTree.AddDevice(mdevType, uuid, dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, envs, nil))
+	}
+}
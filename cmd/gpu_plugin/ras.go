@@ -0,0 +1,193 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+)
+
+const (
+	// sysfsEdacDirectory is the directory of the EDAC memory controllers,
+	// which have the error counters of the devices they belong to.
+	sysfsEdacDirectory = "/sys/devices/system/edac/mc"
+	ceCountFile        = "ce_count"
+	ueCountFile        = "ue_count"
+)
+
+// rasState is the reliability state of a GPU derived from its error counters.
+type rasState int
+
+const (
+	rasOK rasState = iota
+	// rasDegraded GPUs are still advertised, but they are expected to fail.
+	rasDegraded
+	rasFailed
+)
+
+// rasStates is the RAS state of each GPU, 0 when it's healthy, 1 when it's
+// degraded and 2 when it's unhealthy.
+var rasStates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "device_plugin",
+	Subsystem: "gpu",
+	Name:      "ras_state",
+	Help:      "RAS state of the GPU derived from its EDAC error counters: 0 healthy, 1 degraded, 2 unhealthy.",
+}, []string{"device"})
+
+func init() {
+	dpapi.RegisterMetrics(rasStates)
+}
+
+// rasMonitor derives the health of the GPUs from their EDAC error counters.
+// Correctable errors accumulating past correctableThreshold mark the GPU
+// degraded and uncorrectable errors reaching uncorrectableThreshold mark it
+// unhealthy. GPUs without the counters are always healthy.
+type rasMonitor struct {
+	// states are the previous states of the GPUs for logging the changes.
+	states map[string]rasState
+	// edacDir is the directory of the EDAC memory controllers, mc0, mc1 and
+	// so on, whose device links tell the device they belong to.
+	edacDir                string
+	correctableThreshold   uint64
+	uncorrectableThreshold uint64
+}
+
+func newRASMonitor(edacDir string, correctableThreshold, uncorrectableThreshold uint64) *rasMonitor {
+	return &rasMonitor{
+		states:                 make(map[string]rasState),
+		edacDir:                edacDir,
+		correctableThreshold:   correctableThreshold,
+		uncorrectableThreshold: uncorrectableThreshold,
+	}
+}
+
+// health returns the device plugin health of the GPU in the sysfs directory.
+func (r *rasMonitor) health(name, sysfsDevicePath string) string {
+	state, err := r.state(sysfsDevicePath)
+	if err != nil {
+		klog.Warningf("Can't read the EDAC counters of %s: %v", name, err)
+	}
+
+	if previous := r.states[name]; state != previous {
+		switch state {
+		case rasDegraded:
+			klog.Warningf("GPU %s is degraded, its correctable errors exceed %d", name, r.correctableThreshold)
+		case rasFailed:
+			klog.Errorf("GPU %s is unhealthy, it has uncorrectable errors", name)
+		case rasOK:
+			klog.Infof("GPU %s has recovered", name)
+		}
+
+		r.states[name] = state
+	}
+
+	rasStates.WithLabelValues(name).Set(float64(state))
+
+	if state == rasFailed {
+		return pluginapi.Unhealthy
+	}
+
+	return pluginapi.Healthy
+}
+
+func (r *rasMonitor) state(sysfsDevicePath string) (rasState, error) {
+	controllers, err := r.memoryControllers(sysfsDevicePath)
+	if err != nil {
+		return rasOK, err
+	}
+
+	var correctable, uncorrectable uint64
+
+	// A GPU may have several memory controllers, e.g. one per tile.
+	for _, controller := range controllers {
+		count, err := readCounter(path.Join(controller, ueCountFile))
+		if err != nil {
+			return rasOK, err
+		}
+
+		uncorrectable += count
+
+		if count, err = readCounter(path.Join(controller, ceCountFile)); err != nil {
+			return rasOK, err
+		}
+
+		correctable += count
+	}
+
+	if uncorrectable >= r.uncorrectableThreshold {
+		return rasFailed, nil
+	}
+
+	if r.correctableThreshold > 0 && correctable > r.correctableThreshold {
+		return rasDegraded, nil
+	}
+
+	return rasOK, nil
+}
+
+// memoryControllers returns the directories of the EDAC memory controllers
+// of the device in the sysfs directory, whose device links resolve to it.
+func (r *rasMonitor) memoryControllers(sysfsDevicePath string) ([]string, error) {
+	device, err := filepath.EvalSymlinks(sysfsDevicePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// The EDAC directory is missing without EDAC drivers.
+	entries, err := filepath.Glob(path.Join(r.edacDir, "mc*", "device"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var controllers []string
+
+	for _, entry := range entries {
+		if target, err := filepath.EvalSymlinks(entry); err == nil && target == device {
+			controllers = append(controllers, path.Dir(entry))
+		}
+	}
+
+	return controllers, nil
+}
+
+// readCounter reads an EDAC counter file. A missing file reads as zero, as
+// not all GPUs and drivers support RAS.
+func readCounter(filePath string) (uint64, error) {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	count, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid counter %s", filePath)
+	}
+
+	return count, nil
+}
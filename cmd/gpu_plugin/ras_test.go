@@ -0,0 +1,191 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestRASMonitor(t *testing.T) {
+	type sample struct {
+		ce, ue        string
+		expectedState rasState
+	}
+
+	tcases := []struct {
+		name        string
+		progression []sample
+	}{
+		{
+			name: "no errors",
+			progression: []sample{
+				{ce: "0", ue: "0", expectedState: rasOK},
+				{ce: "0\n", ue: "0\n", expectedState: rasOK},
+			},
+		},
+		{
+			name: "rising correctable errors",
+			progression: []sample{
+				{ce: "3", ue: "0", expectedState: rasOK},
+				{ce: "10", ue: "0", expectedState: rasOK},
+				{ce: "11", ue: "0", expectedState: rasDegraded},
+				{ce: "250", ue: "0", expectedState: rasDegraded},
+			},
+		},
+		{
+			name: "uncorrectable error",
+			progression: []sample{
+				{ce: "0", ue: "0", expectedState: rasOK},
+				{ce: "20", ue: "0", expectedState: rasDegraded},
+				{ce: "20", ue: "1", expectedState: rasFailed},
+			},
+		},
+		{
+			name: "counters reset by a driver reload",
+			progression: []sample{
+				{ce: "2", ue: "1", expectedState: rasFailed},
+				{ce: "0", ue: "0", expectedState: rasOK},
+			},
+		},
+		{
+			name: "missing counters",
+			progression: []sample{
+				{expectedState: rasOK},
+			},
+		},
+		{
+			name: "invalid counter",
+			progression: []sample{
+				{ce: "0", ue: "many", expectedState: rasOK},
+			},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			deviceDir, edacDir := createTestRASFiles(t)
+
+			ras := newRASMonitor(edacDir, 10, 1)
+
+			for i, s := range tc.progression {
+				for file, value := range map[string]string{ceCountFile: s.ce, ueCountFile: s.ue} {
+					if value == "" {
+						continue
+					}
+
+					if err := os.WriteFile(path.Join(edacDir, "mc1", file), []byte(value), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				expectedHealth := v1beta1.Healthy
+				if s.expectedState == rasFailed {
+					expectedHealth = v1beta1.Unhealthy
+				}
+
+				if health := ras.health("card0", deviceDir); health != expectedHealth {
+					t.Errorf("sample %d: expected health %s, got %s", i, expectedHealth, health)
+				}
+
+				if state := ras.states["card0"]; state != s.expectedState {
+					t.Errorf("sample %d: expected state %d, got %d", i, s.expectedState, state)
+				}
+
+				if metric := testutil.ToFloat64(rasStates.WithLabelValues("card0")); metric != float64(s.expectedState) {
+					t.Errorf("sample %d: expected the state metric %d, got %v", i, s.expectedState, metric)
+				}
+			}
+		})
+	}
+}
+
+func TestRASMonitorWithoutDegradedThreshold(t *testing.T) {
+	deviceDir, edacDir := createTestRASFiles(t)
+
+	if err := os.WriteFile(path.Join(edacDir, "mc1", ceCountFile), []byte("100000"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ras := newRASMonitor(edacDir, 0, 1)
+
+	if health := ras.health("card0", deviceDir); health != v1beta1.Healthy || ras.states["card0"] != rasOK {
+		t.Errorf("expected a healthy GPU, got %s in state %d", health, ras.states["card0"])
+	}
+}
+
+func TestRASMonitorWithSeveralControllers(t *testing.T) {
+	deviceDir, edacDir := createTestRASFiles(t)
+
+	if err := os.MkdirAll(path.Join(edacDir, "mc2"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(deviceDir, path.Join(edacDir, "mc2", "device")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The correctable errors of the GPU add up over its memory controllers,
+	// the errors of the other device don't count.
+	for controller, count := range map[string]string{"mc0": "100", "mc1": "6", "mc2": "6"} {
+		if err := os.WriteFile(path.Join(edacDir, controller, ceCountFile), []byte(count), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ras := newRASMonitor(edacDir, 10, 1)
+
+	if health := ras.health("card0", deviceDir); health != v1beta1.Healthy || ras.states["card0"] != rasDegraded {
+		t.Errorf("expected a degraded GPU, got %s in state %d", health, ras.states["card0"])
+	}
+}
+
+// createTestRASFiles creates the sysfs device directory of card0 and an EDAC
+// directory with the memory controller mc1 of card0 and mc0 of another device.
+func createTestRASFiles(t *testing.T) (deviceDir, edacDir string) {
+	t.Helper()
+
+	root := t.TempDir()
+	edacDir = path.Join(root, "edac", "mc")
+	deviceDir = path.Join(root, "drm", "card0", "device")
+
+	for _, dir := range []string{
+		path.Join(root, "pci", "0000:00:01.0"),
+		path.Join(root, "pci", "0000:00:02.0"),
+		path.Join(edacDir, "mc0"),
+		path.Join(edacDir, "mc1"),
+		path.Dir(deviceDir),
+	} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for link, target := range map[string]string{
+		deviceDir:                           path.Join(root, "pci", "0000:00:02.0"),
+		path.Join(edacDir, "mc0", "device"): path.Join(root, "pci", "0000:00:01.0"),
+		path.Join(edacDir, "mc1", "device"): path.Join(root, "pci", "0000:00:02.0"),
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return deviceDir, edacDir
+}
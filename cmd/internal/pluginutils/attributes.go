@@ -0,0 +1,85 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pluginutils
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AttributeMatcher matches the value of a sysfs attribute of a device.
+type AttributeMatcher struct {
+	regexp *regexp.Regexp
+	// Attribute is the path of the attribute file relative to the sysfs
+	// directory of the device, e.g. subsystem_device.
+	Attribute string
+}
+
+// AttributeMatchers limits the devices to the ones whose sysfs attributes match
+// all the matchers. It implements flag.Value and can be given several times as
+// "attribute=regexp", e.g. "subsystem_device=^0x10(20|21)$".
+type AttributeMatchers []AttributeMatcher
+
+func (a *AttributeMatchers) String() string {
+	entries := make([]string, 0, len(*a))
+
+	for _, matcher := range *a {
+		entries = append(entries, matcher.Attribute+"="+matcher.regexp.String())
+	}
+
+	return strings.Join(entries, ",")
+}
+
+// Set adds an "attribute=regexp" matcher.
+func (a *AttributeMatchers) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid attribute match %q, expected attribute=regexp", value)
+	}
+
+	if path.IsAbs(parts[0]) || path.Clean(parts[0]) != parts[0] || strings.HasPrefix(parts[0], "..") {
+		return errors.Errorf("invalid attribute %q, expected a clean path relative to the device", parts[0])
+	}
+
+	re, err := regexp.Compile(parts[1])
+	if err != nil {
+		return errors.Wrapf(err, "invalid regexp for attribute %s", parts[0])
+	}
+
+	*a = append(*a, AttributeMatcher{Attribute: parts[0], regexp: re})
+
+	return nil
+}
+
+// Match returns an error telling the first attribute of the device in the sysfs
+// directory which doesn't match, or can't be read. It returns nil if all match.
+func (a AttributeMatchers) Match(sysfsDevicePath string) error {
+	for _, matcher := range a {
+		value, err := os.ReadFile(path.Join(sysfsDevicePath, matcher.Attribute))
+		if err != nil {
+			return errors.Wrapf(err, "can't read attribute %s", matcher.Attribute)
+		}
+
+		if trimmed := strings.TrimSpace(string(value)); !matcher.regexp.MatchString(trimmed) {
+			return errors.Errorf("attribute %s value %q doesn't match %s", matcher.Attribute, trimmed, matcher.regexp)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pluginutils
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const anyPCIDevice = "*"
+
+var pciIDRegexp = regexp.MustCompile(`^0x[0-9a-f]{4}$`)
+
+// PCIIDAllowlist contains the allowed PCI vendor and device ID pairs.
+// A nil allowlist allows all devices.
+type PCIIDAllowlist map[string]map[string]bool
+
+// ParsePCIIDAllowlist parses a comma separated list of vendor:device pairs,
+// e.g. "0x8086:0x56a0,0x8086:0x56a1". "*" as the device ID allows
+// all devices of the vendor.
+func ParsePCIIDAllowlist(list string) (PCIIDAllowlist, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	allowlist := make(PCIIDAllowlist)
+
+	for _, entry := range strings.Split(list, ",") {
+		ids := strings.Split(strings.ToLower(strings.TrimSpace(entry)), ":")
+		if len(ids) != 2 || !pciIDRegexp.MatchString(ids[0]) ||
+			(ids[1] != anyPCIDevice && !pciIDRegexp.MatchString(ids[1])) {
+			return nil, errors.Errorf("invalid PCI ID pair %q, expected vendor:device, e.g. 0x8086:0x56a0", entry)
+		}
+
+		if _, ok := allowlist[ids[0]]; !ok {
+			allowlist[ids[0]] = make(map[string]bool)
+		}
+
+		allowlist[ids[0]][ids[1]] = true
+	}
+
+	return allowlist, nil
+}
+
+// Allowed returns true if the vendor and device ID pair is in the allowlist.
+func (a PCIIDAllowlist) Allowed(vendor, device string) bool {
+	if a == nil {
+		return true
+	}
+
+	devices, ok := a[strings.ToLower(vendor)]
+
+	return ok && (devices[anyPCIDevice] || devices[strings.ToLower(device)])
+}
+
+// ReadPCIIDs returns the vendor and device IDs of the PCI device in the given sysfs directory.
+func ReadPCIIDs(sysfsDevicePath string) (string, string, error) {
+	vendor, err := os.ReadFile(path.Join(sysfsDevicePath, "vendor"))
+	if err != nil {
+		return "", "", errors.Wrap(err, "can't read vendor ID")
+	}
+
+	device, err := os.ReadFile(path.Join(sysfsDevicePath, "device"))
+	if err != nil {
+		return "", "", errors.Wrap(err, "can't read device ID")
+	}
+
+	return strings.TrimSpace(string(vendor)), strings.TrimSpace(string(device)), nil
+}
@@ -162,6 +162,10 @@ func main() {
 		mgr.GetWebhookServer().Register("/pods-sgx", &webhook.Admission{
 			Handler: &sgxwebhook.Mutator{Client: mgr.GetClient()},
 		})
+
+		mgr.GetWebhookServer().Register("/pods-sgx-validate", &webhook.Admission{
+			Handler: &sgxwebhook.Validator{Client: mgr.GetClient()},
+		})
 	}
 
 	if contains(devices, "fpga") {
@@ -43,6 +43,10 @@ func main() {
 	kernelVfDrivers := flag.String("kernel-vf-drivers", "c6xxvf,4xxxvf", "Comma separated VF Device Driver of the QuickAssist Devices in the system. Devices supported: DH895xCC, C62x, C3xxx, C4xxx, 4xxx, and D15xx")
 	preferredAllocationPolicy := flag.String("allocation-policy", "", "Modes of allocating QAT devices: balanced and packed")
 	maxNumDevices := flag.Int("max-num-devices", 32, "maximum number of QAT devices to be provided to the QuickAssist device plugin")
+
+	frameworkOptions := deviceplugin.NewOptions()
+	frameworkOptions.AddFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	switch *mode {
@@ -61,7 +65,7 @@ func main() {
 
 	klog.V(1).Infof("QAT device plugin started in '%s' mode", *mode)
 
-	manager := deviceplugin.NewManager(namespace, plugin)
+	manager := deviceplugin.NewManager(namespace, plugin, frameworkOptions)
 
 	manager.Run()
 }
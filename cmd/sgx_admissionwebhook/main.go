@@ -19,7 +19,10 @@ import (
 	"os"
 
 	sgxwebhook "github.com/intel/intel-device-plugins-for-kubernetes/pkg/webhooks/sgx"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	cliflag "k8s.io/component-base/cli/flag"
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/klogr"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -33,22 +36,149 @@ var (
 
 func init() {
 	klog.InitFlags(nil)
+
+	_ = clientgoscheme.AddToScheme(scheme)
 }
 
 func main() {
 	var (
 		metricsAddr          string
 		enableLeaderElection bool
+		config               sgxwebhook.MutatorConfig
+		rejectUnschedulable  bool
+		requireJustification bool
+		decisionSinkURL      string
+		decisionQueueSize    int
+		allowedMrenclaves    []string
+		allowedPolicies      []string
+		dryRun               bool
+		productionSelector   string
 	)
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.Var(cliflag.NewMapStringString(&config.ScrapeAnnotations), "scrape-annotations",
+		"Comma separated list of key=value annotations added to SGX pods which don't set them, "+
+			"e.g. prometheus.io/scrape=true,prometheus.io/port=8080.")
+	flag.Var(cliflag.NewMapStringString(&config.HostAliases), "host-aliases",
+		"Comma separated list of hostname=IP entries added to the host aliases of SGX pods, "+
+			"e.g. pccs.example.com=10.0.0.10.")
+	flag.Var(cliflag.NewStringSlice(&config.DNSNameservers), "dns-nameservers",
+		"Comma separated list of nameserver IP addresses set in the DNS config of SGX pods which don't have one.")
+	flag.Var(cliflag.NewStringSlice(&config.DNSSearches), "dns-searches",
+		"Comma separated list of DNS search domains set in the DNS config of SGX pods which don't have one.")
+	flag.StringVar(&config.OptOutSelector, "opt-out-selector", "sgx.intel.com/mutate=false",
+		"Label selector of pods, or namespaces of pods, which are admitted without mutations. Empty disables it.")
+	flag.Var(cliflag.NewMapStringString(&config.AnnotationDefaults), "annotation-defaults",
+		"Comma separated list of annotation=value defaults for the SGX annotations forwarded to containers, "+
+			"e.g. sgx.intel.com/attestation-audience=https://attestation.example.com.")
+	flag.StringVar(&config.ThreadsEnv, "threads-env", "",
+		"Environment variable set to the CPU limit of SGX containers with an integral CPU limit, e.g. ENCLAVE_THREADS (default: disabled).")
+	flag.StringVar(&config.EnclaveHeapEnv, "enclave-heap-env", "ENCLAVE_HEAP_SIZE",
+		"Environment variable set to the sgx.intel.com/enclave-heap size in bytes of SGX containers. Empty disables it.")
+	flag.StringVar(&config.EnclaveStackEnv, "enclave-stack-env", "ENCLAVE_STACK_SIZE",
+		"Environment variable set to the sgx.intel.com/enclave-stack size in bytes of SGX containers. Empty disables it.")
+	flag.StringVar(&config.TcsCountEnv, "tcs-count-env", "ENCLAVE_TCS_COUNT",
+		"Environment variable set to the sgx.intel.com/tcs-count of SGX containers. Empty disables it.")
+	flag.BoolVar(&config.TcsCountFromCPU, "tcs-count-from-cpu", false,
+		"Set the TCS count environment variable of SGX pods without sgx.intel.com/tcs-count to the integral CPU limit of the containers.")
+	flag.Var(cliflag.NewMapStringString(&config.RuntimeEnvs), "runtime-envs",
+		"Comma separated list of runtime.NAME=value environment variables added to the SGX containers of pods "+
+			"naming the enclave runtime in the sgx.intel.com/runtime annotation, e.g. gramine.SGX=1.")
+	flag.Var(cliflag.NewMapStringString(&config.EpcClasses), "epc-classes",
+		"Comma separated list of class=size entries setting the minimum total EPC size of the classes set to "+
+			"the sgx.intel.com/epc-class annotation of SGX pods, e.g. small=0,medium=64Mi,large=1Gi.")
+	flag.Var(cliflag.NewStringSlice(&config.AllowedSysctls), "allowed-sysctls",
+		"Comma separated list of namespaced sysctls SGX pods may set with the sgx.intel.com/sysctls annotation, "+
+			"e.g. net.core.somaxconn,net.ipv4.tcp_rmem.")
+	flag.Var(cliflag.NewStringSlice(&config.EpcResourceNames), "epc-resource-names",
+		"Comma separated list of resource names accepted as EPC requests besides sgx.intel.com/epc, e.g. during a migration.")
+	flag.StringVar(&config.DefaultEpc, "default-epc", "",
+		"EPC size requested for containers which request sgx.intel.com/enclave directly without EPC, e.g. 64Mi (default: disabled).")
+	flag.StringVar(&config.EpcPageSize, "epc-page-size", "",
+		"EPC page size recorded in the sgx.intel.com/epc-page-size annotation of SGX pods, e.g. 4Ki (default: disabled).")
+	flag.StringVar(&config.ReadinessGate, "readiness-gate", "",
+		"Condition type of a readiness gate added to SGX pods, e.g. sgx.intel.com/attested (default: disabled).")
+	flag.Var(cliflag.NewMapStringString(&config.NodeSelector), "node-selector",
+		"Comma separated list of label=value entries added to the node selector of SGX pods which don't select the label, "+
+			"e.g. sgx.intel.com/capable=true.")
+	flag.StringVar(&config.NodeClassAnnotation, "node-class-annotation", "",
+		"Annotation set on SGX pods to the -node-selector labels added to them, e.g. sgx.intel.com/node-class (default: disabled).")
+	flag.Var(cliflag.NewStringSlice(&config.Tolerations), "tolerations",
+		"Comma separated list of key[=value][:effect] tolerations added to SGX pods which don't tolerate them, "+
+			"e.g. sgx.intel.com/sgx=true:NoSchedule.")
+	flag.StringVar(&config.PriorityClassName, "priority-class-name", "",
+		"Name of the PriorityClass set to SGX pods which don't set a priority class (default: disabled).")
+	flag.BoolVar(&config.DisableTokenAutomount, "disable-token-automount", false,
+		"Set automountServiceAccountToken to false for SGX pods which don't set it.")
+	flag.StringVar(&config.ConfigHashAnnotation, "config-hash-annotation", "",
+		"Annotation set to the hash of the webhook configuration on SGX pods, e.g. sgx.intel.com/webhook-config (default: disabled).")
+	flag.StringVar(&config.AesmdContainerName, "aesmd-container-name", "aesmd",
+		"Name of the aesmd sidecar container of pods setting sgx.intel.com/quote-provider: aesmd.")
+	flag.StringVar(&config.AesmdSocketDir, "aesmd-socket-dir", "/var/run/aesmd",
+		"Directory of the aesmd socket mounted to the SGX containers of pods setting sgx.intel.com/quote-provider: aesmd.")
+	flag.StringVar(&config.AesmAddr, "aesm-addr", "1",
+		"Value of SGX_AESM_ADDR set to the SGX containers of pods setting sgx.intel.com/quote-provider: aesmd, e.g. the socket path /var/run/aesmd/aesm.sock.")
+	flag.StringVar(&config.AesmdSocketMedium, "aesmd-socket-medium", "Memory",
+		"Medium of the emptyDir volume sharing the aesmd socket with the aesmd sidecar, Memory or Disk.")
+	flag.StringVar(&config.AesmdPodSelector, "aesmd-pod-selector", "",
+		"Label selector of the aesmd DaemonSet pods, warn about pods using the DaemonSet when none is ready (default: disabled).")
+	flag.StringVar(&config.CoreDumpCollectorImage, "core-dump-collector-image", "",
+		"Image of the sidecar collecting the enclave core dumps of SGX pods setting sgx.intel.com/core-dumps: \"true\" (default: disabled).")
+	flag.Var(cliflag.NewStringSlice(&config.CoreDumpCollectorArgs), "core-dump-collector-args",
+		"Comma separated list of arguments of the core dump collector sidecar.")
+	flag.StringVar(&config.CoreDumpDir, "core-dump-dir", "/var/crash/enclave",
+		"Directory the core dump volume is mounted at in the SGX containers and the core dump collector.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Admit the pods without mutations, with warnings describing the mutations instead.")
+	flag.BoolVar(&rejectUnschedulable, "reject-unschedulable-epc", false,
+		"Reject SGX pods requesting more EPC than the largest node has.")
+	flag.Var(cliflag.NewStringSlice(&allowedMrenclaves), "allowed-mrenclaves",
+		"Comma separated list of hex encoded enclave measurements SGX pods may set in the sgx.intel.com/mrenclave "+
+			"annotation (default: any).")
+	flag.Var(cliflag.NewStringSlice(&allowedPolicies), "allowed-launch-policies",
+		"Comma separated list of launch control policies SGX pods may set in the sgx.intel.com/launch-policy "+
+			"annotation (default: any).")
+	flag.StringVar(&productionSelector, "production-namespace-selector", "",
+		"Label selector of the production namespaces in which pods with debug enclaves are rejected (default: disabled).")
+	flag.BoolVar(&requireJustification, "require-provision-justification", false,
+		"Reject SGX pods granted sgx.intel.com/provision without the sgx.intel.com/provision-justification annotation.")
+	flag.StringVar(&decisionSinkURL, "decision-sink-url", "",
+		"HTTP endpoint the admission decision records of SGX pods are posted to (default: disabled).")
+	flag.IntVar(&decisionQueueSize, "decision-queue-size", 1000,
+		"Maximum number of admission decision records queued for the decision sink.")
 	flag.Parse()
 
 	ctrl.SetLogger(klogr.New())
 
+	if err := config.Validate(); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+
+	allowedMrenclaves, err := sgxwebhook.NormalizeMrenclaves(allowedMrenclaves)
+	if err != nil {
+		setupLog.Error(err, "invalid allowed enclave measurements")
+		os.Exit(1)
+	}
+
+	if err := sgxwebhook.ValidateLaunchPolicies(allowedPolicies); err != nil {
+		setupLog.Error(err, "invalid allowed launch control policies")
+		os.Exit(1)
+	}
+
+	if _, err := labels.Parse(productionSelector); err != nil {
+		setupLog.Error(err, "invalid production namespace selector")
+		os.Exit(1)
+	}
+
+	if decisionSinkURL != "" && decisionQueueSize <= 0 {
+		setupLog.Error(nil, "decision queue size must be positive")
+		os.Exit(1)
+	}
+
 	webHook := &webhook.Server{
 		Port:          9443,
 		TLSMinVersion: "1.3",
@@ -67,8 +197,39 @@ func main() {
 		os.Exit(1)
 	}
 
+	var decisionSink *sgxwebhook.DecisionSink
+
+	if decisionSinkURL != "" {
+		decisionSink = sgxwebhook.NewDecisionSink(decisionSinkURL, decisionQueueSize)
+
+		if err = mgr.Add(decisionSink); err != nil {
+			setupLog.Error(err, "unable to add decision sink")
+			os.Exit(1)
+		}
+	}
+
 	mgr.GetWebhookServer().Register("/pods-sgx", &webhook.Admission{
-		Handler: &sgxwebhook.Mutator{Client: mgr.GetClient()},
+		Handler: &sgxwebhook.Mutator{
+			Client:        mgr.GetClient(),
+			Log:           ctrl.Log.WithName("mutator"),
+			DecisionSink:  decisionSink,
+			MutatorConfig: config,
+			DryRun:        dryRun,
+		},
+	})
+
+	mgr.GetWebhookServer().Register("/pods-sgx-validate", &webhook.Admission{
+		Handler: &sgxwebhook.Validator{
+			Client:                        mgr.GetClient(),
+			DecisionSink:                  decisionSink,
+			RejectUnschedulableEpc:        rejectUnschedulable,
+			RequireProvisionJustification: requireJustification,
+			AesmdContainerName:            config.AesmdContainerName,
+			AllowedMrenclaves:             allowedMrenclaves,
+			AllowedLaunchPolicies:         allowedPolicies,
+			EpcResourceNames:              config.EpcResourceNames,
+			ProductionNamespaceSelector:   productionSelector,
+		},
 	})
 
 	setupLog.Info("starting manager")
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
 	"syscall"
 
 	"github.com/klauspost/cpuid/v2"
@@ -35,8 +36,34 @@ const (
 	namespace = "sgx.intel.com"
 	epc       = "epc"
 	capable   = "capable"
+	driver    = "driver"
+	devfsDir  = "/dev"
+
+	// Driver variants.
+	inTreeDriver    = "in-tree"
+	outOfTreeDriver = "out-of-tree"
 )
 
+// detectDriver returns the SGX driver variant by the device nodes it creates,
+// or an empty string if neither driver is loaded.
+func detectDriver(devfsDir string) string {
+	variants := []struct {
+		node    string
+		variant string
+	}{
+		{node: "sgx_enclave", variant: inTreeDriver},
+		{node: "sgx/enclave", variant: outOfTreeDriver},
+	}
+
+	for _, v := range variants {
+		if _, err := os.Stat(path.Join(devfsDir, v.node)); err == nil {
+			return v.variant
+		}
+	}
+
+	return ""
+}
+
 type patchNodeOp struct {
 	Value interface{} `json:"value"`
 	Op    string      `json:"op"`
@@ -69,13 +96,17 @@ func main() {
 		klog.Fatal("SGX EPC is not available")
 	}
 
-	if err := updateNode(epcSize, register, label); err != nil {
+	driverVariant := detectDriver(devfsDir)
+
+	klog.Infof("sgx driver: %q", driverVariant)
+
+	if err := updateNode(epcSize, driverVariant, register, label); err != nil {
 		klog.Fatal(err.Error())
 	}
 
 	// if the "register" flag is FALSE, we assume that sgx_epchook is used as NFD hook
 	if !register {
-		fmt.Printf("%s/%s=%d", namespace, epc, epcSize)
+		fmt.Print(nfdFeatures(epcSize, driverVariant))
 	}
 
 	if daemon {
@@ -88,7 +119,19 @@ func main() {
 	}
 }
 
-func updateNode(epcSize uint64, register, label bool) error {
+// nfdFeatures returns the features printed as an NFD hook. The driver
+// feature is omitted if no SGX driver is loaded.
+func nfdFeatures(epcSize uint64, driverVariant string) string {
+	features := fmt.Sprintf("%s/%s=%d\n", namespace, epc, epcSize)
+
+	if driverVariant != "" {
+		features += fmt.Sprintf("%s/%s=%s\n", namespace, driver, driverVariant)
+	}
+
+	return features
+}
+
+func updateNode(epcSize uint64, driverVariant string, register, label bool) error {
 	// create patch payload
 	payload := []patchNodeOp{}
 	if register {
@@ -107,6 +150,14 @@ func updateNode(epcSize uint64, register, label bool) error {
 		})
 	}
 
+	if label && driverVariant != "" {
+		payload = append(payload, patchNodeOp{
+			Op:    "add",
+			Path:  fmt.Sprintf("/metadata/labels/%s~1%s", namespace, driver),
+			Value: driverVariant,
+		})
+	}
+
 	if len(payload) == 0 {
 		return nil
 	}
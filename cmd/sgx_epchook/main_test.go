@@ -0,0 +1,76 @@
+// Copyright 2020 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDetectDriver(t *testing.T) {
+	tcases := []struct {
+		name     string
+		expected string
+		nodes    []string
+	}{
+		{
+			name:     "in-tree driver",
+			nodes:    []string{"sgx_enclave", "sgx_provision"},
+			expected: inTreeDriver,
+		},
+		{
+			name:     "out-of-tree driver",
+			nodes:    []string{"sgx/enclave", "sgx/provision"},
+			expected: outOfTreeDriver,
+		},
+		{
+			name:     "no driver",
+			nodes:    []string{"null"},
+			expected: "",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			devfs := t.TempDir()
+
+			for _, node := range tc.nodes {
+				if err := os.MkdirAll(path.Dir(path.Join(devfs, node)), 0750); err != nil {
+					t.Fatalf("unable to create fake devfs: %+v", err)
+				}
+
+				if err := os.WriteFile(path.Join(devfs, node), nil, 0600); err != nil {
+					t.Fatalf("unable to create fake device node: %+v", err)
+				}
+			}
+
+			if variant := detectDriver(devfs); variant != tc.expected {
+				t.Errorf("expected driver %q, got %q", tc.expected, variant)
+			}
+
+			features := nfdFeatures(1024, tc.expected)
+			expectedFeatures := "sgx.intel.com/epc=1024\n"
+
+			if tc.expected != "" {
+				expectedFeatures += "sgx.intel.com/driver=" + tc.expected + "\n"
+			}
+
+			if features != expectedFeatures {
+				t.Errorf("expected NFD features %q, got %q", expectedFeatures, features)
+			}
+		})
+	}
+}
@@ -21,8 +21,13 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 
 	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	"github.com/klauspost/cpuid/v2"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -34,6 +39,7 @@ const (
 	deviceTypeProvision         = "provision"
 	devicePath                  = "/dev"
 	podsPerCoreEnvVariable      = "PODS_PER_CORE"
+	enclaveDevicePrefix         = "sgx-enclave-"
 	defaultPodCount        uint = 110
 )
 
@@ -85,7 +91,7 @@ func (dp *devicePlugin) scan() (dpapi.DeviceTree, error) {
 	}
 
 	for i := uint(0); i < dp.nEnclave; i++ {
-		devID := fmt.Sprintf("%s-%d", "sgx-enclave", i)
+		devID := fmt.Sprintf("%s%d", enclaveDevicePrefix, i)
 		nodes := []pluginapi.DeviceSpec{{HostPath: sgxEnclavePath, ContainerPath: sgxEnclavePath, Permissions: "rw"}}
 		devTree.AddDevice(deviceTypeEnclave, devID, dpapi.NewDeviceInfo(pluginapi.Healthy, nodes, nil, nil, nil))
 	}
@@ -118,18 +124,149 @@ func getDefaultPodCount(nCPUs uint) uint {
 	return defaultPodCount
 }
 
+// epcSize returns the total size of the EPC sections of the CPUs.
+func epcSize() uint64 {
+	var size uint64
+
+	if cpuid.CPU.SGX.Available {
+		for _, s := range cpuid.CPU.SGX.EPCSections {
+			size += s.EPCSize
+		}
+	}
+
+	return size
+}
+
+// enclaveBudget caps the number of enclave resources to the EPC size divided by
+// the EPC reserved per enclave. As every SGX container requests one enclave
+// resource, the node can't admit more SGX containers than its EPC can back.
+// Zero epcPerEnclave or an unknown, zero, EPC size disables the cap.
+func enclaveBudget(limit uint, epcSize, epcPerEnclave uint64) uint {
+	if epcPerEnclave == 0 || epcSize == 0 {
+		return limit
+	}
+
+	if budget := epcSize / epcPerEnclave; budget < uint64(limit) {
+		return uint(budget)
+	}
+
+	return limit
+}
+
+// epcBudgetPlugin is a device plugin allocating an enclave resource only if
+// the EPC of the node can back it next to the enclaves held by containers,
+// each reserving epcPerEnclave. The held enclaves are forgotten when the
+// deallocation polls of the framework find them released.
+type epcBudgetPlugin struct {
+	*devicePlugin
+	// held are the IDs of the enclave devices allocated to containers.
+	held          map[string]bool
+	epcSize       uint64
+	epcPerEnclave uint64
+	mutex         sync.Mutex
+}
+
+func newEPCBudgetPlugin(dp *devicePlugin, epcSize, epcPerEnclave uint64) *epcBudgetPlugin {
+	return &epcBudgetPlugin{
+		devicePlugin:  dp,
+		held:          make(map[string]bool),
+		epcSize:       epcSize,
+		epcPerEnclave: epcPerEnclave,
+	}
+}
+
+// Allocate fails if the EPC can't back the requested enclaves too, otherwise
+// the enclaves are held and the framework allocates them.
+func (p *epcBudgetPlugin) Allocate(rqt *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	requested := []string{}
+
+	for _, crqt := range rqt.ContainerRequests {
+		for _, id := range crqt.DevicesIDs {
+			if strings.HasPrefix(id, enclaveDevicePrefix) && !p.held[id] {
+				requested = append(requested, id)
+			}
+		}
+	}
+
+	if epc := uint64(len(p.held)+len(requested)) * p.epcPerEnclave; epc > p.epcSize {
+		return nil, dpapi.NewAllocationError(dpapi.ResourcesExhausted, requested,
+			errors.Errorf("%d enclaves need %d bytes of EPC, the node has %d bytes", len(p.held)+len(requested), epc, p.epcSize))
+	}
+
+	for _, id := range requested {
+		p.held[id] = true
+	}
+
+	return nil, &dpapi.UseDefaultMethodError{}
+}
+
+// PostDeallocate releases the EPC of the released enclaves.
+func (p *epcBudgetPlugin) PostDeallocate(devType string, deviceIDs []string) {
+	if devType != deviceTypeEnclave {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, id := range deviceIDs {
+		delete(p.held, id)
+	}
+}
+
 func main() {
-	var enclaveLimit, provisionLimit uint
+	var (
+		enclaveLimit, provisionLimit uint
+		epcPerEnclave                string
+	)
 
 	podCount := getDefaultPodCount(uint(runtime.NumCPU()))
 
 	flag.UintVar(&enclaveLimit, "enclave-limit", podCount, "Number of \"enclave\" resources")
 	flag.UintVar(&provisionLimit, "provision-limit", podCount, "Number of \"provision\" resources")
+	flag.StringVar(&epcPerEnclave, "epc-per-enclave", "",
+		"EPC reserved per \"enclave\" resource, e.g. 8Mi, capping the enclave resources to the EPC size divided by it (default: disabled)")
+
+	frameworkOptions := dpapi.NewOptions()
+	frameworkOptions.AddFlags(flag.CommandLine)
+
 	flag.Parse()
 
+	var epcPerEnclaveBytes, epc uint64
+
+	if epcPerEnclave != "" {
+		quantity, err := resource.ParseQuantity(epcPerEnclave)
+		if err != nil || quantity.Sign() <= 0 {
+			klog.Errorf("Invalid EPC per enclave %q, expected a positive quantity of bytes", epcPerEnclave)
+			os.Exit(1)
+		}
+
+		epcPerEnclaveBytes = uint64(quantity.Value())
+
+		if epc = epcSize(); epc == 0 {
+			klog.Warning("Unknown EPC size, \"enclave\" resources are not limited by it")
+		}
+
+		budget := enclaveBudget(enclaveLimit, epc, epcPerEnclaveBytes)
+		if budget < enclaveLimit {
+			klog.Infof("Limiting \"enclave\" resources to %d by the EPC size", budget)
+		}
+
+		enclaveLimit = budget
+	}
+
 	klog.V(4).Infof("SGX device plugin started with %d \"%s/enclave\" resources and %d \"%s/provision\" resources.", enclaveLimit, namespace, provisionLimit, namespace)
 
-	plugin := newDevicePlugin(devicePath, enclaveLimit, provisionLimit)
-	manager := dpapi.NewManager(namespace, plugin)
+	dp := newDevicePlugin(devicePath, enclaveLimit, provisionLimit)
+
+	var plugin dpapi.Scanner = dp
+	if epc > 0 {
+		plugin = newEPCBudgetPlugin(dp, epc, epcPerEnclaveBytes)
+	}
+
+	manager := dpapi.NewManager(namespace, plugin, frameworkOptions)
 	manager.Run()
 }
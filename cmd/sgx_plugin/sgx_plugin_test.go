@@ -21,6 +21,8 @@ import (
 	"testing"
 
 	dpapi "github.com/intel/intel-device-plugins-for-kubernetes/pkg/deviceplugin"
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 func init() {
@@ -178,3 +180,107 @@ func TestScan(t *testing.T) {
 		})
 	}
 }
+
+func TestEnclaveBudget(t *testing.T) {
+	const mib = 1024 * 1024
+
+	tcases := []struct {
+		name          string
+		limit         uint
+		epcSize       uint64
+		epcPerEnclave uint64
+		expected      uint
+	}{
+		{
+			name:     "disabled",
+			limit:    110,
+			epcSize:  64 * mib,
+			expected: 110,
+		},
+		{
+			name:          "EPC backs fewer enclaves than the limit",
+			limit:         110,
+			epcSize:       64 * mib,
+			epcPerEnclave: 8 * mib,
+			expected:      8,
+		},
+		{
+			name:          "EPC backs more enclaves than the limit",
+			limit:         20,
+			epcSize:       64 * 1024 * mib,
+			epcPerEnclave: 8 * mib,
+			expected:      20,
+		},
+		{
+			name:          "partial enclave budget is rounded down",
+			limit:         110,
+			epcSize:       60 * mib,
+			epcPerEnclave: 8 * mib,
+			expected:      7,
+		},
+		{
+			name:          "unknown EPC size",
+			limit:         110,
+			epcPerEnclave: 8 * mib,
+			expected:      110,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if budget := enclaveBudget(tc.limit, tc.epcSize, tc.epcPerEnclave); budget != tc.expected {
+				t.Errorf("expected %d enclave resources, got %d", tc.expected, budget)
+			}
+		})
+	}
+}
+
+func TestEPCBudgetAllocate(t *testing.T) {
+	const mib = 1024 * 1024
+
+	// The EPC backs two enclaves.
+	plugin := newEPCBudgetPlugin(newDevicePlugin("/dev", 10, 10), 16*mib, 8*mib)
+
+	allocate := func(ids ...string) error {
+		_, err := plugin.Allocate(&pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+		})
+
+		return err
+	}
+
+	expectAllocated := func(ids ...string) {
+		t.Helper()
+
+		if err := allocate(ids...); !errors.As(err, new(*dpapi.UseDefaultMethodError)) {
+			t.Errorf("expected %v allocated by the framework, got %+v", ids, err)
+		}
+	}
+
+	expectExhausted := func(ids ...string) {
+		t.Helper()
+
+		var allocErr *dpapi.AllocationError
+		if err := allocate(ids...); !errors.As(err, &allocErr) || allocErr.Reason != dpapi.ResourcesExhausted {
+			t.Errorf("expected %v to exhaust the EPC, got %+v", ids, err)
+		}
+	}
+
+	expectAllocated("sgx-enclave-0")
+	expectAllocated("sgx-enclave-1", "sgx-provision-0")
+	expectExhausted("sgx-enclave-2")
+
+	// Provisioning doesn't need EPC.
+	expectAllocated("sgx-provision-1")
+
+	// An enclave given to a new container was released, even if the
+	// release hasn't been detected yet.
+	expectAllocated("sgx-enclave-1")
+
+	plugin.PostDeallocate(deviceTypeProvision, []string{"sgx-provision-0"})
+	expectExhausted("sgx-enclave-2")
+
+	plugin.PostDeallocate(deviceTypeEnclave, []string{"sgx-enclave-0"})
+	expectAllocated("sgx-enclave-2")
+	expectExhausted("sgx-enclave-0")
+}
@@ -309,6 +309,10 @@ func main() {
 
 	flag.IntVar(&sharedDevNum, "shared-dev-num", 1, "number of containers sharing the same VPU device")
 	flag.IntVar(&scanMode, "mode", 1, "USB=1 PCI=2")
+
+	frameworkOptions := dpapi.NewOptions()
+	frameworkOptions.AddFlags(flag.CommandLine)
+
 	flag.Parse()
 
 	klog.V(1).Info("VPU device plugin started")
@@ -338,6 +342,6 @@ func main() {
 		klog.Fatal("Cannot create device plugin, please check above error messages.")
 	}
 
-	manager := dpapi.NewManager(namespace, plugin)
+	manager := dpapi.NewManager(namespace, plugin, frameworkOptions)
 	manager.Run()
 }
@@ -0,0 +1,276 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	adminStatePath    = "/state"
+	adminRescanPath   = "/rescan"
+	adminCordonPath   = "/cordon"
+	adminUncordonPath = "/uncordon"
+
+	// adminSocketMode lets only the user the plugin runs as connect to the
+	// admin socket.
+	adminSocketMode = 0600
+)
+
+// adminDevice is the state of a device in the admin state dump.
+type adminDevice struct {
+	ID string `json:"id"`
+	// Health is the health advertised to kubelet.
+	Health   string `json:"health"`
+	Cordoned bool   `json:"cordoned"`
+}
+
+// adminOperation runs an admin operation with the query parameters of the
+// request. It returns the HTTP status of a failure.
+type adminOperation func(m *Manager, query url.Values) (int, error)
+
+// adminResult is the outcome of an admin operation.
+type adminResult struct {
+	err    error
+	state  map[string][]adminDevice
+	status int
+}
+
+// adminRequest is an admin operation run in the event loop of the Manager,
+// so that the operations don't race with the device updates.
+type adminRequest struct {
+	operation adminOperation
+	query     url.Values
+	result    chan<- adminResult
+}
+
+// run runs the operation and returns the device state after it.
+func (r *adminRequest) run(m *Manager) adminResult {
+	if status, err := r.operation(m, r.query); err != nil {
+		return adminResult{err: err, status: status}
+	}
+
+	return adminResult{state: m.adminState()}
+}
+
+// adminServer serves the admin operations over HTTP.
+type adminServer struct {
+	requests chan<- adminRequest
+}
+
+func (s *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(adminStatePath, s.handle(http.MethodGet, func(*Manager, url.Values) (int, error) { return 0, nil }))
+	mux.Handle(adminRescanPath, s.handle(http.MethodPost, (*Manager).adminRescan))
+	mux.Handle(adminCordonPath, s.handle(http.MethodPost, (*Manager).adminCordon))
+	mux.Handle(adminUncordonPath, s.handle(http.MethodPost, (*Manager).adminUncordon))
+
+	return mux
+}
+
+// handle returns a handler passing the operation to the Manager and serving
+// the device state after it as JSON.
+func (s *adminServer) handle(method string, operation adminOperation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		results := make(chan adminResult, 1)
+
+		select {
+		case s.requests <- adminRequest{operation: operation, query: r.URL.Query(), result: results}:
+		case <-r.Context().Done():
+			return
+		}
+
+		var result adminResult
+
+		select {
+		case result = <-results:
+		case <-r.Context().Done():
+			return
+		}
+
+		if result.err != nil {
+			http.Error(w, result.err.Error(), result.status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(result.state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// listenAdmin listens to the admin socket. A stale socket left by a previous
+// instance is removed first.
+func listenAdmin(socket string) (net.Listener, error) {
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "unable to remove the stale admin socket")
+	}
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen to the admin socket")
+	}
+
+	if err := os.Chmod(socket, adminSocketMode); err != nil {
+		lis.Close()
+
+		return nil, errors.Wrap(err, "unable to restrict the admin socket permissions")
+	}
+
+	return lis, nil
+}
+
+// serveAdmin serves the admin operations at the socket.
+func serveAdmin(socket string, requests chan<- adminRequest) {
+	lis, err := listenAdmin(socket)
+	if err != nil {
+		klog.Errorf("Admin server failed: %+v", err)
+		return
+	}
+
+	httpServer := &http.Server{
+		Handler:           (&adminServer{requests: requests}).handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	klog.V(1).Infof("Serving admin operations at %s", socket)
+
+	if err := httpServer.Serve(lis); err != nil {
+		klog.Errorf("Admin server failed: %+v", err)
+	}
+}
+
+// adminState returns the advertised devices of all resources.
+func (m *Manager) adminState() map[string][]adminDevice {
+	state := make(map[string][]adminDevice, len(m.advertised))
+
+	for devType, devices := range m.advertised {
+		ids := make([]string, 0, len(devices))
+		for id := range devices {
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+
+		state[devType] = make([]adminDevice, 0, len(ids))
+
+		for _, id := range ids {
+			state[devType] = append(state[devType], adminDevice{
+				ID:       id,
+				Health:   devices[id].state,
+				Cordoned: m.cordoned[devType][id],
+			})
+		}
+	}
+
+	return state
+}
+
+// adminRescan runs the health checks of all devices right away, regardless of
+// their intervals, and sends the devices to kubelet again.
+func (m *Manager) adminRescan(url.Values) (int, error) {
+	for _, checker := range m.health {
+		for devType := range m.devices {
+			checker.forget(devType)
+		}
+	}
+
+	for devType := range m.devices {
+		m.resend(devType)
+	}
+
+	return 0, nil
+}
+
+func (m *Manager) adminCordon(query url.Values) (int, error) {
+	return m.setCordoned(query.Get("resource"), query.Get("id"), true)
+}
+
+func (m *Manager) adminUncordon(query url.Values) (int, error) {
+	return m.setCordoned(query.Get("resource"), query.Get("id"), false)
+}
+
+// setCordoned cordons or uncordons a device and sends the devices of its
+// resource to kubelet again.
+func (m *Manager) setCordoned(devType, id string, cordoned bool) (int, error) {
+	if devType == "" || id == "" {
+		return http.StatusBadRequest, errors.New("resource and id are required")
+	}
+
+	if _, ok := m.devices[devType][id]; !ok {
+		return http.StatusNotFound, errors.Errorf("unknown device %s/%s", devType, id)
+	}
+
+	if m.cordoned[devType][id] == cordoned {
+		return 0, nil
+	}
+
+	if m.cordoned == nil {
+		m.cordoned = make(map[string]map[string]bool)
+	}
+
+	if m.cordoned[devType] == nil {
+		m.cordoned[devType] = make(map[string]bool)
+	}
+
+	if cordoned {
+		klog.Infof("Cordoning device %s/%s", devType, id)
+		m.cordoned[devType][id] = true
+	} else {
+		klog.Infof("Uncordoning device %s/%s", devType, id)
+		delete(m.cordoned[devType], id)
+	}
+
+	m.resend(devType)
+
+	return 0, nil
+}
+
+// applyCordons returns the devices with the cordoned ones reported unhealthy,
+// so that kubelet doesn't allocate them to new containers.
+func applyCordons(devices map[string]DeviceInfo, cordoned map[string]bool) map[string]DeviceInfo {
+	if len(cordoned) == 0 {
+		return devices
+	}
+
+	applied := make(map[string]DeviceInfo, len(devices))
+
+	for id, device := range devices {
+		if cordoned[id] {
+			device.state = pluginapi.Unhealthy
+		}
+
+		applied[id] = device
+	}
+
+	return applied
+}
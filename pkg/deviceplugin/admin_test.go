@@ -0,0 +1,181 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestAdminSocket(t *testing.T) {
+	recorder := &updateRecorder{}
+	failing := map[string]bool{}
+
+	mgr := &Manager{
+		devicePlugin: &devicePluginStub{},
+		servers:      map[string]devicePluginServer{"gpu": recorder},
+		devices:      NewDeviceTree(),
+		advertised:   NewDeviceTree(),
+		tracker:      &allocationTracker{},
+		admin:        make(chan adminRequest),
+		health: []*healthChecker{
+			newHealthChecker("test check", time.Hour, func(devType, id string, nodes []pluginapi.DeviceSpec) error {
+				if failing[id] {
+					return errors.New("failed")
+				}
+
+				return nil
+			}),
+		},
+	}
+
+	mgr.handleUpdate(updateInfo{Updated: DeviceTree{"gpu": {
+		"card0": {state: pluginapi.Healthy},
+		"card1": {state: pluginapi.Healthy},
+	}}})
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+
+	lis, err := listenAdmin(socket)
+	if err != nil {
+		t.Fatalf("unable to listen: %+v", err)
+	}
+
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != adminSocketMode {
+		t.Errorf("expected socket mode %o, got %v (%v)", adminSocketMode, info.Mode().Perm(), err)
+	}
+
+	server := &http.Server{
+		Handler:           (&adminServer{requests: mgr.admin}).handler(),
+		ReadHeaderTimeout: time.Second,
+	}
+
+	go func() { _ = server.Serve(lis) }()
+	defer server.Close()
+
+	// The event loop of the Manager.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case req := <-mgr.admin:
+				req.result <- req.run(mgr)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	call := func(method, path string, expectedStatus int) map[string][]adminDevice {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, "http://admin"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %+v", method, path, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, expectedStatus, resp.StatusCode)
+		}
+
+		state := map[string][]adminDevice{}
+
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+				t.Fatalf("unable to decode the state: %+v", err)
+			}
+		}
+
+		return state
+	}
+
+	expectState := func(state map[string][]adminDevice, expected ...adminDevice) {
+		t.Helper()
+
+		if len(state["gpu"]) != len(expected) {
+			t.Fatalf("expected %d devices, got %v", len(expected), state)
+		}
+
+		for i, device := range expected {
+			if state["gpu"][i] != device {
+				t.Errorf("expected %+v, got %+v", device, state["gpu"][i])
+			}
+
+			if advertised := recorder.devices[device.ID].state; advertised != device.Health {
+				t.Errorf("expected %s to be advertised %s, got %s", device.ID, device.Health, advertised)
+			}
+		}
+	}
+
+	expectState(call(http.MethodGet, adminStatePath, http.StatusOK),
+		adminDevice{ID: "card0", Health: pluginapi.Healthy},
+		adminDevice{ID: "card1", Health: pluginapi.Healthy})
+
+	// The checks are not due for an hour, but a rescan runs them right away.
+	failing["card0"] = true
+
+	expectState(call(http.MethodPost, adminRescanPath, http.StatusOK),
+		adminDevice{ID: "card0", Health: pluginapi.Unhealthy},
+		adminDevice{ID: "card1", Health: pluginapi.Healthy})
+
+	expectState(call(http.MethodPost, adminCordonPath+"?resource=gpu&id=card1", http.StatusOK),
+		adminDevice{ID: "card0", Health: pluginapi.Unhealthy},
+		adminDevice{ID: "card1", Health: pluginapi.Unhealthy, Cordoned: true})
+
+	// Cordons are kept over device updates.
+	failing["card0"] = false
+
+	mgr.handleUpdate(updateInfo{Updated: DeviceTree{"gpu": {
+		"card0": {state: pluginapi.Healthy},
+		"card1": {state: pluginapi.Healthy},
+	}}})
+
+	expectState(call(http.MethodPost, adminRescanPath, http.StatusOK),
+		adminDevice{ID: "card0", Health: pluginapi.Healthy},
+		adminDevice{ID: "card1", Health: pluginapi.Unhealthy, Cordoned: true})
+
+	expectState(call(http.MethodPost, adminUncordonPath+"?resource=gpu&id=card1", http.StatusOK),
+		adminDevice{ID: "card0", Health: pluginapi.Healthy},
+		adminDevice{ID: "card1", Health: pluginapi.Healthy})
+
+	call(http.MethodPost, adminCordonPath+"?resource=gpu&id=card9", http.StatusNotFound)
+	call(http.MethodPost, adminCordonPath+"?resource=gpu", http.StatusBadRequest)
+	call(http.MethodGet, adminRescanPath, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// defaultAllocationLogLevel is the klog verbosity the allocations of the
+// resources without an AllocationLogLevels entry are logged at.
+const defaultAllocationLogLevel = 4
+
+// AllocationLogLevels maps resource names to the klog verbosity, i.e. the
+// minimum -v, the allocations of the resource are logged at. It implements
+// flag.Value and can be given several times as "resource=level".
+type AllocationLogLevels map[string]int
+
+func (a AllocationLogLevels) String() string {
+	entries := make([]string, 0, len(a))
+
+	for resource, level := range a {
+		entries = append(entries, resource+"="+strconv.Itoa(level))
+	}
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// Set adds a "resource=level" entry.
+func (a AllocationLogLevels) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid allocation log level %q, expected resource=level", value)
+	}
+
+	level, err := strconv.Atoi(parts[1])
+	if err != nil || level < 0 {
+		return errors.Errorf("invalid allocation log level %q, expected a non-negative integer", parts[1])
+	}
+
+	a[parts[0]] = level
+
+	return nil
+}
+
+// allocationLogLevel returns the verbosity of the allocation logs of the resource.
+func allocationLogLevel(levels AllocationLogLevels, devType string) klog.Level {
+	if level, ok := levels[devType]; ok {
+		return klog.Level(level)
+	}
+
+	return defaultAllocationLogLevel
+}
+
+// logAllocation logs the devices allocated to the containers, or the failure
+// of the allocation, at the allocation log level of the resource.
+func (srv *server) logAllocation(rqt *pluginapi.AllocateRequest, err error) {
+	log := klog.V(srv.allocationLogLevel)
+	if !log.Enabled() {
+		return
+	}
+
+	if err != nil {
+		log.Infof("Allocation of %s devices %v failed: %+v", srv.devType, requestedDeviceIDs(rqt), err)
+		return
+	}
+
+	for _, crqt := range rqt.ContainerRequests {
+		log.Infof("Allocated %s devices %v to a container", srv.devType, crqt.DevicesIDs)
+	}
+}
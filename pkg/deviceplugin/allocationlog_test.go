@@ -0,0 +1,96 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestAllocationLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+
+	verbosity := flag.Lookup("v").Value.String()
+	if err := flag.Set("v", "2"); err != nil {
+		t.Fatalf("unable to set the verbosity: %+v", err)
+	}
+
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+
+	defer func() {
+		klog.SetOutput(nil)
+		klog.LogToStderr(true)
+		_ = flag.Set("v", verbosity)
+	}()
+
+	levels := AllocationLogLevels{}
+	for _, value := range []string{"gpu=5", "fpga=1"} {
+		if err := levels.Set(value); err != nil {
+			t.Fatalf("unexpected error for %q: %+v", value, err)
+		}
+	}
+
+	for _, devType := range []string{"gpu", "fpga", "qat"} {
+		srv, ok := newServer(devType, nil, nil, nil, nil, &allocationTracker{}, Options{
+			AllocationStrategy:  DefaultAllocationStrategy,
+			AllocationLogLevels: levels,
+		}).(*server)
+		if !ok {
+			t.Fatal("unexpected server type")
+		}
+
+		srv.devices = map[string]DeviceInfo{"dev1": {state: pluginapi.Healthy}}
+
+		for _, id := range []string{"dev1", "missing"} {
+			_, _ = srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{id}}},
+			})
+		}
+	}
+
+	klog.Flush()
+
+	logged := map[string]int{}
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		for _, devType := range []string{"gpu", "fpga", "qat"} {
+			if strings.Contains(line, "Allocated "+devType+" devices") || strings.Contains(line, "Allocation of "+devType+" devices") {
+				logged[devType]++
+			}
+		}
+	}
+
+	// The quiet GPUs and the QAT devices at the default level are below -v=2.
+	if logged["fpga"] != 2 || logged["gpu"] != 0 || logged["qat"] != 0 {
+		t.Errorf("expected 2 FPGA allocation logs only, got %v in %q", logged, buf.String())
+	}
+
+	for _, invalid := range []string{"gpu", "=1", "gpu=-1", "gpu=x"} {
+		if err := levels.Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+
+	if s := levels.String(); s != "fpga=1,gpu=5" {
+		t.Errorf("unexpected levels %q", s)
+	}
+}
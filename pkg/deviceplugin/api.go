@@ -29,6 +29,8 @@ type DeviceInfo struct {
 	topology    *pluginapi.TopologyInfo
 	state       string
 	nodes       []pluginapi.DeviceSpec
+	// generation is the hardware generation of the device, higher is newer.
+	generation int
 }
 
 // UseDefaultMethodError allows the plugin to request running the default
@@ -137,6 +139,24 @@ type PreferredAllocator interface {
 	GetPreferredAllocation(*pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error)
 }
 
+// DeviceHealthChecker is an optional interface implemented by device plugins.
+type DeviceHealthChecker interface {
+	// CheckDeviceHealth performs a lightweight real operation on the device,
+	// e.g. opening its device nodes and calling a trivial ioctl, and returns
+	// an error if the device is not functional. It's called periodically when
+	// the deep health check is enabled. By default the device nodes are opened.
+	CheckDeviceHealth(devType, id string, nodes []pluginapi.DeviceSpec) error
+}
+
+// PostDeallocator is an optional interface implemented by device plugins.
+type PostDeallocator interface {
+	// PostDeallocate is called with the IDs of previously allocated devices
+	// which have been released, e.g. to clean them up for the next pod. Kubelet
+	// doesn't report deallocation, so the releases are detected by polling the
+	// kubelet podresources API which must be accessible to the plugin.
+	PostDeallocate(devType string, deviceIDs []string)
+}
+
 // ContainerPreStarter is an optional interface implemented by device plugins.
 type ContainerPreStarter interface {
 	// PreStartContainer  defines device initialization function before container is started.
@@ -0,0 +1,118 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	capacityFree      = "free"
+	capacityUsed      = "used"
+	capacityUnhealthy = "unhealthy"
+)
+
+var capacityDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "capacity_devices",
+	Help:      "Number of devices of a resource which are free (healthy and not allocated), used (allocated) or unhealthy and not allocated.",
+}, []string{"resource", "state", "pool"})
+
+func init() {
+	metricsRegistry.MustRegister(capacityDevices)
+}
+
+// deviceCapacity exports the free and used devices of each resource, e.g. for
+// autoscaling on device scarcity through a custom metrics adapter. The health
+// of the devices comes from the Manager and the allocations from the
+// deallocation polls, which run in different goroutines.
+type deviceCapacity struct {
+	// healthy tells the health of the advertised devices keyed by the
+	// resource and the device ID.
+	healthy map[string]map[string]bool
+	// allocated are the allocated device IDs keyed by the resource.
+	allocated map[string]map[string]bool
+	// pool is the node pool label of the metrics.
+	pool  string
+	mutex sync.Mutex
+}
+
+func newDeviceCapacity(pool string) *deviceCapacity {
+	return &deviceCapacity{
+		healthy:   make(map[string]map[string]bool),
+		allocated: make(map[string]map[string]bool),
+		pool:      pool,
+	}
+}
+
+// setDevices sets the devices advertised for the resource, nil if the
+// resource is gone.
+func (c *deviceCapacity) setDevices(resource string, devices map[string]DeviceInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if devices == nil {
+		delete(c.healthy, resource)
+
+		for _, state := range []string{capacityFree, capacityUsed, capacityUnhealthy} {
+			capacityDevices.DeleteLabelValues(resource, state, c.pool)
+		}
+
+		return
+	}
+
+	healthy := make(map[string]bool, len(devices))
+	for id, device := range devices {
+		healthy[id] = device.state == pluginapi.Healthy
+	}
+
+	c.healthy[resource] = healthy
+	c.export(resource)
+}
+
+// setAllocated sets the allocated devices of all resources.
+func (c *deviceCapacity) setAllocated(allocated map[string]map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.allocated = allocated
+
+	for resource := range c.healthy {
+		c.export(resource)
+	}
+}
+
+// export sets the metrics of the resource. Allocated devices the plugin
+// doesn't advertise anymore are counted as used until they are released.
+func (c *deviceCapacity) export(resource string) {
+	counts := map[string]int{capacityUsed: len(c.allocated[resource])}
+
+	for id, healthy := range c.healthy[resource] {
+		switch {
+		case c.allocated[resource][id]:
+		case healthy:
+			counts[capacityFree]++
+		default:
+			counts[capacityUnhealthy]++
+		}
+	}
+
+	for _, state := range []string{capacityFree, capacityUsed, capacityUnhealthy} {
+		capacityDevices.WithLabelValues(resource, state, c.pool).Set(float64(counts[state]))
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+func TestCapacityMetrics(t *testing.T) {
+	tracker := &allocationTracker{capacity: newDeviceCapacity("")}
+
+	capacityDevices.Reset()
+
+	var pods []*podresourcesv1.PodResources
+
+	watcher := newDeallocationWatcher("capacity.intel.com", nil, tracker)
+	watcher.list = func(context.Context) ([]*podresourcesv1.PodResources, error) {
+		return pods, nil
+	}
+
+	expectMetrics := func(expected string) {
+		t.Helper()
+
+		if err := testutil.CollectAndCompare(capacityDevices, strings.NewReader(expected)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	const header = `
+# HELP device_plugin_capacity_devices Number of devices of a resource which are free (healthy and not allocated), used (allocated) or unhealthy and not allocated.
+# TYPE device_plugin_capacity_devices gauge
+`
+
+	mgr := Manager{
+		servers: map[string]devicePluginServer{"gpu": &serverStub{}, "fpga": &serverStub{}},
+		tracker: tracker,
+	}
+
+	mgr.update("gpu", map[string]DeviceInfo{
+		"card0": {state: pluginapi.Healthy},
+		"card1": {state: pluginapi.Healthy},
+		"card2": {state: pluginapi.Unhealthy},
+		"card3": {state: pluginapi.Healthy},
+	})
+	mgr.update("fpga", map[string]DeviceInfo{
+		"port0": {state: pluginapi.Unhealthy},
+	})
+
+	expectMetrics(header + `
+device_plugin_capacity_devices{pool="",resource="fpga",state="free"} 0
+device_plugin_capacity_devices{pool="",resource="fpga",state="unhealthy"} 1
+device_plugin_capacity_devices{pool="",resource="fpga",state="used"} 0
+device_plugin_capacity_devices{pool="",resource="gpu",state="free"} 3
+device_plugin_capacity_devices{pool="",resource="gpu",state="unhealthy"} 1
+device_plugin_capacity_devices{pool="",resource="gpu",state="used"} 0
+`)
+
+	// Allocated devices are used, unhealthy or not.
+	pods = []*podresourcesv1.PodResources{
+		podWithDevices("capacity.intel.com/gpu", "card1", "card2"),
+		podWithDevices("other.intel.com/gpu", "card0"),
+	}
+
+	if err := watcher.poll(context.Background()); err != nil {
+		t.Fatalf("unexpected poll error: %+v", err)
+	}
+
+	expectMetrics(header + `
+device_plugin_capacity_devices{pool="",resource="fpga",state="free"} 0
+device_plugin_capacity_devices{pool="",resource="fpga",state="unhealthy"} 1
+device_plugin_capacity_devices{pool="",resource="fpga",state="used"} 0
+device_plugin_capacity_devices{pool="",resource="gpu",state="free"} 2
+device_plugin_capacity_devices{pool="",resource="gpu",state="unhealthy"} 0
+device_plugin_capacity_devices{pool="",resource="gpu",state="used"} 2
+`)
+
+	// The metrics of removed resources are dropped.
+	mgr.handleUpdate(updateInfo{Removed: DeviceTree{"fpga": {}}})
+
+	expectMetrics(header + `
+device_plugin_capacity_devices{pool="",resource="gpu",state="free"} 2
+device_plugin_capacity_devices{pool="",resource="gpu",state="unhealthy"} 0
+device_plugin_capacity_devices{pool="",resource="gpu",state="used"} 2
+`)
+}
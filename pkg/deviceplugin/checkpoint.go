@@ -0,0 +1,128 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// checkpointDir is the directory of the plugin checkpoints in the device
+// plugin directory. Kubelet removes the files of the device plugin directory
+// when it starts, but leaves the directories in it alone.
+const checkpointDir = "checkpoints"
+
+// allocationCountsPath returns the path of the allocation counter checkpoint
+// of the resources of the namespace in the device plugin directory pluginDir.
+func allocationCountsPath(pluginDir, namespace string) string {
+	return filepath.Join(pluginDir, checkpointDir, namespace+"-allocations.json")
+}
+
+// allocationCounts counts the allocations of each device. The counts are
+// saved to a checkpoint file after every allocation and loaded from it at
+// startup, so that the device_plugin_device_allocations_total counters carry
+// on where they were when the plugin restarts.
+type allocationCounts struct {
+	// counts are the allocations keyed by the resource and the device ID.
+	counts map[string]map[string]uint64
+	path   string
+	// pool is the node pool label of the metrics.
+	pool  string
+	mutex sync.Mutex
+}
+
+// loadAllocationCounts returns the counts saved at path. The counting starts
+// from zero if the checkpoint is missing or can't be read.
+func loadAllocationCounts(path, pool string) *allocationCounts {
+	c := &allocationCounts{
+		counts: make(map[string]map[string]uint64),
+		path:   path,
+		pool:   pool,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Unable to read the allocation counts, counting from zero: %v", err)
+		}
+
+		return c
+	}
+
+	if err := json.Unmarshal(data, &c.counts); err != nil {
+		klog.Warningf("Unable to parse the allocation counts in %s, counting from zero: %v", path, err)
+
+		c.counts = make(map[string]map[string]uint64)
+
+		return c
+	}
+
+	for resource, devices := range c.counts {
+		for id, count := range devices {
+			// Replaced, not added to, should the counts be loaded again.
+			deviceAllocations.DeleteLabelValues(resource, id, pool)
+			deviceAllocations.WithLabelValues(resource, id, pool).Add(float64(count))
+		}
+	}
+
+	return c
+}
+
+// record counts the allocations of the devices of a request and saves the counts.
+func (c *allocationCounts) record(resource string, rqt *pluginapi.AllocateRequest) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.counts[resource] == nil {
+		c.counts[resource] = make(map[string]uint64)
+	}
+
+	for _, crqt := range rqt.ContainerRequests {
+		for _, id := range crqt.DevicesIDs {
+			c.counts[resource][id]++
+			deviceAllocations.WithLabelValues(resource, id, c.pool).Inc()
+		}
+	}
+
+	if err := c.save(); err != nil {
+		klog.Warningf("Unable to save the allocation counts: %+v", err)
+	}
+}
+
+// save writes the counts to a temporary file renamed over the checkpoint,
+// so that a crash can't leave a partially written checkpoint behind.
+func (c *allocationCounts) save() error {
+	data, err := json.Marshal(c.counts)
+	if err != nil {
+		return errors.Wrap(err, "can't encode the allocation counts")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0750); err != nil {
+		return errors.Wrap(err, "can't create the checkpoint directory")
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "can't write the allocation counts")
+	}
+
+	return errors.Wrap(os.Rename(tmp, c.path), "can't replace the allocation counts")
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	defaultDeallocationPollInterval = 10 * time.Second
+
+	podResourcesSocket  = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	podResourcesTimeout = 5 * time.Second
+)
+
+type listPodResourcesFunc func(ctx context.Context) ([]*podresourcesv1.PodResources, error)
+
+// deallocationWatcher detects the devices released by terminated pods by
+// polling the kubelet podresources API, as kubelet doesn't tell device plugins
+// about deallocation. Devices allocated and released between two polls are
+// not detected.
+type deallocationWatcher struct {
+	list listPodResourcesFunc
+	// postDeallocate is called with the released devices, nil if the plugin
+	// doesn't implement PostDeallocator.
+	postDeallocate func(devType string, deviceIDs []string)
+	// allocated are the device IDs allocated at the previous poll keyed by
+	// the device type, nil before the first poll.
+	allocated map[string]map[string]bool
+	// tracker is told about the released devices.
+	tracker *allocationTracker
+	prefix  string
+}
+
+func newDeallocationWatcher(namespace string, postDeallocate func(devType string, deviceIDs []string),
+	tracker *allocationTracker) *deallocationWatcher {
+	return &deallocationWatcher{
+		list:           listPodResources,
+		postDeallocate: postDeallocate,
+		tracker:        tracker,
+		prefix:         namespace + "/",
+	}
+}
+
+// run polls the allocated devices at the given interval forever. Stale
+// allocations are reaped at reapInterval unless it's zero.
+func (w *deallocationWatcher) run(interval, reapInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var reapTicks <-chan time.Time
+
+	if reapInterval > 0 {
+		reapTicker := time.NewTicker(reapInterval)
+		defer reapTicker.Stop()
+
+		reapTicks = reapTicker.C
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.poll(context.Background()); err != nil {
+				klog.Errorf("Unable to detect released devices: %+v", err)
+			}
+		case <-reapTicks:
+			if err := w.reap(context.Background(), reapInterval); err != nil {
+				klog.Errorf("Unable to reap stale allocations: %+v", err)
+			}
+		}
+	}
+}
+
+// poll calls the post deallocate hook with the devices allocated at the
+// previous poll but not anymore, records their hold durations and updates
+// the device capacity.
+func (w *deallocationWatcher) poll(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, podResourcesTimeout)
+	defer cancel()
+
+	pods, err := w.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	allocated := w.allocatedDevices(pods)
+
+	if w.tracker.capacity != nil {
+		w.tracker.capacity.setAllocated(allocated)
+	}
+
+	if w.allocated != nil {
+		for devType, ids := range releasedDevices(w.allocated, allocated) {
+			klog.V(4).Infof("Devices %v of %s released", ids, devType)
+			w.tracker.released(devType, ids)
+
+			if w.postDeallocate != nil {
+				w.postDeallocate(devType, ids)
+			}
+		}
+	}
+
+	w.allocated = allocated
+
+	return nil
+}
+
+// reap releases the tracked allocations made at least grace ago whose devices
+// no pod has allocated anymore, e.g. because the pod vanished between two
+// polls or while kubelet was down. Devices allocated at the previous poll
+// are left for poll to release.
+func (w *deallocationWatcher) reap(ctx context.Context, grace time.Duration) error {
+	holds := w.tracker.holds
+	if holds == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, podResourcesTimeout)
+	defer cancel()
+
+	pods, err := w.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	allocated := w.allocatedDevices(pods)
+
+	for devType, ids := range holds.stale(grace) {
+		reaped := make([]string, 0, len(ids))
+
+		for _, id := range ids {
+			if !allocated[devType][id] && !w.allocated[devType][id] {
+				reaped = append(reaped, id)
+			}
+		}
+
+		if len(reaped) == 0 {
+			continue
+		}
+
+		klog.Infof("Reaping stale allocations of devices %v of %s", reaped, devType)
+		reapedAllocations.WithLabelValues(devType, w.tracker.pool).Add(float64(len(reaped)))
+		holds.forget(devType, reaped)
+
+		if w.postDeallocate != nil {
+			w.postDeallocate(devType, reaped)
+		}
+	}
+
+	return nil
+}
+
+// allocatedDevices returns the device IDs of the plugin's resources allocated
+// to the pods keyed by the device type.
+func (w *deallocationWatcher) allocatedDevices(pods []*podresourcesv1.PodResources) map[string]map[string]bool {
+	allocated := make(map[string]map[string]bool)
+
+	for _, pod := range pods {
+		for _, container := range pod.Containers {
+			for _, devices := range container.Devices {
+				if !strings.HasPrefix(devices.ResourceName, w.prefix) {
+					continue
+				}
+
+				devType := strings.TrimPrefix(devices.ResourceName, w.prefix)
+				if allocated[devType] == nil {
+					allocated[devType] = make(map[string]bool)
+				}
+
+				for _, id := range devices.DeviceIds {
+					allocated[devType][id] = true
+				}
+			}
+		}
+	}
+
+	return allocated
+}
+
+// releasedDevices returns the sorted device IDs in previous but not in current
+// keyed by the device type.
+func releasedDevices(previous, current map[string]map[string]bool) map[string][]string {
+	released := make(map[string][]string)
+
+	for devType, ids := range previous {
+		for id := range ids {
+			if !current[devType][id] {
+				released[devType] = append(released[devType], id)
+			}
+		}
+
+		sort.Strings(released[devType])
+	}
+
+	return released
+}
+
+// listPodResources lists the resources allocated to the pods on the node.
+func listPodResources(ctx context.Context) ([]*podresourcesv1.PodResources, error) {
+	conn, err := grpc.DialContext(ctx, podResourcesSocket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot connect to the podresources service")
+	}
+
+	defer conn.Close()
+
+	resp, err := podresourcesv1.NewPodResourcesListerClient(conn).List(ctx, &podresourcesv1.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot list pod resources")
+	}
+
+	return resp.PodResources, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+type postDeallocatorStub struct {
+	released map[string][]string
+}
+
+func (p *postDeallocatorStub) PostDeallocate(devType string, deviceIDs []string) {
+	p.released[devType] = append(p.released[devType], deviceIDs...)
+}
+
+func podWithDevices(resourceName string, ids ...string) *podresourcesv1.PodResources {
+	return &podresourcesv1.PodResources{
+		Containers: []*podresourcesv1.ContainerResources{
+			{
+				Devices: []*podresourcesv1.ContainerDevices{
+					{ResourceName: resourceName, DeviceIds: ids},
+				},
+			},
+		},
+	}
+}
+
+func TestPostDeallocate(t *testing.T) {
+	stub := &postDeallocatorStub{released: make(map[string][]string)}
+	watcher := newDeallocationWatcher("fpga.intel.com", stub.PostDeallocate, &allocationTracker{})
+
+	var (
+		pods    []*podresourcesv1.PodResources
+		listErr error
+	)
+
+	watcher.list = func(context.Context) ([]*podresourcesv1.PodResources, error) {
+		return pods, listErr
+	}
+
+	poll := func() {
+		t.Helper()
+
+		if err := watcher.poll(context.Background()); err != nil {
+			t.Fatalf("unexpected poll error: %+v", err)
+		}
+	}
+
+	pods = []*podresourcesv1.PodResources{
+		podWithDevices("fpga.intel.com/region-1", "dev1", "dev2"),
+		podWithDevices("fpga.intel.com/region-1", "dev3"),
+		podWithDevices("gpu.intel.com/i915", "card0"),
+	}
+
+	poll()
+
+	if len(stub.released) != 0 {
+		t.Errorf("devices allocated at the first poll were reported released: %v", stub.released)
+	}
+
+	// The first pod terminates and the GPU pod of another plugin too.
+	pods = pods[1:2]
+
+	poll()
+
+	expected := map[string][]string{"region-1": {"dev1", "dev2"}}
+	if !reflect.DeepEqual(stub.released, expected) {
+		t.Errorf("expected released devices %v, got %v", expected, stub.released)
+	}
+
+	// A failed poll must not report the allocated devices released.
+	listErr = errors.New("kubelet is restarting")
+
+	if err := watcher.poll(context.Background()); err == nil {
+		t.Error("poll didn't fail")
+	}
+
+	listErr = nil
+
+	poll()
+
+	if !reflect.DeepEqual(stub.released, expected) {
+		t.Errorf("devices still allocated were reported released: %v", stub.released)
+	}
+}
+
+func TestReapStaleAllocations(t *testing.T) {
+	now := time.Now()
+
+	holds := newDeviceHolds(false, "")
+	holds.now = func() time.Time { return now }
+
+	stub := &postDeallocatorStub{released: make(map[string][]string)}
+	watcher := newDeallocationWatcher("fpga.intel.com", stub.PostDeallocate, &allocationTracker{holds: holds})
+
+	var pods []*podresourcesv1.PodResources
+
+	watcher.list = func(context.Context) ([]*podresourcesv1.PodResources, error) {
+		return pods, nil
+	}
+
+	reap := func() {
+		t.Helper()
+
+		if err := watcher.reap(context.Background(), time.Minute); err != nil {
+			t.Fatalf("unexpected reap error: %+v", err)
+		}
+	}
+
+	pods = []*podresourcesv1.PodResources{podWithDevices("fpga.intel.com/reaptest", "dev3")}
+
+	if err := watcher.poll(context.Background()); err != nil {
+		t.Fatalf("unexpected poll error: %+v", err)
+	}
+
+	holds.allocate("reaptest", []string{"dev1", "dev2", "dev3"})
+
+	// Recent allocations are kept even if no pod has the devices yet.
+	pods = nil
+
+	reap()
+
+	if len(stub.released) != 0 {
+		t.Errorf("recent allocations were reaped: %v", stub.released)
+	}
+
+	// The pod of dev1 vanished, dev2 is still allocated and the release of
+	// dev3 is detected by the next poll.
+	now = now.Add(2 * time.Minute)
+	pods = []*podresourcesv1.PodResources{podWithDevices("fpga.intel.com/reaptest", "dev2")}
+
+	reap()
+
+	expected := map[string][]string{"reaptest": {"dev1"}}
+	if !reflect.DeepEqual(stub.released, expected) {
+		t.Errorf("expected reaped devices %v, got %v", expected, stub.released)
+	}
+
+	if reaped := testutil.ToFloat64(reapedAllocations.WithLabelValues("reaptest", "")); reaped != 1 {
+		t.Errorf("expected 1 reaped allocation, got %v", reaped)
+	}
+
+	// Reaped allocations are released only once.
+	reap()
+
+	if !reflect.DeepEqual(stub.released, expected) {
+		t.Errorf("expected reaped devices %v, got %v", expected, stub.released)
+	}
+}
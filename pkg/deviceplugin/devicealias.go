@@ -0,0 +1,104 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// aliasIndex is replaced by the index of the device node in the device alias paths.
+const aliasIndex = "%d"
+
+// DeviceAliases maps resource names to the fixed container path the allocated
+// device nodes are made available at too. It implements flag.Value and can be
+// given several times as "resource=path". A "%d" in the path is replaced by
+// the index of the device node among the nodes allocated to the container.
+type DeviceAliases map[string]string
+
+func (d DeviceAliases) String() string {
+	entries := make([]string, 0, len(d))
+
+	for resource, alias := range d {
+		entries = append(entries, resource+"="+alias)
+	}
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// Set adds a "resource=path" entry.
+func (d DeviceAliases) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid device alias %q, expected resource=path", value)
+	}
+
+	alias := parts[1]
+
+	if !path.IsAbs(alias) || path.Clean(alias) != alias {
+		return errors.Errorf("invalid device alias %q, expected a clean absolute path", alias)
+	}
+
+	if strings.Count(alias, "%") != strings.Count(alias, aliasIndex) || strings.Count(alias, aliasIndex) > 1 {
+		return errors.Errorf("invalid device alias %q, only one %s is allowed", alias, aliasIndex)
+	}
+
+	d[parts[0]] = alias
+
+	return nil
+}
+
+// addDeviceAliases adds the device nodes of the containers again at the alias
+// path. Without an index in the alias only containers with a single device
+// node get it. Paths the container has a device node at already are skipped.
+func addDeviceAliases(response *pluginapi.AllocateResponse, alias string) {
+	indexed := strings.Contains(alias, aliasIndex)
+
+	for _, cresp := range response.ContainerResponses {
+		nodes := cresp.Devices
+
+		if !indexed && len(nodes) != 1 {
+			klog.Warningf("Device alias %s skipped for a container with %d device nodes", alias, len(nodes))
+			continue
+		}
+
+		taken := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			taken[node.ContainerPath] = true
+		}
+
+		for i, node := range nodes {
+			containerPath := strings.Replace(alias, aliasIndex, strconv.Itoa(i), 1)
+			if taken[containerPath] {
+				klog.Warningf("Device alias %s skipped, the container has a device node there already", containerPath)
+				continue
+			}
+
+			cresp.Devices = append(cresp.Devices, &pluginapi.DeviceSpec{
+				ContainerPath: containerPath,
+				HostPath:      node.HostPath,
+				Permissions:   node.Permissions,
+			})
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceAliases(t *testing.T) {
+	tcases := []struct {
+		name          string
+		alias         string
+		ids           []string
+		expectedPaths []string
+	}{
+		{
+			name:          "single device",
+			alias:         "/dev/accel",
+			ids:           []string{"dev1"},
+			expectedPaths: []string{"/dev/dri/card1", "/dev/accel"},
+		},
+		{
+			name:          "several devices without an index",
+			alias:         "/dev/accel",
+			ids:           []string{"dev1", "dev2"},
+			expectedPaths: []string{"/dev/dri/card1", "/dev/dri/card2"},
+		},
+		{
+			name:          "indexed devices",
+			alias:         "/dev/accel%d",
+			ids:           []string{"dev2", "dev1"},
+			expectedPaths: []string{"/dev/dri/card2", "/dev/dri/card1", "/dev/accel0", "/dev/accel1"},
+		},
+		{
+			name:          "alias taken by a device node",
+			alias:         "/dev/dri/card1",
+			ids:           []string{"dev1"},
+			expectedPaths: []string{"/dev/dri/card1"},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, ok := newServer("testtype", nil, nil, nil, nil, &allocationTracker{}, Options{
+				AllocationStrategy: DefaultAllocationStrategy,
+				DeviceAliases:      DeviceAliases{"testtype": tc.alias},
+			}).(*server)
+			if !ok {
+				t.Fatal("unexpected server type")
+			}
+
+			srv.devices = map[string]DeviceInfo{}
+
+			for _, id := range []string{"dev1", "dev2"} {
+				srv.devices[id] = DeviceInfo{
+					state: pluginapi.Healthy,
+					nodes: []pluginapi.DeviceSpec{{
+						HostPath:      "/dev/dri/card" + id[3:],
+						ContainerPath: "/dev/dri/card" + id[3:],
+						Permissions:   "rw",
+					}},
+				}
+			}
+
+			response, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{DevicesIDs: tc.ids},
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected allocation error: %+v", err)
+			}
+
+			paths := []string{}
+
+			for _, node := range response.ContainerResponses[0].Devices {
+				paths = append(paths, node.ContainerPath)
+			}
+
+			if !reflect.DeepEqual(paths, tc.expectedPaths) {
+				t.Errorf("expected device nodes at %v, got %v", tc.expectedPaths, paths)
+			}
+
+			// The aliases are the allocated device nodes.
+			nodes := response.ContainerResponses[0].Devices
+			for i := len(tc.ids); i < len(nodes); i++ {
+				if original := nodes[i-len(tc.ids)]; nodes[i].HostPath != original.HostPath || nodes[i].Permissions != original.Permissions {
+					t.Errorf("expected alias %s of %s, got %s", nodes[i].ContainerPath, original.HostPath, nodes[i].HostPath)
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceAliasesFlag(t *testing.T) {
+	aliases := DeviceAliases{}
+
+	for _, value := range []string{"gpu=/dev/accel", "fpga=/dev/fpga%d"} {
+		if err := aliases.Set(value); err != nil {
+			t.Errorf("unexpected error for %q: %+v", value, err)
+		}
+	}
+
+	if s := aliases.String(); s != "fpga=/dev/fpga%d,gpu=/dev/accel" {
+		t.Errorf("unexpected aliases %q", s)
+	}
+
+	for _, value := range []string{"gpu", "=/dev/accel", "gpu=dev/accel", "gpu=/dev/../accel", "gpu=/dev/accel%s", "gpu=/dev/%d/accel%d"} {
+		if err := aliases.Set(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// discoveryNotifier takes the devices found by the first scan. Later scans
+// are ignored.
+type discoveryNotifier struct {
+	devices chan DeviceTree
+	once    sync.Once
+}
+
+func (n *discoveryNotifier) Notify(devices DeviceTree) {
+	n.once.Do(func() {
+		n.devices <- devices
+	})
+}
+
+// discover runs the first scan of the plugin and writes the devices it would
+// advertise to out as JSON, without serving them to kubelet.
+func (m *Manager) discover(out io.Writer) error {
+	n := &discoveryNotifier{devices: make(chan DeviceTree, 1)}
+	scanErr := make(chan error, 1)
+
+	go func() {
+		scanErr <- m.devicePlugin.Scan(n)
+	}()
+
+	var devices DeviceTree
+
+	select {
+	case devices = <-n.devices:
+	case err := <-scanErr:
+		if err != nil {
+			return errors.Wrap(err, "device scan failed")
+		}
+
+		// The scan may have notified before returning.
+		select {
+		case devices = <-n.devices:
+		default:
+			devices = NewDeviceTree()
+		}
+	}
+
+	advertised := NewDeviceTree()
+
+	for devType, typeDevices := range capDevices(devices, m.options.MaxAdvertised) {
+		if minHealthy := m.options.MinHealthy[devType]; minHealthy > 0 {
+			typeDevices = applyMinHealthy(typeDevices, minHealthy)
+		}
+
+		advertised[devType] = typeDevices
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return errors.Wrap(encoder.Encode(deviceInventory(advertised)), "unable to write the device inventory")
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// scannerFunc runs a scan function as the Scanner of a plugin.
+type scannerFunc func(Notifier) error
+
+func (f scannerFunc) Scan(n Notifier) error {
+	return f(n)
+}
+
+func TestDiscoverOnly(t *testing.T) {
+	devices := DeviceTree{
+		"gpu": {
+			"card1": {state: pluginapi.Healthy, nodes: []pluginapi.DeviceSpec{{HostPath: "/dev/dri/card1"}}},
+			"card0": {
+				state:    pluginapi.Healthy,
+				nodes:    []pluginapi.DeviceSpec{{HostPath: "/dev/dri/card0"}},
+				topology: &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 0}}},
+			},
+		},
+		"fpga": {
+			"port0": {state: pluginapi.Unhealthy, nodes: []pluginapi.DeviceSpec{{HostPath: "/dev/intel-fpga-port.0"}}},
+		},
+	}
+
+	tcases := []struct {
+		scan              func(Notifier) error
+		options           Options
+		name              string
+		expectedInventory []inventoryDevice
+		expectedErr       bool
+	}{
+		{
+			name: "scanning plugin",
+			// Plugins keep scanning after the first notification.
+			scan: func(n Notifier) error {
+				n.Notify(devices)
+				n.Notify(NewDeviceTree())
+				select {}
+			},
+			expectedInventory: []inventoryDevice{
+				{Resource: "fpga", ID: "port0", Health: pluginapi.Unhealthy, Nodes: []string{"/dev/intel-fpga-port.0"}},
+				{Resource: "gpu", ID: "card0", Health: pluginapi.Healthy, Nodes: []string{"/dev/dri/card0"}, NUMANodes: []int64{0}},
+				{Resource: "gpu", ID: "card1", Health: pluginapi.Healthy, Nodes: []string{"/dev/dri/card1"}},
+			},
+		},
+		{
+			name: "advertising options",
+			scan: func(n Notifier) error {
+				n.Notify(devices)
+
+				return nil
+			},
+			options: Options{MaxAdvertised: 1, MinHealthy: MinHealthy{"gpu": 2}},
+			expectedInventory: []inventoryDevice{
+				{Resource: "fpga", ID: "port0", Health: pluginapi.Unhealthy, Nodes: []string{"/dev/intel-fpga-port.0"}},
+				{Resource: "gpu", ID: "card0", Health: pluginapi.Unhealthy, Nodes: []string{"/dev/dri/card0"}, NUMANodes: []int64{0}},
+			},
+		},
+		{
+			name: "no devices",
+			scan: func(n Notifier) error {
+				return nil
+			},
+			expectedInventory: []inventoryDevice{},
+		},
+		{
+			name: "failing scan",
+			scan: func(n Notifier) error {
+				return errors.New("no sysfs")
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mgr := NewManager("testnamespace", scannerFunc(tc.scan), tc.options)
+			mgr.createServer = func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc, *allocationTracker, Options) devicePluginServer {
+				t.Error("a device plugin server was created")
+				return &serverStub{}
+			}
+
+			var out bytes.Buffer
+
+			err := mgr.discover(&out)
+			if tc.expectedErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			var inventory []inventoryDevice
+			if err := json.Unmarshal(out.Bytes(), &inventory); err != nil {
+				t.Fatalf("unable to decode the inventory %q: %+v", out.String(), err)
+			}
+
+			if !reflect.DeepEqual(inventory, tc.expectedInventory) {
+				t.Errorf("expected inventory %+v, got %+v", tc.expectedInventory, inventory)
+			}
+
+			if len(mgr.servers) != 0 {
+				t.Errorf("expected no registered resources, got %v", mgr.servers)
+			}
+
+			// The devices of the plugin are left as they are.
+			if devices["gpu"]["card0"].state != pluginapi.Healthy {
+				t.Error("the scanned devices were modified")
+			}
+		})
+	}
+}
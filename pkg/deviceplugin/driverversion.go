@@ -0,0 +1,225 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// sysfsModuleDir has the directories of the loaded kernel modules, which
+	// have their version in the version file if the module declares one.
+	sysfsModuleDir = "/sys/module"
+
+	versionRangeSeparator = ".."
+)
+
+var driverVersionSkew = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "driver_version_skew",
+	Help:      "1 if the loaded version of a kernel driver is outside its compatible range, 0 otherwise.",
+}, []string{"driver", "version", "pool"})
+
+func init() {
+	metricsRegistry.MustRegister(driverVersionSkew)
+}
+
+// versionRange is an inclusive range of versions. Empty bounds are open.
+type versionRange struct {
+	min string
+	max string
+}
+
+func (r versionRange) String() string {
+	return r.min + versionRangeSeparator + r.max
+}
+
+func (r versionRange) contains(version string) (bool, error) {
+	if r.min != "" {
+		cmp, err := compareVersions(version, r.min)
+		if err != nil || cmp < 0 {
+			return false, err
+		}
+	}
+
+	if r.max != "" {
+		cmp, err := compareVersions(version, r.max)
+		if err != nil || cmp > 0 {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// DriverVersions maps kernel driver names to the range of their versions the
+// plugin is known to work with. It implements flag.Value and can be given
+// several times as "driver=min..max", where either bound may be left out.
+type DriverVersions map[string]versionRange
+
+func (d DriverVersions) String() string {
+	entries := make([]string, 0, len(d))
+
+	for driver, versions := range d {
+		entries = append(entries, driver+"="+versions.String())
+	}
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// Set adds a "driver=min..max" entry.
+func (d DriverVersions) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid driver versions %q, expected driver=min..max", value)
+	}
+
+	bounds := strings.Split(parts[1], versionRangeSeparator)
+	if len(bounds) != 2 || (bounds[0] == "" && bounds[1] == "") {
+		return errors.Errorf("invalid driver version range %q, expected min..max", parts[1])
+	}
+
+	for _, bound := range bounds {
+		if bound == "" {
+			continue
+		}
+
+		if _, err := parseVersion(bound); err != nil {
+			return err
+		}
+	}
+
+	d[parts[0]] = versionRange{min: bounds[0], max: bounds[1]}
+
+	return nil
+}
+
+// parseVersion returns the numeric components of a dotted version such as
+// "1.2.3". Anything after the leading digits of a component is ignored, so
+// that e.g. "5.1.0-k" is 5.1.0.
+func parseVersion(version string) ([]int, error) {
+	fields := strings.Split(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".")
+	numbers := make([]int, 0, len(fields))
+
+	for _, field := range fields {
+		digits := len(field) - len(strings.TrimLeft(field, "0123456789"))
+		if digits == 0 {
+			break
+		}
+
+		number, err := strconv.Atoi(field[:digits])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid version %q", version)
+		}
+
+		numbers = append(numbers, number)
+
+		if digits < len(field) {
+			break
+		}
+	}
+
+	if len(numbers) == 0 {
+		return nil, errors.Errorf("invalid version %q", version)
+	}
+
+	return numbers, nil
+}
+
+// compareVersions returns -1, 0 or 1 if a is older than, the same as or newer
+// than b. Missing components are zero, so "1.2" equals "1.2.0".
+func compareVersions(a, b string) (int, error) {
+	aNumbers, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+
+	bNumbers, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(aNumbers) || i < len(bNumbers); i++ {
+		var aNumber, bNumber int
+
+		if i < len(aNumbers) {
+			aNumber = aNumbers[i]
+		}
+
+		if i < len(bNumbers) {
+			bNumber = bNumbers[i]
+		}
+
+		switch {
+		case aNumber < bNumber:
+			return -1, nil
+		case aNumber > bNumber:
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// checkDriverVersions reads the versions of the loaded drivers from moduleDir
+// and warns about the ones outside their compatible range. The devices are
+// advertised regardless, the warning is meant to explain failures before they
+// happen. The skewed drivers are returned. The metrics are labelled with pool.
+func checkDriverVersions(moduleDir string, versions DriverVersions, pool string) []string {
+	skewed := make([]string, 0)
+
+	for driver, compatible := range versions {
+		data, err := os.ReadFile(filepath.Join(moduleDir, driver, "version"))
+		if err != nil {
+			klog.Warningf("Unable to check the version of driver %s: %v", driver, err)
+			continue
+		}
+
+		version := strings.TrimSpace(string(data))
+
+		ok, err := compatible.contains(version)
+		if err != nil {
+			klog.Warningf("Unable to check the version of driver %s: %v", driver, err)
+			continue
+		}
+
+		if ok {
+			klog.V(1).Infof("Driver %s version %s is within the compatible range %s", driver, version, compatible)
+			driverVersionSkew.WithLabelValues(driver, version, pool).Set(0)
+
+			continue
+		}
+
+		klog.Errorf("Driver %s version %s is outside the compatible range %s, the devices may fail",
+			driver, version, compatible)
+		driverVersionSkew.WithLabelValues(driver, version, pool).Set(1)
+
+		skewed = append(skewed, driver)
+	}
+
+	sort.Strings(skewed)
+
+	return skewed
+}
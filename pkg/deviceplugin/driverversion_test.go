@@ -0,0 +1,111 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDriverVersionsFlag(t *testing.T) {
+	versions := DriverVersions{}
+
+	for _, valid := range []string{"i915=1.6..2.0", "ice=1.9..", "qat=..4"} {
+		if err := versions.Set(valid); err != nil {
+			t.Errorf("valid driver versions %q were rejected: %+v", valid, err)
+		}
+	}
+
+	if value := versions.String(); value != "i915=1.6..2.0,ice=1.9..,qat=..4" {
+		t.Errorf("unexpected value %q", value)
+	}
+
+	for _, invalid := range []string{"i915", "=1..2", "i915=1.6", "i915=..", "i915=a..b", "i915=1..2..3"} {
+		if err := versions.Set(invalid); err == nil {
+			t.Errorf("invalid driver versions %q were accepted", invalid)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tcases := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "1.2.3", b: "1.2.3", expected: 0},
+		{a: "1.2", b: "1.2.0", expected: 0},
+		{a: "1.10", b: "1.9", expected: 1},
+		{a: "1.2.3", b: "1.3", expected: -1},
+		{a: "5.1.0-k", b: "5.1", expected: 0},
+		{a: "v2.0", b: "1.99", expected: 1},
+	}
+
+	for _, tc := range tcases {
+		cmp, err := compareVersions(tc.a, tc.b)
+		if err != nil || cmp != tc.expected {
+			t.Errorf("comparing %s to %s: expected %d, got %d (%v)", tc.a, tc.b, tc.expected, cmp, err)
+		}
+	}
+
+	if _, err := compareVersions("unknown", "1.0"); err == nil {
+		t.Error("invalid version was compared")
+	}
+}
+
+func TestCheckDriverVersions(t *testing.T) {
+	moduleDir := t.TempDir()
+
+	for driver, version := range map[string]string{
+		"inrange": "1.8.2\n",
+		"old":     "1.5.0",
+		"new":     "2.0.1-k",
+		"bounded": "2.0",
+		"garbage": "unknown",
+	} {
+		if err := os.MkdirAll(filepath.Join(moduleDir, driver), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(moduleDir, driver, "version"), []byte(version), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions := DriverVersions{}
+	for _, value := range []string{
+		"inrange=1.6..2.0", "old=1.6..2.0", "new=1.6..2.0", "bounded=1.6..2.0", "garbage=1.6..", "missing=1.0..",
+	} {
+		if err := versions.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skewed := checkDriverVersions(moduleDir, versions, "")
+	if !reflect.DeepEqual(skewed, []string{"new", "old"}) {
+		t.Errorf("expected drivers new and old skewed, got %v", skewed)
+	}
+
+	if skew := testutil.ToFloat64(driverVersionSkew.WithLabelValues("old", "1.5.0", "")); skew != 1 {
+		t.Errorf("expected skew of the old driver, got %v", skew)
+	}
+
+	if skew := testutil.ToFloat64(driverVersionSkew.WithLabelValues("inrange", "1.8.2", "")); skew != 0 {
+		t.Errorf("expected no skew of the driver in range, got %v", skew)
+	}
+}
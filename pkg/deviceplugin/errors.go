@@ -0,0 +1,116 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// AllocationErrorReason tells why an allocation failed.
+type AllocationErrorReason string
+
+// Allocation error reasons.
+const (
+	// DeviceNotFound means that an allocated device is not known to the plugin.
+	DeviceNotFound AllocationErrorReason = "device not found"
+	// DeviceUnhealthy means that an allocated device is not healthy.
+	DeviceUnhealthy AllocationErrorReason = "device unhealthy"
+	// ResourcesExhausted means that there are not enough devices for the request.
+	ResourcesExhausted AllocationErrorReason = "resources exhausted"
+	// RateLimited means that the request was canceled while waiting for the
+	// allocation rate limit of the devices.
+	RateLimited AllocationErrorReason = "rate limited"
+	// FairShareExceeded means that the devices are kept for the pods of
+	// namespaces holding fewer of them than the requester.
+	FairShareExceeded AllocationErrorReason = "fair share exceeded"
+	// PluginFailure means that the plugin failed to prepare the devices for the container.
+	PluginFailure AllocationErrorReason = "plugin failure"
+)
+
+// AllocationError is returned to kubelet when devices can't be allocated. Its
+// message ends up in the pod events and names the resource, the reason and the
+// devices involved. Plugins may return it from their optional interface methods
+// to give a more specific reason than PluginFailure.
+type AllocationError struct {
+	Err       error
+	Resource  string
+	Reason    AllocationErrorReason
+	DeviceIDs []string
+}
+
+// NewAllocationError creates an AllocationError. The resource is filled in by the framework.
+func NewAllocationError(reason AllocationErrorReason, deviceIDs []string, err error) *AllocationError {
+	return &AllocationError{
+		Reason:    reason,
+		DeviceIDs: deviceIDs,
+		Err:       err,
+	}
+}
+
+func (e *AllocationError) Error() string {
+	var msg strings.Builder
+
+	msg.WriteString("allocation of ")
+	msg.WriteString(e.Resource)
+	msg.WriteString(" failed: ")
+	msg.WriteString(string(e.Reason))
+
+	if len(e.DeviceIDs) > 0 {
+		msg.WriteString(" (devices: ")
+		msg.WriteString(strings.Join(e.DeviceIDs, ", "))
+		msg.WriteString(")")
+	}
+
+	if e.Err != nil {
+		msg.WriteString(": ")
+		msg.WriteString(e.Err.Error())
+	}
+
+	return msg.String()
+}
+
+func (e *AllocationError) Unwrap() error {
+	return e.Err
+}
+
+// toAllocationError turns err into an AllocationError of the resource. Errors
+// which are AllocationErrors already keep their reason and devices.
+func toAllocationError(err error, resource string, reason AllocationErrorReason, deviceIDs []string) *AllocationError {
+	var allocErr *AllocationError
+
+	if !errors.As(err, &allocErr) {
+		allocErr = NewAllocationError(reason, deviceIDs, err)
+	}
+
+	if allocErr.Resource == "" {
+		allocErr.Resource = resource
+	}
+
+	return allocErr
+}
+
+// requestedDeviceIDs returns the device IDs of all container requests.
+func requestedDeviceIDs(rqt *pluginapi.AllocateRequest) []string {
+	ids := make([]string, 0)
+
+	for _, crqt := range rqt.ContainerRequests {
+		ids = append(ids, crqt.DevicesIDs...)
+	}
+
+	return ids
+}
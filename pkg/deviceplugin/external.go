@@ -0,0 +1,104 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	procRoot = "/proc"
+	// podCgroupMarker is contained in the cgroup paths of pod processes.
+	podCgroupMarker = "kubepods"
+)
+
+// externalUsageCheck fails for devices whose device nodes are open in processes
+// outside pods, e.g. host processes grabbing a device kubelet thinks is free.
+// The open files are found by scanning /proc/<pid>/fd, so the plugin must run
+// in the host PID namespace to see the host processes.
+type externalUsageCheck struct {
+	procRoot string
+	self     int
+}
+
+func newExternalUsageCheck(procRoot string) *externalUsageCheck {
+	return &externalUsageCheck{
+		procRoot: procRoot,
+		self:     os.Getpid(),
+	}
+}
+
+func (e *externalUsageCheck) check(devType, id string, nodes []pluginapi.DeviceSpec) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	paths := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		paths[node.HostPath] = true
+	}
+
+	entries, err := os.ReadDir(e.procRoot)
+	if err != nil {
+		return errors.Wrapf(err, "can't list processes")
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == e.self {
+			continue
+		}
+
+		if path, ok := e.openDeviceNode(pid, paths); ok && !e.inPod(pid) {
+			return errors.Errorf("%s is used by process %d outside pods", path, pid)
+		}
+	}
+
+	return nil
+}
+
+// openDeviceNode returns the first of the paths the process has open.
+func (e *externalUsageCheck) openDeviceNode(pid int, paths map[string]bool) (string, bool) {
+	fdDir := filepath.Join(e.procRoot, strconv.Itoa(pid), "fd")
+
+	// The process may have exited or be inaccessible, it's skipped then.
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return "", false
+	}
+
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err == nil && paths[target] {
+			return target, true
+		}
+	}
+
+	return "", false
+}
+
+// inPod tells if the process runs in a pod. Processes whose cgroups can't
+// be read are assumed to, to not report devices unhealthy by mistake.
+func (e *externalUsageCheck) inPod(pid int) bool {
+	cgroups, err := os.ReadFile(filepath.Join(e.procRoot, strconv.Itoa(pid), "cgroup"))
+
+	return err != nil || strings.Contains(string(cgroups), podCgroupMarker)
+}
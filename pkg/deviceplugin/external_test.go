@@ -0,0 +1,92 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// addFakeProcess adds a process with the given cgroup and open files to a fake /proc.
+func addFakeProcess(t *testing.T, root, pid, cgroup string, files ...string) {
+	t.Helper()
+
+	fdDir := filepath.Join(root, pid, "fd")
+	if err := os.MkdirAll(fdDir, 0755); err != nil {
+		t.Fatalf("unable to create %s: %+v", fdDir, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, pid, "cgroup"), []byte(cgroup), 0600); err != nil {
+		t.Fatalf("unable to create the cgroup file: %+v", err)
+	}
+
+	for i, file := range files {
+		if err := os.Symlink(file, filepath.Join(fdDir, string(rune('3'+i)))); err != nil {
+			t.Fatalf("unable to create fd link: %+v", err)
+		}
+	}
+}
+
+func TestExternalUsageCheck(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+
+	checker := newHealthChecker("external usage check", time.Minute, newExternalUsageCheck(root).check)
+	checker.now = func() time.Time { return now }
+
+	devices := map[string]DeviceInfo{
+		"card0": NewDeviceInfo(pluginapi.Healthy, []pluginapi.DeviceSpec{{HostPath: "/dev/dri/card0"}}, nil, nil, nil),
+		"card1": NewDeviceInfo(pluginapi.Healthy, []pluginapi.DeviceSpec{{HostPath: "/dev/dri/card1"}}, nil, nil, nil),
+	}
+
+	// A pod using card0 and a host process using a device of no resource.
+	addFakeProcess(t, root, "100", "0::/kubepods.slice/kubepods-pod1.slice/cri-containerd-1.scope\n", "/dev/dri/card0")
+	addFakeProcess(t, root, "101", "0::/system.slice/sshd.service\n", "/dev/null")
+
+	checked, changed := checker.apply("gpu", devices)
+	if changed || checked["card0"].state != pluginapi.Healthy || checked["card1"].state != pluginapi.Healthy {
+		t.Errorf("devices used only by pods reported unhealthy: %v", checked)
+	}
+
+	// A host process grabs card1.
+	addFakeProcess(t, root, "200", "0::/user.slice/user-1000.slice/session-1.scope\n", "/dev/null", "/dev/dri/card1")
+
+	now = now.Add(time.Minute)
+
+	checked, changed = checker.apply("gpu", devices)
+	if !changed || checked["card1"].state != pluginapi.Unhealthy {
+		t.Error("device used by a host process was not reported unhealthy")
+	}
+
+	if checked["card0"].state != pluginapi.Healthy {
+		t.Error("device used by a pod was reported unhealthy")
+	}
+
+	// The host process releases card1.
+	if err := os.RemoveAll(filepath.Join(root, "200")); err != nil {
+		t.Fatalf("unable to remove the fake process: %+v", err)
+	}
+
+	now = now.Add(time.Minute)
+
+	checked, changed = checker.apply("gpu", devices)
+	if !changed || checked["card1"].state != pluginapi.Healthy {
+		t.Error("released device was not reported healthy")
+	}
+}
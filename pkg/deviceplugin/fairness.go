@@ -0,0 +1,276 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// FairAllocation is the set of resources whose devices are shared fairly
+// between namespaces when they are scarce. It implements flag.Value and can
+// be given several times.
+type FairAllocation map[string]bool
+
+func (f FairAllocation) String() string {
+	resources := make([]string, 0, len(f))
+
+	for resource := range f {
+		resources = append(resources, resource)
+	}
+
+	sort.Strings(resources)
+
+	return strings.Join(resources, ",")
+}
+
+// Set adds a resource.
+func (f FairAllocation) Set(value string) error {
+	if value == "" {
+		return errors.New("empty fair allocation resource")
+	}
+
+	f[value] = true
+
+	return nil
+}
+
+type listPodsFunc func(ctx context.Context) ([]corev1.Pod, error)
+
+// namespaceDevices are the devices of a resource the pods of a namespace hold
+// and wait for.
+type namespaceDevices struct {
+	held    int
+	waiting int
+}
+
+// fairAllocator keeps namespaces from taking more than their fair share of
+// the devices of a resource while the pods of other namespaces wait for them.
+// Kubelet doesn't tell which pod an Allocate call is for, but it admits the
+// pods of the node one at a time in the order of their creation, so the
+// requester is the oldest pod of the node whose devices haven't all been
+// allocated yet. The devices held by each namespace come from the kubelet
+// podresources API and the devices the pods wait for from the pod specs.
+type fairAllocator struct {
+	listPodResources listPodResourcesFunc
+	listPods         listPodsFunc
+	resources        FairAllocation
+	prefix           string
+}
+
+// newFairAllocator returns the fair allocator of the resources of the
+// namespace, nil if the pods of the node can't be listed.
+func newFairAllocator(namespace string, resources FairAllocation) *fairAllocator {
+	listPods, err := nodePodLister(os.Getenv("NODE_NAME"))
+	if err != nil {
+		klog.Errorf("Unable to list the pods of the node, allocating devices first come first served: %+v", err)
+		return nil
+	}
+
+	return &fairAllocator{
+		listPodResources: listPodResources,
+		listPods:         listPods,
+		resources:        resources,
+		prefix:           namespace + "/",
+	}
+}
+
+// nodePodLister returns a function listing the pods bound to the node.
+func nodePodLister(nodeName string) (listPodsFunc, error) {
+	if nodeName == "" {
+		return nil, errors.New("NODE_NAME is not set")
+	}
+
+	clientset, err := inClusterClientset()
+	if err != nil {
+		return nil, err
+	}
+
+	selector := fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+
+	return func(ctx context.Context) ([]corev1.Pod, error) {
+		pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: selector})
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't list the pods of node %s", nodeName)
+		}
+
+		return pods.Items, nil
+	}, nil
+}
+
+// admit returns an error if granting requested more devices of the resource
+// would take the requester over its fair share, i.e. the healthy devices
+// divided by the namespaces holding or waiting for them, and leave too few
+// devices for the namespaces under their share which wait. Fairness is best
+// effort, so failures to tell the requester or the demand admit the request.
+func (f *fairAllocator) admit(ctx context.Context, devType string, requested, healthy int) error {
+	ctx, cancel := context.WithTimeout(ctx, podResourcesTimeout)
+	defer cancel()
+
+	allocated, err := f.listPodResources(ctx)
+	if err != nil {
+		klog.Warningf("Unable to check the fair share of %s, allocating anyway: %+v", devType, err)
+		return nil
+	}
+
+	pods, err := f.listPods(ctx)
+	if err != nil {
+		klog.Warningf("Unable to check the fair share of %s, allocating anyway: %+v", devType, err)
+		return nil
+	}
+
+	namespaces, requester := namespaceDemand(f.prefix+devType, pods, allocated)
+	if requester == "" {
+		klog.V(4).Infof("Unable to tell the requester of %d %s devices, allocating anyway", requested, devType)
+		return nil
+	}
+
+	share := (healthy + len(namespaces) - 1) / len(namespaces)
+	held := namespaces[requester].held + requested
+
+	if held <= share {
+		return nil
+	}
+
+	free := healthy
+	for _, devices := range namespaces {
+		free -= devices.held
+	}
+
+	reserved := 0
+	starved := []string{}
+
+	for namespace, devices := range namespaces {
+		if namespace == requester || devices.waiting == 0 || devices.held >= share {
+			continue
+		}
+
+		if devices.waiting < share-devices.held {
+			reserved += devices.waiting
+		} else {
+			reserved += share - devices.held
+		}
+
+		starved = append(starved, namespace)
+	}
+
+	if free-requested >= reserved {
+		return nil
+	}
+
+	sort.Strings(starved)
+
+	return errors.Errorf("namespace %s would hold %d devices, over its fair share of %d, while %s wait",
+		requester, held, share, strings.Join(starved, ", "))
+}
+
+// namespaceDemand returns the devices of the resource held and waited for by
+// the pods of each namespace, and the namespace of the oldest waiting pod.
+// The namespace is empty if several namespaces have the oldest waiting pods.
+func namespaceDemand(resourceName string, pods []corev1.Pod, allocated []*podresourcesv1.PodResources) (map[string]*namespaceDevices, string) {
+	namespaces := make(map[string]*namespaceDevices)
+	podDevices := make(map[string]int)
+
+	demand := func(namespace string) *namespaceDevices {
+		if namespaces[namespace] == nil {
+			namespaces[namespace] = &namespaceDevices{}
+		}
+
+		return namespaces[namespace]
+	}
+
+	for _, pod := range allocated {
+		for _, container := range pod.Containers {
+			for _, devices := range container.Devices {
+				if devices.ResourceName == resourceName {
+					podDevices[pod.Namespace+"/"+pod.Name] += len(devices.DeviceIds)
+					demand(pod.Namespace).held += len(devices.DeviceIds)
+				}
+			}
+		}
+	}
+
+	var (
+		oldest    *corev1.Pod
+		requester string
+	)
+
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed || pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		missing := requestedDevices(pod, resourceName) - podDevices[pod.Namespace+"/"+pod.Name]
+		if missing <= 0 {
+			continue
+		}
+
+		demand(pod.Namespace).waiting += missing
+
+		switch {
+		case oldest == nil || pod.CreationTimestamp.Before(&oldest.CreationTimestamp):
+			oldest, requester = pod, pod.Namespace
+		case pod.CreationTimestamp.Equal(&oldest.CreationTimestamp) && pod.Namespace != requester:
+			requester = ""
+		}
+	}
+
+	return namespaces, requester
+}
+
+// requestedDevices returns the number of devices of the resource the pod
+// requests. Kubelet reuses the devices of the init containers for the app
+// containers, so it's the sum of the app container requests or the largest
+// init container request, whichever is larger.
+func requestedDevices(pod *corev1.Pod, resourceName string) int {
+	name := corev1.ResourceName(resourceName)
+	requested := 0
+
+	for i := range pod.Spec.Containers {
+		requested += int(pod.Spec.Containers[i].Resources.Limits.Name(name, "").Value())
+	}
+
+	for i := range pod.Spec.InitContainers {
+		if count := int(pod.Spec.InitContainers[i].Resources.Limits.Name(name, "").Value()); count > requested {
+			requested = count
+		}
+	}
+
+	return requested
+}
+
+// healthyDevices returns the number of healthy devices.
+func healthyDevices(devices map[string]DeviceInfo) int {
+	healthy := 0
+
+	for _, device := range devices {
+		if device.state == pluginapi.Healthy {
+			healthy++
+		}
+	}
+
+	return healthy
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const fairResourceName = "fair.intel.com/testtype"
+
+// fairnessNode is a node whose pods kubelet admits one at a time in the
+// order of their creation.
+type fairnessNode struct {
+	pods      []corev1.Pod
+	allocated []*podresourcesv1.PodResources
+}
+
+func (n *fairnessNode) listPods(context.Context) ([]corev1.Pod, error) {
+	return n.pods, nil
+}
+
+func (n *fairnessNode) listPodResources(context.Context) ([]*podresourcesv1.PodResources, error) {
+	return n.allocated, nil
+}
+
+// addPods adds count pods of the namespace requesting one device each.
+func (n *fairnessNode) addPods(namespace string, count int) {
+	for i := 0; i < count; i++ {
+		created := time.Date(2022, 1, 1, 0, 0, len(n.pods), 0, time.UTC)
+
+		n.pods = append(n.pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              fmt.Sprintf("%s-%d", namespace, i),
+				Namespace:         namespace,
+				CreationTimestamp: metav1.NewTime(created),
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{fairResourceName: resource.MustParse("1")},
+					},
+				}},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodPending},
+		})
+	}
+}
+
+// admit admits the pods with srv, handing out the free devices in turn like
+// kubelet does, and returns the number of devices each namespace got. Pods
+// whose allocation fails or which find no free device fail.
+func (n *fairnessNode) admit(t *testing.T, srv *server, free []string) map[string]int {
+	t.Helper()
+
+	got := make(map[string]int)
+
+	for i := range n.pods {
+		pod := &n.pods[i]
+
+		if len(free) == 0 {
+			pod.Status.Phase = corev1.PodFailed
+			continue
+		}
+
+		_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: free[:1]}},
+		})
+
+		var allocErr *AllocationError
+
+		switch {
+		case errors.As(err, &allocErr) && allocErr.Reason == FairShareExceeded:
+			pod.Status.Phase = corev1.PodFailed
+			continue
+		case err != nil:
+			t.Fatalf("unexpected allocation error: %+v", err)
+		}
+
+		n.allocated = append(n.allocated, &podresourcesv1.PodResources{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Containers: []*podresourcesv1.ContainerResources{{
+				Devices: []*podresourcesv1.ContainerDevices{{ResourceName: fairResourceName, DeviceIds: free[:1]}},
+			}},
+		})
+		pod.Status.Phase = corev1.PodRunning
+		got[pod.Namespace]++
+		free = free[1:]
+	}
+
+	return got
+}
+
+func TestFairAllocation(t *testing.T) {
+	tcs := []struct {
+		expected map[string]int
+		name     string
+		devices  int
+		fair     bool
+	}{
+		{
+			name:     "first come first served",
+			devices:  4,
+			expected: map[string]int{"greedy": 4},
+		},
+		{
+			name:     "fair share of scarce devices",
+			devices:  4,
+			fair:     true,
+			expected: map[string]int{"greedy": 2, "modest": 2},
+		},
+		{
+			name:     "enough devices for all",
+			devices:  6,
+			fair:     true,
+			expected: map[string]int{"greedy": 4, "modest": 2},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			node := &fairnessNode{}
+			// The pods of the greedy namespace are created first.
+			node.addPods("greedy", 4)
+			node.addPods("modest", 2)
+
+			srv := newTestServer()
+			srv.devices = make(map[string]DeviceInfo)
+			free := make([]string, 0, tc.devices)
+
+			for i := 0; i < tc.devices; i++ {
+				id := fmt.Sprintf("dev%d", i)
+				srv.devices[id] = DeviceInfo{state: pluginapi.Healthy}
+				free = append(free, id)
+			}
+
+			if tc.fair {
+				srv.tracker.fairness = &fairAllocator{
+					listPodResources: node.listPodResources,
+					listPods:         node.listPods,
+					resources:        FairAllocation{"testtype": true},
+					prefix:           "fair.intel.com/",
+				}
+			}
+
+			if got := node.admit(t, srv, free); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected devices %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// NewestFirst prefers the devices of the newest generation.
+	NewestFirst = "newest-first"
+	// OldestFirst prefers the devices of the oldest generation.
+	OldestFirst = "oldest-first"
+)
+
+// SetGeneration sets the hardware generation of the device, higher being
+// newer, for ordering the preferred devices by their generation.
+func (info *DeviceInfo) SetGeneration(generation int) {
+	info.generation = generation
+}
+
+func validateGenerationPreference(preference string) error {
+	switch preference {
+	case "", NewestFirst, OldestFirst:
+		return nil
+	default:
+		return errors.Errorf("unknown generation preference %q, expected %s or %s", preference, NewestFirst, OldestFirst)
+	}
+}
+
+// byGeneration orders the device IDs by the generation of the devices. The
+// order within a generation is kept. Devices without a generation are zero,
+// i.e. the oldest.
+func byGeneration(ids []string, devices map[string]DeviceInfo, preference string) []string {
+	ordered := append([]string{}, ids...)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		gi, gj := devices[ordered[i]].generation, devices[ordered[j]].generation
+		if preference == NewestFirst {
+			return gi > gj
+		}
+
+		return gi < gj
+	})
+
+	return ordered
+}
+
+// preferredByGeneration returns the devices preferred by the strategy, ordered
+// by their generation first.
+func (srv *server) preferredByGeneration(available, mustInclude []string, size int) []string {
+	devices := srv.currentDevices()
+
+	// The strategy orders all the available devices and the generation
+	// preference overrides it.
+	candidates := srv.strategy.Preferred(available, mustInclude, len(available))
+
+	return preferredFrom(byGeneration(candidates, devices, srv.generationPreference), mustInclude, size)
+}
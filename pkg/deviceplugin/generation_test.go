@@ -0,0 +1,119 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestGenerationPreference(t *testing.T) {
+	tcases := []struct {
+		name         string
+		preference   string
+		strategy     string
+		mustInclude  []string
+		size         int32
+		expectedIDs  []string
+		allocatedIDs []string
+	}{
+		{
+			name:        "newest first",
+			preference:  NewestFirst,
+			strategy:    DefaultAllocationStrategy,
+			size:        6,
+			expectedIDs: []string{"gen12-a", "gen12-b", "gen11-a", "gen11-b", "gen9", "unknown"},
+		},
+		{
+			name:        "oldest first",
+			preference:  OldestFirst,
+			strategy:    DefaultAllocationStrategy,
+			size:        3,
+			expectedIDs: []string{"unknown", "gen9", "gen11-a"},
+		},
+		{
+			name:        "must include an old device",
+			preference:  NewestFirst,
+			strategy:    DefaultAllocationStrategy,
+			mustInclude: []string{"gen9"},
+			size:        2,
+			expectedIDs: []string{"gen9", "gen12-a"},
+		},
+		{
+			name:         "strategy order within a generation",
+			preference:   NewestFirst,
+			strategy:     LRUAllocationStrategy,
+			size:         3,
+			allocatedIDs: []string{"gen12-a"},
+			expectedIDs:  []string{"gen12-b", "gen12-a", "gen11-a"},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, ok := newServer("testtype", nil, nil, nil, nil, &allocationTracker{}, Options{
+				AllocationStrategy:   tc.strategy,
+				GenerationPreference: tc.preference,
+			}).(*server)
+			if !ok {
+				t.Fatal("unexpected server type")
+			}
+
+			if !srv.getDevicePluginOptions().GetPreferredAllocationAvailable {
+				t.Error("preferred allocation is not available")
+			}
+
+			srv.devices = map[string]DeviceInfo{"unknown": {state: pluginapi.Healthy}}
+
+			for id, generation := range map[string]int{"gen9": 9, "gen11-a": 11, "gen11-b": 11, "gen12-a": 12, "gen12-b": 12} {
+				info := DeviceInfo{state: pluginapi.Healthy}
+				info.SetGeneration(generation)
+				srv.devices[id] = info
+			}
+
+			srv.strategy.Allocated(tc.allocatedIDs)
+
+			response, err := srv.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+					AvailableDeviceIDs:   []string{"gen9", "unknown", "gen11-a", "gen12-a", "gen11-b", "gen12-b"},
+					MustIncludeDeviceIDs: tc.mustInclude,
+					AllocationSize:       tc.size,
+				}},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if ids := response.ContainerResponses[0].DeviceIDs; !reflect.DeepEqual(ids, tc.expectedIDs) {
+				t.Errorf("expected preferred devices %v, got %v", tc.expectedIDs, ids)
+			}
+		})
+	}
+}
+
+func TestGenerationPreferenceOption(t *testing.T) {
+	for _, preference := range []string{"", NewestFirst, OldestFirst} {
+		if err := validateGenerationPreference(preference); err != nil {
+			t.Errorf("unexpected error for %q: %+v", preference, err)
+		}
+	}
+
+	if err := validateGenerationPreference("newest"); err == nil {
+		t.Error("expected an error for an unknown preference")
+	}
+}
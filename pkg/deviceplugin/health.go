@@ -0,0 +1,110 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+type deviceHealthCheckFunc func(devType, id string, nodes []pluginapi.DeviceSpec) error
+
+// openDeviceNodes is the default deep health check. It fails if a device
+// node of the device can't be opened.
+func openDeviceNodes(devType, id string, nodes []pluginapi.DeviceSpec) error {
+	for _, node := range nodes {
+		f, err := os.OpenFile(node.HostPath, os.O_RDWR, 0)
+		if err != nil {
+			return errors.Wrapf(err, "can't open %s", node.HostPath)
+		}
+
+		f.Close()
+	}
+
+	return nil
+}
+
+type healthResult struct {
+	checked time.Time
+	failed  bool
+}
+
+// healthChecker runs a health check of the devices reported healthy by the
+// plugin and marks the devices failing it unhealthy. A device is checked at
+// most once per interval.
+type healthChecker struct {
+	check    deviceHealthCheckFunc
+	now      func() time.Time
+	results  map[string]map[string]healthResult
+	name     string
+	interval time.Duration
+}
+
+func newHealthChecker(name string, interval time.Duration, check deviceHealthCheckFunc) *healthChecker {
+	return &healthChecker{
+		name:     name,
+		check:    check,
+		now:      time.Now,
+		results:  make(map[string]map[string]healthResult),
+		interval: interval,
+	}
+}
+
+// apply returns the devices with the ones failing the health check marked
+// unhealthy. The second return value tells if the health of a device changed.
+func (h *healthChecker) apply(devType string, devices map[string]DeviceInfo) (map[string]DeviceInfo, bool) {
+	previous := h.results[devType]
+	results := make(map[string]healthResult, len(devices))
+	checked := make(map[string]DeviceInfo, len(devices))
+	changed := false
+
+	for id, device := range devices {
+		if device.state != pluginapi.Healthy {
+			checked[id] = device
+			continue
+		}
+
+		result, ok := previous[id]
+		if now := h.now(); !ok || now.Sub(result.checked) >= h.interval {
+			err := h.check(devType, id, device.nodes)
+			if err != nil && !result.failed {
+				klog.Warningf("Device %s/%s failed the %s: %+v", devType, id, h.name, err)
+			}
+
+			changed = changed || result.failed != (err != nil)
+			result = healthResult{checked: now, failed: err != nil}
+		}
+
+		if result.failed {
+			device.state = pluginapi.Unhealthy
+		}
+
+		results[id] = result
+		checked[id] = device
+	}
+
+	h.results[devType] = results
+
+	return checked, changed
+}
+
+// forget drops the results of a removed resource.
+func (h *healthChecker) forget(devType string) {
+	delete(h.results, devType)
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeDeviceBackend passes the shallow health check of the plugin, i.e. its
+// devices are reported healthy, but the devices in dead fail real operations.
+type fakeDeviceBackend struct {
+	dead   map[string]bool
+	checks int
+}
+
+func (b *fakeDeviceBackend) CheckDeviceHealth(devType, id string, nodes []pluginapi.DeviceSpec) error {
+	b.checks++
+
+	if b.dead[id] {
+		return errors.Errorf("ioctl on %s failed", id)
+	}
+
+	return nil
+}
+
+func TestDeepHealthCheck(t *testing.T) {
+	backend := &fakeDeviceBackend{dead: map[string]bool{"dev2": true}}
+	now := time.Now()
+	checker := newHealthChecker("deep health check", time.Minute, backend.CheckDeviceHealth)
+	checker.now = func() time.Time { return now }
+
+	devices := map[string]DeviceInfo{
+		"dev1": NewDeviceInfo(pluginapi.Healthy, nil, nil, nil, nil),
+		"dev2": NewDeviceInfo(pluginapi.Healthy, nil, nil, nil, nil),
+		"dev3": NewDeviceInfo(pluginapi.Unhealthy, nil, nil, nil, nil),
+	}
+
+	checked, changed := checker.apply("testtype", devices)
+	if !changed {
+		t.Error("failed deep health check was not reported as a change")
+	}
+
+	if checked["dev1"].state != pluginapi.Healthy || checked["dev2"].state != pluginapi.Unhealthy {
+		t.Errorf("unexpected device health after the first check: %v", checked)
+	}
+
+	if backend.checks != 2 {
+		t.Errorf("expected the 2 healthy devices to be checked, got %d checks", backend.checks)
+	}
+
+	if devices["dev2"].state != pluginapi.Healthy {
+		t.Error("the devices reported by the plugin were modified")
+	}
+
+	now = now.Add(time.Second)
+
+	checked, changed = checker.apply("testtype", devices)
+	if changed || backend.checks != 2 {
+		t.Errorf("devices were checked again within the interval, %d checks", backend.checks)
+	}
+
+	if checked["dev2"].state != pluginapi.Unhealthy {
+		t.Error("failed device was reported healthy within the interval")
+	}
+
+	backend.dead["dev2"] = false
+	now = now.Add(time.Minute)
+
+	checked, changed = checker.apply("testtype", devices)
+	if !changed || checked["dev2"].state != pluginapi.Healthy {
+		t.Error("recovered device was not reported healthy")
+	}
+
+	checker.forget("testtype")
+
+	if _, ok := checker.results["testtype"]; ok {
+		t.Error("results of a removed resource were not dropped")
+	}
+}
+
+func TestDeepHealthCheckInterval(t *testing.T) {
+	opts := Options{AllocationStrategy: DefaultAllocationStrategy, DeepHealthCheckInterval: -time.Second}
+	if err := opts.validate(); err == nil {
+		t.Error("negative deep health check interval passed validation")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// allocationHistoryPath is the debug endpoint serving the allocation history.
+const allocationHistoryPath = "/debug/allocations"
+
+// allocationEvent is a container allocation made by kubelet.
+type allocationEvent struct {
+	Time      time.Time `json:"time"`
+	Resource  string    `json:"resource"`
+	DeviceIDs []string  `json:"deviceIDs"`
+}
+
+// allocationHistory keeps the most recent allocation events in a ring buffer.
+type allocationHistory struct {
+	events []allocationEvent
+	next   int
+	full   bool
+	mutex  sync.Mutex
+}
+
+func newAllocationHistory(size int) *allocationHistory {
+	return &allocationHistory{
+		events: make([]allocationEvent, size),
+	}
+}
+
+// record adds an event overwriting the oldest one if the buffer is full.
+func (h *allocationHistory) record(event allocationEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.events[h.next] = event
+	h.next = (h.next + 1) % len(h.events)
+	h.full = h.full || h.next == 0
+}
+
+// query returns the events of the resource, or of all resources if resource is
+// empty, which happened at or after since, oldest first.
+func (h *allocationHistory) query(resource string, since time.Time) []allocationEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ordered := h.events[:h.next]
+	if h.full {
+		ordered = append(append([]allocationEvent{}, h.events[h.next:]...), ordered...)
+	}
+
+	events := []allocationEvent{}
+
+	for _, event := range ordered {
+		if (resource == "" || event.Resource == resource) && !event.Time.Before(since) {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// ServeHTTP serves the history as JSON. The optional query parameters resource
+// and since, e.g. since=15m, limit the events to a resource and a time window.
+func (h *allocationHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+
+	if value := r.URL.Query().Get("since"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		since = time.Now().Add(-window)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(h.query(r.URL.Query().Get("resource"), since)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// recordAllocations adds the container allocations of a request to the history.
+func (h *allocationHistory) recordAllocations(resource string, rqt *pluginapi.AllocateRequest) {
+	now := time.Now()
+
+	for _, crqt := range rqt.ContainerRequests {
+		h.record(allocationEvent{
+			Time:      now,
+			Resource:  resource,
+			DeviceIDs: append([]string{}, crqt.DevicesIDs...),
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func historyDeviceIDs(events []allocationEvent) [][]string {
+	ids := [][]string{}
+	for _, event := range events {
+		ids = append(ids, event.DeviceIDs)
+	}
+
+	return ids
+}
+
+func TestAllocationHistoryRollover(t *testing.T) {
+	h := newAllocationHistory(3)
+	start := time.Now()
+
+	for i, id := range []string{"dev1", "dev2", "dev3", "dev4", "dev5"} {
+		h.record(allocationEvent{
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Resource:  "testtype",
+			DeviceIDs: []string{id},
+		})
+	}
+
+	expected := [][]string{{"dev3"}, {"dev4"}, {"dev5"}}
+	if ids := historyDeviceIDs(h.query("", time.Time{})); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v after rollover, got %v", expected, ids)
+	}
+
+	expected = [][]string{{"dev4"}, {"dev5"}}
+	if ids := historyDeviceIDs(h.query("testtype", start.Add(3*time.Minute))); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v since the 4th event, got %v", expected, ids)
+	}
+
+	if events := h.query("other", time.Time{}); len(events) != 0 {
+		t.Errorf("unexpected events of another resource: %v", events)
+	}
+}
+
+func TestAllocationHistoryEndpoint(t *testing.T) {
+	history := newAllocationHistory(10)
+
+	srv := newTestServer()
+	srv.tracker = &allocationTracker{history: history}
+
+	_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev1"}},
+			{DevicesIDs: []string{"dev2"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected allocation error: %+v", err)
+	}
+
+	tcases := []struct {
+		name           string
+		query          string
+		expectedIDs    [][]string
+		expectedStatus int
+	}{
+		{
+			name:           "all events",
+			query:          "",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    [][]string{{"dev1"}, {"dev2"}},
+		},
+		{
+			name:           "recent events of the resource",
+			query:          "?resource=testtype&since=1m",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    [][]string{{"dev1"}, {"dev2"}},
+		},
+		{
+			name:           "events of another resource",
+			query:          "?resource=other",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    [][]string{},
+		},
+		{
+			name:           "invalid time window",
+			query:          "?since=yesterday",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			history.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, allocationHistoryPath+tc.query, nil))
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			events := []allocationEvent{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &events); err != nil {
+				t.Fatalf("unable to decode the history: %+v", err)
+			}
+
+			for _, event := range events {
+				if event.Resource != "testtype" || event.Time.IsZero() {
+					t.Errorf("unexpected event %+v", event)
+				}
+			}
+
+			if ids := historyDeviceIDs(events); !reflect.DeepEqual(ids, tc.expectedIDs) {
+				t.Errorf("expected %v, got %v", tc.expectedIDs, ids)
+			}
+		})
+	}
+}
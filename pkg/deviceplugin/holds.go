@@ -0,0 +1,142 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deviceHoldSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "device_hold_seconds",
+		Help:      "Time devices were held by containers, from allocation to release.",
+		// From a minute to about eleven days.
+		Buckets: prometheus.ExponentialBuckets(60, 4, 9),
+	}, []string{"resource", "pool"})
+
+	unknownDeviceHolds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "device_holds_unknown_total",
+		Help:      "Number of device releases whose allocation time is unknown, e.g. allocated before the plugin started.",
+	}, []string{"resource", "pool"})
+
+	reapedAllocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reaped_allocations_total",
+		Help:      "Number of stale device allocations reclaimed because no pod had the device allocated anymore.",
+	}, []string{"resource", "pool"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(deviceHoldSeconds, unknownDeviceHolds, reapedAllocations)
+}
+
+// deviceHolds keeps the allocation times of the devices until they are released.
+type deviceHolds struct {
+	now func() time.Time
+	// allocated are the allocation times keyed by the resource and the device ID.
+	allocated map[string]map[string]time.Time
+	mutex     sync.Mutex
+	// pool is the node pool label of the metrics.
+	pool string
+	// metrics tells to observe the hold durations of released devices.
+	metrics bool
+}
+
+func newDeviceHolds(metrics bool, pool string) *deviceHolds {
+	return &deviceHolds{
+		now:       time.Now,
+		allocated: make(map[string]map[string]time.Time),
+		pool:      pool,
+		metrics:   metrics,
+	}
+}
+
+// allocate records the allocation time of the devices.
+func (h *deviceHolds) allocate(resource string, ids []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.allocated[resource] == nil {
+		h.allocated[resource] = make(map[string]time.Time)
+	}
+
+	now := h.now()
+
+	for _, id := range ids {
+		h.allocated[resource][id] = now
+	}
+}
+
+// release observes the hold durations of the released devices. Devices whose
+// allocation time is unknown, because they were allocated before the plugin
+// started, are only counted.
+func (h *deviceHolds) release(resource string, ids []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := h.now()
+
+	for _, id := range ids {
+		allocated, ok := h.allocated[resource][id]
+
+		switch {
+		case !h.metrics:
+		case !ok:
+			unknownDeviceHolds.WithLabelValues(resource, h.pool).Inc()
+		default:
+			deviceHoldSeconds.WithLabelValues(resource, h.pool).Observe(now.Sub(allocated).Seconds())
+		}
+
+		delete(h.allocated[resource], id)
+	}
+}
+
+// stale returns the sorted IDs of the devices allocated at least age ago
+// keyed by the resource.
+func (h *deviceHolds) stale(age time.Duration) map[string][]string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	stale := make(map[string][]string)
+	now := h.now()
+
+	for resource, devices := range h.allocated {
+		for id, allocated := range devices {
+			if now.Sub(allocated) >= age {
+				stale[resource] = append(stale[resource], id)
+			}
+		}
+
+		sort.Strings(stale[resource])
+	}
+
+	return stale
+}
+
+// forget drops the devices without observing their hold durations.
+func (h *deviceHolds) forget(resource string, ids []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, id := range ids {
+		delete(h.allocated[resource], id)
+	}
+}
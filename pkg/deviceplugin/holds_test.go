@@ -0,0 +1,103 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+func holdHistogram(t *testing.T, resource string) *dto.Histogram {
+	t.Helper()
+
+	metric := &dto.Metric{}
+	if err := deviceHoldSeconds.WithLabelValues(resource, "").(prometheus.Metric).Write(metric); err != nil {
+		t.Fatalf("unable to read the hold durations: %+v", err)
+	}
+
+	return metric.Histogram
+}
+
+func TestDeviceHoldDuration(t *testing.T) {
+	now := time.Now()
+
+	holds := newDeviceHolds(true, "")
+	holds.now = func() time.Time { return now }
+
+	srv := newTestServer()
+	srv.devType = "holdtest"
+	srv.tracker = &allocationTracker{holds: holds}
+
+	var pods []*podresourcesv1.PodResources
+
+	watcher := newDeallocationWatcher("test.intel.com", nil, srv.tracker)
+	watcher.list = func(context.Context) ([]*podresourcesv1.PodResources, error) {
+		return pods, nil
+	}
+
+	poll := func() {
+		t.Helper()
+
+		if err := watcher.poll(context.Background()); err != nil {
+			t.Fatalf("unexpected poll error: %+v", err)
+		}
+	}
+
+	// dev2 was allocated before the plugin started.
+	pods = []*podresourcesv1.PodResources{podWithDevices("test.intel.com/holdtest", "dev2")}
+
+	poll()
+
+	_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev1"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected allocation error: %+v", err)
+	}
+
+	pods = append(pods, podWithDevices("test.intel.com/holdtest", "dev1"))
+
+	poll()
+
+	now = now.Add(5 * time.Minute)
+	pods = nil
+
+	poll()
+
+	histogram := holdHistogram(t, "holdtest")
+	if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != 300 {
+		t.Errorf("expected one hold of 300s, got %d holds of %vs in total", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+
+	if unknown := testutil.ToFloat64(unknownDeviceHolds.WithLabelValues("holdtest", "")); unknown != 1 {
+		t.Errorf("expected 1 hold of unknown duration, got %v", unknown)
+	}
+
+	// The devices are released only once.
+	poll()
+
+	if histogram = holdHistogram(t, "holdtest"); histogram.GetSampleCount() != 1 {
+		t.Errorf("expected one hold, got %d", histogram.GetSampleCount())
+	}
+}
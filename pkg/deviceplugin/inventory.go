@@ -0,0 +1,83 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"sort"
+
+	"k8s.io/klog/v2"
+)
+
+// inventoryDevice is a device in the startup inventory log.
+type inventoryDevice struct {
+	Resource string   `json:"resource"`
+	ID       string   `json:"id"`
+	Health   string   `json:"health"`
+	Nodes    []string `json:"nodes"`
+	// NUMANodes are the NUMA nodes of the device, empty without topology
+	// information.
+	NUMANodes []int64 `json:"numaNodes,omitempty"`
+}
+
+// deviceInventory returns the devices sorted by the resource name and the ID.
+func deviceInventory(devices DeviceTree) []inventoryDevice {
+	inventory := []inventoryDevice{}
+
+	for devType, typeDevices := range devices {
+		for id, device := range typeDevices {
+			entry := inventoryDevice{
+				Resource: devType,
+				ID:       id,
+				Health:   device.state,
+				Nodes:    make([]string, 0, len(device.nodes)),
+			}
+
+			for _, node := range device.nodes {
+				entry.Nodes = append(entry.Nodes, node.HostPath)
+			}
+
+			if device.topology != nil {
+				for _, numaNode := range device.topology.Nodes {
+					entry.NUMANodes = append(entry.NUMANodes, numaNode.ID)
+				}
+			}
+
+			inventory = append(inventory, entry)
+		}
+	}
+
+	sort.Slice(inventory, func(i, j int) bool {
+		if inventory[i].Resource != inventory[j].Resource {
+			return inventory[i].Resource < inventory[j].Resource
+		}
+
+		return inventory[i].ID < inventory[j].ID
+	})
+
+	return inventory
+}
+
+// logInventory logs the devices as a single JSON line, so that node onboarding
+// automation can check the node came up with the expected devices.
+func logInventory(devices DeviceTree) {
+	data, err := json.Marshal(deviceInventory(devices))
+	if err != nil {
+		klog.Errorf("Unable to marshal the device inventory: %+v", err)
+		return
+	}
+
+	klog.Infof("Device inventory: %s", data)
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestInventoryLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+
+	defer func() {
+		klog.SetOutput(nil)
+		klog.LogToStderr(true)
+	}()
+
+	mgr := Manager{
+		devicePlugin: &devicePluginStub{},
+		servers:      map[string]devicePluginServer{},
+		tracker:      &allocationTracker{},
+		createServer: func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc, *allocationTracker, Options) devicePluginServer {
+			return &serverStub{}
+		},
+	}
+
+	mgr.handleUpdate(updateInfo{Added: DeviceTree{
+		"gpu": {
+			"card1": {
+				state: pluginapi.Unhealthy,
+				nodes: []pluginapi.DeviceSpec{{HostPath: "/dev/dri/card1"}, {HostPath: "/dev/dri/renderD129"}},
+			},
+			"card0": {
+				state:    pluginapi.Healthy,
+				nodes:    []pluginapi.DeviceSpec{{HostPath: "/dev/dri/card0"}},
+				topology: &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 1}}},
+			},
+		},
+		"fpga": {
+			"port0": {
+				state: pluginapi.Healthy,
+				nodes: []pluginapi.DeviceSpec{{HostPath: "/dev/intel-fpga-port.0"}},
+			},
+		},
+	}})
+
+	// Later updates are not logged.
+	mgr.handleUpdate(updateInfo{Updated: DeviceTree{"fpga": {}}})
+
+	klog.Flush()
+
+	var logged []inventoryDevice
+
+	count := 0
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if i := strings.Index(line, "Device inventory: "); i >= 0 {
+			count++
+
+			if err := json.Unmarshal([]byte(line[i+len("Device inventory: "):]), &logged); err != nil {
+				t.Fatalf("unable to decode the inventory %q: %+v", line, err)
+			}
+		}
+	}
+
+	if count != 1 {
+		t.Fatalf("expected one inventory log line, got %d in %q", count, buf.String())
+	}
+
+	expected := []inventoryDevice{
+		{Resource: "fpga", ID: "port0", Health: pluginapi.Healthy, Nodes: []string{"/dev/intel-fpga-port.0"}},
+		{Resource: "gpu", ID: "card0", Health: pluginapi.Healthy, Nodes: []string{"/dev/dri/card0"}, NUMANodes: []int64{1}},
+		{Resource: "gpu", ID: "card1", Health: pluginapi.Unhealthy, Nodes: []string{"/dev/dri/card1", "/dev/dri/renderD129"}},
+	}
+
+	if !reflect.DeepEqual(logged, expected) {
+		t.Errorf("expected inventory %+v, got %+v", expected, logged)
+	}
+}
@@ -17,6 +17,7 @@ package deviceplugin
 import (
 	"os"
 	"reflect"
+	"time"
 
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -38,6 +39,9 @@ type updateInfo struct {
 type notifier struct {
 	deviceTree DeviceTree
 	updatesCh  chan<- updateInfo
+	// maxDevices is the maximum number of devices advertised per resource,
+	// zero for no limit.
+	maxDevices int
 }
 
 func newNotifier(updatesCh chan<- updateInfo) *notifier {
@@ -47,6 +51,8 @@ func newNotifier(updatesCh chan<- updateInfo) *notifier {
 }
 
 func (n *notifier) Notify(newDeviceTree DeviceTree) {
+	newDeviceTree = capDevices(newDeviceTree, n.maxDevices)
+
 	added := NewDeviceTree()
 	updated := NewDeviceTree()
 
@@ -78,26 +84,121 @@ func (n *notifier) Notify(newDeviceTree DeviceTree) {
 type Manager struct {
 	devicePlugin Scanner
 	servers      map[string]devicePluginServer
-	createServer func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc) devicePluginServer
-	namespace    string
+	createServer func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc,
+		*allocationTracker, Options) devicePluginServer
+	// tracker is the allocation bookkeeping shared by the servers.
+	tracker *allocationTracker
+	// pluginDir is the kubelet device plugin directory the checkpoints are kept in.
+	pluginDir string
+	// health are the enabled health checks of the devices.
+	health []*healthChecker
+	// devices are the latest devices reported by the plugin.
+	devices DeviceTree
+	// advertised are the devices last sent to kubelet, nil unless the admin
+	// socket is enabled.
+	advertised DeviceTree
+	// cordoned are the devices cordoned over the admin socket, keyed by the
+	// resource name and the device ID.
+	cordoned map[string]map[string]bool
+	// admin are the requests of the admin socket, nil if disabled.
+	admin     chan adminRequest
+	namespace string
+	options   Options
+	// inventoryLogged tells if the devices found by the first scan have
+	// been logged.
+	inventoryLogged bool
 }
 
-// NewManager creates a new instance of Manager.
-func NewManager(namespace string, devicePlugin Scanner) *Manager {
+// NewManager creates a new instance of Manager with the framework options opts.
+func NewManager(namespace string, devicePlugin Scanner, opts Options) *Manager {
 	return &Manager{
 		devicePlugin: devicePlugin,
 		namespace:    namespace,
 		servers:      make(map[string]devicePluginServer),
+		devices:      NewDeviceTree(),
 		createServer: newServer,
+		tracker:      &allocationTracker{},
+		pluginDir:    pluginapi.DevicePluginPath,
+		options:      opts,
 	}
 }
 
 // Run prepares and launches event loop for updates from Scanner.
 func (m *Manager) Run() {
+	if err := m.options.validate(); err != nil {
+		klog.Errorf("Invalid device plugin options: %+v", err)
+		os.Exit(1)
+	}
+
+	if m.options.DiscoverOnly {
+		if err := m.discover(os.Stdout); err != nil {
+			klog.Errorf("Device discovery failed: %+v", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	m.tracker = newAllocationTracker(m.namespace, m.pluginDir, m.options)
+
+	if len(m.options.DriverVersions) > 0 {
+		checkDriverVersions(sysfsModuleDir, m.options.DriverVersions, m.tracker.pool)
+	}
+
+	if m.options.MetricsAddr != "" {
+		go serveMetrics(m.options.MetricsAddr, m.tracker.history)
+	}
+
+	if m.options.AdminSocket != "" {
+		m.advertised = NewDeviceTree()
+		m.admin = make(chan adminRequest)
+
+		go serveAdmin(m.options.AdminSocket, m.admin)
+	}
+
+	postDeallocator, isPostDeallocator := m.devicePlugin.(PostDeallocator)
+	if (isPostDeallocator || m.tracker.watchesDeallocations()) && m.options.DeallocationPollInterval > 0 {
+		var postDeallocate func(devType string, deviceIDs []string)
+		if isPostDeallocator {
+			postDeallocate = postDeallocator.PostDeallocate
+		}
+
+		go newDeallocationWatcher(m.namespace, postDeallocate, m.tracker).run(m.options.DeallocationPollInterval, m.options.StaleAllocationReapInterval)
+	}
+
+	var deepHealthTicks, externalUsageTicks <-chan time.Time
+
+	if m.options.DeepHealthCheckInterval > 0 {
+		check := openDeviceNodes
+		if checker, ok := m.devicePlugin.(DeviceHealthChecker); ok {
+			check = checker.CheckDeviceHealth
+		}
+
+		m.health = append(m.health, newHealthChecker("deep health check", m.options.DeepHealthCheckInterval, check))
+
+		ticker := time.NewTicker(m.options.DeepHealthCheckInterval)
+		defer ticker.Stop()
+
+		deepHealthTicks = ticker.C
+	}
+
+	if m.options.ExternalUsageCheckInterval > 0 {
+		check := newExternalUsageCheck(procRoot).check
+		m.health = append(m.health, newHealthChecker("external usage check", m.options.ExternalUsageCheckInterval, check))
+
+		ticker := time.NewTicker(m.options.ExternalUsageCheckInterval)
+		defer ticker.Stop()
+
+		externalUsageTicks = ticker.C
+	}
+
 	updatesCh := make(chan updateInfo)
 
+	n := newNotifier(updatesCh)
+	n.maxDevices = m.options.MaxAdvertised
+
 	go func() {
-		err := m.devicePlugin.Scan(newNotifier(updatesCh))
+		err := m.devicePlugin.Scan(n)
 		if err != nil {
 			klog.Errorf("Device scan failed: %+v", err)
 			os.Exit(1)
@@ -106,14 +207,100 @@ func (m *Manager) Run() {
 		close(updatesCh)
 	}()
 
-	for update := range updatesCh {
-		m.handleUpdate(update)
+	for {
+		select {
+		case update, ok := <-updatesCh:
+			if !ok {
+				return
+			}
+
+			m.handleUpdate(update)
+		case <-deepHealthTicks:
+			m.checkHealth()
+		case <-externalUsageTicks:
+			m.checkHealth()
+		case req := <-m.admin:
+			req.result <- req.run(m)
+		}
+	}
+}
+
+// applyHealthChecks returns the devices with the results of the enabled health
+// checks applied. The second return value tells if the health of a device changed.
+func (m *Manager) applyHealthChecks(devType string, devices map[string]DeviceInfo) (map[string]DeviceInfo, bool) {
+	changed := false
+
+	for _, checker := range m.health {
+		var checkerChanged bool
+
+		devices, checkerChanged = checker.apply(devType, devices)
+		changed = changed || checkerChanged
+	}
+
+	return devices, changed
+}
+
+// checked returns the devices with the health check results applied. The
+// devices are kept for the health checks and the admin operations.
+func (m *Manager) checked(devType string, devices map[string]DeviceInfo) map[string]DeviceInfo {
+	if len(m.health) == 0 && m.advertised == nil {
+		return devices
 	}
+
+	m.devices[devType] = devices
+	checked, _ := m.applyHealthChecks(devType, devices)
+
+	return checked
 }
 
+// checkHealth runs the health checks due and updates the resources whose
+// device health changed.
+func (m *Manager) checkHealth() {
+	for devType, devices := range m.devices {
+		if checked, changed := m.applyHealthChecks(devType, devices); changed {
+			m.update(devType, checked)
+		}
+	}
+}
+
+// resend sends the latest devices of the resource to its server again.
+func (m *Manager) resend(devType string) {
+	checked, _ := m.applyHealthChecks(devType, m.devices[devType])
+	m.update(devType, checked)
+}
+
+// update sends the devices to the server of the resource. Cordoned devices are
+// reported unhealthy, and all the devices are if fewer than the minimum number
+// of them are healthy.
+func (m *Manager) update(devType string, devices map[string]DeviceInfo) {
+	devices = applyCordons(devices, m.cordoned[devType])
+
+	if minHealthy := m.options.MinHealthy[devType]; minHealthy > 0 {
+		devices = applyMinHealthy(devices, minHealthy)
+	}
+
+	if m.advertised != nil {
+		m.advertised[devType] = devices
+	}
+
+	if m.tracker.capacity != nil {
+		m.tracker.capacity.setDevices(devType, devices)
+	}
+
+	m.servers[devType].Update(devices)
+}
+
+// handleUpdate starts, updates and stops the servers of the resources. The
+// devices of the first update, i.e. the ones found by the first scan, are
+// logged as the device inventory of the node.
 func (m *Manager) handleUpdate(update updateInfo) {
 	klog.V(4).Info("Received dev updates:", update)
 
+	var inventory DeviceTree
+	if !m.inventoryLogged {
+		inventory = NewDeviceTree()
+	}
+
 	for devType, devices := range update.Added {
 		var (
 			allocate               allocateFunc
@@ -138,27 +325,52 @@ func (m *Manager) handleUpdate(update updateInfo) {
 			allocate = allocator.Allocate
 		}
 
-		m.servers[devType] = m.createServer(devType, postAllocate, preStartContainer, getPreferredAllocation, allocate)
+		srv := m.createServer(devType, postAllocate, preStartContainer, getPreferredAllocation, allocate, m.tracker, m.options)
+		m.servers[devType] = srv
 
 		go func(dt string) {
-			err := m.servers[dt].Serve(m.namespace)
+			err := srv.Serve(m.namespace)
 			if err != nil {
 				klog.Errorf("Failed to serve %s/%s: %+v", m.namespace, dt, err)
 				os.Exit(1)
 			}
 		}(devType)
-		m.servers[devType].Update(devices)
+
+		checked := m.checked(devType, devices)
+		if inventory != nil {
+			inventory[devType] = checked
+		}
+
+		m.update(devType, checked)
 	}
 
 	for devType, devices := range update.Updated {
-		m.servers[devType].Update(devices)
+		m.update(devType, m.checked(devType, devices))
 	}
 
 	for devType := range update.Removed {
+		for _, checker := range m.health {
+			checker.forget(devType)
+		}
+
+		delete(m.devices, devType)
+		delete(m.advertised, devType)
+		delete(m.cordoned, devType)
+
+		if m.tracker.capacity != nil {
+			m.tracker.capacity.setDevices(devType, nil)
+		}
+
 		if err := m.servers[devType].Stop(); err != nil {
 			klog.Errorf("Unable to stop gRPC server for %q: %+v", devType, err)
 		}
 
 		delete(m.servers, devType)
 	}
+
+	if inventory != nil {
+		logInventory(inventory)
+
+		m.inventoryLogged = true
+	}
 }
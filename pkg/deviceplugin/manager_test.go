@@ -135,6 +135,60 @@ func TestNotify(t *testing.T) {
 	}
 }
 
+func TestNotifyMaxAdvertised(t *testing.T) {
+	ch := make(chan updateInfo, 2)
+	n := newNotifier(ch)
+	n.maxDevices = 3
+
+	tree := NewDeviceTree()
+	for _, id := range []string{"card10", "card1", "card2", "card0", "card11"} {
+		tree.AddDevice("gpu", id, DeviceInfo{state: pluginapi.Healthy})
+	}
+
+	tree.AddDevice("fpga", "0000:3b:00.0", DeviceInfo{state: pluginapi.Healthy})
+	tree.AddDevice("fpga", "0000:1a:00.0", DeviceInfo{state: pluginapi.Healthy})
+
+	n.Notify(tree)
+
+	update := <-ch
+
+	expected := []string{"card0", "card1", "card2"}
+	if len(update.Added["gpu"]) != len(expected) {
+		t.Fatalf("expected advertised devices %v, got %v", expected, update.Added["gpu"])
+	}
+
+	for _, id := range expected {
+		if _, ok := update.Added["gpu"][id]; !ok {
+			t.Errorf("expected advertised devices %v, got %v", expected, update.Added["gpu"])
+		}
+	}
+
+	if len(update.Added["fpga"]) != 2 {
+		t.Errorf("resource under the limit was capped: %v", update.Added["fpga"])
+	}
+
+	if len(tree["gpu"]) != 5 {
+		t.Errorf("the scanned device tree was modified")
+	}
+
+	// The same devices scanned in another order give the same selection.
+	reordered := NewDeviceTree()
+	for _, id := range []string{"card11", "card2", "card0", "card10", "card1"} {
+		reordered.AddDevice("gpu", id, DeviceInfo{state: pluginapi.Healthy})
+	}
+
+	reordered.AddDevice("fpga", "0000:1a:00.0", DeviceInfo{state: pluginapi.Healthy})
+	reordered.AddDevice("fpga", "0000:3b:00.0", DeviceInfo{state: pluginapi.Healthy})
+
+	n.Notify(reordered)
+
+	select {
+	case update = <-ch:
+		t.Errorf("unchanged selection was notified: %v", update)
+	default:
+	}
+}
+
 type serverStub struct{}
 
 func (*serverStub) Serve(string) error {
@@ -274,7 +328,8 @@ func TestHandleUpdate(t *testing.T) {
 		mgr := Manager{
 			devicePlugin: &devicePluginStub{},
 			servers:      tt.servers,
-			createServer: func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc) devicePluginServer {
+			tracker:      &allocationTracker{},
+			createServer: func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc, *allocationTracker, Options) devicePluginServer {
 				return &serverStub{}
 			},
 		}
@@ -289,8 +344,8 @@ func TestHandleUpdate(t *testing.T) {
 }
 
 func TestRun(t *testing.T) {
-	mgr := NewManager("testnamespace", &devicePluginStub{})
-	mgr.createServer = func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc) devicePluginServer {
+	mgr := NewManager("testnamespace", &devicePluginStub{}, NewOptions())
+	mgr.createServer = func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc, *allocationTracker, Options) devicePluginServer {
 		return &serverStub{}
 	}
 	mgr.Run()
@@ -0,0 +1,62 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sort"
+)
+
+// lessDeviceID orders device IDs shorter first and then lexicographically,
+// so that numbered IDs such as card2 and card10 are in numeric order and fixed
+// width IDs such as PCI addresses are in address order.
+func lessDeviceID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
+}
+
+// capDevices returns the tree with at most maxDevices devices of every
+// resource. The lowest device IDs are kept, so the selection only depends
+// on the devices and is stable across restarts. Zero maxDevices disables it.
+func capDevices(tree DeviceTree, maxDevices int) DeviceTree {
+	if maxDevices <= 0 {
+		return tree
+	}
+
+	capped := NewDeviceTree()
+
+	for devType, devices := range tree {
+		if len(devices) <= maxDevices {
+			capped[devType] = devices
+			continue
+		}
+
+		ids := make([]string, 0, len(devices))
+		for id := range devices {
+			ids = append(ids, id)
+		}
+
+		sort.Slice(ids, func(i, j int) bool { return lessDeviceID(ids[i], ids[j]) })
+
+		capped[devType] = make(map[string]DeviceInfo, maxDevices)
+		for _, id := range ids[:maxDevices] {
+			capped[devType][id] = devices[id]
+		}
+	}
+
+	return capped
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	metricsNamespace = "device_plugin"
+
+	numaAligned    = "aligned"
+	numaMisaligned = "misaligned"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	numaAllocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "numa_allocations_total",
+		Help:      "Number of container allocations whose devices are within a single NUMA node (aligned) or span several (misaligned).",
+	}, []string{"resource", "alignment", "pool"})
+
+	inflightAllocations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_allocations",
+		Help:      "Number of Allocate calls being served, including the ones waiting for the allocation rate limit.",
+	}, []string{"resource", "pool"})
+
+	maxConcurrentAllocations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "max_concurrent_allocations",
+		Help:      "Highest number of Allocate calls served at the same time since the plugin started.",
+	}, []string{"resource", "pool"})
+
+	deviceAllocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "device_allocations_total",
+		Help:      "Number of times a device has been allocated to a container.",
+	}, []string{"resource", "device", "pool"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(numaAllocations, inflightAllocations, maxConcurrentAllocations, deviceAllocations)
+}
+
+// RegisterMetrics registers the metrics of a plugin to be exposed at the
+// framework's metrics endpoint next to the framework metrics. It panics if
+// a metric is already registered, so it's meant to be called from init().
+func RegisterMetrics(collectors ...prometheus.Collector) {
+	metricsRegistry.MustRegister(collectors...)
+}
+
+// serveMetrics exposes the framework metrics in Prometheus format at addr,
+// and the allocation history unless it's nil.
+func serveMetrics(addr string, history *allocationHistory) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	if history != nil {
+		mux.Handle(allocationHistoryPath, history)
+	}
+
+	metricsServer := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	klog.V(1).Infof("Serving metrics at %s", addr)
+
+	if err := metricsServer.ListenAndServe(); err != nil {
+		klog.Errorf("Metrics server failed: %+v", err)
+	}
+}
+
+// numaAlignment tells if the devices allocated to a container are all within
+// the same NUMA node. Kubelet doesn't pass the topology hint to the plugin, so
+// single NUMA node placement is used as the measure of alignment. The second
+// return value is false if the alignment can't be determined because some
+// of the devices have no topology information.
+func numaAlignment(devices map[string]DeviceInfo, ids []string) (string, bool) {
+	nodes := make(map[int64]bool)
+
+	for _, id := range ids {
+		dev, ok := devices[id]
+		if !ok || dev.topology == nil || len(dev.topology.Nodes) == 0 {
+			return "", false
+		}
+
+		for _, node := range dev.topology.Nodes {
+			nodes[node.ID] = true
+		}
+	}
+
+	if len(nodes) == 1 {
+		return numaAligned, true
+	}
+
+	return numaMisaligned, len(nodes) > 1
+}
+
+// recordNUMAAlignment updates the NUMA alignment counters for an allocation.
+func recordNUMAAlignment(resource string, devices map[string]DeviceInfo, rqt *pluginapi.AllocateRequest, pool string) {
+	for _, crqt := range rqt.ContainerRequests {
+		if alignment, ok := numaAlignment(devices, crqt.DevicesIDs); ok {
+			numaAllocations.WithLabelValues(resource, alignment, pool).Inc()
+		}
+	}
+}
+
+// startAllocation counts an Allocate call in flight until the returned
+// function is called, and raises the high-water mark of concurrent calls.
+func (srv *server) startAllocation() func() {
+	srv.allocationsMutex.Lock()
+	defer srv.allocationsMutex.Unlock()
+
+	srv.inflightAllocations++
+	inflightAllocations.WithLabelValues(srv.devType, srv.tracker.pool).Set(float64(srv.inflightAllocations))
+
+	if srv.inflightAllocations > srv.maxAllocations {
+		srv.maxAllocations = srv.inflightAllocations
+		maxConcurrentAllocations.WithLabelValues(srv.devType, srv.tracker.pool).Set(float64(srv.maxAllocations))
+	}
+
+	return func() {
+		srv.allocationsMutex.Lock()
+		defer srv.allocationsMutex.Unlock()
+
+		srv.inflightAllocations--
+		inflightAllocations.WithLabelValues(srv.devType, srv.tracker.pool).Set(float64(srv.inflightAllocations))
+	}
+}
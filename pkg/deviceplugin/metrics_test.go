@@ -0,0 +1,259 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func numaDevice(nodes ...int64) DeviceInfo {
+	topology := &pluginapi.TopologyInfo{}
+	for _, node := range nodes {
+		topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: node})
+	}
+
+	return DeviceInfo{
+		state:    pluginapi.Healthy,
+		topology: topology,
+	}
+}
+
+func TestNUMAAlignmentCounters(t *testing.T) {
+	srv := newTestServer()
+	srv.devType = "numatest"
+	srv.devices = map[string]DeviceInfo{
+		"dev0": numaDevice(0),
+		"dev1": numaDevice(0),
+		"dev2": numaDevice(1),
+		"dev3": {state: pluginapi.Healthy},
+	}
+
+	requests := [][]string{
+		{"dev0", "dev1"}, // aligned
+		{"dev2"},         // aligned
+		{"dev1", "dev2"}, // misaligned
+		{"dev0", "dev3"}, // no topology, not counted
+	}
+
+	for _, ids := range requests {
+		_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: ids},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected allocation error: %+v", err)
+		}
+	}
+
+	if aligned := testutil.ToFloat64(numaAllocations.WithLabelValues("numatest", numaAligned, "")); aligned != 2 {
+		t.Errorf("expected 2 aligned allocations, got %v", aligned)
+	}
+
+	if misaligned := testutil.ToFloat64(numaAllocations.WithLabelValues("numatest", numaMisaligned, "")); misaligned != 1 {
+		t.Errorf("expected 1 misaligned allocation, got %v", misaligned)
+	}
+}
+
+func TestDeviceAllocationCounters(t *testing.T) {
+	pluginDir := t.TempDir()
+
+	// newCountingServer recreates the manager as a plugin restart does.
+	newCountingServer := func() *server {
+		mgr := NewManager("counter.intel.com", nil, NewOptions())
+		mgr.pluginDir = pluginDir
+		mgr.tracker = newAllocationTracker(mgr.namespace, mgr.pluginDir, mgr.options)
+
+		srv := newTestServer()
+		srv.devType = "countertest"
+		srv.tracker = mgr.tracker
+
+		return srv
+	}
+
+	allocate := func(srv *server, ids ...string) error {
+		_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: ids},
+			},
+		})
+
+		return err
+	}
+
+	expectCounts := func(expected map[string]float64) {
+		t.Helper()
+
+		for id, count := range expected {
+			if value := testutil.ToFloat64(deviceAllocations.WithLabelValues("countertest", id, "")); value != count {
+				t.Errorf("expected %v allocations of %s, got %v", count, id, value)
+			}
+		}
+	}
+
+	srv := newCountingServer()
+
+	for _, ids := range [][]string{{"dev1"}, {"dev1", "dev2"}, {"dev1"}} {
+		if err := allocate(srv, ids...); err != nil {
+			t.Fatalf("unexpected allocation error: %+v", err)
+		}
+	}
+
+	// Failed allocations are not counted.
+	if err := allocate(srv, "dev2", "dev9"); err == nil {
+		t.Fatal("expected an allocation error for an unknown device")
+	}
+
+	expectCounts(map[string]float64{"dev1": 3, "dev2": 1})
+
+	// The counts carry on after a restart.
+	srv = newCountingServer()
+
+	expectCounts(map[string]float64{"dev1": 3, "dev2": 1})
+
+	if err := allocate(srv, "dev2"); err != nil {
+		t.Fatalf("unexpected allocation error: %+v", err)
+	}
+
+	expectCounts(map[string]float64{"dev1": 3, "dev2": 2})
+
+	expected := map[string]map[string]uint64{"countertest": {"dev1": 3, "dev2": 2}}
+	if counts := loadAllocationCounts(allocationCountsPath(pluginDir, "counter.intel.com"), "").counts; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected the checkpoint %v, got %v", expected, counts)
+	}
+}
+
+func TestNodePoolLabel(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "labeled", Labels: map[string]string{"pool": "gpu-pool"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}},
+	)
+
+	pool, err := nodeLabel(clientset, "unlabeled", "pool")
+	if err != nil || pool != "" {
+		t.Errorf("expected an empty pool for a node without the label, got %q: %+v", pool, err)
+	}
+
+	if _, err = nodeLabel(clientset, "nonexisting", "pool"); err == nil {
+		t.Error("reading the label of a non-existing node didn't fail")
+	}
+
+	pool, err = nodeLabel(clientset, "labeled", "pool")
+	if err != nil || pool != "gpu-pool" {
+		t.Fatalf("expected pool gpu-pool, got %q: %+v", pool, err)
+	}
+
+	srv := newTestServer()
+	srv.devType = "pooltest"
+	srv.tracker.pool = pool
+	srv.devices = map[string]DeviceInfo{
+		"dev0": numaDevice(0),
+	}
+
+	_, err = srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev0"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected allocation error: %+v", err)
+	}
+
+	if aligned := testutil.ToFloat64(numaAllocations.WithLabelValues("pooltest", numaAligned, "gpu-pool")); aligned != 1 {
+		t.Errorf("expected 1 aligned allocation in gpu-pool, got %v", aligned)
+	}
+}
+
+func TestAllocationConcurrency(t *testing.T) {
+	const concurrent = 3
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	srv := newTestServer()
+	srv.devType = "concurrencytest"
+	srv.allocate = func(*pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+		started <- struct{}{}
+		<-release
+
+		return &pluginapi.AllocateResponse{}, nil
+	}
+
+	inflight := inflightAllocations.WithLabelValues("concurrencytest", "")
+	highWater := maxConcurrentAllocations.WithLabelValues("concurrencytest", "")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{DevicesIDs: []string{"dev1"}},
+				},
+			})
+			if err != nil {
+				t.Errorf("unexpected allocation error: %+v", err)
+			}
+		}()
+	}
+
+	for i := 0; i < concurrent; i++ {
+		<-started
+	}
+
+	if n := testutil.ToFloat64(inflight); n != concurrent {
+		t.Errorf("expected %d allocations in flight, got %v", concurrent, n)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := testutil.ToFloat64(inflight); n != 0 {
+		t.Errorf("expected no allocations in flight, got %v", n)
+	}
+
+	if n := testutil.ToFloat64(highWater); n != concurrent {
+		t.Errorf("expected %d concurrent allocations at most, got %v", concurrent, n)
+	}
+
+	// The high-water mark is kept over sequential allocations.
+	srv.allocate = nil
+
+	_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev1"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected allocation error: %+v", err)
+	}
+
+	if n := testutil.ToFloat64(highWater); n != concurrent {
+		t.Errorf("expected the high-water mark %d to be kept, got %v", concurrent, n)
+	}
+}
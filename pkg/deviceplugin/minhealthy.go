@@ -0,0 +1,84 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// MinHealthy maps resource names to the minimum number of healthy devices
+// needed for advertising any of them. It implements flag.Value and can be
+// given several times as "resource=count".
+type MinHealthy map[string]int
+
+func (m MinHealthy) String() string {
+	entries := make([]string, 0, len(m))
+
+	for resource, count := range m {
+		entries = append(entries, resource+"="+strconv.Itoa(count))
+	}
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// Set adds a "resource=count" entry.
+func (m MinHealthy) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid minimum healthy devices %q, expected resource=count", value)
+	}
+
+	count, err := strconv.Atoi(parts[1])
+	if err != nil || count < 1 {
+		return errors.Errorf("invalid minimum healthy devices %q, expected a positive integer", parts[1])
+	}
+
+	m[parts[0]] = count
+
+	return nil
+}
+
+// applyMinHealthy returns the devices all reported unhealthy if fewer than
+// minHealthy of them are healthy, so that kubelet advertises no allocatable
+// devices. Otherwise the devices are returned as is.
+func applyMinHealthy(devices map[string]DeviceInfo, minHealthy int) map[string]DeviceInfo {
+	healthy := 0
+
+	for _, device := range devices {
+		if device.state == pluginapi.Healthy {
+			healthy++
+		}
+	}
+
+	if healthy >= minHealthy {
+		return devices
+	}
+
+	unhealthy := make(map[string]DeviceInfo, len(devices))
+
+	for id, device := range devices {
+		device.state = pluginapi.Unhealthy
+		unhealthy[id] = device
+	}
+
+	return unhealthy
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"strconv"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// updateRecorder is a server stub keeping the latest device update.
+type updateRecorder struct {
+	serverStub
+	devices map[string]DeviceInfo
+}
+
+func (r *updateRecorder) Update(devices map[string]DeviceInfo) {
+	r.devices = devices
+}
+
+func healthyCount(devices map[string]DeviceInfo) int {
+	healthy := 0
+
+	for _, device := range devices {
+		if device.state == pluginapi.Healthy {
+			healthy++
+		}
+	}
+
+	return healthy
+}
+
+func TestMinHealthy(t *testing.T) {
+	recorder := &updateRecorder{}
+	mgr := Manager{
+		devicePlugin: &devicePluginStub{},
+		servers:      map[string]devicePluginServer{"gpu": recorder},
+		devices:      NewDeviceTree(),
+		tracker:      &allocationTracker{},
+		options:      Options{MinHealthy: MinHealthy{"gpu": 2}},
+	}
+
+	devices := func(states ...string) map[string]DeviceInfo {
+		devices := make(map[string]DeviceInfo)
+		for i, state := range states {
+			devices["card"+strconv.Itoa(i)] = DeviceInfo{state: state}
+		}
+
+		return devices
+	}
+
+	tcases := []struct {
+		name            string
+		devices         map[string]DeviceInfo
+		expectedHealthy int
+	}{
+		{
+			name:            "enough healthy devices",
+			devices:         devices(pluginapi.Healthy, pluginapi.Healthy, pluginapi.Unhealthy),
+			expectedHealthy: 2,
+		},
+		{
+			name:            "healthy devices fall below the threshold",
+			devices:         devices(pluginapi.Healthy, pluginapi.Unhealthy, pluginapi.Unhealthy),
+			expectedHealthy: 0,
+		},
+		{
+			name:            "healthy devices recover",
+			devices:         devices(pluginapi.Healthy, pluginapi.Healthy, pluginapi.Healthy),
+			expectedHealthy: 3,
+		},
+	}
+
+	for _, tc := range tcases {
+		mgr.handleUpdate(updateInfo{Updated: DeviceTree{"gpu": tc.devices}})
+
+		if len(recorder.devices) != len(tc.devices) {
+			t.Errorf("%s: expected %d devices, got %v", tc.name, len(tc.devices), recorder.devices)
+		}
+
+		if healthy := healthyCount(recorder.devices); healthy != tc.expectedHealthy {
+			t.Errorf("%s: expected %d healthy devices, got %d", tc.name, tc.expectedHealthy, healthy)
+		}
+	}
+
+	// Resources without a threshold are not affected.
+	other := &updateRecorder{}
+	mgr.servers["fpga"] = other
+
+	mgr.handleUpdate(updateInfo{Updated: DeviceTree{"fpga": devices(pluginapi.Healthy, pluginapi.Unhealthy)}})
+
+	if healthy := healthyCount(other.devices); healthy != 1 {
+		t.Errorf("expected 1 healthy device without a threshold, got %d", healthy)
+	}
+}
+
+func TestMinHealthyFlag(t *testing.T) {
+	minHealthy := MinHealthy{}
+
+	if err := minHealthy.Set("gpu=4"); err != nil || minHealthy["gpu"] != 4 {
+		t.Errorf("unexpected result %v, error: %+v", minHealthy, err)
+	}
+
+	for _, value := range []string{"gpu", "=4", "gpu=0", "gpu=four"} {
+		if err := minHealthy.Set(value); err == nil {
+			t.Errorf("invalid minimum healthy devices %q was accepted", value)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+const nodeLookupTimeout = 10 * time.Second
+
+// lookupNodePool returns the value of the label of the node the plugin runs on,
+// which is given in the NODE_NAME environment variable. Errors are logged and
+// an empty pool is returned, so that the metrics are served regardless.
+func lookupNodePool(label string) string {
+	clientset, err := inClusterClientset()
+	if err != nil {
+		klog.Warningf("Unable to read the node pool label %s: %+v", label, err)
+		return ""
+	}
+
+	pool, err := nodeLabel(clientset, os.Getenv("NODE_NAME"), label)
+	if err != nil {
+		klog.Warningf("Unable to read the node pool label %s: %+v", label, err)
+	}
+
+	return pool
+}
+
+// inClusterClientset returns a clientset using the service account of the plugin.
+func inClusterClientset() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read the in-cluster configuration")
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create a clientset")
+	}
+
+	return clientset, nil
+}
+
+// nodeLabel returns the value of the label of the node, empty if it's not set.
+func nodeLabel(clientset kubernetes.Interface, nodeName, label string) (string, error) {
+	if nodeName == "" {
+		return "", errors.New("NODE_NAME is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nodeLookupTimeout)
+	defer cancel()
+
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "can't get node %s", nodeName)
+	}
+
+	if _, ok := node.Labels[label]; !ok {
+		klog.Warningf("Node %s has no pool label %s", nodeName, label)
+	}
+
+	return node.Labels[label], nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"flag"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Options contains the framework settings shared by all device plugins.
+// They are set with the command line flags registered by AddFlags.
+type Options struct {
+	// AllocationStrategy is the name of the registered AllocationStrategy
+	// used for the resources of the plugin.
+	AllocationStrategy string
+	// GenerationPreference orders the preferred devices by their generation,
+	// NewestFirst or OldestFirst, before the AllocationStrategy. Empty disables it.
+	GenerationPreference string
+	// MetricsAddr is the address the metrics endpoint binds to. Empty disables it.
+	MetricsAddr string
+	// AdminSocket is the path of the Unix socket serving the admin operations.
+	// Empty disables it.
+	AdminSocket string
+	// NodePoolLabel is the node label whose value is set to the pool label of
+	// the metrics. Empty disables the lookup.
+	NodePoolLabel string
+	// UpdateBatchWindow is the time device updates are collected for before
+	// the consolidated device list is sent to kubelet. Zero disables batching.
+	UpdateBatchWindow time.Duration
+	// SettleDelay is the time the devices get to settle before the first
+	// device list is sent to kubelet. Zero sends it right away.
+	SettleDelay time.Duration
+	// WarmupCommands are the commands run against the allocated devices of
+	// a resource at PreStartContainer, keyed by the resource name.
+	WarmupCommands WarmupCommands
+	// DeviceAliases are the fixed container paths the allocated device nodes
+	// of a resource are made available at too, keyed by the resource name.
+	DeviceAliases DeviceAliases
+	// OversubscriptionRatios are the numbers of logical devices advertised per
+	// physical device, keyed by the resource name. Containers get to share the
+	// physical devices, so this is meant only for development clusters.
+	OversubscriptionRatios OversubscriptionRatios
+	// MinHealthy are the minimum numbers of healthy devices of a resource
+	// needed for advertising any of them, keyed by the resource name.
+	MinHealthy MinHealthy
+	// DriverVersions are the compatible version ranges of the kernel drivers
+	// of the devices, keyed by the driver name. Skew is warned about at startup.
+	DriverVersions DriverVersions
+	// AllocationRateLimits are the numbers of Allocate and PreStartContainer
+	// calls per second allowed for each device, keyed by the resource name.
+	AllocationRateLimits AllocationRateLimits
+	// FairAllocation are the resources whose scarce devices are shared fairly
+	// between the namespaces of the pods requesting them.
+	FairAllocation FairAllocation
+	// AllocationLogLevels are the klog verbosities the allocations of a
+	// resource are logged at, keyed by the resource name.
+	AllocationLogLevels AllocationLogLevels
+	// WarmupTimeout is the time a warmup command may run before the container start fails.
+	WarmupTimeout time.Duration
+	// MaxAdvertised is the maximum number of devices advertised per resource.
+	// The devices with the lowest IDs are advertised. Zero means no limit.
+	MaxAdvertised int
+	// AllocationHistorySize is the number of recent allocations served at the
+	// debug endpoint of the metrics server. Zero disables the history.
+	AllocationHistorySize int
+	// DeepHealthCheckInterval is the interval of the deep health checks of
+	// the devices. Zero disables them.
+	DeepHealthCheckInterval time.Duration
+	// ExternalUsageCheckInterval is the interval of checking if the devices are
+	// used by processes outside Kubernetes pods. Zero disables the checks.
+	ExternalUsageCheckInterval time.Duration
+	// DeallocationPollInterval is the interval of polling kubelet for released
+	// devices if the plugin implements PostDeallocator, DeviceHoldMetrics
+	// or CapacityMetrics is set. Zero disables polling.
+	DeallocationPollInterval time.Duration
+	// KeepStaleSockets makes the plugin fail to start if it finds a socket left
+	// by a previous instance, instead of removing it.
+	KeepStaleSockets bool
+	// DeviceHoldMetrics enables the metrics of the time devices are held by
+	// containers, measured from allocation to detected release.
+	DeviceHoldMetrics bool
+	// CapacityMetrics enables the metrics of the number of free, used and
+	// unhealthy devices of each resource.
+	CapacityMetrics bool
+	// DiscoverOnly makes the plugin print the devices found by the first scan
+	// as JSON and exit, without registering with kubelet.
+	DiscoverOnly bool
+	// StaleAllocationReapInterval is the interval of reconciling the allocations
+	// made by the plugin against the devices allocated to pods, releasing the
+	// ones no pod has anymore. Zero disables the reaper.
+	StaleAllocationReapInterval time.Duration
+}
+
+// NewOptions returns the default framework options.
+func NewOptions() Options {
+	return Options{
+		AllocationStrategy:       DefaultAllocationStrategy,
+		WarmupCommands:           WarmupCommands{},
+		DeviceAliases:            DeviceAliases{},
+		OversubscriptionRatios:   OversubscriptionRatios{},
+		MinHealthy:               MinHealthy{},
+		DriverVersions:           DriverVersions{},
+		AllocationRateLimits:     AllocationRateLimits{},
+		AllocationLogLevels:      AllocationLogLevels{},
+		FairAllocation:           FairAllocation{},
+		WarmupTimeout:            defaultWarmupTimeout,
+		DeallocationPollInterval: defaultDeallocationPollInterval,
+	}
+}
+
+// AddFlags registers the command line flags of the options in fs, with the
+// current values as the defaults. The plugins call it before parsing their flags.
+func (o *Options) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.AllocationStrategy, "allocation-strategy", o.AllocationStrategy,
+		"name of the allocation strategy used by the device plugin framework")
+	fs.StringVar(&o.GenerationPreference, "generation-preference", "",
+		"prefer the devices of the newest (newest-first) or the oldest (oldest-first) generation (default: disabled)")
+	fs.DurationVar(&o.UpdateBatchWindow, "update-batch-window", 0,
+		"time to collect device updates for before sending a consolidated device list to kubelet (default: disabled)")
+	fs.DurationVar(&o.SettleDelay, "settle-delay", 0,
+		"time to let the devices settle for before sending the first device list to kubelet (default: disabled)")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", "", "address the metrics endpoint binds to, e.g. :8080 (default: disabled)")
+	fs.StringVar(&o.AdminSocket, "admin-socket", "",
+		"path of the Unix socket serving the admin operations, e.g. /var/run/device-plugin-admin.sock (default: disabled)")
+	fs.StringVar(&o.NodePoolLabel, "node-pool-label", "",
+		"node label whose value is added to the metrics as the pool label, e.g. cloud.google.com/gke-nodepool (default: disabled)")
+	fs.Var(o.WarmupCommands, "warmup-command",
+		"resource=command run with the allocated device IDs as arguments before a container starts, can be given several times")
+	fs.Var(o.DeviceAliases, "device-alias",
+		"resource=path adding the allocated device nodes at path in the containers too, %d in path is the node index, can be given several times")
+	fs.DurationVar(&o.WarmupTimeout, "warmup-timeout", o.WarmupTimeout, "time a warmup command may run before the container start fails")
+	fs.DurationVar(&o.DeepHealthCheckInterval, "deep-health-check-interval", 0,
+		"interval of checking that the devices work by operating them (default: disabled)")
+	fs.DurationVar(&o.ExternalUsageCheckInterval, "external-usage-check-interval", 0,
+		"interval of checking if the devices are used by processes outside pods, requires the host PID namespace (default: disabled)")
+	fs.DurationVar(&o.DeallocationPollInterval, "deallocation-poll-interval", o.DeallocationPollInterval,
+		"interval of polling kubelet for released devices, used if the plugin cleans up released devices or device metrics are enabled")
+	fs.BoolVar(&o.DiscoverOnly, "discover-only", false,
+		"print the devices found on the node as JSON and exit without registering with kubelet")
+	fs.BoolVar(&o.KeepStaleSockets, "keep-stale-sockets", false,
+		"fail to start instead of removing a plugin socket left by a previous instance")
+	fs.BoolVar(&o.DeviceHoldMetrics, "device-hold-metrics", false,
+		"measure the time devices are held by containers, requires the metrics endpoint and the kubelet podresources socket")
+	fs.BoolVar(&o.CapacityMetrics, "capacity-metrics", false,
+		"export the number of free, used and unhealthy devices of each resource, requires the metrics endpoint and the kubelet podresources socket")
+	fs.DurationVar(&o.StaleAllocationReapInterval, "stale-allocation-reap-interval", 0,
+		"interval of releasing allocations whose devices no pod has anymore, requires the kubelet podresources socket (default: disabled)")
+	fs.IntVar(&o.MaxAdvertised, "max-advertised", 0,
+		"maximum number of devices advertised per resource, the devices with the lowest IDs are selected (default: no limit)")
+	fs.IntVar(&o.AllocationHistorySize, "allocation-history-size", 0,
+		"number of recent allocations served at "+allocationHistoryPath+" of the metrics endpoint (default: disabled)")
+	fs.Var(o.AllocationRateLimits, "allocation-rate-limit",
+		"resource=rate limiting the Allocate and PreStartContainer calls per second for each device of the resource, can be given several times")
+	fs.Var(o.AllocationLogLevels, "allocation-log-level",
+		"resource=level logging the allocations of the resource at verbosity level instead of 4, can be given several times")
+	fs.Var(o.FairAllocation, "fair-allocation",
+		"resource whose devices aren't granted to a namespace over its fair share while other namespaces wait for them, requires the kubelet podresources socket and listing pods, can be given several times")
+	fs.Var(o.MinHealthy, "min-healthy",
+		"resource=count reporting all devices of the resource unhealthy while fewer than count of them are healthy, can be given several times")
+	fs.Var(o.DriverVersions, "driver-version",
+		"driver=min..max compatible version range of a kernel driver, warned about if the loaded driver is outside it, can be given several times")
+	fs.Var(o.OversubscriptionRatios, "oversubscription-ratio",
+		"UNSAFE: resource=ratio advertising ratio logical devices per physical device of the resource, can be given several times")
+}
+
+func (o *Options) validate() error {
+	if _, err := newAllocationStrategy(o.AllocationStrategy); err != nil {
+		return errors.Wrap(err, "invalid allocation strategy")
+	}
+
+	if err := validateGenerationPreference(o.GenerationPreference); err != nil {
+		return err
+	}
+
+	if o.UpdateBatchWindow < 0 {
+		return errors.Errorf("negative update batch window %v", o.UpdateBatchWindow)
+	}
+
+	if o.SettleDelay < 0 {
+		return errors.Errorf("negative settle delay %v", o.SettleDelay)
+	}
+
+	for resource, ratio := range o.OversubscriptionRatios {
+		if ratio < 1 {
+			return errors.Errorf("invalid oversubscription ratio %d for %s", ratio, resource)
+		}
+	}
+
+	if o.MaxAdvertised < 0 {
+		return errors.Errorf("negative maximum number of advertised devices %d", o.MaxAdvertised)
+	}
+
+	if o.AllocationHistorySize < 0 {
+		return errors.Errorf("negative allocation history size %d", o.AllocationHistorySize)
+	}
+
+	for resource, count := range o.MinHealthy {
+		if count < 1 {
+			return errors.Errorf("invalid minimum healthy devices %d for %s", count, resource)
+		}
+	}
+
+	for resource, level := range o.AllocationLogLevels {
+		if level < 0 {
+			return errors.Errorf("invalid allocation log level %d for %s", level, resource)
+		}
+	}
+
+	for resource, limit := range o.AllocationRateLimits {
+		if limit <= 0 {
+			return errors.Errorf("invalid allocation rate limit %v for %s", limit, resource)
+		}
+	}
+
+	if o.DeepHealthCheckInterval < 0 {
+		return errors.Errorf("negative deep health check interval %v", o.DeepHealthCheckInterval)
+	}
+
+	if o.ExternalUsageCheckInterval < 0 {
+		return errors.Errorf("negative external usage check interval %v", o.ExternalUsageCheckInterval)
+	}
+
+	if o.DeallocationPollInterval < 0 {
+		return errors.Errorf("negative deallocation poll interval %v", o.DeallocationPollInterval)
+	}
+
+	if o.StaleAllocationReapInterval < 0 {
+		return errors.Errorf("negative stale allocation reap interval %v", o.StaleAllocationReapInterval)
+	}
+
+	if o.StaleAllocationReapInterval > 0 && o.DeallocationPollInterval == 0 {
+		return errors.New("stale allocation reaper requires deallocation polling")
+	}
+
+	if o.DeviceHoldMetrics && (o.MetricsAddr == "" || o.DeallocationPollInterval == 0) {
+		return errors.New("device hold metrics require the metrics endpoint and deallocation polling")
+	}
+
+	if o.CapacityMetrics && (o.MetricsAddr == "" || o.DeallocationPollInterval == 0) {
+		return errors.New("capacity metrics require the metrics endpoint and deallocation polling")
+	}
+
+	if len(o.WarmupCommands) > 0 && o.WarmupTimeout <= 0 {
+		return errors.Errorf("non-positive warmup timeout %v", o.WarmupTimeout)
+	}
+
+	return nil
+}
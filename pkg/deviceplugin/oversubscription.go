@@ -0,0 +1,126 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// logicalIDSeparator separates the physical device ID and the index of
+// the logical device in the IDs of oversubscribed devices.
+const logicalIDSeparator = "~"
+
+// OversubscriptionRatios maps resource names to the number of logical devices
+// advertised per physical device. It implements flag.Value and can be given
+// several times as "resource=ratio".
+type OversubscriptionRatios map[string]int
+
+func (o OversubscriptionRatios) String() string {
+	entries := make([]string, 0, len(o))
+
+	for resource, ratio := range o {
+		entries = append(entries, resource+"="+strconv.Itoa(ratio))
+	}
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// Set adds a "resource=ratio" entry.
+func (o OversubscriptionRatios) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid oversubscription ratio %q, expected resource=ratio", value)
+	}
+
+	ratio, err := strconv.Atoi(parts[1])
+	if err != nil || ratio < 1 {
+		return errors.Errorf("invalid oversubscription ratio %q, expected a positive integer", parts[1])
+	}
+
+	o[parts[0]] = ratio
+
+	return nil
+}
+
+func logicalDeviceID(id string, index int) string {
+	return fmt.Sprintf("%s%s%d", id, logicalIDSeparator, index)
+}
+
+func physicalDeviceID(id string) string {
+	if i := strings.LastIndex(id, logicalIDSeparator); i >= 0 {
+		return id[:i]
+	}
+
+	return id
+}
+
+// advertisedDevices returns the devices advertised to kubelet. With
+// oversubscription every physical device is advertised ratio times.
+func (srv *server) advertisedDevices(devices map[string]DeviceInfo) map[string]DeviceInfo {
+	if srv.oversubscription <= 1 {
+		return devices
+	}
+
+	logical := make(map[string]DeviceInfo, len(devices)*srv.oversubscription)
+
+	for id, device := range devices {
+		for i := 0; i < srv.oversubscription; i++ {
+			logical[logicalDeviceID(id, i)] = device
+		}
+	}
+
+	return logical
+}
+
+// physicalIDs maps logical device IDs to physical ones. Logical devices of
+// the same physical device are listed once.
+func physicalIDs(logicalIDs []string) []string {
+	ids := make([]string, 0, len(logicalIDs))
+	seen := make(map[string]bool)
+
+	for _, id := range logicalIDs {
+		if id = physicalDeviceID(id); !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+
+	return ids
+}
+
+// physicalRequest maps the logical device IDs of the request to physical ones.
+func (srv *server) physicalRequest(rqt *pluginapi.AllocateRequest) *pluginapi.AllocateRequest {
+	if srv.oversubscription <= 1 {
+		return rqt
+	}
+
+	physical := &pluginapi.AllocateRequest{}
+
+	for _, crqt := range rqt.ContainerRequests {
+		physical.ContainerRequests = append(physical.ContainerRequests, &pluginapi.ContainerAllocateRequest{
+			DevicesIDs: physicalIDs(crqt.DevicesIDs),
+		})
+	}
+
+	return physical
+}
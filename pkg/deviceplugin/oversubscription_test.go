@@ -0,0 +1,124 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func newOversubscribedTestServer(t *testing.T, ratio int) *server {
+	t.Helper()
+
+	srv, ok := newServer("testtype", nil, nil, nil, nil, &allocationTracker{}, Options{
+		OversubscriptionRatios: OversubscriptionRatios{"testtype": ratio},
+	}).(*server)
+	if !ok {
+		t.Fatal("unexpected server type")
+	}
+
+	for _, id := range []string{"dev1", "dev2"} {
+		srv.devices[id] = NewDeviceInfo(pluginapi.Healthy, []pluginapi.DeviceSpec{
+			{HostPath: "/dev/" + id, ContainerPath: "/dev/" + id, Permissions: "rw"},
+		}, nil, nil, nil)
+	}
+
+	return srv
+}
+
+func TestOversubscriptionAdvertisedDevices(t *testing.T) {
+	srv := newOversubscribedTestServer(t, 2)
+	stream := &listAndWatchServerStub{
+		testServer: srv,
+		cdata:      make(chan []*pluginapi.Device, 1),
+	}
+
+	if err := srv.sendDevices(stream, srv.devices); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	ids := make([]string, 0)
+	for _, device := range <-stream.cdata {
+		ids = append(ids, device.ID)
+	}
+
+	sort.Strings(ids)
+
+	expected := []string{"dev1~0", "dev1~1", "dev2~0", "dev2~1"}
+	if len(ids) != len(expected) {
+		t.Fatalf("expected %d advertised devices, got %v", len(expected), ids)
+	}
+
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Errorf("expected advertised devices %v, got %v", expected, ids)
+			break
+		}
+	}
+}
+
+func TestOversubscriptionAllocate(t *testing.T) {
+	srv := newOversubscribedTestServer(t, 2)
+
+	response, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev1~1"}},
+			{DevicesIDs: []string{"dev1~0", "dev2~1", "dev1~1"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := [][]string{{"/dev/dev1"}, {"/dev/dev1", "/dev/dev2"}}
+
+	for i, cresp := range response.ContainerResponses {
+		paths := make([]string, 0)
+		for _, dev := range cresp.Devices {
+			paths = append(paths, dev.HostPath)
+		}
+
+		sort.Strings(paths)
+
+		if len(paths) != len(expected[i]) {
+			t.Errorf("container %d: expected devices %v, got %v", i, expected[i], paths)
+			continue
+		}
+
+		for j := range paths {
+			if paths[j] != expected[i][j] {
+				t.Errorf("container %d: expected devices %v, got %v", i, expected[i], paths)
+				break
+			}
+		}
+	}
+}
+
+func TestOversubscriptionRatiosFlag(t *testing.T) {
+	ratios := OversubscriptionRatios{}
+
+	if err := ratios.Set("gpu=2"); err != nil || ratios["gpu"] != 2 {
+		t.Errorf("unexpected result %v, error: %+v", ratios, err)
+	}
+
+	for _, value := range []string{"gpu", "=2", "gpu=0", "gpu=two"} {
+		if err := ratios.Set(value); err == nil {
+			t.Errorf("invalid oversubscription ratio %q was accepted", value)
+		}
+	}
+}
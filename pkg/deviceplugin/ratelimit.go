@@ -0,0 +1,100 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// AllocationRateLimits maps resource names to the number of Allocate and
+// PreStartContainer calls per second allowed for each device. It implements
+// flag.Value and can be given several times as "resource=rate".
+type AllocationRateLimits map[string]float64
+
+func (a AllocationRateLimits) String() string {
+	entries := make([]string, 0, len(a))
+
+	for resource, limit := range a {
+		entries = append(entries, resource+"="+strconv.FormatFloat(limit, 'g', -1, 64))
+	}
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// Set adds a "resource=rate" entry.
+func (a AllocationRateLimits) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid allocation rate limit %q, expected resource=rate", value)
+	}
+
+	limit, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || limit <= 0 {
+		return errors.Errorf("invalid allocation rate limit %q, expected a positive number", parts[1])
+	}
+
+	a[parts[0]] = limit
+
+	return nil
+}
+
+// deviceRateLimiter limits the rate of an operation on every device with a
+// token bucket of one token, i.e. concurrent operations on the same device
+// are serialized and spread evenly.
+type deviceRateLimiter struct {
+	limiters map[string]*rate.Limiter
+	limit    rate.Limit
+	mutex    sync.Mutex
+}
+
+func newDeviceRateLimiter(perSecond float64) *deviceRateLimiter {
+	return &deviceRateLimiter{
+		limiters: make(map[string]*rate.Limiter),
+		limit:    rate.Limit(perSecond),
+	}
+}
+
+func (l *deviceRateLimiter) limiter(id string) *rate.Limiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limiter, ok := l.limiters[id]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, 1)
+		l.limiters[id] = limiter
+	}
+
+	return limiter
+}
+
+// wait blocks until the operation is allowed on all the devices.
+func (l *deviceRateLimiter) wait(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if err := l.limiter(id).Wait(ctx); err != nil {
+			return errors.Wrapf(err, "rate limit of device %s", id)
+		}
+	}
+
+	return nil
+}
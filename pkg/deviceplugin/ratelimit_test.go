@@ -0,0 +1,131 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestAllocationRateLimit(t *testing.T) {
+	srv, ok := newServer("testtype", nil, nil, nil, nil, &allocationTracker{}, Options{
+		AllocationStrategy:   DefaultAllocationStrategy,
+		AllocationRateLimits: AllocationRateLimits{"testtype": 10},
+	}).(*server)
+	if !ok {
+		t.Fatal("unexpected server type")
+	}
+
+	srv.devices = map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Healthy},
+	}
+
+	allocate := func(id string) time.Duration {
+		start := time.Now()
+
+		_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{id}},
+			},
+		})
+		if err != nil {
+			t.Errorf("unexpected allocation error: %+v", err)
+		}
+
+		return time.Since(start)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		durations []time.Duration
+	)
+
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			duration := allocate("dev1")
+
+			mutex.Lock()
+			durations = append(durations, duration)
+			mutex.Unlock()
+		}()
+	}
+
+	// Allocations of another device are not delayed.
+	if duration := allocate("dev2"); duration > 50*time.Millisecond {
+		t.Errorf("allocation of another device was delayed by %v", duration)
+	}
+
+	wg.Wait()
+
+	// At 10 allocations per second the last of three concurrent allocations
+	// completes 200ms after the first one.
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("concurrent allocations of the same device completed in %v, expected them to be serialized", elapsed)
+	}
+
+	immediate := 0
+
+	for _, duration := range durations {
+		if duration < 50*time.Millisecond {
+			immediate++
+		}
+	}
+
+	if immediate != 1 {
+		t.Errorf("expected one of the concurrent allocations to complete immediately, got %d", immediate)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := srv.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev1"}},
+		},
+	})
+	if err == nil {
+		t.Error("canceled allocation waiting for the rate limit didn't fail")
+	}
+}
+
+func TestAllocationRateLimitsFlag(t *testing.T) {
+	limits := AllocationRateLimits{}
+
+	if err := limits.Set("fpga=0.5"); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	for _, invalid := range []string{"fpga", "=1", "fpga=0", "fpga=fast"} {
+		if err := limits.Set(invalid); err == nil {
+			t.Errorf("invalid rate limit %q was accepted", invalid)
+		}
+	}
+
+	if limits.String() != "fpga=0.5" {
+		t.Errorf("unexpected rate limits %s", limits.String())
+	}
+}
@@ -34,6 +34,13 @@ import (
 
 type serverState int
 
+// gracefulStopTimeout is the time pending gRPC calls get to complete when a server is stopped.
+const gracefulStopTimeout = 5 * time.Second
+
+// staleSocketDialTimeout is the time a listener of a plugin socket gets to
+// accept a connection before the socket is considered stale.
+const staleSocketDialTimeout = time.Second
+
 // Server state.
 const (
 	uninitialized serverState = iota
@@ -52,16 +59,49 @@ type devicePluginServer interface {
 
 // server implements devicePluginServer and pluginapi.PluginInterfaceServer interfaces.
 type server struct {
-	grpcServer             *grpc.Server
-	updatesCh              chan map[string]DeviceInfo
-	devices                map[string]DeviceInfo
+	grpcServer *grpc.Server
+	updatesCh  chan map[string]DeviceInfo
+	devices    map[string]DeviceInfo
+	// subscribers are the update channels of the ListAndWatch streams.
+	subscribers            map[chan map[string]DeviceInfo]bool
 	allocate               allocateFunc
 	postAllocate           postAllocateFunc
 	preStartContainer      preStartContainerFunc
 	getPreferredAllocation getPreferredAllocationFunc
+	strategy               AllocationStrategy
+	tracker                *allocationTracker
+	allocateLimiter        *deviceRateLimiter
+	preStartLimiter        *deviceRateLimiter
 	devType                string
+	warmupCommand          string
+	deviceAlias            string
+	generationPreference   string
+	batchWindow            time.Duration
+	warmupTimeout          time.Duration
+	oversubscription       int
 	state                  serverState
 	stateMutex             sync.Mutex
+	devicesMutex           sync.RWMutex
+	dispatchOnce           sync.Once
+	// inflightAllocations and maxAllocations are the current and the highest
+	// number of concurrent Allocate calls.
+	inflightAllocations int
+	maxAllocations      int
+	allocationsMutex    sync.Mutex
+	// updatesDone tells that the updates channel is closed.
+	updatesDone bool
+	// useStrategyPreferred tells to answer GetPreferredAllocation with strategy
+	// when the plugin doesn't implement the PreferredAllocator interface.
+	useStrategyPreferred bool
+	// keepStaleSocket tells to fail instead of removing a stale plugin socket.
+	keepStaleSocket bool
+	// allocationLogLevel is the klog verbosity of the allocation logs.
+	allocationLogLevel klog.Level
+	// settleDelay is the time the devices get to settle before the first
+	// device list is sent to kubelet, starting at settleDeadline.
+	settleDelay    time.Duration
+	settleDeadline time.Time
+	settleOnce     sync.Once
 }
 
 // newServer creates a new server satisfying the devicePluginServer interface.
@@ -69,7 +109,27 @@ func newServer(devType string,
 	postAllocate postAllocateFunc,
 	preStartContainer preStartContainerFunc,
 	getPreferredAllocation getPreferredAllocationFunc,
-	allocate allocateFunc) devicePluginServer {
+	allocate allocateFunc,
+	tracker *allocationTracker,
+	opts Options) devicePluginServer {
+	strategy, err := newAllocationStrategy(opts.AllocationStrategy)
+	if err != nil {
+		klog.Warningf("Falling back to %q allocation strategy for %s: %+v", DefaultAllocationStrategy, devType, err)
+
+		strategy = &defaultStrategy{}
+	}
+
+	if ratio := opts.OversubscriptionRatios[devType]; ratio > 1 {
+		klog.Warningf("UNSAFE: %s is oversubscribed %d times, containers share its devices. Never use this in production!", devType, ratio)
+	}
+
+	var allocateLimiter, preStartLimiter *deviceRateLimiter
+
+	if limit := opts.AllocationRateLimits[devType]; limit > 0 {
+		allocateLimiter = newDeviceRateLimiter(limit)
+		preStartLimiter = newDeviceRateLimiter(limit)
+	}
+
 	return &server{
 		devType:                devType,
 		updatesCh:              make(chan map[string]DeviceInfo, 1), // TODO: is 1 needed?
@@ -78,14 +138,28 @@ func newServer(devType string,
 		postAllocate:           postAllocate,
 		preStartContainer:      preStartContainer,
 		getPreferredAllocation: getPreferredAllocation,
+		strategy:               strategy,
+		tracker:                tracker,
+		useStrategyPreferred:   opts.GenerationPreference != "" || (err == nil && opts.AllocationStrategy != DefaultAllocationStrategy),
+		generationPreference:   opts.GenerationPreference,
+		keepStaleSocket:        opts.KeepStaleSockets,
+		allocationLogLevel:     allocationLogLevel(opts.AllocationLogLevels, devType),
+		batchWindow:            opts.UpdateBatchWindow,
+		settleDelay:            opts.SettleDelay,
+		warmupCommand:          opts.WarmupCommands[devType],
+		deviceAlias:            opts.DeviceAliases[devType],
+		warmupTimeout:          opts.WarmupTimeout,
+		oversubscription:       opts.OversubscriptionRatios[devType],
+		allocateLimiter:        allocateLimiter,
+		preStartLimiter:        preStartLimiter,
 		state:                  uninitialized,
 	}
 }
 
 func (srv *server) getDevicePluginOptions() *pluginapi.DevicePluginOptions {
 	return &pluginapi.DevicePluginOptions{
-		PreStartRequired:                srv.preStartContainer != nil,
-		GetPreferredAllocationAvailable: srv.getPreferredAllocation != nil,
+		PreStartRequired:                srv.preStartContainer != nil || srv.warmupCommand != "",
+		GetPreferredAllocationAvailable: srv.getPreferredAllocation != nil || srv.useStrategyPreferred,
 	}
 }
 
@@ -93,9 +167,9 @@ func (srv *server) GetDevicePluginOptions(ctx context.Context, empty *pluginapi.
 	return srv.getDevicePluginOptions(), nil
 }
 
-func (srv *server) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer) error {
+func (srv *server) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer, devices map[string]DeviceInfo) error {
 	resp := new(pluginapi.ListAndWatchResponse)
-	for id, device := range srv.devices {
+	for id, device := range srv.advertisedDevices(devices) {
 		resp.Devices = append(resp.Devices, &pluginapi.Device{
 			ID:       id,
 			Health:   device.state,
@@ -106,35 +180,282 @@ func (srv *server) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer)
 	klog.V(4).Info("Sending to kubelet", resp.Devices)
 
 	if err := stream.Send(resp); err != nil {
-		_ = srv.Stop()
 		return errors.Wrapf(err, "Cannot update device list")
 	}
 
 	return nil
 }
 
+// ListAndWatch streams the device list to kubelet. Several streams may be open
+// at the same time, each gets the full device list first and then every update.
+// A stream failing to send ends only itself, the other streams carry on.
 func (srv *server) ListAndWatch(empty *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
 	klog.V(4).Info("Started ListAndWatch for", srv.devType)
 
-	if err := srv.sendDevices(stream); err != nil {
+	devices, updates := srv.subscribe()
+	defer srv.unsubscribe(updates)
+
+	srv.dispatchOnce.Do(func() {
+		go srv.dispatchUpdates()
+	})
+
+	// Until the devices have settled the updates only replace the devices
+	// sent when the settle delay is over.
+	var settled <-chan time.Time
+
+	if wait := srv.settleWait(); wait > 0 {
+		klog.V(4).Infof("Waiting %v for the %s devices to settle", wait, srv.devType)
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		settled = timer.C
+	} else if err := srv.sendDevices(stream, devices); err != nil {
 		return err
 	}
 
-	for srv.devices = range srv.updatesCh {
-		if err := srv.sendDevices(stream); err != nil {
-			return err
+	for {
+		select {
+		case update, open := <-updates:
+			if !open {
+				return srv.clearDevices(stream)
+			}
+
+			devices = update
+
+			if settled != nil {
+				continue
+			}
+
+			if err := srv.sendDevices(stream, devices); err != nil {
+				return err
+			}
+		case <-settled:
+			settled = nil
+
+			if err := srv.sendDevices(stream, devices); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			klog.V(4).Info("ListAndWatch stream closed for ", srv.devType)
+
+			return nil
 		}
 	}
+}
+
+// settleWait returns the time left of the settle delay, which starts at the
+// first ListAndWatch call. Devices may appear healthy for a moment before
+// settling, so the first device list is sent to kubelet only after it.
+func (srv *server) settleWait() time.Duration {
+	srv.settleOnce.Do(func() {
+		srv.settleDeadline = time.Now().Add(srv.settleDelay)
+	})
+
+	return time.Until(srv.settleDeadline)
+}
+
+// clearDevices sends an empty device list to kubelet if all devices of the
+// resource are gone. An empty list makes kubelet drop the capacity right away
+// instead of after the endpoint's grace period.
+func (srv *server) clearDevices(stream pluginapi.DevicePlugin_ListAndWatchServer) error {
+	if srv.getState() != terminating {
+		return nil
+	}
 
-	return nil
+	klog.V(4).Info("Sending empty device list to kubelet for ", srv.devType)
+
+	return errors.Wrap(stream.Send(new(pluginapi.ListAndWatchResponse)), "Cannot clear device list")
+}
+
+// subscribe registers a ListAndWatch stream for device updates. It returns the
+// current devices and the channel the updated devices are sent to, which is
+// closed when there are no more updates.
+func (srv *server) subscribe() (map[string]DeviceInfo, chan map[string]DeviceInfo) {
+	srv.devicesMutex.Lock()
+	defer srv.devicesMutex.Unlock()
+
+	updates := make(chan map[string]DeviceInfo, 1)
+
+	if srv.updatesDone {
+		close(updates)
+
+		return srv.devices, updates
+	}
+
+	if srv.subscribers == nil {
+		srv.subscribers = make(map[chan map[string]DeviceInfo]bool)
+	}
+
+	srv.subscribers[updates] = true
+
+	return srv.devices, updates
+}
+
+// unsubscribe stops sending device updates to a ListAndWatch stream.
+func (srv *server) unsubscribe(updates chan map[string]DeviceInfo) {
+	srv.devicesMutex.Lock()
+	defer srv.devicesMutex.Unlock()
+
+	delete(srv.subscribers, updates)
+}
+
+// dispatchUpdates fans the device updates from Manager out to all ListAndWatch
+// streams until the updates channel is closed.
+func (srv *server) dispatchUpdates() {
+	for devices := range srv.updatesCh {
+		devices, open := srv.batchUpdates(devices)
+
+		srv.publish(devices)
+
+		if !open {
+			break
+		}
+	}
+
+	srv.devicesMutex.Lock()
+	defer srv.devicesMutex.Unlock()
+
+	srv.updatesDone = true
+
+	if srv.getState() == terminating {
+		srv.devices = make(map[string]DeviceInfo)
+	}
+
+	for updates := range srv.subscribers {
+		close(updates)
+		delete(srv.subscribers, updates)
+	}
+}
+
+// publish sets the devices and sends them to all ListAndWatch streams. Every
+// update carries the full device list, so an update a stream hasn't received
+// yet is replaced instead of blocking on a slow stream.
+func (srv *server) publish(devices map[string]DeviceInfo) {
+	srv.devicesMutex.Lock()
+	defer srv.devicesMutex.Unlock()
+
+	srv.devices = devices
+
+	for updates := range srv.subscribers {
+		select {
+		case <-updates:
+		default:
+		}
+
+		updates <- devices
+	}
+}
+
+// currentDevices returns the devices last sent to the ListAndWatch streams.
+// The device map is replaced on every update instead of being modified, so
+// the returned map stays consistent after the lock is released.
+func (srv *server) currentDevices() map[string]DeviceInfo {
+	srv.devicesMutex.RLock()
+	defer srv.devicesMutex.RUnlock()
+
+	return srv.devices
+}
+
+// removesDevices tells if devices lacks some of the devices advertised to kubelet.
+func (srv *server) removesDevices(devices map[string]DeviceInfo) bool {
+	for id := range srv.currentDevices() {
+		if _, ok := devices[id]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// batchUpdates collects the device updates received within the batch window
+// and returns the latest of them. Every update carries the full device list, so
+// the latest one consolidates all the changes. Updates removing devices are
+// returned immediately so that unplugged devices are not advertised. The second
+// return value is false if the updates channel got closed meanwhile.
+func (srv *server) batchUpdates(devices map[string]DeviceInfo) (map[string]DeviceInfo, bool) {
+	if srv.batchWindow <= 0 || srv.removesDevices(devices) {
+		return devices, true
+	}
+
+	timer := time.NewTimer(srv.batchWindow)
+	defer timer.Stop()
+
+	for {
+		select {
+		case update, ok := <-srv.updatesCh:
+			if !ok {
+				return devices, false
+			}
+
+			devices = update
+
+			if srv.removesDevices(devices) {
+				return devices, true
+			}
+		case <-timer.C:
+			return devices, true
+		}
+	}
 }
 
 func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	defer srv.startAllocation()()
+
+	// Released devices are reported by kubelet with the advertised IDs.
+	advertisedIDs := requestedDeviceIDs(rqt)
+	rqt = srv.physicalRequest(rqt)
+
+	if srv.allocateLimiter != nil {
+		if err := srv.allocateLimiter.wait(ctx, requestedDeviceIDs(rqt)); err != nil {
+			err = toAllocationError(err, srv.devType, RateLimited, requestedDeviceIDs(rqt))
+			srv.logAllocation(rqt, err)
+
+			return nil, err
+		}
+	}
+
+	devices := srv.currentDevices()
+
+	if err := srv.tracker.admit(ctx, srv.devType, len(advertisedIDs), healthyDevices(srv.advertisedDevices(devices))); err != nil {
+		err = toAllocationError(err, srv.devType, FairShareExceeded, nil)
+		srv.logAllocation(rqt, err)
+
+		return nil, err
+	}
+
+	response, err := srv.doAllocate(rqt, devices)
+	srv.logAllocation(rqt, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if srv.deviceAlias != "" {
+		addDeviceAliases(response, srv.deviceAlias)
+	}
+
+	if srv.strategy != nil {
+		for _, crqt := range rqt.ContainerRequests {
+			srv.strategy.Allocated(crqt.DevicesIDs)
+		}
+	}
+
+	srv.tracker.allocated(srv.devType, devices, rqt, advertisedIDs)
+
+	return response, nil
+}
+
+func (srv *server) doAllocate(rqt *pluginapi.AllocateRequest, devices map[string]DeviceInfo) (*pluginapi.AllocateResponse, error) {
 	if srv.allocate != nil {
 		response, err := srv.allocate(rqt)
 
 		if _, ok := err.(*UseDefaultMethodError); !ok {
-			return response, err
+			if err != nil {
+				return nil, toAllocationError(err, srv.devType, PluginFailure, requestedDeviceIDs(rqt))
+			}
+
+			return response, nil
 		}
 	}
 
@@ -144,13 +465,13 @@ func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest)
 		cresp := new(pluginapi.ContainerAllocateResponse)
 
 		for _, id := range crqt.DevicesIDs {
-			dev, ok := srv.devices[id]
+			dev, ok := devices[id]
 			if !ok {
-				return nil, errors.Errorf("Invalid allocation request with non-existing device %s", id)
+				return nil, toAllocationError(nil, srv.devType, DeviceNotFound, []string{id})
 			}
 
 			if dev.state != pluginapi.Healthy {
-				return nil, errors.Errorf("Invalid allocation request with unhealthy device %s", id)
+				return nil, toAllocationError(nil, srv.devType, DeviceUnhealthy, []string{id})
 			}
 
 			for i := range dev.nodes {
@@ -180,7 +501,7 @@ func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest)
 	if srv.postAllocate != nil {
 		err := srv.postAllocate(response)
 		if err != nil {
-			return nil, err
+			return nil, toAllocationError(err, srv.devType, PluginFailure, requestedDeviceIDs(rqt))
 		}
 	}
 
@@ -188,21 +509,82 @@ func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest)
 }
 
 func (srv *server) PreStartContainer(ctx context.Context, rqt *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if srv.preStartContainer == nil && srv.warmupCommand == "" {
+		return nil, errors.New("PreStartContainer() should not be called as this device plugin doesn't implement it")
+	}
+
+	if srv.oversubscription > 1 {
+		rqt = &pluginapi.PreStartContainerRequest{DevicesIDs: physicalIDs(rqt.DevicesIDs)}
+	}
+
+	if srv.preStartLimiter != nil {
+		if err := srv.preStartLimiter.wait(ctx, rqt.DevicesIDs); err != nil {
+			return nil, err
+		}
+	}
+
 	if srv.preStartContainer != nil {
-		return new(pluginapi.PreStartContainerResponse), srv.preStartContainer(rqt)
+		if err := srv.preStartContainer(rqt); err != nil {
+			return new(pluginapi.PreStartContainerResponse), err
+		}
 	}
 
-	return nil, errors.New("PreStartContainer() should not be called as this device plugin doesn't implement it")
+	if srv.warmupCommand != "" {
+		if err := runWarmup(srv.warmupCommand, rqt.DevicesIDs, srv.warmupTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	return new(pluginapi.PreStartContainerResponse), nil
 }
 
 func (srv *server) GetPreferredAllocation(ctx context.Context, rqt *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	// Plugins and strategies only know physical devices.
+	if srv.oversubscription > 1 {
+		response := new(pluginapi.PreferredAllocationResponse)
+
+		for _, crqt := range rqt.ContainerRequests {
+			response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+				DeviceIDs: preferredFrom(crqt.AvailableDeviceIDs, crqt.MustIncludeDeviceIDs, int(crqt.AllocationSize)),
+			})
+		}
+
+		return response, nil
+	}
+
 	if srv.getPreferredAllocation != nil {
-		return srv.getPreferredAllocation(rqt)
+		response, err := srv.getPreferredAllocation(rqt)
+		if err != nil {
+			return nil, toAllocationError(err, srv.devType, PluginFailure, nil)
+		}
+
+		return response, nil
+	}
+
+	if srv.useStrategyPreferred && srv.strategy != nil {
+		response := new(pluginapi.PreferredAllocationResponse)
+
+		for _, crqt := range rqt.ContainerRequests {
+			response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+				DeviceIDs: srv.preferred(crqt.AvailableDeviceIDs, crqt.MustIncludeDeviceIDs, int(crqt.AllocationSize)),
+			})
+		}
+
+		return response, nil
 	}
 
 	return nil, errors.New("GetPreferredAllocation should not be called as this device plugin doesn't implement it")
 }
 
+// preferred returns the devices preferred by the strategy and the generation preference.
+func (srv *server) preferred(available, mustInclude []string, size int) []string {
+	if srv.generationPreference != "" {
+		return srv.preferredByGeneration(available, mustInclude, size)
+	}
+
+	return srv.strategy.Preferred(available, mustInclude, size)
+}
+
 // Serve starts a gRPC server to serve pluginapi.PluginInterfaceServer interface.
 func (srv *server) Serve(namespace string) error {
 	return srv.setupAndServe(namespace, pluginapi.DevicePluginPath, pluginapi.KubeletSocket)
@@ -210,14 +592,42 @@ func (srv *server) Serve(namespace string) error {
 
 // Stop stops serving pluginapi.PluginInterfaceServer interface.
 func (srv *server) Stop() error {
+	return srv.stop(gracefulStopTimeout)
+}
+
+// stop stops the server letting pending gRPC calls complete within timeout.
+func (srv *server) stop(timeout time.Duration) error {
 	if srv.grpcServer == nil {
 		return errors.New("Can't stop non-existing gRPC server. Calling Stop() before Serve()?")
 	}
 
-	srv.setState(terminating)
-	srv.grpcServer.Stop()
+	// Several ListAndWatch streams may fail and stop the server.
+	if srv.swapState(terminating) == terminating {
+		return nil
+	}
+
 	close(srv.updatesCh)
 
+	if timeout <= 0 {
+		srv.grpcServer.Stop()
+		return nil
+	}
+
+	// Give ListAndWatch a chance to send the empty device list before
+	// the connection to kubelet is closed.
+	stopped := make(chan struct{})
+
+	go func() {
+		srv.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		srv.grpcServer.Stop()
+	}
+
 	return nil
 }
 
@@ -232,6 +642,17 @@ func (srv *server) setState(state serverState) {
 	srv.state = state
 }
 
+// swapState sets the state and returns the previous one.
+func (srv *server) swapState(state serverState) serverState {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+
+	previous := srv.state
+	srv.state = state
+
+	return previous
+}
+
 func (srv *server) getState() serverState {
 	srv.stateMutex.Lock()
 	defer srv.stateMutex.Unlock()
@@ -249,11 +670,9 @@ func (srv *server) setupAndServe(namespace string, devicePluginPath string, kube
 		pluginEndpoint := pluginPrefix + ".sock"
 		pluginSocket := path.Join(devicePluginPath, pluginEndpoint)
 
-		if err := waitForServer(pluginSocket, time.Second); err == nil {
-			return errors.Errorf("Socket %s is already in use", pluginSocket)
+		if err := removeStaleSocket(pluginSocket, srv.keepStaleSocket); err != nil {
+			return err
 		}
-		// We don't care if the plugin's socket file doesn't exist.
-		_ = os.Remove(pluginSocket)
 
 		lis, err := net.Listen("unix", pluginSocket)
 		if err != nil {
@@ -356,6 +775,44 @@ func (srv *server) registerWithKubelet(kubeletSocket, pluginEndPoint, resourceNa
 	return nil
 }
 
+// removeStaleSocket removes the socket left by a previous instance of the
+// plugin which crashed or was killed. A socket with a live listener, e.g.
+// another instance of the plugin, is never removed. With keep set a stale
+// socket is an error instead.
+func removeStaleSocket(socket string, keep bool) error {
+	info, err := os.Lstat(socket)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "unable to check socket %s", socket)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s is not a socket, refusing to remove it", socket)
+	}
+
+	conn, err := net.DialTimeout("unix", socket, staleSocketDialTimeout)
+	if err == nil {
+		conn.Close()
+
+		return errors.Errorf("Socket %s is already in use", socket)
+	}
+
+	if keep {
+		return errors.Errorf("stale socket %s left by a previous instance, remove it to start", socket)
+	}
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "unable to remove stale socket %s", socket)
+	}
+
+	klog.Infof("Removed stale socket %s left by a previous instance", socket)
+
+	return nil
+}
+
 // waitForServer checks if grpc server is alive
 // by making grpc blocking connection to the server socket.
 func waitForServer(socket string, timeout time.Duration) error {
@@ -71,6 +71,7 @@ func newKubeletStub(socket string) *kubeletStub {
 func newTestServer() *server {
 	return &server{
 		devType: "testtype",
+		tracker: &allocationTracker{},
 		devices: map[string]DeviceInfo{
 			"dev1": {
 				state: pluginapi.Healthy,
@@ -278,12 +279,14 @@ func TestAllocate(t *testing.T) {
 		devices           map[string]DeviceInfo
 		postAllocate      func(*pluginapi.AllocateResponse) error
 		name              string
+		expectedReason    AllocationErrorReason
 		expectedAllocated int
 		expectedErr       bool
 	}{
 		{
-			name:        "Allocate non-existing device",
-			expectedErr: true,
+			name:           "Allocate non-existing device",
+			expectedErr:    true,
+			expectedReason: DeviceNotFound,
 		},
 		{
 			name: "Allocate unhealthy devices",
@@ -299,7 +302,8 @@ func TestAllocate(t *testing.T) {
 					},
 				},
 			},
-			expectedErr: true,
+			expectedErr:    true,
+			expectedReason: DeviceUnhealthy,
 		},
 		{
 			name: "Allocate healthy device",
@@ -371,7 +375,8 @@ func TestAllocate(t *testing.T) {
 			postAllocate: func(resp *pluginapi.AllocateResponse) error {
 				return fmt.Errorf("%w for %q", errFake, "dev1")
 			},
-			expectedErr: true,
+			expectedErr:    true,
+			expectedReason: PluginFailure,
 		},
 	}
 
@@ -385,6 +390,11 @@ func TestAllocate(t *testing.T) {
 			continue
 		}
 
+		var allocErr *AllocationError
+		if tt.expectedErr && (!errors.As(err, &allocErr) || allocErr.Reason != tt.expectedReason) {
+			t.Errorf("Test case '%s': expected %q allocation error, got %+v", tt.name, tt.expectedReason, err)
+		}
+
 		if !tt.expectedErr && err != nil {
 			t.Errorf("Test case '%s': got unexpected error %+v", tt.name, err)
 			continue
@@ -402,8 +412,82 @@ func TestAllocate(t *testing.T) {
 	}
 }
 
+func TestAllocationErrorMessages(t *testing.T) {
+	rqt := &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev1", "dev2"}},
+		},
+	}
+
+	tcases := []struct {
+		allocate        allocateFunc
+		postAllocate    postAllocateFunc
+		devices         map[string]DeviceInfo
+		name            string
+		expectedMessage string
+	}{
+		{
+			name:            "non-existing device",
+			devices:         map[string]DeviceInfo{"dev1": {state: pluginapi.Healthy}},
+			expectedMessage: "allocation of testtype failed: device not found (devices: dev2)",
+		},
+		{
+			name: "unhealthy device",
+			devices: map[string]DeviceInfo{
+				"dev1": {state: pluginapi.Unhealthy},
+				"dev2": {state: pluginapi.Healthy},
+			},
+			expectedMessage: "allocation of testtype failed: device unhealthy (devices: dev1)",
+		},
+		{
+			name: "failing allocator",
+			allocate: func(*pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+				return nil, errFake
+			},
+			expectedMessage: "allocation of testtype failed: plugin failure (devices: dev1, dev2): Fake error",
+		},
+		{
+			name: "allocator with a specific reason",
+			allocate: func(*pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+				return nil, NewAllocationError(ResourcesExhausted, []string{"dev2"}, errFake)
+			},
+			expectedMessage: "allocation of testtype failed: resources exhausted (devices: dev2): Fake error",
+		},
+		{
+			name: "failing postAllocate hook",
+			devices: map[string]DeviceInfo{
+				"dev1": {state: pluginapi.Healthy},
+				"dev2": {state: pluginapi.Healthy},
+			},
+			postAllocate: func(*pluginapi.AllocateResponse) error {
+				return errFake
+			},
+			expectedMessage: "allocation of testtype failed: plugin failure (devices: dev1, dev2): Fake error",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestServer()
+			srv.devices = tc.devices
+			srv.allocate = tc.allocate
+			srv.postAllocate = tc.postAllocate
+
+			_, err := srv.Allocate(context.Background(), rqt)
+			if err == nil {
+				t.Fatal("no error returned")
+			}
+
+			if err.Error() != tc.expectedMessage {
+				t.Errorf("expected error %q, got %q", tc.expectedMessage, err.Error())
+			}
+		})
+	}
+}
+
 // Minimal implementation of pluginapi.DevicePlugin_ListAndWatchServer.
 type listAndWatchServerStub struct {
+	ctx         context.Context
 	cdata       chan []*pluginapi.Device
 	testServer  *server
 	generateErr int
@@ -424,7 +508,11 @@ func (s *listAndWatchServerStub) Send(resp *pluginapi.ListAndWatchResponse) erro
 }
 
 func (s *listAndWatchServerStub) Context() context.Context {
-	return nil
+	if s.ctx == nil {
+		return context.Background()
+	}
+
+	return s.ctx
 }
 
 func (s *listAndWatchServerStub) RecvMsg(m interface{}) error {
@@ -525,6 +613,364 @@ func TestListAndWatch(t *testing.T) {
 	}
 }
 
+func TestListAndWatchBatching(t *testing.T) {
+	devCh := make(chan map[string]DeviceInfo, 3)
+	testServer := newTestServer()
+	testServer.updatesCh = devCh
+	testServer.batchWindow = 100 * time.Millisecond
+
+	stream := &listAndWatchServerStub{
+		testServer: testServer,
+		cdata:      make(chan []*pluginapi.Device, 10),
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- testServer.ListAndWatch(&pluginapi.Empty{}, stream)
+	}()
+
+	// The initial device list is sent without delay.
+	if devices := <-stream.cdata; len(devices) != 2 {
+		t.Fatalf("expected initial list of 2 devices, got %d", len(devices))
+	}
+
+	for _, state := range []string{pluginapi.Unhealthy, pluginapi.Healthy, pluginapi.Unhealthy} {
+		devCh <- map[string]DeviceInfo{
+			"dev1": {state: state},
+			"dev2": {state: pluginapi.Healthy},
+		}
+	}
+
+	time.Sleep(3 * testServer.batchWindow)
+	close(devCh)
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(stream.cdata) != 1 {
+		t.Fatalf("expected one consolidated update, got %d", len(stream.cdata))
+	}
+
+	devices := <-stream.cdata
+	for _, device := range devices {
+		if device.ID == "dev1" && device.Health != pluginapi.Unhealthy {
+			t.Errorf("consolidated update doesn't reflect the latest state: %v", devices)
+		}
+	}
+}
+
+func TestListAndWatchUnplug(t *testing.T) {
+	devCh := make(chan map[string]DeviceInfo, 1)
+	testServer := newTestServer()
+	testServer.updatesCh = devCh
+	// Removals must not wait for the batch window.
+	testServer.batchWindow = time.Hour
+
+	stream := &listAndWatchServerStub{
+		testServer: testServer,
+		cdata:      make(chan []*pluginapi.Device, 10),
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- testServer.ListAndWatch(&pluginapi.Empty{}, stream)
+	}()
+
+	if devices := <-stream.cdata; len(devices) != 2 {
+		t.Fatalf("expected initial list of 2 devices, got %d", len(devices))
+	}
+
+	// dev2 is unplugged.
+	devCh <- map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+	}
+
+	select {
+	case devices := <-stream.cdata:
+		if len(devices) != 1 || devices[0].ID != "dev1" {
+			t.Errorf("unplugged device is still advertised: %v", devices)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("device removal was not sent to kubelet")
+	}
+
+	// The last device is unplugged and the resource is removed.
+	testServer.setState(terminating)
+	close(devCh)
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if devices := <-stream.cdata; len(devices) != 0 {
+		t.Errorf("expected an empty device list for a removed resource, got %v", devices)
+	}
+}
+
+func TestListAndWatchSettleDelay(t *testing.T) {
+	devCh := make(chan map[string]DeviceInfo, 1)
+	testServer := newTestServer()
+	testServer.updatesCh = devCh
+	testServer.settleDelay = 200 * time.Millisecond
+
+	stream := &listAndWatchServerStub{
+		testServer: testServer,
+		cdata:      make(chan []*pluginapi.Device, 10),
+	}
+
+	done := make(chan error)
+	start := time.Now()
+
+	go func() {
+		done <- testServer.ListAndWatch(&pluginapi.Empty{}, stream)
+	}()
+
+	// dev1 turns unhealthy right after it appeared.
+	devCh <- map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Unhealthy},
+		"dev2": {state: pluginapi.Healthy},
+	}
+
+	var devices []*pluginapi.Device
+
+	select {
+	case devices = <-stream.cdata:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the settled devices were not sent to kubelet")
+	}
+
+	if elapsed := time.Since(start); elapsed < testServer.settleDelay {
+		t.Errorf("the first device list was sent after %v, before the settle delay", elapsed)
+	}
+
+	for _, device := range devices {
+		if device.ID == "dev1" && device.Health != pluginapi.Unhealthy {
+			t.Errorf("the first device list doesn't reflect the settled state: %v", devices)
+		}
+	}
+
+	if len(stream.cdata) != 0 {
+		t.Errorf("expected a single device list after the settle delay, got %d more", len(stream.cdata))
+	}
+
+	// The later updates are sent right away.
+	devCh <- map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Healthy},
+	}
+
+	select {
+	case <-stream.cdata:
+	case <-time.After(testServer.settleDelay / 2):
+		t.Error("an update after the settle delay was delayed")
+	}
+
+	close(devCh)
+
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+}
+
+func TestListAndWatchStreams(t *testing.T) {
+	devCh := make(chan map[string]DeviceInfo, 1)
+	testServer := newTestServer()
+	testServer.updatesCh = devCh
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	streams := []*listAndWatchServerStub{
+		{testServer: testServer, cdata: make(chan []*pluginapi.Device, 10), ctx: ctx},
+		{testServer: testServer, cdata: make(chan []*pluginapi.Device, 10)},
+	}
+	done := make([]chan error, len(streams))
+
+	for i, stream := range streams {
+		done[i] = make(chan error, 1)
+
+		go func(stream *listAndWatchServerStub, done chan error) {
+			done <- testServer.ListAndWatch(&pluginapi.Empty{}, stream)
+		}(stream, done[i])
+	}
+
+	receive := func(stream *listAndWatchServerStub, expected int) {
+		t.Helper()
+
+		select {
+		case devices := <-stream.cdata:
+			if len(devices) != expected {
+				t.Errorf("expected %d devices, got %v", expected, devices)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("device list was not sent to kubelet")
+		}
+	}
+
+	// Every stream gets the full device list on connect.
+	for _, stream := range streams {
+		receive(stream, 2)
+	}
+
+	devCh <- map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+	}
+
+	for _, stream := range streams {
+		receive(stream, 1)
+	}
+
+	// The first stream disconnects and is cleaned up.
+	cancel()
+
+	if err := <-done[0]; err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	testServer.devicesMutex.Lock()
+	subscribers := len(testServer.subscribers)
+	testServer.devicesMutex.Unlock()
+
+	if subscribers != 1 {
+		t.Errorf("expected 1 subscriber after disconnect, got %d", subscribers)
+	}
+
+	devCh <- map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Healthy},
+		"dev3": {state: pluginapi.Healthy},
+	}
+
+	receive(streams[1], 3)
+
+	if len(streams[0].cdata) != 0 {
+		t.Errorf("disconnected stream got an update")
+	}
+
+	close(devCh)
+
+	if err := <-done[1]; err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	testServer.devicesMutex.Lock()
+	subscribers = len(testServer.subscribers)
+	testServer.devicesMutex.Unlock()
+
+	if subscribers != 0 {
+		t.Errorf("expected no subscribers after the updates ended, got %d", subscribers)
+	}
+}
+
+func TestListAndWatchSendError(t *testing.T) {
+	devCh := make(chan map[string]DeviceInfo, 1)
+	testServer := newTestServer()
+	testServer.updatesCh = devCh
+	testServer.setState(serving)
+
+	// The first stream fails to send the first update.
+	streams := []*listAndWatchServerStub{
+		{testServer: testServer, cdata: make(chan []*pluginapi.Device, 10), generateErr: 2},
+		{testServer: testServer, cdata: make(chan []*pluginapi.Device, 10)},
+	}
+	done := make([]chan error, len(streams))
+
+	for i, stream := range streams {
+		done[i] = make(chan error, 1)
+
+		go func(stream *listAndWatchServerStub, done chan error) {
+			done <- testServer.ListAndWatch(&pluginapi.Empty{}, stream)
+		}(stream, done[i])
+	}
+
+	receive := func(stream *listAndWatchServerStub, expected int) {
+		t.Helper()
+
+		select {
+		case devices := <-stream.cdata:
+			if len(devices) != expected {
+				t.Errorf("expected %d devices, got %v", expected, devices)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("device list was not sent to kubelet")
+		}
+	}
+
+	for _, stream := range streams {
+		receive(stream, 2)
+	}
+
+	devCh <- map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+	}
+
+	if err := <-done[0]; err == nil {
+		t.Error("no error returned for a failed send")
+	}
+
+	receive(streams[1], 1)
+
+	if state := testServer.getState(); state != serving {
+		t.Errorf("a failed stream stopped the server, got state %v", state)
+	}
+
+	testServer.devicesMutex.Lock()
+	subscribers := len(testServer.subscribers)
+	testServer.devicesMutex.Unlock()
+
+	if subscribers != 1 {
+		t.Errorf("expected 1 subscriber after the failed send, got %d", subscribers)
+	}
+
+	// The other stream keeps receiving updates.
+	devCh <- map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Healthy},
+		"dev3": {state: pluginapi.Healthy},
+	}
+
+	receive(streams[1], 3)
+
+	close(devCh)
+
+	if err := <-done[1]; err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+}
+
+func TestAllocateDuringUpdates(t *testing.T) {
+	srv := newTestServer()
+	srv.devices = map[string]DeviceInfo{"dev1": {state: pluginapi.Healthy}}
+
+	rqt := &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev1"}},
+		},
+	}
+
+	done := make(chan struct{})
+
+	// The race detector catches Allocate reading the devices unlocked.
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			srv.publish(map[string]DeviceInfo{"dev1": {state: pluginapi.Healthy}})
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, err := srv.Allocate(context.Background(), rqt); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+	}
+
+	<-done
+}
+
 func TestGetDevicePluginOptions(t *testing.T) {
 	srv := newTestServer()
 	if _, err := srv.GetDevicePluginOptions(context.Background(), nil); err != nil {
@@ -596,8 +1042,79 @@ func TestGetPreferredAllocation(t *testing.T) {
 	}
 }
 
+func TestPreStartContainerWarmup(t *testing.T) {
+	tcases := []struct {
+		name          string
+		command       string
+		expectedError bool
+	}{
+		{
+			name:    "successful warmup",
+			command: "true",
+		},
+		{
+			name:          "failing warmup",
+			command:       "false",
+			expectedError: true,
+		},
+		{
+			name:          "timed out warmup",
+			command:       "sleep 10",
+			expectedError: true,
+		},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, ok := newServer("testtype", nil, nil, nil, nil, &allocationTracker{}, Options{
+				WarmupCommands: WarmupCommands{"testtype": tc.command},
+				WarmupTimeout:  100 * time.Millisecond,
+			}).(*server)
+			if !ok {
+				t.Fatal("unexpected server type")
+			}
+
+			if !srv.getDevicePluginOptions().PreStartRequired {
+				t.Error("PreStartContainer is not required with a warmup command")
+			}
+
+			start := time.Now()
+
+			_, err := srv.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{
+				DevicesIDs: []string{"dev1"},
+			})
+			if !tc.expectedError && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			} else if tc.expectedError && err == nil {
+				t.Error("didn't fail when expected to fail")
+			}
+
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("warmup wasn't stopped at timeout, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestWarmupCommandsFlag(t *testing.T) {
+	commands := WarmupCommands{}
+
+	if err := commands.Set("gpu=/usr/bin/warmup --model resnet"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if commands["gpu"] != "/usr/bin/warmup --model resnet" {
+		t.Errorf("unexpected warmup command %q", commands["gpu"])
+	}
+
+	for _, value := range []string{"gpu", "=true", "gpu= "} {
+		if err := commands.Set(value); err == nil {
+			t.Errorf("invalid warmup command %q was accepted", value)
+		}
+	}
+}
+
 func TestNewServer(t *testing.T) {
-	_ = newServer("test", nil, nil, nil, nil)
+	_ = newServer("test", nil, nil, nil, nil, &allocationTracker{}, Options{})
 }
 
 func TestUpdate(t *testing.T) {
@@ -610,3 +1127,86 @@ func maybeLogError(f func() error, message string) {
 		klog.Errorf(message+":%+v", err)
 	}
 }
+
+func TestRemoveStaleSocket(t *testing.T) {
+	listen := func(t *testing.T, socket string) *net.UnixListener {
+		t.Helper()
+
+		lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+		if err != nil {
+			t.Fatalf("unable to listen: %+v", err)
+		}
+
+		return lis
+	}
+
+	tcases := []struct {
+		setup           func(t *testing.T, socket string)
+		name            string
+		keep            bool
+		expectedErr     bool
+		expectedRemoved bool
+	}{
+		{
+			name:  "no socket",
+			setup: func(*testing.T, string) {},
+		},
+		{
+			name: "stale socket",
+			setup: func(t *testing.T, socket string) {
+				// A crashed plugin leaves the socket behind.
+				lis := listen(t, socket)
+				lis.SetUnlinkOnClose(false)
+				lis.Close()
+			},
+			expectedRemoved: true,
+		},
+		{
+			name: "stale socket kept",
+			setup: func(t *testing.T, socket string) {
+				lis := listen(t, socket)
+				lis.SetUnlinkOnClose(false)
+				lis.Close()
+			},
+			keep:        true,
+			expectedErr: true,
+		},
+		{
+			name: "live socket",
+			setup: func(t *testing.T, socket string) {
+				lis := listen(t, socket)
+				t.Cleanup(func() { lis.Close() })
+			},
+			expectedErr: true,
+		},
+		{
+			name: "not a socket",
+			setup: func(t *testing.T, socket string) {
+				if err := os.WriteFile(socket, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			socket := path.Join(t.TempDir(), "plugin.sock")
+			tc.setup(t, socket)
+
+			_, statErr := os.Lstat(socket)
+			existed := statErr == nil
+
+			err := removeStaleSocket(socket, tc.keep)
+			if (err != nil) != tc.expectedErr {
+				t.Errorf("expected error %v, got %+v", tc.expectedErr, err)
+			}
+
+			_, statErr = os.Lstat(socket)
+			if removed := existed && os.IsNotExist(statErr); removed != tc.expectedRemoved {
+				t.Errorf("expected removed %v, got %v", tc.expectedRemoved, removed)
+			}
+		})
+	}
+}
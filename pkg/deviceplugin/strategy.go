@@ -0,0 +1,155 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultAllocationStrategy leaves the device selection to kubelet.
+	DefaultAllocationStrategy = "default"
+	// LRUAllocationStrategy prefers the least recently allocated devices.
+	LRUAllocationStrategy = "lru"
+)
+
+// AllocationStrategy allows customizing how the framework selects and tracks
+// the devices of a resource. A new instance is created for every resource.
+type AllocationStrategy interface {
+	// Preferred returns the preferred device IDs for a container. The returned
+	// list must contain all mustInclude IDs and at most size IDs in total.
+	Preferred(available, mustInclude []string, size int) []string
+	// Allocated is called with the device IDs of every successful container allocation.
+	Allocated(deviceIDs []string)
+}
+
+// AllocationStrategyFactory creates a new AllocationStrategy instance.
+type AllocationStrategyFactory func() AllocationStrategy
+
+var (
+	strategiesMutex sync.Mutex
+	strategies      = map[string]AllocationStrategyFactory{
+		DefaultAllocationStrategy: func() AllocationStrategy { return &defaultStrategy{} },
+		LRUAllocationStrategy:     func() AllocationStrategy { return newLRUStrategy() },
+	}
+)
+
+// RegisterAllocationStrategy makes an allocation strategy available under the given name.
+// It's meant to be called from init() functions, e.g. in files guarded by build tags.
+func RegisterAllocationStrategy(name string, factory AllocationStrategyFactory) error {
+	strategiesMutex.Lock()
+	defer strategiesMutex.Unlock()
+
+	if factory == nil {
+		return errors.Errorf("nil factory for allocation strategy %q", name)
+	}
+
+	if _, ok := strategies[name]; ok {
+		return errors.Errorf("allocation strategy %q is already registered", name)
+	}
+
+	strategies[name] = factory
+
+	return nil
+}
+
+func newAllocationStrategy(name string) (AllocationStrategy, error) {
+	strategiesMutex.Lock()
+	defer strategiesMutex.Unlock()
+
+	factory, ok := strategies[name]
+	if !ok {
+		return nil, errors.Errorf("unknown allocation strategy %q", name)
+	}
+
+	return factory(), nil
+}
+
+// preferredFrom returns mustInclude followed by the candidates not in it, truncated to size.
+func preferredFrom(candidates, mustInclude []string, size int) []string {
+	preferred := append([]string{}, mustInclude...)
+	included := make(map[string]bool, len(mustInclude))
+
+	for _, id := range mustInclude {
+		included[id] = true
+	}
+
+	for _, id := range candidates {
+		if len(preferred) >= size {
+			break
+		}
+
+		if !included[id] {
+			preferred = append(preferred, id)
+			included[id] = true
+		}
+	}
+
+	return preferred
+}
+
+// defaultStrategy picks the available devices in the order given by kubelet.
+type defaultStrategy struct{}
+
+func (*defaultStrategy) Preferred(available, mustInclude []string, size int) []string {
+	return preferredFrom(available, mustInclude, size)
+}
+
+func (*defaultStrategy) Allocated([]string) {}
+
+// lruStrategy prefers the devices which have been allocated least recently.
+type lruStrategy struct {
+	lastUsed map[string]uint64
+	clock    uint64
+	mutex    sync.Mutex
+}
+
+func newLRUStrategy() *lruStrategy {
+	return &lruStrategy{
+		lastUsed: make(map[string]uint64),
+	}
+}
+
+func (s *lruStrategy) Preferred(available, mustInclude []string, size int) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	candidates := append([]string{}, available...)
+
+	// Never allocated devices have zero as their last use and come first.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if s.lastUsed[candidates[i]] != s.lastUsed[candidates[j]] {
+			return s.lastUsed[candidates[i]] < s.lastUsed[candidates[j]]
+		}
+
+		return candidates[i] < candidates[j]
+	})
+
+	return preferredFrom(candidates, mustInclude, size)
+}
+
+func (s *lruStrategy) Allocated(deviceIDs []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.clock++
+
+	for _, id := range deviceIDs {
+		s.lastUsed[id] = s.clock
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+type strategyStub struct {
+	allocated [][]string
+}
+
+func (s *strategyStub) Preferred(available, mustInclude []string, size int) []string {
+	return available[:size]
+}
+
+func (s *strategyStub) Allocated(deviceIDs []string) {
+	s.allocated = append(s.allocated, deviceIDs)
+}
+
+func TestCustomAllocationStrategy(t *testing.T) {
+	stub := &strategyStub{}
+
+	if err := RegisterAllocationStrategy("stub", func() AllocationStrategy { return stub }); err != nil {
+		t.Fatalf("unable to register strategy: %+v", err)
+	}
+
+	if err := RegisterAllocationStrategy("stub", func() AllocationStrategy { return stub }); err == nil {
+		t.Error("registering the same strategy twice didn't fail")
+	}
+
+	srv, ok := newServer("testtype", nil, nil, nil, nil, &allocationTracker{}, Options{AllocationStrategy: "stub"}).(*server)
+	if !ok {
+		t.Fatal("unexpected server type")
+	}
+
+	srv.devices = map[string]DeviceInfo{
+		"dev1": {state: pluginapi.Healthy},
+		"dev2": {state: pluginapi.Healthy},
+	}
+
+	if !srv.getDevicePluginOptions().GetPreferredAllocationAvailable {
+		t.Error("preferred allocation is not advertised with a custom strategy")
+	}
+
+	_, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev2"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected allocation error: %+v", err)
+	}
+
+	if !reflect.DeepEqual(stub.allocated, [][]string{{"dev2"}}) {
+		t.Errorf("strategy was not invoked on Allocate, got %v", stub.allocated)
+	}
+
+	_, err = srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"dev3"}},
+		},
+	})
+	if err == nil {
+		t.Fatal("allocation of a non-existing device didn't fail")
+	}
+
+	if len(stub.allocated) != 1 {
+		t.Error("strategy was invoked for a failed allocation")
+	}
+}
+
+func TestDefaultAllocationStrategy(t *testing.T) {
+	srv, ok := newServer("testtype", nil, nil, nil, nil, &allocationTracker{}, Options{AllocationStrategy: DefaultAllocationStrategy}).(*server)
+	if !ok {
+		t.Fatal("unexpected server type")
+	}
+
+	if srv.getDevicePluginOptions().GetPreferredAllocationAvailable {
+		t.Error("preferred allocation is advertised with the default strategy")
+	}
+
+	strategy := &defaultStrategy{}
+
+	preferred := strategy.Preferred([]string{"dev1", "dev2", "dev3"}, []string{"dev3"}, 2)
+	if !reflect.DeepEqual(preferred, []string{"dev3", "dev1"}) {
+		t.Errorf("unexpected preferred devices %v", preferred)
+	}
+}
+
+func TestLRUAllocationStrategy(t *testing.T) {
+	strategy := newLRUStrategy()
+	available := []string{"dev1", "dev2", "dev3"}
+
+	strategy.Allocated([]string{"dev1"})
+	strategy.Allocated([]string{"dev3"})
+
+	preferred := strategy.Preferred(available, nil, 2)
+	if !reflect.DeepEqual(preferred, []string{"dev2", "dev1"}) {
+		t.Errorf("unexpected preferred devices %v", preferred)
+	}
+
+	strategy.Allocated([]string{"dev2"})
+
+	preferred = strategy.Preferred(available, []string{"dev2"}, 2)
+	if !reflect.DeepEqual(preferred, []string{"dev2", "dev1"}) {
+		t.Errorf("unexpected preferred devices with must include, got %v", preferred)
+	}
+}
+
+func TestInvalidAllocationStrategy(t *testing.T) {
+	opts := Options{AllocationStrategy: "nonexisting"}
+	if err := opts.validate(); err == nil {
+		t.Error("invalid allocation strategy passed validation")
+	}
+}
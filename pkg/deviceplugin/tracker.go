@@ -0,0 +1,107 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// allocationTracker is the allocation bookkeeping of a Manager, shared by its
+// servers and its deallocation watcher. Each Manager has its own, so that
+// several of them can run in one process. The optional parts are nil if
+// disabled.
+type allocationTracker struct {
+	history  *allocationHistory
+	holds    *deviceHolds
+	fairness *fairAllocator
+	capacity *deviceCapacity
+	counts   *allocationCounts
+	// pool is the value of the node pool label of the node, set to the pool
+	// label of the metrics. Empty if the label is not configured or not set.
+	pool string
+}
+
+// newAllocationTracker creates the allocation bookkeeping of the resources
+// of the namespace enabled in opts. The allocation counts are loaded from and
+// saved to their checkpoint in the device plugin directory pluginDir.
+func newAllocationTracker(namespace, pluginDir string, opts Options) *allocationTracker {
+	tracker := &allocationTracker{}
+
+	if opts.NodePoolLabel != "" {
+		tracker.pool = lookupNodePool(opts.NodePoolLabel)
+	}
+
+	if opts.AllocationHistorySize > 0 {
+		tracker.history = newAllocationHistory(opts.AllocationHistorySize)
+	}
+
+	if opts.DeviceHoldMetrics || opts.StaleAllocationReapInterval > 0 {
+		tracker.holds = newDeviceHolds(opts.DeviceHoldMetrics, tracker.pool)
+	}
+
+	if len(opts.FairAllocation) > 0 {
+		tracker.fairness = newFairAllocator(namespace, opts.FairAllocation)
+	}
+
+	if opts.CapacityMetrics {
+		tracker.capacity = newDeviceCapacity(tracker.pool)
+	}
+
+	tracker.counts = loadAllocationCounts(allocationCountsPath(pluginDir, namespace), tracker.pool)
+
+	return tracker
+}
+
+// watchesDeallocations tells if the tracker needs the released devices.
+func (t *allocationTracker) watchesDeallocations() bool {
+	return t.holds != nil || t.capacity != nil
+}
+
+// allocated records the container allocations of a request, which kubelet
+// knows by advertisedIDs, made from devices.
+func (t *allocationTracker) allocated(resource string, devices map[string]DeviceInfo, rqt *pluginapi.AllocateRequest, advertisedIDs []string) {
+	recordNUMAAlignment(resource, devices, rqt, t.pool)
+
+	if t.counts != nil {
+		t.counts.record(resource, rqt)
+	}
+
+	if t.history != nil {
+		t.history.recordAllocations(resource, rqt)
+	}
+
+	if t.holds != nil {
+		t.holds.allocate(resource, advertisedIDs)
+	}
+}
+
+// admit returns an error if the resource is allocated fairly and requested
+// more devices would be an unfair share of the healthy devices.
+func (t *allocationTracker) admit(ctx context.Context, resource string, requested, healthy int) error {
+	if t.fairness == nil || !t.fairness.resources[resource] {
+		return nil
+	}
+
+	return t.fairness.admit(ctx, resource, requested, healthy)
+}
+
+// released records the release of the devices.
+func (t *allocationTracker) released(resource string, ids []string) {
+	if t.holds != nil {
+		t.holds.release(resource, ids)
+	}
+}
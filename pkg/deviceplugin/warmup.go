@@ -0,0 +1,78 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+const defaultWarmupTimeout = 30 * time.Second
+
+// WarmupCommands maps resource names to the warmup commands run at PreStartContainer.
+// It implements flag.Value and can be given several times as "resource=command args".
+type WarmupCommands map[string]string
+
+func (w WarmupCommands) String() string {
+	entries := make([]string, 0, len(w))
+
+	for resource, command := range w {
+		entries = append(entries, resource+"="+command)
+	}
+
+	sort.Strings(entries)
+
+	return strings.Join(entries, ";")
+}
+
+// Set adds a "resource=command args" entry.
+func (w WarmupCommands) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+		return errors.Errorf("invalid warmup command %q, expected resource=command", value)
+	}
+
+	w[parts[0]] = strings.TrimSpace(parts[1])
+
+	return nil
+}
+
+// runWarmup runs command with the device IDs appended as arguments and
+// fails if it doesn't complete successfully within timeout.
+func runWarmup(command string, deviceIDs []string, timeout time.Duration) error {
+	args := append(strings.Fields(command), deviceIDs...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Errorf("warmup command %q timed out after %v", command, timeout)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "warmup command %q failed: %s", command, output)
+	}
+
+	klog.V(4).Infof("Warmup of devices %v done", deviceIDs)
+
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// hostnameLabel is the node label pods can be pinned to a node with.
+const hostnameLabel = "kubernetes.io/hostname"
+
+// podNode returns the node the pod is bound or pinned to, empty if it's not
+// known at admission, as usual for pods not scheduled yet.
+func podNode(pod *corev1.Pod) string {
+	if pod.Spec.NodeName != "" {
+		return pod.Spec.NodeName
+	}
+
+	return pod.Spec.NodeSelector[hostnameLabel]
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// checkAesmdDaemonSet returns a warning if no aesmd DaemonSet pod matching
+// the AesmdPodSelector is ready to serve the aesmd socket to the pod. The
+// check is best-effort: the node of the pod is usually not known at
+// admission, in which case a ready aesmd pod on any node is enough.
+func (s *Mutator) checkAesmdDaemonSet(ctx context.Context, pod *corev1.Pod) []string {
+	if s.AesmdPodSelector == "" || s.Client == nil {
+		return nil
+	}
+
+	selector, err := labels.Parse(s.AesmdPodSelector)
+	if err != nil {
+		return []string{"ignoring the aesmd pod selector: " + err.Error()}
+	}
+
+	aesmdPods := &corev1.PodList{}
+	if err := s.Client.List(ctx, aesmdPods, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return []string{"unable to check the aesmd DaemonSet pods: " + err.Error()}
+	}
+
+	node := podNode(pod)
+
+	for i := range aesmdPods.Items {
+		aesmdPod := &aesmdPods.Items[i]
+
+		if isPodReady(aesmdPod) && (node == "" || aesmdPod.Spec.NodeName == node) {
+			return nil
+		}
+	}
+
+	if node == "" {
+		return []string{"no aesmd DaemonSet pod is ready, the aesmd socket may not be available to the pod"}
+	}
+
+	return []string{"no aesmd DaemonSet pod is ready on node " + node + ", the aesmd socket may not be available to the pod"}
+}
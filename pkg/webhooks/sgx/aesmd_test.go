@@ -0,0 +1,146 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestAesmdPod(node string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "aesmd-" + node,
+			Namespace: "sgx-system",
+			Labels:    map[string]string{"app": "intel-sgx-aesmd"},
+		},
+		Spec: corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestAesmdDaemonSetCheck(t *testing.T) {
+	readyPod := newTestAesmdPod("node-1", true)
+	unreadyPod := newTestAesmdPod("node-2", false)
+
+	tcases := []struct {
+		name            string
+		selector        string
+		aesmdPods       []client.Object
+		nodeName        string
+		hostname        string
+		sidecar         bool
+		expectedWarning bool
+	}{
+		{
+			name:      "check disabled",
+			aesmdPods: []client.Object{unreadyPod},
+		},
+		{
+			name:      "ready aesmd pod on the node",
+			selector:  "app=intel-sgx-aesmd",
+			aesmdPods: []client.Object{readyPod, unreadyPod},
+			nodeName:  "node-1",
+		},
+		{
+			name:            "unready aesmd pod on the node",
+			selector:        "app=intel-sgx-aesmd",
+			aesmdPods:       []client.Object{readyPod, unreadyPod},
+			nodeName:        "node-2",
+			expectedWarning: true,
+		},
+		{
+			name:            "no aesmd pod on the pinned node",
+			selector:        "app=intel-sgx-aesmd",
+			aesmdPods:       []client.Object{readyPod, unreadyPod},
+			hostname:        "node-3",
+			expectedWarning: true,
+		},
+		{
+			name:      "ready aesmd pod on any node",
+			selector:  "app=intel-sgx-aesmd",
+			aesmdPods: []client.Object{readyPod, unreadyPod},
+		},
+		{
+			name:            "no ready aesmd pod",
+			selector:        "app=intel-sgx-aesmd",
+			aesmdPods:       []client.Object{unreadyPod},
+			expectedWarning: true,
+		},
+		{
+			name:            "no aesmd pod",
+			selector:        "app=intel-sgx-aesmd",
+			expectedWarning: true,
+		},
+		{
+			name:     "aesmd sidecar",
+			selector: "app=intel-sgx-aesmd",
+			sidecar:  true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.AesmdPodSelector = tc.selector
+			mutator.Client = fake.NewClientBuilder().WithObjects(tc.aesmdPods...).Build()
+
+			containers := []corev1.Container{newTestContainer("app", "1Mi")}
+			if tc.sidecar {
+				containers = append(containers, newTestContainer("aesmd", "1Mi"))
+			}
+
+			testPod := newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey}, containers...)
+			testPod.Spec.NodeName = tc.nodeName
+
+			if tc.hostname != "" {
+				testPod.Spec.NodeSelector = map[string]string{hostnameLabel: tc.hostname}
+			}
+
+			pod, resp := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			warned := false
+
+			for _, warning := range resp.Warnings {
+				if strings.Contains(warning, "no aesmd DaemonSet pod is ready") {
+					warned = true
+				}
+			}
+
+			if warned != tc.expectedWarning {
+				t.Errorf("expected aesmd DaemonSet warning %v, got %v", tc.expectedWarning, resp.Warnings)
+			}
+
+			if node := tc.nodeName + tc.hostname; warned && node != "" && !strings.Contains(strings.Join(resp.Warnings, "\n"), node) {
+				t.Errorf("expected the warning to name node %s, got %v", node, resp.Warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// nodeEpcCacheTTL is the time the largest node EPC is cached for.
+const nodeEpcCacheTTL = time.Minute
+
+// nodeEpcCache caches the largest allocatable EPC of the nodes so that
+// admission requests don't list the nodes every time.
+type nodeEpcCache struct {
+	updated time.Time
+	now     func() time.Time
+	largest int64
+	mutex   sync.Mutex
+}
+
+// get returns the largest allocatable EPC of the nodes, listing the nodes
+// if the cached value has expired.
+func (c *nodeEpcCache) get(ctx context.Context, cl client.Client) (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+
+	if !c.updated.IsZero() && now().Sub(c.updated) < nodeEpcCacheTTL {
+		return c.largest, nil
+	}
+
+	nodes := &corev1.NodeList{}
+	if err := cl.List(ctx, nodes); err != nil {
+		return 0, errors.Wrap(err, "unable to list nodes")
+	}
+
+	c.largest = 0
+
+	for _, node := range nodes.Items {
+		if size, ok := node.Status.Allocatable[epc]; ok && size.Value() > c.largest {
+			c.largest = size.Value()
+		}
+	}
+
+	c.updated = now()
+
+	return c.largest, nil
+}
+
+// podEpc returns the effective EPC request of the pod as the scheduler sees
+// it: the larger of the sum over the containers and the largest request of an
+// init container, which run one at a time before them. The EPC requested under
+// all the names in epcNames adds up.
+func podEpc(pod *corev1.Pod, epcNames []corev1.ResourceName) int64 {
+	total := int64(0)
+
+	for idx := range pod.Spec.Containers {
+		total += containerEpc(&pod.Spec.Containers[idx], epcNames)
+	}
+
+	for idx := range pod.Spec.InitContainers {
+		if size := containerEpc(&pod.Spec.InitContainers[idx], epcNames); size > total {
+			total = size
+		}
+	}
+
+	return total
+}
+
+// containerEpc returns the EPC limit of the container under the names in epcNames.
+func containerEpc(container *corev1.Container, epcNames []corev1.ResourceName) int64 {
+	total := int64(0)
+
+	for _, name := range epcNames {
+		if size, ok := container.Resources.Limits[name]; ok {
+			total += size.Value()
+		}
+	}
+
+	return total
+}
+
+// validateEpcCapacity rejects pods requesting more EPC than the largest node
+// has, as they would never be scheduled.
+func validateEpcCapacity(pod *corev1.Pod, epcNames []corev1.ResourceName, largest int64) error {
+	if requested := podEpc(pod, epcNames); requested > largest {
+		return errors.Errorf("the pod requests %s of %s but the largest node has %s",
+			canonicalEpc(requested), epc, canonicalEpc(largest))
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestNode(name, epcSize string) client.Object {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{},
+		},
+	}
+
+	if epcSize != "" {
+		node.Status.Allocatable[epc] = resource.MustParse(epcSize)
+	}
+
+	return node
+}
+
+func TestRejectUnschedulableEpc(t *testing.T) {
+	tcases := []struct {
+		name            string
+		nodes           []client.Object
+		initContainers  []corev1.Container
+		containers      []corev1.Container
+		epcNames        []string
+		disabled        bool
+		expectedAllowed bool
+	}{
+		{
+			name:            "a node has enough EPC",
+			nodes:           []client.Object{newTestNode("small", "64Mi"), newTestNode("large", "256Mi")},
+			containers:      []corev1.Container{newTestContainer("app", "128Mi"), newTestContainer("sidecar", "128Mi")},
+			expectedAllowed: true,
+		},
+		{
+			name:            "no node has enough EPC",
+			nodes:           []client.Object{newTestNode("small", "64Mi"), newTestNode("large", "256Mi")},
+			containers:      []corev1.Container{newTestContainer("app", "256Mi"), newTestContainer("sidecar", "1Mi")},
+			expectedAllowed: false,
+		},
+		{
+			name:            "no SGX nodes",
+			nodes:           []client.Object{newTestNode("plain", "")},
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedAllowed: false,
+		},
+		{
+			name:            "no EPC requested",
+			nodes:           []client.Object{newTestNode("plain", "")},
+			containers:      []corev1.Container{newTestContainer("app", "")},
+			expectedAllowed: true,
+		},
+		{
+			name:            "init containers run before the containers",
+			nodes:           []client.Object{newTestNode("large", "256Mi")},
+			initContainers:  []corev1.Container{newTestContainer("init", "256Mi")},
+			containers:      []corev1.Container{newTestContainer("app", "128Mi"), newTestContainer("sidecar", "128Mi")},
+			expectedAllowed: true,
+		},
+		{
+			name:            "an init container requests too much EPC",
+			nodes:           []client.Object{newTestNode("large", "256Mi")},
+			initContainers:  []corev1.Container{newTestContainer("init", "512Mi")},
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedAllowed: false,
+		},
+		{
+			name:  "EPC requested under another name",
+			nodes: []client.Object{newTestNode("large", "256Mi")},
+			containers: []corev1.Container{
+				newTestContainer("app", "128Mi"),
+				withResource(newTestContainer("legacy", ""), "example.com/epc", "256Mi"),
+			},
+			epcNames:        []string{"example.com/epc"},
+			expectedAllowed: false,
+		},
+		{
+			name:            "disabled",
+			nodes:           []client.Object{newTestNode("small", "64Mi")},
+			containers:      []corev1.Container{newTestContainer("app", "128Mi")},
+			disabled:        true,
+			expectedAllowed: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			validator := newTestValidator(t)
+			validator.Client = fake.NewClientBuilder().WithObjects(tc.nodes...).Build()
+			validator.RejectUnschedulableEpc = !tc.disabled
+			validator.EpcResourceNames = tc.epcNames
+
+			pod := newTestPod(nil, tc.containers...)
+			pod.Spec.InitContainers = tc.initContainers
+
+			resp := validateTestPod(t, validator, pod)
+			if resp.Allowed != tc.expectedAllowed {
+				t.Errorf("expected allowed=%v, got %v: %v", tc.expectedAllowed, resp.Allowed, resp.Result)
+			}
+
+			if !resp.Allowed && (resp.Result == nil || !strings.Contains(string(resp.Result.Reason), "largest node")) {
+				t.Errorf("denied without stating the largest node EPC: %v", resp.Result)
+			}
+		})
+	}
+}
+
+func TestNodeEpcCache(t *testing.T) {
+	now := time.Now()
+	cache := &nodeEpcCache{now: func() time.Time { return now }}
+	cl := fake.NewClientBuilder().WithObjects(newTestNode("small", "64Mi")).Build()
+
+	check := func(expected string) {
+		t.Helper()
+
+		largest, err := cache.get(context.Background(), cl)
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if size := resource.MustParse(expected); largest != size.Value() {
+			t.Errorf("expected largest node EPC %s, got %d", expected, largest)
+		}
+	}
+
+	check("64Mi")
+
+	if err := cl.Create(context.Background(), newTestNode("large", "256Mi")); err != nil {
+		t.Fatalf("unable to add node: %+v", err)
+	}
+
+	check("64Mi")
+
+	now = now.Add(nodeEpcCacheTTL)
+
+	check("256Mi")
+}
@@ -0,0 +1,367 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"path"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// maxDNSNameservers is the maximum number of nameservers in a pod DNS config.
+const maxDNSNameservers = 3
+
+// MutatorConfig contains the optional settings of the Mutator. The zero value
+// keeps the default behavior.
+type MutatorConfig struct {
+	// ScrapeAnnotations are added to SGX pods unless the pod sets them already.
+	ScrapeAnnotations map[string]string
+	// HostAliases maps hostnames to IP addresses added to the /etc/hosts of SGX pods,
+	// e.g. to resolve PCCS and attestation endpoints in air-gapped clusters.
+	HostAliases map[string]string
+	// DNSNameservers and DNSSearches are set as the DNS config of SGX pods
+	// without one, e.g. to resolve PCCS with split-horizon DNS.
+	DNSNameservers []string
+	DNSSearches    []string
+	// OptOutSelector is a label selector, e.g. sgx.intel.com/mutate=false,
+	// for pods which are admitted without mutations. Pods match it with
+	// their own labels or the labels of their namespace.
+	OptOutSelector string
+	// AnnotationDefaults are the values of the forwarded annotations, e.g.
+	// sgx.intel.com/attestation-audience, used when neither the pod nor its
+	// namespace sets them.
+	AnnotationDefaults map[string]string
+	// ThreadsEnv is the environment variable set to the CPU limit of SGX
+	// containers with an integral CPU limit, for sizing enclave thread pools.
+	ThreadsEnv string
+	// EnclaveHeapEnv is the environment variable set to the enclave heap size
+	// in bytes of the SGX containers of pods setting sgx.intel.com/enclave-heap,
+	// for enclave runtimes overriding the heap size set at signing time.
+	EnclaveHeapEnv string
+	// EnclaveStackEnv is the environment variable set to the enclave stack
+	// size in bytes of the SGX containers of pods setting sgx.intel.com/enclave-stack.
+	EnclaveStackEnv string
+	// TcsCountEnv is the environment variable set to the sgx.intel.com/tcs-count
+	// of the SGX containers, for enclave runtimes with a tunable number of
+	// thread control structures.
+	TcsCountEnv string
+	// TcsCountFromCPU sets TcsCountEnv of the SGX containers of pods without
+	// the sgx.intel.com/tcs-count annotation to their integral CPU limit.
+	TcsCountFromCPU bool
+	// RuntimeEnvs are the environment variables added to the SGX containers
+	// of pods which name their enclave runtime in the sgx.intel.com/runtime
+	// annotation. The keys are of the form runtime.NAME, e.g. gramine.SGX.
+	RuntimeEnvs map[string]string
+	// EpcClasses maps size class names to the minimum total EPC size of the
+	// class, e.g. small=0,medium=64Mi,large=1Gi. The class of the total EPC
+	// size of an SGX pod is set to its sgx.intel.com/epc-class annotation.
+	EpcClasses map[string]string
+	// EpcResourceNames are resource names accepted as EPC requests besides
+	// sgx.intel.com/epc, e.g. while migrating to another resource name. The
+	// EPC requested under all of them is added up in the sgx.intel.com/epc
+	// annotation.
+	EpcResourceNames []string
+	// DefaultEpc is the EPC size, e.g. 64Mi, requested for the containers
+	// which request sgx.intel.com/enclave directly without EPC, to ease the
+	// migration of old manifests. Empty disables the conversion.
+	DefaultEpc string
+	// EpcPageSize is the EPC page size recorded in the sgx.intel.com/epc-page-size
+	// annotation of SGX pods for tools converting EPC sizes to pages.
+	EpcPageSize string
+	// ReadinessGate is the condition type of a readiness gate added to SGX pods,
+	// e.g. for a controller which sets the condition once the node is attested.
+	ReadinessGate string
+	// NodeSelector are the node labels, e.g. sgx.intel.com/capable=true,
+	// added to the node selector of SGX pods which don't select the label.
+	NodeSelector map[string]string
+	// NodeClassAnnotation is the annotation set on SGX pods to the labels of
+	// NodeSelector the webhook added, e.g. sgx.intel.com/node-class for
+	// auditing and cost allocation by the SGX node class. The annotation is
+	// removed from the other pods. Empty disables it.
+	NodeClassAnnotation string
+	// Tolerations are added to SGX pods which don't tolerate them already,
+	// e.g. for tainted SGX nodes. They are of the kubectl taint form
+	// key[=value][:effect], without a value any value is tolerated and
+	// without an effect any effect.
+	Tolerations []string
+	// PriorityClassName is set to SGX pods which don't set a priority class,
+	// e.g. to let enclave workloads preempt best-effort pods on SGX nodes.
+	PriorityClassName string
+	// DisableTokenAutomount sets automountServiceAccountToken to false for SGX
+	// pods which don't set it, to not expose the token to enclave workloads.
+	DisableTokenAutomount bool
+	// AllowedSysctls are the namespaced sysctls SGX pods may set with the
+	// sgx.intel.com/sysctls annotation, e.g. socket buffer sizes for enclave
+	// networking stacks.
+	AllowedSysctls []string
+	// ConfigHashAnnotation is the annotation set to the hash of the configuration
+	// on SGX pods, for tracing which configuration mutated a pod.
+	ConfigHashAnnotation string
+	// AesmdContainerName is the name of the aesmd sidecar container of pods
+	// using the "aesmd" quote provider which don't name it in the
+	// sgx.intel.com/aesmd-container annotation. Empty means "aesmd".
+	AesmdContainerName string
+	// AesmdSocketDir is the directory of the aesmd socket mounted to the SGX
+	// containers of pods using the "aesmd" quote provider, and the host
+	// directory of the aesmd DaemonSet socket. Empty means /var/run/aesmd.
+	AesmdSocketDir string
+	// AesmAddr is the value of SGX_AESM_ADDR set to the SGX containers of pods
+	// using the "aesmd" quote provider. Empty means "1". An aesmd socket path
+	// must be in AesmdSocketDir, e.g. /var/run/aesmd/aesm.sock.
+	AesmAddr string
+	// AesmdSocketMedium is the medium of the emptyDir volume sharing the aesmd
+	// socket with the aesmd sidecar, "Memory" or "Disk" for the default medium
+	// of the node. Empty means "Memory".
+	AesmdSocketMedium string
+	// AesmdPodSelector is a label selector of the aesmd DaemonSet pods, e.g.
+	// app=intel-sgx-aesmd. Pods mounting the socket directory of the aesmd
+	// DaemonSet are warned about if none of them is ready on their node.
+	// Empty disables the check.
+	AesmdPodSelector string
+	// CoreDumpCollectorImage is the image of the sidecar added to SGX pods
+	// setting the sgx.intel.com/core-dumps annotation to collect their
+	// enclave core dumps. Empty disables the sidecar.
+	CoreDumpCollectorImage string
+	// CoreDumpCollectorArgs are the arguments of the core dump collector.
+	CoreDumpCollectorArgs []string
+	// CoreDumpDir is the directory the core dump volume is mounted at in the
+	// SGX containers and the collector.
+	CoreDumpDir string
+}
+
+// Hash returns a short hash of the configuration which changes with any of
+// the settings. Maps are marshaled in key order, so the hash is stable.
+func (c *MutatorConfig) Hash() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// Validate checks the configuration for errors.
+func (c *MutatorConfig) Validate() error {
+	for hostname, ip := range c.HostAliases {
+		if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+			return errors.Errorf("invalid host alias hostname %q: %v", hostname, errs)
+		}
+
+		if net.ParseIP(ip) == nil {
+			return errors.Errorf("invalid host alias IP address %q for %q", ip, hostname)
+		}
+	}
+
+	if len(c.DNSNameservers) > maxDNSNameservers {
+		return errors.Errorf("at most %d DNS nameservers can be set", maxDNSNameservers)
+	}
+
+	for _, nameserver := range c.DNSNameservers {
+		if net.ParseIP(nameserver) == nil {
+			return errors.Errorf("invalid DNS nameserver %q", nameserver)
+		}
+	}
+
+	for _, search := range c.DNSSearches {
+		if errs := validation.IsDNS1123Subdomain(search); len(errs) > 0 {
+			return errors.Errorf("invalid DNS search domain %q: %v", search, errs)
+		}
+	}
+
+	if c.OptOutSelector != "" {
+		if _, err := labels.Parse(c.OptOutSelector); err != nil {
+			return errors.Wrapf(err, "invalid opt-out selector %q", c.OptOutSelector)
+		}
+	}
+
+	if c.DefaultEpc != "" {
+		if err := validateBytes(c.DefaultEpc); err != nil {
+			return errors.Wrap(err, "invalid default EPC size")
+		}
+	}
+
+	if c.EpcPageSize != "" {
+		pageSize, err := resource.ParseQuantity(c.EpcPageSize)
+		if size := pageSize.Value(); err != nil || size <= 0 || size&(size-1) != 0 {
+			return errors.Errorf("invalid EPC page size %q, must be a power of two", c.EpcPageSize)
+		}
+	}
+
+	if c.ThreadsEnv != "" {
+		if errs := validation.IsEnvVarName(c.ThreadsEnv); len(errs) > 0 {
+			return errors.Errorf("invalid threads environment variable name %q: %v", c.ThreadsEnv, errs)
+		}
+	}
+
+	if c.EnclaveHeapEnv != "" {
+		if errs := validation.IsEnvVarName(c.EnclaveHeapEnv); len(errs) > 0 {
+			return errors.Errorf("invalid enclave heap environment variable name %q: %v", c.EnclaveHeapEnv, errs)
+		}
+	}
+
+	if c.EnclaveStackEnv != "" {
+		if errs := validation.IsEnvVarName(c.EnclaveStackEnv); len(errs) > 0 {
+			return errors.Errorf("invalid enclave stack environment variable name %q: %v", c.EnclaveStackEnv, errs)
+		}
+	}
+
+	if c.TcsCountEnv != "" {
+		if errs := validation.IsEnvVarName(c.TcsCountEnv); len(errs) > 0 {
+			return errors.Errorf("invalid TCS count environment variable name %q: %v", c.TcsCountEnv, errs)
+		}
+	} else if c.TcsCountFromCPU {
+		return errors.New("TCS counts from the CPU limit require the TCS count environment variable")
+	}
+
+	if err := validateRuntimeEnvs(c.RuntimeEnvs); err != nil {
+		return err
+	}
+
+	if err := validateEpcClasses(c.EpcClasses); err != nil {
+		return err
+	}
+
+	if err := validateAllowedSysctls(c.AllowedSysctls); err != nil {
+		return err
+	}
+
+	if c.ReadinessGate != "" {
+		if errs := validation.IsQualifiedName(c.ReadinessGate); len(errs) > 0 {
+			return errors.Errorf("invalid readiness gate condition type %q: %v", c.ReadinessGate, errs)
+		}
+	}
+
+	for key, value := range c.NodeSelector {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return errors.Errorf("invalid node selector label %q: %v", key, errs)
+		}
+
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return errors.Errorf("invalid node selector value %q of %s: %v", value, key, errs)
+		}
+	}
+
+	if c.NodeClassAnnotation != "" {
+		if errs := validation.IsQualifiedName(c.NodeClassAnnotation); len(errs) > 0 {
+			return errors.Errorf("invalid node class annotation %q: %v", c.NodeClassAnnotation, errs)
+		}
+
+		if len(c.NodeSelector) == 0 {
+			return errors.New("node class annotation requires a node selector")
+		}
+	}
+
+	for _, toleration := range c.Tolerations {
+		if _, err := parseToleration(toleration); err != nil {
+			return err
+		}
+	}
+
+	if c.PriorityClassName != "" {
+		if errs := validation.IsDNS1123Subdomain(c.PriorityClassName); len(errs) > 0 {
+			return errors.Errorf("invalid priority class name %q: %v", c.PriorityClassName, errs)
+		}
+	}
+
+	if c.AesmdContainerName != "" {
+		if errs := validation.IsDNS1123Label(c.AesmdContainerName); len(errs) > 0 {
+			return errors.Errorf("invalid aesmd container name %q: %v", c.AesmdContainerName, errs)
+		}
+	}
+
+	if c.AesmdSocketDir != "" && (!path.IsAbs(c.AesmdSocketDir) || path.Clean(c.AesmdSocketDir) != c.AesmdSocketDir) {
+		return errors.Errorf("aesmd socket directory %q must be a clean absolute path", c.AesmdSocketDir)
+	}
+
+	if c.AesmdPodSelector != "" {
+		if _, err := labels.Parse(c.AesmdPodSelector); err != nil {
+			return errors.Wrapf(err, "invalid aesmd pod selector %q", c.AesmdPodSelector)
+		}
+	}
+
+	for _, name := range c.EpcResourceNames {
+		if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+			return errors.Errorf("invalid EPC resource name %q: %v", name, errs)
+		}
+
+		if name == encl || name == provision {
+			return errors.Errorf("%s can't be an EPC resource name", name)
+		}
+	}
+
+	if c.AesmdSocketMedium != "" && c.AesmdSocketMedium != string(corev1.StorageMediumMemory) && c.AesmdSocketMedium != diskMedium {
+		return errors.Errorf("invalid aesmd socket medium %q, expected %s or %s", c.AesmdSocketMedium, corev1.StorageMediumMemory, diskMedium)
+	}
+
+	if path.IsAbs(c.AesmAddr) && (path.Clean(c.AesmAddr) != c.AesmAddr || path.Dir(c.AesmAddr) != aesmdSocketDir(c.AesmdSocketDir)) {
+		return errors.Errorf("aesmd socket path %q must be in the aesmd socket directory %s", c.AesmAddr, aesmdSocketDir(c.AesmdSocketDir))
+	}
+
+	if err := validateCoreDumpDir(c.CoreDumpDir); err != nil {
+		return err
+	}
+
+	if c.ConfigHashAnnotation != "" {
+		if errs := validation.IsQualifiedName(c.ConfigHashAnnotation); len(errs) > 0 {
+			return errors.Errorf("invalid config hash annotation %q: %v", c.ConfigHashAnnotation, errs)
+		}
+	}
+
+	for key, value := range c.AnnotationDefaults {
+		forwarded, ok := findForwardedAnnotation(key)
+		if !ok {
+			return errors.Errorf("annotation %q has no default", key)
+		}
+
+		if _, err := forwarded.resolve(value); err != nil {
+			return errors.Wrapf(err, "invalid default for %s", key)
+		}
+	}
+
+	return nil
+}
+
+func validateEpcClasses(classes map[string]string) error {
+	classOf := make(map[int64]string, len(classes))
+
+	for class, value := range classes {
+		if errs := validation.IsValidLabelValue(class); class == "" || len(errs) > 0 {
+			return errors.Errorf("invalid EPC class name %q: %v", class, errs)
+		}
+
+		minSize, err := resource.ParseQuantity(value)
+		if err != nil || minSize.Sign() < 0 {
+			return errors.Errorf("invalid minimum EPC size %q for class %s", value, class)
+		}
+
+		if other, ok := classOf[minSize.Value()]; ok {
+			return errors.Errorf("EPC classes %s and %s have the same minimum size", class, other)
+		}
+
+		classOf[minSize.Value()] = class
+	}
+
+	return nil
+}
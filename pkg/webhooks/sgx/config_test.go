@@ -0,0 +1,367 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tcases := []struct {
+		name        string
+		config      MutatorConfig
+		expectedErr bool
+	}{
+		{
+			name: "empty config",
+		},
+		{
+			name: "valid host alias",
+			config: MutatorConfig{
+				HostAliases: map[string]string{"pccs.example.com": "10.0.0.10"},
+			},
+		},
+		{
+			name: "invalid host alias IP",
+			config: MutatorConfig{
+				HostAliases: map[string]string{"pccs.example.com": "10.0.0"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "invalid host alias hostname",
+			config: MutatorConfig{
+				HostAliases: map[string]string{"pccs_example": "10.0.0.10"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "invalid config hash annotation",
+			config: MutatorConfig{
+				ConfigHashAnnotation: "sgx.intel.com/webhook config",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "invalid aesmd container name",
+			config: MutatorConfig{
+				AesmdContainerName: "SGX_aesmd",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "alternative EPC resource name",
+			config: MutatorConfig{
+				EpcResourceNames: []string{"sgx.example.com/epc"},
+			},
+		},
+		{
+			name: "invalid EPC resource name",
+			config: MutatorConfig{
+				EpcResourceNames: []string{"sgx.example.com/epc size"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "enclave as EPC resource name",
+			config: MutatorConfig{
+				EpcResourceNames: []string{encl},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "disk aesmd socket medium",
+			config: MutatorConfig{
+				AesmdSocketMedium: "Disk",
+			},
+		},
+		{
+			name: "invalid aesmd socket medium",
+			config: MutatorConfig{
+				AesmdSocketMedium: "HugePages",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid node selector and tolerations",
+			config: MutatorConfig{
+				NodeSelector: map[string]string{"sgx.intel.com/capable": "true"},
+				Tolerations:  []string{"sgx.intel.com/sgx=true:NoSchedule"},
+			},
+		},
+		{
+			name: "node class annotation",
+			config: MutatorConfig{
+				NodeSelector:        map[string]string{"sgx.intel.com/capable": "true"},
+				NodeClassAnnotation: "sgx.intel.com/node-class",
+			},
+		},
+		{
+			name:        "node class annotation without a node selector",
+			config:      MutatorConfig{NodeClassAnnotation: "sgx.intel.com/node-class"},
+			expectedErr: true,
+		},
+		{
+			name: "invalid node class annotation",
+			config: MutatorConfig{
+				NodeSelector:        map[string]string{"sgx.intel.com/capable": "true"},
+				NodeClassAnnotation: "sgx.intel.com/node class",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "invalid node selector value",
+			config: MutatorConfig{
+				NodeSelector: map[string]string{"sgx.intel.com/capable": "yes please"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "invalid toleration effect",
+			config: MutatorConfig{
+				Tolerations: []string{"sgx.intel.com/sgx=true:Never"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "TCS count from the CPU limit",
+			config: MutatorConfig{
+				TcsCountEnv:     "ENCLAVE_TCS_COUNT",
+				TcsCountFromCPU: true,
+			},
+		},
+		{
+			name: "TCS count from the CPU limit without the environment variable",
+			config: MutatorConfig{
+				TcsCountFromCPU: true,
+			},
+			expectedErr: true,
+		},
+		{
+			name: "default EPC",
+			config: MutatorConfig{
+				DefaultEpc: "64Mi",
+			},
+		},
+		{
+			name: "invalid default EPC",
+			config: MutatorConfig{
+				DefaultEpc: "-1Mi",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid aesmd pod selector",
+			config: MutatorConfig{
+				AesmdPodSelector: "app=intel-sgx-aesmd",
+			},
+		},
+		{
+			name: "invalid aesmd pod selector",
+			config: MutatorConfig{
+				AesmdPodSelector: "app in (intel-sgx-aesmd",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "relative aesmd socket directory",
+			config: MutatorConfig{
+				AesmdSocketDir: "run/aesmd",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "aesmd socket path outside the socket directory",
+			config: MutatorConfig{
+				AesmdSocketDir: "/run/aesmd",
+				AesmAddr:       "/var/run/aesmd/aesm.sock",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "aesmd socket path in the socket directory",
+			config: MutatorConfig{
+				AesmdSocketDir: "/run/aesmd",
+				AesmAddr:       "/run/aesmd/aesm.sock",
+			},
+		},
+		{
+			name: "invalid core dump directory",
+			config: MutatorConfig{
+				CoreDumpDir: "var/crash/../enclave",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid allowed sysctls",
+			config: MutatorConfig{
+				AllowedSysctls: []string{"net.core.somaxconn", "kernel.shmmax"},
+			},
+		},
+		{
+			name: "node level allowed sysctl",
+			config: MutatorConfig{
+				AllowedSysctls: []string{"vm.max_map_count"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid DNS config",
+			config: MutatorConfig{
+				DNSNameservers: []string{"10.0.0.53"},
+				DNSSearches:    []string{"pccs.example.com"},
+			},
+		},
+		{
+			name: "invalid DNS nameserver",
+			config: MutatorConfig{
+				DNSNameservers: []string{"ns.example.com"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "too many DNS nameservers",
+			config: MutatorConfig{
+				DNSNameservers: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "invalid DNS search domain",
+			config: MutatorConfig{
+				DNSSearches: []string{"pccs_example"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid runtime environment variables",
+			config: MutatorConfig{
+				RuntimeEnvs: map[string]string{"gramine.SGX": "1"},
+			},
+		},
+		{
+			name: "runtime environment variable without runtime",
+			config: MutatorConfig{
+				RuntimeEnvs: map[string]string{"SGX": "1"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid EPC page size",
+			config: MutatorConfig{
+				EpcPageSize: "4Ki",
+			},
+		},
+		{
+			name: "EPC page size not a power of two",
+			config: MutatorConfig{
+				EpcPageSize: "3Ki",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid EPC classes",
+			config: MutatorConfig{
+				EpcClasses: map[string]string{"small": "0", "large": "1Gi"},
+			},
+		},
+		{
+			name: "invalid EPC class size",
+			config: MutatorConfig{
+				EpcClasses: map[string]string{"small": "tiny"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "EPC classes with the same size",
+			config: MutatorConfig{
+				EpcClasses: map[string]string{"large": "1Gi", "huge": "1024Mi"},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid readiness gate",
+			config: MutatorConfig{
+				ReadinessGate: "sgx.intel.com/attested",
+			},
+		},
+		{
+			name: "invalid readiness gate",
+			config: MutatorConfig{
+				ReadinessGate: "attested?",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid priority class name",
+			config: MutatorConfig{
+				PriorityClassName: "sgx-enclaves",
+			},
+		},
+		{
+			name: "invalid priority class name",
+			config: MutatorConfig{
+				PriorityClassName: " ",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid opt-out selector",
+			config: MutatorConfig{
+				OptOutSelector: "sgx.intel.com/mutate=false",
+			},
+		},
+		{
+			name: "invalid opt-out selector",
+			config: MutatorConfig{
+				OptOutSelector: "sgx.intel.com/mutate in (false",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid annotation default",
+			config: MutatorConfig{
+				AnnotationDefaults: map[string]string{attestationAudienceAnnotation: "https://attestation.example.com"},
+			},
+		},
+		{
+			name: "invalid annotation default",
+			config: MutatorConfig{
+				AnnotationDefaults: map[string]string{attestationAudienceAnnotation: ""},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "default for an unknown annotation",
+			config: MutatorConfig{
+				AnnotationDefaults: map[string]string{"sgx.intel.com/unknown": "value"},
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.expectedErr && err == nil {
+				t.Error("expected an error")
+			}
+
+			if !tc.expectedErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"path"
+	"strconv"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	coreDumpsAnnotation   = namespace + "/core-dumps"
+	coreDumpDirEnv        = "ENCLAVE_CORE_DUMP_DIR"
+	coreDumpVolumeName    = "enclave-core-dumps"
+	coreDumpCollectorName = "enclave-core-dump-collector"
+	defaultCoreDumpDir    = "/var/crash/enclave"
+)
+
+// addCoreDumpCollector adds the configured core dump collector sidecar to pods
+// which set the sgx.intel.com/core-dumps annotation to true. The SGX containers
+// and the sidecar share an emptyDir volume the enclave runtimes write their
+// core dumps to and the sidecar ships them off the node from. Pods having the
+// sidecar already, e.g. when the webhook is invoked again, are left untouched.
+//
+// The sidecar is appended to the pod containers, which may move them in
+// memory, so sgxContainers must not be used after this.
+func (s *Mutator) addCoreDumpCollector(pod *corev1.Pod, sgxContainers []*corev1.Container) []string {
+	value, ok := pod.Annotations[coreDumpsAnnotation]
+	if !ok {
+		return nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return []string{coreDumpsAnnotation + " must be true or false, ignoring " + value}
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	if s.CoreDumpCollectorImage == "" {
+		return []string{coreDumpsAnnotation + " is set but no core dump collector is configured"}
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name == coreDumpCollectorName {
+			return nil
+		}
+	}
+
+	dumpDir := s.CoreDumpDir
+	if dumpDir == "" {
+		dumpDir = defaultCoreDumpDir
+	}
+
+	addVolumeIfNotExists(pod, corev1.Volume{
+		Name: coreDumpVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+
+	mount := corev1.VolumeMount{
+		Name:      coreDumpVolumeName,
+		MountPath: dumpDir,
+	}
+
+	for _, container := range sgxContainers {
+		if !volumeMountExists(dumpDir, container) {
+			container.VolumeMounts = createNewVolumeMounts(container, &mount)
+		}
+
+		addEnvIfNotExists(container, coreDumpDirEnv, dumpDir)
+	}
+
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+		Name:  coreDumpCollectorName,
+		Image: s.CoreDumpCollectorImage,
+		Args:  append([]string{}, s.CoreDumpCollectorArgs...),
+		Env: []corev1.EnvVar{
+			{Name: coreDumpDirEnv, Value: dumpDir},
+		},
+		VolumeMounts: []corev1.VolumeMount{mount},
+	})
+
+	return nil
+}
+
+func validateCoreDumpDir(dumpDir string) error {
+	if dumpDir != "" && (!path.IsAbs(dumpDir) || path.Clean(dumpDir) != dumpDir) {
+		return errors.Errorf("core dump directory %q must be a clean absolute path", dumpDir)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// validateEnclaveDebug rejects pods enabling debug enclaves with the
+// sgx.intel.com/enclave-debug annotation in the namespaces matching the
+// ProductionNamespaceSelector. The memory of debug enclaves can be read by
+// the host, so they're only meant for development. Pods are rejected if the
+// namespace can't be read, as debug enclaves might be let in otherwise.
+func (v *Validator) validateEnclaveDebug(ctx context.Context, ns string, pod *corev1.Pod) error {
+	if v.ProductionNamespaceSelector == "" || normalizeBool(pod.Annotations[enclaveDebugAnnotation]) != "true" {
+		return nil
+	}
+
+	selector, err := labels.Parse(v.ProductionNamespaceSelector)
+	if err != nil {
+		return errors.Wrap(err, "invalid production namespace selector")
+	}
+
+	if ns == "" {
+		ns = pod.Namespace
+	}
+
+	if v.Client == nil || ns == "" {
+		return errors.Errorf("unable to check the namespace of the pod enabling debug enclaves with %s", enclaveDebugAnnotation)
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := v.Client.Get(ctx, client.ObjectKey{Name: ns}, namespace); err != nil {
+		return errors.Wrapf(err, "unable to check if namespace %s allows the debug enclaves of %s", ns, enclaveDebugAnnotation)
+	}
+
+	if selector.Matches(labels.Set(namespace.Labels)) {
+		return errors.Errorf("%s: debug enclaves are not protected from the host and not allowed in the production namespace %s, "+
+			"remove the annotation or use a development namespace", enclaveDebugAnnotation, ns)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	decisionSinkTimeout = 10 * time.Second
+	decisionSinkRetries = 3
+	decisionSinkBackoff = time.Second
+
+	droppedQueueFull = "queue_full"
+	droppedSinkError = "sink_error"
+
+	inProcessMode    = "in-process"
+	outOfProcessMode = "out-of-process"
+)
+
+var droppedDecisionRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sgx_webhook_dropped_decision_records_total",
+	Help: "Number of admission decision records not delivered to the decision sink.",
+}, []string{"reason"})
+
+func init() {
+	metrics.Registry.MustRegister(droppedDecisionRecords)
+}
+
+// DecisionRecord is an admission decision of an SGX pod archived to the
+// decision sink.
+type DecisionRecord struct {
+	Time      time.Time `json:"time"`
+	Webhook   string    `json:"webhook"`
+	UID       string    `json:"uid"`
+	Operation string    `json:"operation"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	// Mode is the quote generation mode of the pod, "in-process",
+	// "out-of-process" or empty if the pod doesn't generate quotes.
+	Mode      string   `json:"mode"`
+	Message   string   `json:"message,omitempty"`
+	Mutations []string `json:"mutations,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	// ProvisionContainers are the containers granted sgx.intel.com/provision
+	// and ProvisionJustification the sgx.intel.com/provision-justification
+	// of the pod, for auditing the provisioning key access.
+	ProvisionContainers    []string `json:"provisionContainers,omitempty"`
+	ProvisionJustification string   `json:"provisionJustification,omitempty"`
+	Allowed                bool     `json:"allowed"`
+}
+
+// DecisionSink posts the admission decision records as JSON to an HTTP
+// endpoint in the background. Records are queued without blocking admission
+// and dropped if the queue is full or the endpoint keeps failing.
+type DecisionSink struct {
+	client  *http.Client
+	records chan DecisionRecord
+	url     string
+	backoff time.Duration
+	retries int
+}
+
+// NewDecisionSink creates a sink posting to url with a queue of queueSize records.
+func NewDecisionSink(url string, queueSize int) *DecisionSink {
+	return &DecisionSink{
+		client:  &http.Client{Timeout: decisionSinkTimeout},
+		records: make(chan DecisionRecord, queueSize),
+		url:     url,
+		backoff: decisionSinkBackoff,
+		retries: decisionSinkRetries,
+	}
+}
+
+// Record queues the record, dropping it if the queue is full.
+func (s *DecisionSink) Record(record DecisionRecord) {
+	select {
+	case s.records <- record:
+	default:
+		droppedDecisionRecords.WithLabelValues(droppedQueueFull).Inc()
+	}
+}
+
+// Start implements controller-runtime's manager.Runnable interface. It posts
+// the queued records until ctx is done.
+func (s *DecisionSink) Start(ctx context.Context) error {
+	for {
+		select {
+		case record := <-s.records:
+			if err := s.send(ctx, record); err != nil {
+				droppedDecisionRecords.WithLabelValues(droppedSinkError).Inc()
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// NeedLeaderElection implements controller-runtime's manager.LeaderElectionRunnable
+// interface. Every webhook replica archives the decisions it makes.
+func (s *DecisionSink) NeedLeaderElection() bool {
+	return false
+}
+
+// send posts the record, retrying with an exponential backoff.
+func (s *DecisionSink) send(ctx context.Context, record DecisionRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal decision record")
+	}
+
+	backoff := s.backoff
+
+	for attempt := 0; ; attempt++ {
+		if err = s.post(ctx, body); err == nil || attempt == s.retries {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "decision record not sent")
+		}
+	}
+}
+
+func (s *DecisionSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to create decision sink request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to post decision record")
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("decision sink responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// quoteGenerationMode returns the quote generation mode set in the
+// sgx.intel.com/quote-provider annotation of the pod.
+func quoteGenerationMode(pod *corev1.Pod) string {
+	switch provider := pod.Annotations[quoteProvAnnotation]; provider {
+	case "":
+		return ""
+	case aesmdQuoteProvKey:
+		return outOfProcessMode
+	default:
+		return inProcessMode
+	}
+}
+
+// newDecisionRecord describes the response of a webhook to an admission request.
+func newDecisionRecord(webhook string, req admission.Request, pod *corev1.Pod, resp admission.Response) DecisionRecord {
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+
+	record := DecisionRecord{
+		Time:      time.Now().UTC(),
+		Webhook:   webhook,
+		UID:       string(req.UID),
+		Operation: string(req.Operation),
+		Namespace: req.Namespace,
+		Name:      name,
+		Mode:      quoteGenerationMode(pod),
+		Allowed:   resp.Allowed,
+		Warnings:  resp.Warnings,
+	}
+
+	// Denied responses carry the message in the reason.
+	if resp.Result != nil {
+		record.Message = resp.Result.Message
+		if record.Message == "" {
+			record.Message = string(resp.Result.Reason)
+		}
+	}
+
+	if names := provisionContainers(pod); len(names) > 0 {
+		record.ProvisionContainers = names
+		record.ProvisionJustification = provisionJustification(pod)
+	}
+
+	for _, patch := range resp.Patches {
+		record.Mutations = append(record.Mutations, patch.Operation+" "+patch.Path)
+	}
+
+	return record
+}
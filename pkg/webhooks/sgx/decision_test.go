@@ -0,0 +1,220 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDecisionRecord(t *testing.T) {
+	sink := NewDecisionSink("http://sink.example.com", 10)
+
+	mutator := newTestMutator(t)
+	mutator.DecisionSink = sink
+
+	testPod := newTestPod(map[string]string{
+		quoteProvAnnotation:              "sgx",
+		provisionJustificationAnnotation: "remote attestation",
+	}, newTestContainer("sgx", "1Mi"))
+
+	pod, _ := mutateTestPod(t, mutator, testPod)
+	if pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	if len(sink.records) != 1 {
+		t.Fatalf("expected 1 decision record, got %d", len(sink.records))
+	}
+
+	record := <-sink.records
+	if record.Webhook != "mutating" || record.Namespace != "test-ns" || record.Name != "test-pod" ||
+		record.Mode != inProcessMode || !record.Allowed || record.Time.IsZero() {
+		t.Errorf("unexpected decision record %+v", record)
+	}
+
+	if !reflect.DeepEqual(record.ProvisionContainers, []string{"sgx"}) || record.ProvisionJustification != "remote attestation" {
+		t.Errorf("expected the provision grant of container sgx with its justification, got %+v", record)
+	}
+
+	mutatesContainer := false
+	for _, mutation := range record.Mutations {
+		mutatesContainer = mutatesContainer || strings.HasPrefix(mutation, "add /spec/containers/0/")
+	}
+
+	if !mutatesContainer {
+		t.Errorf("container mutations are missing from %v", record.Mutations)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("unable to marshal the record: %+v", err)
+	}
+
+	fields := map[string]interface{}{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("unable to unmarshal the record: %+v", err)
+	}
+
+	for _, field := range []string{"time", "webhook", "uid", "operation", "namespace", "name", "mode", "allowed", "mutations", "provisionContainers", "provisionJustification"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("record field %q is missing: %s", field, data)
+		}
+	}
+
+	// Non-SGX pods are not recorded.
+	if pod, _ = mutateTestPod(t, mutator, newTestPod(nil, newTestContainer("other", ""))); pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	if len(sink.records) != 0 {
+		t.Errorf("non-SGX pod was recorded: %+v", <-sink.records)
+	}
+
+	// Denials are recorded with the reason.
+	validator := newTestValidator(t)
+	validator.DecisionSink = sink
+
+	deniedPod := newTestPod(map[string]string{quoteProvAnnotation: "aesmd"}, withProvision(newTestContainer("app", "1Mi")))
+	if resp := validateTestPod(t, validator, deniedPod); resp.Allowed {
+		t.Fatal("pod was not denied")
+	}
+
+	if len(sink.records) != 1 {
+		t.Fatalf("expected 1 decision record, got %d", len(sink.records))
+	}
+
+	if record = <-sink.records; record.Webhook != "validating" || record.Allowed || record.Message == "" {
+		t.Errorf("unexpected decision record %+v", record)
+	}
+}
+
+func TestDecisionSinkNonBlocking(t *testing.T) {
+	sink := NewDecisionSink("http://sink.example.com", 1)
+	dropped := testutil.ToFloat64(droppedDecisionRecords.WithLabelValues(droppedQueueFull))
+
+	done := make(chan struct{})
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			sink.Record(DecisionRecord{Name: "pod"})
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording blocked on a full queue")
+	}
+
+	if delta := testutil.ToFloat64(droppedDecisionRecords.WithLabelValues(droppedQueueFull)) - dropped; delta != 2 {
+		t.Errorf("expected 2 records dropped on a full queue, got %v", delta)
+	}
+}
+
+func TestDecisionSinkDelivery(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		requests int
+	)
+
+	received := make(chan DecisionRecord, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		failing := requests == 1 || strings.HasSuffix(r.URL.Path, "/broken")
+		mutex.Unlock()
+
+		// The first post fails and is retried.
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var record DecisionRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- record
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := NewDecisionSink(server.URL, 10)
+	sink.backoff = time.Millisecond
+
+	go func() {
+		_ = sink.Start(ctx)
+	}()
+
+	sink.Record(DecisionRecord{Name: "test-pod", Allowed: true})
+
+	select {
+	case record := <-received:
+		if record.Name != "test-pod" || !record.Allowed {
+			t.Errorf("unexpected decision record %+v", record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decision record was not delivered")
+	}
+
+	// Records are dropped when the sink keeps failing.
+	broken := NewDecisionSink(server.URL+"/broken", 10)
+	broken.backoff = time.Millisecond
+	dropped := testutil.ToFloat64(droppedDecisionRecords.WithLabelValues(droppedSinkError))
+
+	go func() {
+		_ = broken.Start(ctx)
+	}()
+
+	broken.Record(DecisionRecord{Name: "test-pod"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(droppedDecisionRecords.WithLabelValues(droppedSinkError)) == dropped {
+		if time.Now().After(deadline) {
+			t.Fatal("undeliverable decision record was not dropped")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuoteGenerationMode(t *testing.T) {
+	for provider, expected := range map[string]string{"": "", "aesmd": outOfProcessMode, "app": inProcessMode} {
+		pod := &corev1.Pod{}
+		pod.Annotations = map[string]string{quoteProvAnnotation: provider}
+
+		if mode := quoteGenerationMode(pod); mode != expected {
+			t.Errorf("expected mode %q for provider %q, got %q", expected, provider, mode)
+		}
+	}
+}
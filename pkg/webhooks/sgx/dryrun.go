@@ -0,0 +1,53 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"encoding/json"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// dryRunWarningPrefix starts the warnings describing the mutations skipped
+// in the dry-run mode.
+const dryRunWarningPrefix = "dry run: "
+
+// dryRunResponse returns a response admitting the pod as is. The patches of
+// resp are described in its warnings instead, e.g.
+// "dry run: add /spec/volumes/0 {...}".
+func dryRunResponse(resp admission.Response, log logr.Logger) admission.Response {
+	warnings := append([]string{}, resp.Warnings...)
+	mutations := make([]string, 0, len(resp.Patches))
+
+	for _, patch := range resp.Patches {
+		mutation := patch.Operation + " " + patch.Path
+		mutations = append(mutations, mutation)
+
+		if patch.Operation != "remove" {
+			if value, err := json.Marshal(patch.Value); err == nil {
+				mutation += " " + string(value)
+			}
+		}
+
+		warnings = append(warnings, dryRunWarningPrefix+mutation)
+	}
+
+	if len(mutations) > 0 {
+		log.Info("Admitted the pod without the mutations in the dry-run mode", "mutations", mutations)
+	}
+
+	return admission.Allowed("dry run, the pod was not mutated").WithWarnings(warnings...)
+}
@@ -0,0 +1,621 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	attestationAudienceAnnotation = namespace + "/attestation-audience"
+	epcCgroupAnnotation           = namespace + "/epc-cgroup"
+	memlockAnnotation             = namespace + "/memlock"
+	threadAffinityAnnotation      = namespace + "/thread-affinity"
+	tcbPolicyAnnotation           = namespace + "/tcb-policy"
+	qveEndpointAnnotation         = namespace + "/qve-endpoint"
+	noEpcSwapAnnotation           = namespace + "/no-epc-swap"
+	mrenclaveAnnotation           = namespace + "/mrenclave"
+	epcQosAnnotation              = namespace + "/epc-qos"
+	shmGroupAnnotation            = namespace + "/shm-group"
+	reportCacheTTLAnnotation      = namespace + "/report-cache-ttl"
+	enclaveHeapAnnotation         = namespace + "/enclave-heap"
+	enclaveStackAnnotation        = namespace + "/enclave-stack"
+	launchPolicyAnnotation        = namespace + "/launch-policy"
+	epcPackageAnnotation          = namespace + "/epc-package"
+	enclaveDebugAnnotation        = namespace + "/enclave-debug"
+	nonceSourceAnnotation         = namespace + "/nonce-source"
+	tcsCountAnnotation            = namespace + "/tcs-count"
+
+	unlimited = "unlimited"
+
+	// anyPackage lets the node agent place the EPC on any package.
+	anyPackage = "any"
+
+	maxPolicyRefLength = 253
+
+	// mrenclaveLength is the length of a hex encoded SHA-256 enclave measurement.
+	mrenclaveLength = 64
+
+	// maxTcsCount is the largest sgx.intel.com/tcs-count accepted.
+	maxTcsCount = 1 << 16
+
+	// maxShmGroupLength keeps the shared memory volume names valid DNS labels.
+	maxShmGroupLength = validation.DNS1123LabelMaxLength - len(shmVolumePrefix)
+)
+
+var (
+	// threadAffinityPolicies are the valid sgx.intel.com/thread-affinity values.
+	threadAffinityPolicies = []string{"spread", "pack"}
+
+	// epcQosClasses are the valid sgx.intel.com/epc-qos values.
+	epcQosClasses = []string{"guaranteed", "burstable"}
+
+	// nonceSources are the well-known sgx.intel.com/nonce-source keywords,
+	// other sources are given as URIs.
+	nonceSources = []string{"relying-party", "attestation-service", "local"}
+
+	// policyRefPattern matches policy names, versioned names, digests and URIs,
+	// e.g. "strict:v2", "sha256:6d0f..." or "https://as.example.com/policies/strict".
+	policyRefPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._~:/@+=%-]*$`)
+)
+
+// forwardedAnnotation is an annotation whose value is passed to the SGX
+// containers of a pod as an environment variable. The value is taken from
+// the pod, the pod's namespace or the webhook configuration, in that order.
+type forwardedAnnotation struct {
+	validate  func(string) error
+	normalize func(string) string
+	key       string
+	// env is the environment variable set to the value. Empty for annotations
+	// only meant for node components.
+	env string
+	// annotate tells to set the resolved value to the pod annotation too,
+	// for node agents which read it from the pod.
+	annotate bool
+	// reject tells the Validator to deny pods with an invalid value, instead
+	// of the value only being ignored with a warning.
+	reject bool
+}
+
+var forwardedAnnotations = []forwardedAnnotation{
+	{
+		key:      attestationAudienceAnnotation,
+		env:      "SGX_ATTESTATION_AUDIENCE",
+		validate: validateURI,
+	},
+	{
+		key:       epcCgroupAnnotation,
+		env:       "SGX_EPC_CGROUP",
+		normalize: normalizeName,
+		validate:  validateCgroupName,
+		annotate:  true,
+	},
+	{
+		// A hint for runtime hooks or CRI plugins which raise RLIMIT_MEMLOCK
+		// of the containers, as pod specs can't set ulimits.
+		key:       memlockAnnotation,
+		normalize: normalizeMemlock,
+		validate:  validateMemlock,
+		annotate:  true,
+	},
+	{
+		key:       threadAffinityAnnotation,
+		env:       "SGX_THREAD_AFFINITY",
+		normalize: normalizeName,
+		validate:  validateThreadAffinity,
+		reject:    true,
+	},
+	{
+		// Set to the pod annotation too for attestation sidecars reading it
+		// with the downward API.
+		key:       tcbPolicyAnnotation,
+		env:       "SGX_TCB_POLICY",
+		normalize: strings.TrimSpace,
+		validate:  validatePolicyRef,
+		annotate:  true,
+		reject:    true,
+	},
+	{
+		key:       qveEndpointAnnotation,
+		env:       "SGX_QVE_ENDPOINT",
+		normalize: strings.TrimSpace,
+		validate:  validateEndpoint,
+	},
+	{
+		// Set to the pod annotation too for node controllers pinning the
+		// EPC pages of the pod.
+		key:       noEpcSwapAnnotation,
+		env:       "SGX_NO_EPC_SWAP",
+		normalize: normalizeBool,
+		validate:  validateBool,
+		annotate:  true,
+	},
+	{
+		// Set to the pod annotation too for node controllers applying the
+		// EPC cgroup policy of the class. Not sgx.intel.com/epc-class, which
+		// is the size class set by the webhook.
+		key:       epcQosAnnotation,
+		env:       "SGX_EPC_QOS",
+		normalize: normalizeName,
+		validate:  validateEpcQos,
+		annotate:  true,
+		reject:    true,
+	},
+	{
+		// Set to the pod annotation too, so that the Validator checks the
+		// measurements taken from the namespace or the defaults as well.
+		key:       mrenclaveAnnotation,
+		env:       "SGX_MRENCLAVE",
+		normalize: normalizeName,
+		validate:  validateMrenclave,
+		annotate:  true,
+		reject:    true,
+	},
+	{
+		// Set to the pod annotation too, the shared memory volume of the
+		// group is mounted by the resolved value.
+		key:       shmGroupAnnotation,
+		env:       "SGX_SHM_GROUP",
+		normalize: normalizeName,
+		validate:  validateShmGroup,
+		annotate:  true,
+		reject:    true,
+	},
+	{
+		// Set to the pod annotation too, so that the Validator checks the
+		// policies taken from the namespace or the defaults as well.
+		key:       launchPolicyAnnotation,
+		env:       "SGX_LAUNCH_POLICY",
+		normalize: strings.TrimSpace,
+		validate:  validatePolicyRef,
+		annotate:  true,
+		reject:    true,
+	},
+	{
+		// A placement hint for node agents placing the EPC of the pod on a
+		// package (socket) of multi-package nodes, not a NUMA node.
+		key:       epcPackageAnnotation,
+		normalize: normalizePackage,
+		validate:  validatePackage,
+		annotate:  true,
+		reject:    true,
+	},
+	{
+		// Set to the pod annotation too, so that the Validator rejects debug
+		// enclaves enabled by the namespace or the defaults as well.
+		key:       enclaveDebugAnnotation,
+		env:       "SGX_ENCLAVE_DEBUG",
+		normalize: normalizeBool,
+		validate:  validateBool,
+		annotate:  true,
+		reject:    true,
+	},
+	{
+		// Where the attestation flow takes the nonce binding the quotes to
+		// a challenge from, as required by some relying parties.
+		key:       nonceSourceAnnotation,
+		env:       "SGX_NONCE_SOURCE",
+		normalize: normalizeNonceSource,
+		validate:  validateNonceSource,
+	},
+	{
+		key:       reportCacheTTLAnnotation,
+		env:       "SGX_REPORT_CACHE_TTL",
+		normalize: strings.TrimSpace,
+		validate:  validateDuration,
+	},
+	{
+		// Set to the EnclaveHeapEnv environment variable of the containers
+		// by addEnclaveHeap, which also checks it against their EPC.
+		key:       enclaveHeapAnnotation,
+		normalize: normalizeQuantity,
+		validate:  validateBytes,
+		annotate:  true,
+	},
+	{
+		// Set to the EnclaveStackEnv environment variable of the containers
+		// by addEnclaveStack.
+		key:       enclaveStackAnnotation,
+		normalize: normalizeQuantity,
+		validate:  validateBytes,
+		annotate:  true,
+	},
+	{
+		// Set to the TcsCountEnv environment variable of the containers
+		// by addTcsCount.
+		key:       tcsCountAnnotation,
+		normalize: normalizeCount,
+		validate:  validateTcsCount,
+		annotate:  true,
+	},
+}
+
+// resolve returns the normalized value or an error if it's not valid.
+func (f *forwardedAnnotation) resolve(value string) (string, error) {
+	if f.normalize != nil {
+		value = f.normalize(value)
+	}
+
+	if err := f.validate(value); err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+func findForwardedAnnotation(key string) (forwardedAnnotation, bool) {
+	for _, forwarded := range forwardedAnnotations {
+		if forwarded.key == key {
+			return forwarded, true
+		}
+	}
+
+	return forwardedAnnotation{}, false
+}
+
+// validateURI accepts absolute URIs such as "https://attestation.example.com"
+// or "api://my-service".
+func validateURI(value string) error {
+	uri, err := url.Parse(value)
+	if err != nil {
+		return errors.Wrapf(err, "%q is not a valid URI", value)
+	}
+
+	if uri.Scheme == "" || (uri.Host == "" && uri.Opaque == "") {
+		return errors.Errorf("%q is not an absolute URI", value)
+	}
+
+	return nil
+}
+
+// validateEndpoint accepts HTTP(S) URLs with a host such as
+// "https://qve.example.com:8443/verify".
+func validateEndpoint(value string) error {
+	uri, err := url.Parse(value)
+	if err != nil {
+		return errors.Wrapf(err, "%q is not a valid URL", value)
+	}
+
+	if (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" {
+		return errors.Errorf("%q is not an HTTP(S) URL", value)
+	}
+
+	return nil
+}
+
+// normalizeNonceSource lowercases the nonce source keywords, e.g. " Local",
+// and trims URIs.
+func normalizeNonceSource(value string) string {
+	value = strings.TrimSpace(value)
+
+	for _, source := range nonceSources {
+		if strings.EqualFold(value, source) {
+			return source
+		}
+	}
+
+	return value
+}
+
+// validateNonceSource accepts the nonce source keywords or the absolute URI
+// of a nonce service, e.g. "https://nonce.example.com/challenge".
+func validateNonceSource(value string) error {
+	for _, source := range nonceSources {
+		if value == source {
+			return nil
+		}
+	}
+
+	if err := validateURI(value); err != nil {
+		return errors.Errorf("%q is neither one of %v nor an absolute URI", value, nonceSources)
+	}
+
+	return nil
+}
+
+// normalizeBool returns "true" or "false" for the boolean forms accepted by
+// strconv.ParseBool, e.g. " True" or "1".
+func normalizeBool(value string) string {
+	value = strings.TrimSpace(value)
+
+	if b, err := strconv.ParseBool(value); err == nil {
+		return strconv.FormatBool(b)
+	}
+
+	return value
+}
+
+// validateBool accepts "true" and "false".
+func validateBool(value string) error {
+	if value != "true" && value != "false" {
+		return errors.Errorf("%q is neither true nor false", value)
+	}
+
+	return nil
+}
+
+// normalizeName trims and lowercases names such as " Enclaves".
+func normalizeName(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// validateCgroupName accepts names of a single cgroup directory, e.g. "enclaves".
+func validateCgroupName(value string) error {
+	if errs := validation.IsDNS1123Label(value); len(errs) > 0 {
+		return errors.Errorf("%q is not a valid cgroup name: %v", value, errs)
+	}
+
+	return nil
+}
+
+// normalizeMemlock returns "unlimited" or the canonical form of a byte quantity.
+func normalizeMemlock(value string) string {
+	value = strings.TrimSpace(value)
+
+	if strings.EqualFold(value, unlimited) {
+		return unlimited
+	}
+
+	if quantity, err := resource.ParseQuantity(value); err == nil {
+		return quantity.String()
+	}
+
+	return value
+}
+
+// validateMemlock accepts "unlimited" or a positive number of bytes, e.g. "512Mi".
+func validateMemlock(value string) error {
+	if value == unlimited {
+		return nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return errors.Errorf("%q is neither %q nor a quantity of bytes", value, unlimited)
+	}
+
+	if quantity.Sign() <= 0 || quantity.MilliValue()%1000 != 0 {
+		return errors.Errorf("%q is not a positive number of bytes", value)
+	}
+
+	return nil
+}
+
+// normalizeQuantity returns the canonical form of a quantity, e.g. "256Mi"
+// for " 262144Ki".
+func normalizeQuantity(value string) string {
+	value = strings.TrimSpace(value)
+
+	if quantity, err := resource.ParseQuantity(value); err == nil {
+		return quantity.String()
+	}
+
+	return value
+}
+
+// validateBytes accepts positive numbers of bytes, e.g. "256Mi".
+func validateBytes(value string) error {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return errors.Errorf("%q is not a quantity of bytes", value)
+	}
+
+	if quantity.Sign() <= 0 || quantity.MilliValue()%1000 != 0 {
+		return errors.Errorf("%q is not a positive number of bytes", value)
+	}
+
+	return nil
+}
+
+// normalizeCount returns the decimal form of a count, e.g. "16" for " 016".
+func normalizeCount(value string) string {
+	value = strings.TrimSpace(value)
+
+	if count, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return strconv.FormatUint(count, 10)
+	}
+
+	return value
+}
+
+// validateTcsCount accepts positive numbers of enclave thread control
+// structures, e.g. "16".
+func validateTcsCount(value string) error {
+	count, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || count == 0 || count > maxTcsCount {
+		return errors.Errorf("%q is not a TCS count between 1 and %d", value, maxTcsCount)
+	}
+
+	return nil
+}
+
+// validateThreadAffinity accepts the enclave thread placement policies.
+func validateThreadAffinity(value string) error {
+	for _, policy := range threadAffinityPolicies {
+		if value == policy {
+			return nil
+		}
+	}
+
+	return errors.Errorf("%q is not one of %v", value, threadAffinityPolicies)
+}
+
+// validateEpcQos accepts the EPC QoS classes enforced by node controllers.
+func validateEpcQos(value string) error {
+	for _, class := range epcQosClasses {
+		if value == class {
+			return nil
+		}
+	}
+
+	return errors.Errorf("%q is not one of %v", value, epcQosClasses)
+}
+
+// normalizePackage returns "any" or the decimal form of a package index,
+// e.g. "1" for " 01".
+func normalizePackage(value string) string {
+	value = normalizeName(value)
+
+	if index, err := strconv.ParseUint(value, 10, 16); err == nil {
+		return strconv.FormatUint(index, 10)
+	}
+
+	return value
+}
+
+// validatePackage accepts "any" or the index of a package, e.g. "0".
+func validatePackage(value string) error {
+	if value == anyPackage {
+		return nil
+	}
+
+	if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+		return errors.Errorf("%q is neither %q nor a package index", value, anyPackage)
+	}
+
+	return nil
+}
+
+// validatePolicyRef accepts references to the TCB policies of an attestation
+// service or to the launch control policies of the nodes, e.g. "strict:v2".
+func validatePolicyRef(value string) error {
+	if len(value) > maxPolicyRefLength || !policyRefPattern.MatchString(value) {
+		return errors.Errorf("%q is not a valid policy reference", value)
+	}
+
+	return nil
+}
+
+// validateMrenclave accepts hex encoded enclave measurements, e.g.
+// "8f4e0a6b...", in lowercase.
+func validateMrenclave(value string) error {
+	if len(value) != mrenclaveLength || strings.Trim(value, "0123456789abcdef") != "" {
+		return errors.Errorf("%q is not a hex encoded %d byte measurement", value, mrenclaveLength/2)
+	}
+
+	return nil
+}
+
+// validateShmGroup accepts shared memory group keys usable in volume names
+// and paths, e.g. "pipeline-1".
+func validateShmGroup(value string) error {
+	if errs := validation.IsDNS1123Label(value); len(errs) > 0 {
+		return errors.Errorf("%q is not a valid group key: %v", value, errs)
+	}
+
+	if len(value) > maxShmGroupLength {
+		return errors.Errorf("%q is longer than %d characters", value, maxShmGroupLength)
+	}
+
+	return nil
+}
+
+// validateDuration accepts positive durations, e.g. "10m" or "1h30m".
+func validateDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.Errorf("%q is not a duration", value)
+	}
+
+	if duration <= 0 {
+		return errors.Errorf("%q is not a positive duration", value)
+	}
+
+	return nil
+}
+
+// validateForwardedAnnotations returns an error for the first annotation of the
+// pod which has an invalid value and is rejected rather than ignored.
+func validateForwardedAnnotations(pod *corev1.Pod) error {
+	for _, forwarded := range forwardedAnnotations {
+		value, ok := pod.Annotations[forwarded.key]
+		if !ok || !forwarded.reject {
+			continue
+		}
+
+		if _, err := forwarded.resolve(value); err != nil {
+			return errors.Wrapf(err, "invalid %s", forwarded.key)
+		}
+	}
+
+	return nil
+}
+
+// namespaceAnnotations returns the annotations of the pod's namespace. Annotations
+// are optional there so failing to read them only results in a warning.
+func (s *Mutator) namespaceAnnotations(ctx context.Context, name string) (map[string]string, []string) {
+	if s.Client == nil || name == "" {
+		return nil, nil
+	}
+
+	ns := &corev1.Namespace{}
+	if err := s.Client.Get(ctx, client.ObjectKey{Name: name}, ns); err != nil {
+		return nil, []string{"unable to read the SGX annotation defaults of namespace " + name + ": " + err.Error()}
+	}
+
+	return ns.Annotations, nil
+}
+
+// forwardAnnotations sets the environment variables of the forwarded annotations
+// in the SGX containers. Environment variables set by the user are kept.
+func (s *Mutator) forwardAnnotations(ctx context.Context, ns string, pod *corev1.Pod, sgxContainers []*corev1.Container) []string {
+	nsAnnotations, warnings := s.namespaceAnnotations(ctx, ns)
+
+	for _, forwarded := range forwardedAnnotations {
+		value, ok := pod.Annotations[forwarded.key]
+		if !ok {
+			value, ok = nsAnnotations[forwarded.key]
+		}
+
+		if !ok {
+			value, ok = s.AnnotationDefaults[forwarded.key]
+		}
+
+		if !ok {
+			continue
+		}
+
+		value, err := forwarded.resolve(value)
+		if err != nil {
+			warnings = append(warnings, "ignoring "+forwarded.key+": "+err.Error())
+			continue
+		}
+
+		if forwarded.annotate {
+			pod.Annotations[forwarded.key] = value
+		}
+
+		if forwarded.env == "" {
+			continue
+		}
+
+		for _, container := range sgxContainers {
+			addEnvIfNotExists(container, forwarded.env, value)
+		}
+	}
+
+	return warnings
+}
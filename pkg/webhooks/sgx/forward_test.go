@@ -0,0 +1,436 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestMutatorWithNamespace returns a Mutator whose client knows the
+// test-ns namespace with the given annotations.
+func newTestMutatorWithNamespace(t *testing.T, annotations map[string]string) *Mutator {
+	t.Helper()
+
+	mutator := newTestMutator(t)
+	mutator.Client = fake.NewClientBuilder().WithObjects(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-ns",
+			Annotations: annotations,
+		},
+	}).Build()
+
+	return mutator
+}
+
+// forwardedAnnotationTest is a test case of a forwarded annotation.
+type forwardedAnnotationTest struct {
+	key string
+	// name tells what the case checks, the annotation is prepended.
+	name string
+	// pod, ns and flag are the values set to the pod, its namespace and
+	// the webhook defaults, unset if empty.
+	pod  string
+	ns   string
+	flag string
+	// namespace is the namespace of the pod, test-ns if empty.
+	namespace string
+	// env is the environment variable configured for the annotations which
+	// are set to a configurable one, e.g. EnclaveHeapEnv.
+	env string
+	// userEnv is the value of the environment variable set by the user.
+	userEnv string
+	// epc and cpus are the limits of the SGX container, 1Mi EPC if empty.
+	epc  string
+	cpus string
+	// selector is the production namespace selector of the Validator.
+	selector string
+	// expectedValue is the resolved value, empty if none.
+	expectedValue string
+	// expectedEnv is the value of the environment variable if it's not the
+	// resolved value, e.g. the heap size in bytes.
+	expectedEnv string
+	// allowlist is the allowlist of the Validator for the annotation.
+	allowlist []string
+	fromCPU   bool
+	// invalid tells that the value is ignored with a warning, warning that
+	// a warning is expected otherwise and denied that the Validator denies
+	// the pod otherwise.
+	invalid bool
+	warning bool
+	denied  bool
+}
+
+// configureForwardedEnv sets the environment variables of the annotations
+// which the Mutator sets to a configurable one.
+var configureForwardedEnv = map[string]func(*Mutator, string){
+	enclaveHeapAnnotation:  func(m *Mutator, env string) { m.EnclaveHeapEnv = env },
+	enclaveStackAnnotation: func(m *Mutator, env string) { m.EnclaveStackEnv = env },
+	tcsCountAnnotation:     func(m *Mutator, env string) { m.TcsCountEnv = env },
+}
+
+// configureAllowlist sets the allowlists of the Validator.
+var configureAllowlist = map[string]func(*Validator, []string){
+	mrenclaveAnnotation:    func(v *Validator, allowed []string) { v.AllowedMrenclaves = allowed },
+	launchPolicyAnnotation: func(v *Validator, allowed []string) { v.AllowedLaunchPolicies = allowed },
+}
+
+// TestForwardedAnnotations checks how each forwarded annotation is resolved
+// from the pod, its namespace and the webhook defaults and where the value
+// ends up. Invalid values are ignored with a warning, and the Validator denies
+// the pods with invalid values of the rejected annotations and the values it
+// doesn't allow.
+func TestForwardedAnnotations(t *testing.T) {
+	measurement := strings.Repeat("ab", 32)
+	other := strings.Repeat("cd", 32)
+
+	tcases := []forwardedAnnotationTest{
+		{key: attestationAudienceAnnotation, name: "flag default", flag: "https://default.example.com", expectedValue: "https://default.example.com"},
+		{key: attestationAudienceAnnotation, name: "namespace annotation overrides flag default", flag: "https://default.example.com", ns: "https://ns.example.com", expectedValue: "https://ns.example.com"},
+		{key: attestationAudienceAnnotation, name: "pod annotation overrides namespace annotation", ns: "https://ns.example.com", pod: "api://my-service", expectedValue: "api://my-service"},
+		{key: attestationAudienceAnnotation, name: "user set env is kept", pod: "https://pod.example.com", userEnv: "https://user.example.com", expectedValue: "https://pod.example.com"},
+		{key: attestationAudienceAnnotation, name: "invalid pod annotation", flag: "https://default.example.com", pod: "not a uri", invalid: true},
+		{key: epcCgroupAnnotation, name: "pod annotation", pod: "enclaves", expectedValue: "enclaves"},
+		{key: epcCgroupAnnotation, name: "normalized pod annotation", pod: " Enclaves ", expectedValue: "enclaves"},
+		{key: epcCgroupAnnotation, name: "namespace default", ns: "tenant-a", expectedValue: "tenant-a"},
+		{key: epcCgroupAnnotation, name: "invalid cgroup name", pod: "../enclaves", invalid: true},
+		{key: memlockAnnotation, name: "unlimited", pod: "unlimited", expectedValue: "unlimited"},
+		{key: memlockAnnotation, name: "normalized unlimited", pod: " Unlimited", expectedValue: "unlimited"},
+		{key: memlockAnnotation, name: "normalized quantity", pod: "524288Ki", expectedValue: "512Mi"},
+		{key: memlockAnnotation, name: "namespace default", ns: "1Gi", expectedValue: "1Gi"},
+		{key: memlockAnnotation, name: "negative quantity", pod: "-1", invalid: true},
+		{key: memlockAnnotation, name: "fractional bytes", pod: "100m", invalid: true},
+		{key: memlockAnnotation, name: "invalid value", pod: "lots", invalid: true},
+		{key: threadAffinityAnnotation, name: "normalized pod annotation", pod: "Spread", expectedValue: "spread"},
+		{key: threadAffinityAnnotation, name: "namespace default", ns: "pack", expectedValue: "pack"},
+		{key: threadAffinityAnnotation, name: "pod annotation overrides namespace default", ns: "pack", pod: "spread", expectedValue: "spread"},
+		{key: threadAffinityAnnotation, name: "invalid pod annotation", pod: "scatter", invalid: true},
+		{key: tcbPolicyAnnotation, name: "pod annotation", pod: " strict:v2 ", expectedValue: "strict:v2"},
+		{key: tcbPolicyAnnotation, name: "namespace default", ns: "https://as.example.com/policies/relaxed", expectedValue: "https://as.example.com/policies/relaxed"},
+		{key: tcbPolicyAnnotation, name: "pod annotation overrides namespace default", ns: "relaxed", pod: "strict:v2", expectedValue: "strict:v2"},
+		{key: tcbPolicyAnnotation, name: "blank pod annotation", pod: " ", invalid: true},
+		{key: tcbPolicyAnnotation, name: "invalid pod annotation", pod: "strict policy", invalid: true},
+		{key: qveEndpointAnnotation, name: "flag default", flag: "https://qve.example.com", expectedValue: "https://qve.example.com"},
+		{key: qveEndpointAnnotation, name: "namespace default", flag: "https://qve.example.com", ns: "https://qve.ns.example.com:8443/verify", expectedValue: "https://qve.ns.example.com:8443/verify"},
+		{key: qveEndpointAnnotation, name: "pod annotation overrides namespace default", ns: "https://qve.ns.example.com", pod: " http://localhost:8080 ", expectedValue: "http://localhost:8080"},
+		{key: qveEndpointAnnotation, name: "invalid pod annotation", ns: "https://qve.ns.example.com", pod: "qve.example.com", invalid: true},
+		{key: qveEndpointAnnotation, name: "non-HTTP scheme", pod: "api://qve", invalid: true},
+		{key: noEpcSwapAnnotation, name: "pod annotation", pod: "true", expectedValue: "true"},
+		{key: noEpcSwapAnnotation, name: "normalized pod annotation", pod: " True", expectedValue: "true"},
+		{key: noEpcSwapAnnotation, name: "numeric pod annotation", pod: "0", expectedValue: "false"},
+		{key: noEpcSwapAnnotation, name: "pod annotation overrides namespace default", ns: "true", pod: "false", expectedValue: "false"},
+		{key: noEpcSwapAnnotation, name: "invalid pod annotation", pod: "never", invalid: true},
+		{key: epcQosAnnotation, name: "normalized pod annotation", pod: " Guaranteed", expectedValue: "guaranteed"},
+		{key: epcQosAnnotation, name: "namespace default", ns: "burstable", expectedValue: "burstable"},
+		{key: epcQosAnnotation, name: "flag default", flag: "burstable", expectedValue: "burstable"},
+		{key: epcQosAnnotation, name: "pod annotation overrides namespace default", ns: "burstable", pod: "guaranteed", expectedValue: "guaranteed"},
+		{key: epcQosAnnotation, name: "invalid pod annotation", pod: "best-effort", invalid: true},
+		{key: mrenclaveAnnotation, name: "normalized pod annotation", pod: " " + strings.ToUpper(measurement), expectedValue: measurement},
+		{key: mrenclaveAnnotation, name: "namespace default", ns: measurement, expectedValue: measurement},
+		{key: mrenclaveAnnotation, name: "invalid measurement", pod: "abcd", invalid: true},
+		{key: mrenclaveAnnotation, name: "allowlist without an annotation", allowlist: []string{measurement}},
+		{key: mrenclaveAnnotation, name: "allowed measurement", pod: " " + strings.ToUpper(measurement), allowlist: []string{other, measurement}, expectedValue: measurement},
+		{key: mrenclaveAnnotation, name: "disallowed measurement", pod: other, allowlist: []string{measurement}, expectedValue: other, denied: true},
+		{key: mrenclaveAnnotation, name: "disallowed namespace default", ns: other, allowlist: []string{measurement}, expectedValue: other, denied: true},
+		{key: shmGroupAnnotation, name: "normalized pod annotation", pod: " Pipeline", expectedValue: "pipeline"},
+		{key: shmGroupAnnotation, name: "invalid group name", pod: "pipe_line", invalid: true},
+		{key: launchPolicyAnnotation, name: "normalized pod annotation", pod: " prod:v1 ", expectedValue: "prod:v1"},
+		{key: launchPolicyAnnotation, name: "pod annotation overrides namespace default", ns: "debug", pod: "prod:v1", expectedValue: "prod:v1"},
+		{key: launchPolicyAnnotation, name: "invalid policy", pod: "prod v1", invalid: true},
+		{key: launchPolicyAnnotation, name: "allowlist without an annotation", allowlist: []string{"prod:v1"}},
+		{key: launchPolicyAnnotation, name: "allowed policy", pod: " prod:v1 ", allowlist: []string{"debug", "prod:v1"}, expectedValue: "prod:v1"},
+		{key: launchPolicyAnnotation, name: "disallowed policy", pod: "debug", allowlist: []string{"prod:v1"}, expectedValue: "debug", denied: true},
+		{key: launchPolicyAnnotation, name: "disallowed namespace default", ns: "debug", allowlist: []string{"prod:v1"}, expectedValue: "debug", denied: true},
+		{key: launchPolicyAnnotation, name: "pod policy overrides the allowed namespace default", ns: "debug", pod: "prod:v1", allowlist: []string{"prod:v1"}, expectedValue: "prod:v1"},
+		{key: epcPackageAnnotation, name: "pod annotation", pod: "1", expectedValue: "1"},
+		{key: epcPackageAnnotation, name: "normalized index", pod: " 01", expectedValue: "1"},
+		{key: epcPackageAnnotation, name: "normalized any", pod: "Any ", expectedValue: anyPackage},
+		{key: epcPackageAnnotation, name: "namespace default", ns: "0", expectedValue: "0"},
+		{key: epcPackageAnnotation, name: "pod annotation overrides namespace default", ns: "0", pod: "any", expectedValue: anyPackage},
+		{key: epcPackageAnnotation, name: "negative index", pod: "-1", invalid: true},
+		{key: epcPackageAnnotation, name: "NUMA node list", pod: "0,1", invalid: true},
+		{key: enclaveDebugAnnotation, name: "normalized pod annotation", pod: " True", expectedValue: "true"},
+		{key: enclaveDebugAnnotation, name: "namespace default", ns: "false", expectedValue: "false"},
+		{key: enclaveDebugAnnotation, name: "invalid value", pod: "sometimes", invalid: true},
+		{key: enclaveDebugAnnotation, name: "debug enclave in a development namespace", namespace: "dev", selector: "environment=production", pod: " True", expectedValue: "true"},
+		{key: enclaveDebugAnnotation, name: "debug enclave in a production namespace", namespace: "prod", selector: "environment=production", pod: "true", expectedValue: "true", denied: true},
+		{key: enclaveDebugAnnotation, name: "production enclave in a production namespace", namespace: "prod", selector: "environment=production", pod: "false", expectedValue: "false"},
+		{key: enclaveDebugAnnotation, name: "debug enclave without a production selector", namespace: "prod", pod: "true", expectedValue: "true"},
+		{key: enclaveDebugAnnotation, name: "debug enclave in an unknown namespace", namespace: "staging", selector: "environment=production", pod: "true", expectedValue: "true", warning: true, denied: true},
+		{key: nonceSourceAnnotation, name: "flag default", flag: "relying-party", expectedValue: "relying-party"},
+		{key: nonceSourceAnnotation, name: "namespace default", flag: "relying-party", ns: " Attestation-Service", expectedValue: "attestation-service"},
+		{key: nonceSourceAnnotation, name: "pod annotation overrides namespace default", ns: "local", pod: "https://nonce.example.com/challenge ", expectedValue: "https://nonce.example.com/challenge"},
+		{key: nonceSourceAnnotation, name: "unknown keyword", ns: "local", pod: "random", invalid: true},
+		{key: nonceSourceAnnotation, name: "relative URI", pod: "/challenge", invalid: true},
+		{key: reportCacheTTLAnnotation, name: "flag default", flag: "5m", expectedValue: "5m"},
+		{key: reportCacheTTLAnnotation, name: "namespace default", flag: "5m", ns: "1h30m", expectedValue: "1h30m"},
+		{key: reportCacheTTLAnnotation, name: "pod annotation overrides namespace default", ns: "1h", pod: " 90s ", expectedValue: "90s"},
+		{key: reportCacheTTLAnnotation, name: "invalid duration", ns: "1h", pod: "10 minutes", invalid: true},
+		{key: reportCacheTTLAnnotation, name: "unitless duration", pod: "600", invalid: true},
+		{key: reportCacheTTLAnnotation, name: "negative duration", pod: "-5m", invalid: true},
+		{key: enclaveHeapAnnotation, name: "normalized pod annotation", pod: " 262144Ki", expectedValue: "256Mi"},
+		{key: enclaveHeapAnnotation, name: "namespace default", ns: "256Mi", expectedValue: "256Mi"},
+		{key: enclaveHeapAnnotation, name: "invalid quantity", pod: "256 MB", invalid: true},
+		{key: enclaveHeapAnnotation, name: "fractional bytes", pod: "0.5", invalid: true},
+		{key: enclaveHeapAnnotation, name: "zero", pod: "0", invalid: true},
+		{key: enclaveHeapAnnotation, name: "environment variable", env: "ENCLAVE_HEAP_SIZE", pod: "256Mi", epc: "512Mi", expectedValue: "256Mi", expectedEnv: "268435456"},
+		{key: enclaveHeapAnnotation, name: "configured environment variable", env: "SGX_HEAP_MAX_SIZE", pod: "1Mi", expectedValue: "1Mi", expectedEnv: "1048576"},
+		{key: enclaveHeapAnnotation, name: "environment variable without a heap size", env: "ENCLAVE_HEAP_SIZE", epc: "512Mi"},
+		{key: enclaveHeapAnnotation, name: "user set environment variable", env: "ENCLAVE_HEAP_SIZE", pod: "256Mi", epc: "512Mi", userEnv: "0x1000000", expectedValue: "256Mi"},
+		{key: enclaveHeapAnnotation, name: "heap exceeding the EPC", env: "ENCLAVE_HEAP_SIZE", pod: "1Gi", epc: "512Mi", expectedValue: "1Gi", expectedEnv: "1073741824", warning: true},
+		{key: enclaveStackAnnotation, name: "namespace default", ns: "256Ki", expectedValue: "256Ki"},
+		{key: enclaveStackAnnotation, name: "invalid quantity", pod: "8 megabytes", invalid: true},
+		{key: enclaveStackAnnotation, name: "negative size", pod: "-8Mi", invalid: true},
+		{key: enclaveStackAnnotation, name: "environment variable", env: "ENCLAVE_STACK_SIZE", pod: "8Mi", expectedValue: "8Mi", expectedEnv: "8388608"},
+		{key: enclaveStackAnnotation, name: "user set environment variable", env: "ENCLAVE_STACK_SIZE", pod: "8Mi", userEnv: "0x40000", expectedValue: "8Mi"},
+		{key: tcsCountAnnotation, name: "normalized pod annotation", pod: " 016", expectedValue: "16"},
+		{key: tcsCountAnnotation, name: "namespace default", ns: "8", expectedValue: "8"},
+		{key: tcsCountAnnotation, name: "zero count", pod: "0", invalid: true},
+		{key: tcsCountAnnotation, name: "environment variable", env: "ENCLAVE_TCS_COUNT", pod: " 016", cpus: "4", fromCPU: true, expectedValue: "16", expectedEnv: "16"},
+		{key: tcsCountAnnotation, name: "environment variable without a count", env: "ENCLAVE_TCS_COUNT", cpus: "4"},
+		{key: tcsCountAnnotation, name: "CPU limit", env: "ENCLAVE_TCS_COUNT", cpus: "4", fromCPU: true, expectedEnv: "4"},
+		{key: tcsCountAnnotation, name: "fractional CPU limit", env: "ENCLAVE_TCS_COUNT", cpus: "1500m", fromCPU: true},
+		{key: tcsCountAnnotation, name: "user set environment variable", env: "ENCLAVE_TCS_COUNT", pod: "16", userEnv: "32", expectedValue: "16"},
+		{key: tcsCountAnnotation, name: "invalid count with the CPU limit", env: "ENCLAVE_TCS_COUNT", pod: "many", cpus: "2", fromCPU: true, expectedEnv: "2", invalid: true},
+	}
+
+	tested := make(map[string]bool)
+
+	for i := range tcases {
+		tc := &tcases[i]
+		tested[tc.key] = true
+
+		t.Run(strings.TrimPrefix(tc.key, namespace+"/")+" "+tc.name, func(t *testing.T) {
+			testForwardedAnnotation(t, tc)
+		})
+	}
+
+	for _, forwarded := range forwardedAnnotations {
+		if !tested[forwarded.key] {
+			t.Errorf("no test cases for %s", forwarded.key)
+		}
+	}
+}
+
+// testForwardedAnnotation mutates and validates a pod with an SGX container
+// and a non-SGX container as the test case tells.
+func testForwardedAnnotation(t *testing.T, tc *forwardedAnnotationTest) {
+	t.Helper()
+
+	forwarded, ok := findForwardedAnnotation(tc.key)
+	if !ok {
+		t.Fatalf("%s is not forwarded", tc.key)
+	}
+
+	env := forwarded.env
+	if tc.env != "" {
+		env = tc.env
+	}
+
+	cl := fake.NewClientBuilder().WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-ns", Annotations: testAnnotation(tc.key, tc.ns)}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod", Labels: map[string]string{"environment": "production"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"environment": "development"}}},
+	).Build()
+
+	mutator := newTestMutator(t)
+	mutator.Client = cl
+	mutator.AnnotationDefaults = testAnnotation(tc.key, tc.flag)
+	mutator.TcsCountFromCPU = tc.fromCPU
+
+	if configure, ok := configureForwardedEnv[tc.key]; ok {
+		configure(mutator, tc.env)
+	}
+
+	pod, resp := mutateTestPod(t, mutator, newForwardedTestPod(tc, env))
+	if pod == nil {
+		t.Fatal("pod was not admitted by the mutator")
+	}
+
+	if hasWarning := len(resp.Warnings) > 0; hasWarning != (tc.invalid || tc.warning) {
+		t.Errorf("expected warning %v, got %v", tc.invalid || tc.warning, resp.Warnings)
+	}
+
+	// Invalid values and the values of annotations which aren't set
+	// to the pod leave the pod annotation as it was.
+	expectedAnnotation := tc.expectedValue
+	if tc.invalid || !forwarded.annotate {
+		expectedAnnotation = tc.pod
+	}
+
+	expectedEnv := tc.expectedValue
+	if tc.expectedEnv != "" || tc.env != "" {
+		expectedEnv = tc.expectedEnv
+	}
+
+	checkForwardedValue(t, tc.key, env, pod, expectedAnnotation, expectedEnv, tc.userEnv)
+
+	validateForwardedTestPod(t, tc, forwarded.reject, cl, pod)
+}
+
+// newForwardedTestPod returns the pod of the test case with an SGX container
+// and a non-SGX container. env is the environment variable of the annotation.
+func newForwardedTestPod(tc *forwardedAnnotationTest, env string) *corev1.Pod {
+	epc := "1Mi"
+	if tc.epc != "" {
+		epc = tc.epc
+	}
+
+	container := newTestContainer("sgx", epc)
+	if tc.cpus != "" {
+		container.Resources.Limits[corev1.ResourceCPU] = resource.MustParse(tc.cpus)
+	}
+
+	if tc.userEnv != "" {
+		container.Env = []corev1.EnvVar{{Name: env, Value: tc.userEnv}}
+	}
+
+	pod := newTestPod(testAnnotation(tc.key, tc.pod), container, newTestContainer("other", ""))
+	if tc.namespace != "" {
+		pod.Namespace = tc.namespace
+	}
+
+	return pod
+}
+
+// validateForwardedTestPod checks that the Validator allows the mutated pod
+// of the test case, unless the annotation is invalid and rejected or the pod
+// is expected to be denied.
+func validateForwardedTestPod(t *testing.T, tc *forwardedAnnotationTest, reject bool, cl client.Client, pod *corev1.Pod) {
+	t.Helper()
+
+	validator := newTestValidator(t)
+	validator.Client = cl
+	validator.ProductionNamespaceSelector = tc.selector
+
+	if configure, ok := configureAllowlist[tc.key]; ok {
+		configure(validator, tc.allowlist)
+	}
+
+	expectedAllowed := !tc.denied && (!tc.invalid || !reject)
+
+	resp := validateTestPod(t, validator, pod)
+	if resp.Allowed != expectedAllowed {
+		t.Errorf("expected allowed=%v, got %v: %v", expectedAllowed, resp.Allowed, resp.Result)
+	}
+
+	if !resp.Allowed && (resp.Result == nil || !strings.Contains(string(resp.Result.Reason), tc.key)) {
+		t.Errorf("expected the denial to name %s, got %v", tc.key, resp.Result)
+	}
+}
+
+func TestUnsetForwardedAnnotations(t *testing.T) {
+	pod, resp := mutateTestPod(t, newTestMutatorWithNamespace(t, nil), newTestPod(nil, newTestContainer("sgx", "1Mi")))
+	if pod == nil {
+		t.Fatal("pod was not admitted by the mutator")
+	}
+
+	if len(resp.Warnings) != 0 {
+		t.Errorf("unexpected warnings %v", resp.Warnings)
+	}
+
+	for _, forwarded := range forwardedAnnotations {
+		if value, ok := pod.Annotations[forwarded.key]; ok {
+			t.Errorf("unexpected annotation %s=%q", forwarded.key, value)
+		}
+	}
+
+	if len(pod.Spec.Containers[0].Env) != 0 {
+		t.Errorf("unexpected env %v", pod.Spec.Containers[0].Env)
+	}
+}
+
+// testAnnotation returns the annotations with the key set to the value,
+// nil if the value is empty.
+func testAnnotation(key, value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+
+	return map[string]string{key: value}
+}
+
+// checkForwardedValue checks the pod annotation and the environment variable
+// env of a mutated pod with an SGX container and a non-SGX container. The SGX
+// container gets the expected value, unless the user has set the variable.
+func checkForwardedValue(t *testing.T, key, env string, pod *corev1.Pod, expectedAnnotation, expectedValue, userEnv string) {
+	t.Helper()
+
+	if value := pod.Annotations[key]; value != expectedAnnotation {
+		t.Errorf("expected annotation %q, got %q", expectedAnnotation, value)
+	}
+
+	if env == "" {
+		if len(pod.Spec.Containers[0].Env) != 0 {
+			t.Errorf("unexpected env %v", pod.Spec.Containers[0].Env)
+		}
+
+		return
+	}
+
+	if userEnv != "" {
+		expectedValue = userEnv
+	}
+
+	expectedCount := 1
+	if expectedValue == "" {
+		expectedCount = 0
+	}
+
+	if value, count := findEnv(&pod.Spec.Containers[0], env); value != expectedValue || count != expectedCount {
+		t.Errorf("expected %d %s=%q, got %d with value %q", expectedCount, env, expectedValue, count, value)
+	}
+
+	if _, count := findEnv(&pod.Spec.Containers[1], env); count != 0 {
+		t.Errorf("%s set to a non-SGX container", env)
+	}
+}
+
+func TestValidateLaunchPolicies(t *testing.T) {
+	if err := ValidateLaunchPolicies([]string{"prod:v1", "sha256:6d0f"}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	for _, invalid := range []string{"", "prod v1", "-prod"} {
+		if err := ValidateLaunchPolicies([]string{"prod:v1", invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestNormalizeMrenclaves(t *testing.T) {
+	measurement := strings.Repeat("ab", 32)
+
+	normalized, err := NormalizeMrenclaves([]string{strings.ToUpper(measurement)})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(normalized) != 1 || normalized[0] != measurement {
+		t.Errorf("expected [%s], got %v", measurement, normalized)
+	}
+
+	for _, invalid := range []string{"", "abcd", strings.Repeat("xy", 32), measurement + "00"} {
+		if _, err := NormalizeMrenclaves([]string{measurement, invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
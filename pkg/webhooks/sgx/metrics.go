@@ -0,0 +1,90 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	emptyDirVolume = "emptyDir"
+	hostPathVolume = "hostPath"
+
+	// The types of the warnings the mutating webhook emits.
+	directResourceWarning         = "direct_resource"
+	unalignedEpcWarning           = "unaligned_epc"
+	userEnvWarning                = "user_env"
+	unknownQuoteProviderWarning   = "unknown_quote_provider"
+	provisionJustificationWarning = "provision_justification"
+	podSettingsWarning            = "pod_settings"
+	aesmdVolumeWarning            = "aesmd_volume"
+	defaultEpcWarning             = "default_epc"
+)
+
+var (
+	mutatedPods = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sgx_webhook_mutated_pods_total",
+		Help: "Number of SGX pods mutated by the quote generation mode.",
+	}, []string{"mode"})
+
+	annotatedEpcBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sgx_webhook_annotated_epc_bytes_total",
+		Help: "Sum of the sgx.intel.com/epc annotations set to the mutated pods.",
+	})
+
+	aesmdVolumes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sgx_webhook_aesmd_volumes_total",
+		Help: "Number of aesmd socket volumes added, emptyDir for aesmd sidecars and hostPath for the aesmd DaemonSet.",
+	}, []string{"type"})
+
+	mutationWarnings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sgx_webhook_warnings_total",
+		Help: "Number of warnings emitted by the mutating webhook by type.",
+	}, []string{"type"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(mutatedPods, annotatedEpcBytes, aesmdVolumes, mutationWarnings)
+}
+
+// recordMutation updates the metrics of a mutated SGX pod.
+func recordMutation(pod *corev1.Pod, totalEpc int64, vol *corev1.Volume) {
+	mutatedPods.WithLabelValues(quoteGenerationMode(pod)).Inc()
+	annotatedEpcBytes.Add(float64(totalEpc))
+
+	switch {
+	case vol == nil:
+	case vol.EmptyDir != nil:
+		aesmdVolumes.WithLabelValues(emptyDirVolume).Inc()
+	case vol.HostPath != nil:
+		aesmdVolumes.WithLabelValues(hostPathVolume).Inc()
+	}
+}
+
+// countWarnings counts the warnings of the type and returns them.
+func countWarnings(warningType string, warnings []string) []string {
+	if len(warnings) > 0 {
+		mutationWarnings.WithLabelValues(warningType).Add(float64(len(warnings)))
+	}
+
+	return warnings
+}
+
+// keepWarnings returns the warnings without counting them.
+func keepWarnings(_ string, warnings []string) []string {
+	return warnings
+}
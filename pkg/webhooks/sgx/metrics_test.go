@@ -0,0 +1,107 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+func TestMutationMetrics(t *testing.T) {
+	// The counters are shared by the tests, so only their changes are checked.
+	counters := map[string]func() float64{
+		"out-of-process pods": func() float64 { return testutil.ToFloat64(mutatedPods.WithLabelValues(outOfProcessMode)) },
+		"in-process pods":     func() float64 { return testutil.ToFloat64(mutatedPods.WithLabelValues(inProcessMode)) },
+		"epc bytes":           func() float64 { return testutil.ToFloat64(annotatedEpcBytes) },
+		"emptyDir volumes":    func() float64 { return testutil.ToFloat64(aesmdVolumes.WithLabelValues(emptyDirVolume)) },
+		"hostPath volumes":    func() float64 { return testutil.ToFloat64(aesmdVolumes.WithLabelValues(hostPathVolume)) },
+		"direct resource warnings": func() float64 {
+			return testutil.ToFloat64(mutationWarnings.WithLabelValues(directResourceWarning))
+		},
+		"unknown provider warnings": func() float64 {
+			return testutil.ToFloat64(mutationWarnings.WithLabelValues(unknownQuoteProviderWarning))
+		},
+	}
+
+	before := map[string]float64{}
+	for name, counter := range counters {
+		before[name] = counter()
+	}
+
+	pods := []*corev1.Pod{
+		// aesmd sidecar
+		newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey},
+			newTestContainer("app", "1Mi"), newTestContainer("aesmd", "1Mi")),
+		// aesmd DaemonSet
+		newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey}, newTestContainer("app", "2Mi")),
+		// in-process quote generation with an unknown provider and a
+		// directly requested sgx.intel.com/enclave of a wrong size
+		newTestPod(map[string]string{
+			quoteProvAnnotation:              "app,app9",
+			provisionJustificationAnnotation: "remote attestation",
+		}, withResource(newTestContainer("app", "4Mi"), encl, "2")),
+		// not an SGX pod
+		newTestPod(nil, newTestContainer("other", "")),
+	}
+
+	mutator := newTestMutator(t)
+
+	for _, pod := range pods {
+		if mutated, _ := mutateTestPod(t, mutator, pod); mutated == nil {
+			t.Fatalf("pod %v was not admitted", pod.Spec.Containers)
+		}
+	}
+
+	expected := map[string]float64{
+		"out-of-process pods":       2,
+		"in-process pods":           1,
+		"epc bytes":                 8 * 1024 * 1024,
+		"emptyDir volumes":          1,
+		"hostPath volumes":          1,
+		"direct resource warnings":  1,
+		"unknown provider warnings": 1,
+	}
+
+	for name, counter := range counters {
+		if delta := counter() - before[name]; delta != expected[name] {
+			t.Errorf("expected %s to grow by %v, got %v", name, expected[name], delta)
+		}
+	}
+
+	// The metrics are served from the controller-runtime registry.
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather the metrics: %+v", err)
+	}
+
+	served := map[string]bool{}
+	for _, family := range families {
+		served[family.GetName()] = true
+	}
+
+	for _, name := range []string{
+		"sgx_webhook_mutated_pods_total",
+		"sgx_webhook_annotated_epc_bytes_total",
+		"sgx_webhook_aesmd_volumes_total",
+		"sgx_webhook_warnings_total",
+	} {
+		if !served[name] {
+			t.Errorf("metric %s is not in the registry", name)
+		}
+	}
+}
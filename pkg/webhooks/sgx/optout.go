@@ -0,0 +1,52 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// optedOut tells whether the labels of the pod or its namespace match the
+// OptOutSelector, in which case the pod is admitted as is. Failing to read
+// the namespace only results in a warning and the pod is mutated.
+func (s *Mutator) optedOut(ctx context.Context, ns string, pod *corev1.Pod) (bool, []string) {
+	if s.OptOutSelector == "" {
+		return false, nil
+	}
+
+	selector, err := labels.Parse(s.OptOutSelector)
+	if err != nil {
+		return false, []string{"ignoring the SGX opt-out selector: " + err.Error()}
+	}
+
+	if selector.Matches(labels.Set(pod.Labels)) {
+		return true, nil
+	}
+
+	if s.Client == nil || ns == "" {
+		return false, nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := s.Client.Get(ctx, client.ObjectKey{Name: ns}, namespace); err != nil {
+		return false, []string{"unable to read the SGX opt-out labels of namespace " + ns + ": " + err.Error()}
+	}
+
+	return selector.Matches(labels.Set(namespace.Labels)), nil
+}
@@ -0,0 +1,561 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	logDirAnnotation     = namespace + "/log-dir"
+	enclaveLogDirEnv     = "ENCLAVE_LOG_DIR"
+	enclaveLogVolumeName = "enclave-log"
+	// shmVolumePrefix and shmDirectoryPath are the name prefix and the parent
+	// directory of the shared memory volumes of the sgx.intel.com/shm-group
+	// groups, e.g. sgx-shm-pipeline mounted at /run/sgx/shm/pipeline.
+	shmVolumePrefix  = "sgx-shm-"
+	shmDirectoryPath = "/run/sgx/shm"
+	shmDirEnv        = "SGX_SHM_DIR"
+	// tokenVolumePrefix is the name prefix of the service account token
+	// volume added by the ServiceAccount admission plugin.
+	tokenVolumePrefix = "kube-api-access-"
+	tokenMountPath    = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// mutateSgxPod applies the configured pod level mutations to pods having
+// at least one container requesting SGX resources. sgxContainers point to
+// those containers in the pod spec and ns is the namespace of the pod.
+func (s *Mutator) mutateSgxPod(ctx context.Context, ns string, pod *corev1.Pod, sgxContainers []*corev1.Container) []string {
+	warnings := make([]string, 0)
+
+	addMissingAnnotations(pod, s.ScrapeAnnotations)
+	addHostAliases(pod, s.HostAliases)
+	s.setDNSConfig(pod)
+	s.addReadinessGate(pod)
+	s.addTolerations(pod)
+
+	added, selectorWarnings := s.addNodeSelector(pod)
+	warnings = append(warnings, selectorWarnings...)
+	s.annotateNodeClass(pod, added)
+
+	warnings = append(warnings, s.addSysctls(pod)...)
+	warnings = append(warnings, addEnclaveLogDir(pod, sgxContainers)...)
+	warnings = append(warnings, s.forwardAnnotations(ctx, ns, pod, sgxContainers)...)
+
+	if s.EnclaveHeapEnv != "" {
+		warnings = append(warnings, addEnclaveHeap(pod, sgxContainers, s.EnclaveHeapEnv)...)
+	}
+
+	if s.EnclaveStackEnv != "" {
+		addEnclaveStack(pod, sgxContainers, s.EnclaveStackEnv)
+	}
+
+	if s.TcsCountEnv != "" {
+		addTcsCount(pod, sgxContainers, s.TcsCountEnv, s.TcsCountFromCPU)
+	}
+
+	addShmGroup(pod, sgxContainers)
+	warnings = append(warnings, s.addRuntimeEnvs(pod, sgxContainers)...)
+
+	if s.ThreadsEnv != "" {
+		addThreadHints(sgxContainers, s.ThreadsEnv)
+	}
+
+	warnings = append(warnings, s.setPriorityClass(ctx, pod)...)
+
+	if s.DisableTokenAutomount {
+		disableTokenAutomount(pod)
+	}
+
+	// Added last among the container mutations as it invalidates sgxContainers.
+	warnings = append(warnings, s.addCoreDumpCollector(pod, sgxContainers)...)
+
+	// Set last and overwritten so that users can't forge it.
+	if s.ConfigHashAnnotation != "" {
+		pod.Annotations[s.ConfigHashAnnotation] = s.MutatorConfig.Hash()
+	}
+
+	return warnings
+}
+
+// addMissingAnnotations adds the annotations the pod doesn't have yet.
+// Existing annotations are never overwritten.
+func addMissingAnnotations(pod *corev1.Pod, annotations map[string]string) {
+	for key, value := range annotations {
+		if _, ok := pod.Annotations[key]; !ok {
+			pod.Annotations[key] = value
+		}
+	}
+}
+
+// addEnvIfNotExists adds the environment variable to the container unless
+// the container defines it already.
+func addEnvIfNotExists(container *corev1.Container, name, value string) {
+	if envVarExists(name, container) {
+		return
+	}
+
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  name,
+		Value: value,
+	})
+}
+
+// addVolumeIfNotExists adds the volume to the pod unless a volume with the
+// same name exists already.
+func addVolumeIfNotExists(pod *corev1.Pod, volume corev1.Volume) {
+	for _, existing := range pod.Spec.Volumes {
+		if existing.Name == volume.Name {
+			return
+		}
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+}
+
+// addThreadHints sets the environment variable to the CPU limit of the
+// containers, so that enclave runtimes don't size their thread pools by the
+// CPU count of the node. Containers without a CPU limit or with a fractional
+// one are skipped.
+func addThreadHints(sgxContainers []*corev1.Container, env string) {
+	for _, container := range sgxContainers {
+		cpus, ok := container.Resources.Limits[corev1.ResourceCPU]
+		if !ok || cpus.MilliValue()%1000 != 0 || cpus.Value() <= 0 {
+			continue
+		}
+
+		addEnvIfNotExists(container, env, strconv.FormatInt(cpus.Value(), 10))
+	}
+}
+
+// enclaveSize returns the enclave size set with the annotation, e.g. the
+// sgx.intel.com/enclave-heap one. The annotation is resolved and validated
+// by forwardAnnotations, invalid values are skipped here.
+func enclaveSize(pod *corev1.Pod, annotation string) (resource.Quantity, bool) {
+	value, ok := pod.Annotations[annotation]
+	if !ok || validateBytes(value) != nil {
+		return resource.Quantity{}, false
+	}
+
+	return resource.MustParse(value), true
+}
+
+// addEnclaveHeap sets the environment variable to the enclave heap size set
+// with the sgx.intel.com/enclave-heap annotation, in bytes. Heaps larger than
+// the EPC of a container are warned about.
+func addEnclaveHeap(pod *corev1.Pod, sgxContainers []*corev1.Container, env string) []string {
+	heap, ok := enclaveSize(pod, enclaveHeapAnnotation)
+	if !ok {
+		return nil
+	}
+
+	warnings := make([]string, 0)
+
+	for _, container := range sgxContainers {
+		if size, ok := container.Resources.Limits[epc]; ok && heap.Cmp(size) > 0 {
+			warnings = append(warnings, enclaveHeapAnnotation+" "+heap.String()+" exceeds the "+size.String()+
+				" "+epc+" of container "+container.Name)
+		}
+
+		addEnvIfNotExists(container, env, strconv.FormatInt(heap.Value(), 10))
+	}
+
+	return warnings
+}
+
+// addEnclaveStack sets the environment variable to the enclave stack size set
+// with the sgx.intel.com/enclave-stack annotation, in bytes.
+func addEnclaveStack(pod *corev1.Pod, sgxContainers []*corev1.Container, env string) {
+	stack, ok := enclaveSize(pod, enclaveStackAnnotation)
+	if !ok {
+		return
+	}
+
+	for _, container := range sgxContainers {
+		addEnvIfNotExists(container, env, strconv.FormatInt(stack.Value(), 10))
+	}
+}
+
+// addTcsCount sets the environment variable to the sgx.intel.com/tcs-count of
+// the pod. Without a valid annotation and with fromCPU it's set to the CPU
+// limit of the containers like addThreadHints does.
+func addTcsCount(pod *corev1.Pod, sgxContainers []*corev1.Container, env string, fromCPU bool) {
+	if count, ok := pod.Annotations[tcsCountAnnotation]; ok && validateTcsCount(count) == nil {
+		for _, container := range sgxContainers {
+			addEnvIfNotExists(container, env, count)
+		}
+
+		return
+	}
+
+	if fromCPU {
+		addThreadHints(sgxContainers, env)
+	}
+}
+
+// addEnclaveLogDir mounts an emptyDir volume at the directory set with the
+// sgx.intel.com/log-dir annotation so that enclave logs can be collected by a sidecar.
+func addEnclaveLogDir(pod *corev1.Pod, sgxContainers []*corev1.Container) []string {
+	logDir, ok := pod.Annotations[logDirAnnotation]
+	if !ok {
+		return nil
+	}
+
+	if !path.IsAbs(logDir) || path.Clean(logDir) != logDir {
+		return []string{logDirAnnotation + " must be a clean absolute path, ignoring " + logDir}
+	}
+
+	addVolumeIfNotExists(pod, corev1.Volume{
+		Name: enclaveLogVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+
+	for _, container := range sgxContainers {
+		if !volumeMountExists(logDir, container) {
+			container.VolumeMounts = createNewVolumeMounts(container, &corev1.VolumeMount{
+				Name:      enclaveLogVolumeName,
+				MountPath: logDir,
+			})
+		}
+
+		addEnvIfNotExists(container, enclaveLogDirEnv, logDir)
+	}
+
+	return nil
+}
+
+// addShmGroup mounts a memory backed emptyDir volume of the group set with
+// the sgx.intel.com/shm-group annotation to the SGX containers, so that their
+// enclaves can share memory segments. The annotation is resolved and
+// validated by forwardAnnotations, invalid values are skipped here.
+func addShmGroup(pod *corev1.Pod, sgxContainers []*corev1.Container) {
+	group, ok := pod.Annotations[shmGroupAnnotation]
+	if !ok || validateShmGroup(group) != nil {
+		return
+	}
+
+	volumeName := shmVolumePrefix + group
+	shmDir := path.Join(shmDirectoryPath, group)
+
+	addVolumeIfNotExists(pod, corev1.Volume{
+		Name: volumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium: corev1.StorageMediumMemory,
+			},
+		},
+	})
+
+	for _, container := range sgxContainers {
+		if !volumeMountExists(shmDir, container) {
+			container.VolumeMounts = createNewVolumeMounts(container, &corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: shmDir,
+			})
+		}
+
+		addEnvIfNotExists(container, shmDirEnv, shmDir)
+	}
+}
+
+// addHostAliases merges the hostname to IP mappings to the pod's host aliases.
+// Hostnames the pod already has an alias for are left untouched.
+func addHostAliases(pod *corev1.Pod, aliases map[string]string) {
+	hostnames := make([]string, 0, len(aliases))
+
+	for hostname := range aliases {
+		hostnames = append(hostnames, hostname)
+	}
+
+	sort.Strings(hostnames)
+
+	for _, hostname := range hostnames {
+		addHostAlias(pod, hostname, aliases[hostname])
+	}
+}
+
+func addHostAlias(pod *corev1.Pod, hostname, ip string) {
+	for _, alias := range pod.Spec.HostAliases {
+		for _, existing := range alias.Hostnames {
+			if existing == hostname {
+				return
+			}
+		}
+	}
+
+	for i := range pod.Spec.HostAliases {
+		if pod.Spec.HostAliases[i].IP == ip {
+			pod.Spec.HostAliases[i].Hostnames = append(pod.Spec.HostAliases[i].Hostnames, hostname)
+			return
+		}
+	}
+
+	pod.Spec.HostAliases = append(pod.Spec.HostAliases, corev1.HostAlias{
+		IP:        ip,
+		Hostnames: []string{hostname},
+	})
+}
+
+// setDNSConfig sets the configured nameservers and search domains to pods
+// without a DNS config. A DNS config set by the user is never modified.
+func (s *Mutator) setDNSConfig(pod *corev1.Pod) {
+	if pod.Spec.DNSConfig != nil || (len(s.DNSNameservers) == 0 && len(s.DNSSearches) == 0) {
+		return
+	}
+
+	pod.Spec.DNSConfig = &corev1.PodDNSConfig{
+		Nameservers: append([]string{}, s.DNSNameservers...),
+		Searches:    append([]string{}, s.DNSSearches...),
+	}
+}
+
+// addReadinessGate adds the configured readiness gate unless the pod has it already.
+func (s *Mutator) addReadinessGate(pod *corev1.Pod) {
+	if s.ReadinessGate == "" {
+		return
+	}
+
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == corev1.PodConditionType(s.ReadinessGate) {
+			return
+		}
+	}
+
+	pod.Spec.ReadinessGates = append(pod.Spec.ReadinessGates, corev1.PodReadinessGate{
+		ConditionType: corev1.PodConditionType(s.ReadinessGate),
+	})
+}
+
+// nodeSelectorKeys returns the sorted keys of the configured node labels.
+func (s *Mutator) nodeSelectorKeys() []string {
+	keys := make([]string, 0, len(s.NodeSelector))
+
+	for key := range s.NodeSelector {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// addNodeSelector adds the configured node labels to the node selector of the
+// pod, unless the pod selects the label already, in which case the pod's own
+// value is kept and a warning is returned if it differs. It returns the keys
+// of the labels it added and the warnings.
+func (s *Mutator) addNodeSelector(pod *corev1.Pod) ([]string, []string) {
+	added := make([]string, 0, len(s.NodeSelector))
+	warnings := make([]string, 0)
+
+	for _, key := range s.nodeSelectorKeys() {
+		value := s.NodeSelector[key]
+
+		if selected, ok := pod.Spec.NodeSelector[key]; ok {
+			if selected != value {
+				warnings = append(warnings, "the pod selects nodes with "+key+"="+selected+" instead of the SGX nodes with "+key+"="+value)
+			}
+
+			continue
+		}
+
+		if pod.Spec.NodeSelector == nil {
+			pod.Spec.NodeSelector = make(map[string]string)
+		}
+
+		pod.Spec.NodeSelector[key] = value
+		added = append(added, key)
+	}
+
+	return added, warnings
+}
+
+// annotateNodeClass sets the node class annotation to the comma separated
+// label=value entries of the node labels addNodeSelector added, the keys of
+// which are added. The pod is left without the annotation if none were added.
+func (s *Mutator) annotateNodeClass(pod *corev1.Pod, added []string) {
+	if s.NodeClassAnnotation == "" || len(added) == 0 {
+		return
+	}
+
+	entries := make([]string, 0, len(added))
+
+	for _, key := range added {
+		entries = append(entries, key+"="+pod.Spec.NodeSelector[key])
+	}
+
+	pod.Annotations[s.NodeClassAnnotation] = strings.Join(entries, ",")
+}
+
+// removeNodeClass removes the node class annotation the pod came with, as
+// only the webhook sets it, and returns a warning about it. No warning is
+// returned if the pod came without it.
+func (s *Mutator) removeNodeClass(pod *corev1.Pod) []string {
+	if _, ok := pod.Annotations[s.NodeClassAnnotation]; s.NodeClassAnnotation == "" || !ok {
+		return nil
+	}
+
+	delete(pod.Annotations, s.NodeClassAnnotation)
+
+	return []string{"removed the " + s.NodeClassAnnotation + " annotation, which only the SGX webhook sets"}
+}
+
+// parseToleration parses a toleration of the kubectl taint form
+// key[=value][:effect], e.g. sgx.intel.com/sgx=true:NoSchedule.
+func parseToleration(value string) (corev1.Toleration, error) {
+	toleration := corev1.Toleration{Operator: corev1.TolerationOpExists}
+
+	spec := value
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		toleration.Effect = corev1.TaintEffect(spec[i+1:])
+		spec = spec[:i]
+
+		switch toleration.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return corev1.Toleration{}, errors.Errorf("invalid effect %q of toleration %q", toleration.Effect, value)
+		}
+	}
+
+	toleration.Key = spec
+	if i := strings.Index(spec, "="); i >= 0 {
+		toleration.Key, toleration.Value = spec[:i], spec[i+1:]
+		toleration.Operator = corev1.TolerationOpEqual
+
+		if errs := validation.IsValidLabelValue(toleration.Value); len(errs) > 0 {
+			return corev1.Toleration{}, errors.Errorf("invalid value of toleration %q: %v", value, errs)
+		}
+	}
+
+	if errs := validation.IsQualifiedName(toleration.Key); len(errs) > 0 {
+		return corev1.Toleration{}, errors.Errorf("invalid key of toleration %q: %v", value, errs)
+	}
+
+	return toleration, nil
+}
+
+// addTolerations adds the configured tolerations the pod doesn't have yet.
+// A toleration of the pod tolerating the taint of a configured toleration
+// counts too.
+func (s *Mutator) addTolerations(pod *corev1.Pod) {
+	for _, value := range s.Tolerations {
+		toleration, err := parseToleration(value)
+		if err != nil {
+			continue
+		}
+
+		if !toleratesAlready(pod.Spec.Tolerations, &toleration) {
+			pod.Spec.Tolerations = append(pod.Spec.Tolerations, toleration)
+		}
+	}
+}
+
+func toleratesAlready(tolerations []corev1.Toleration, toleration *corev1.Toleration) bool {
+	taint := &corev1.Taint{Key: toleration.Key, Value: toleration.Value, Effect: toleration.Effect}
+
+	for i := range tolerations {
+		if tolerations[i].MatchToleration(toleration) || (taint.Effect != "" && tolerations[i].ToleratesTaint(taint)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setPriorityClass sets the configured priority class to pods without one.
+// The Priority admission plugin has resolved the priority of the pod before
+// webhooks are called, so the priority and preemption policy are copied from
+// the PriorityClass here too.
+func (s *Mutator) setPriorityClass(ctx context.Context, pod *corev1.Pod) []string {
+	if s.PriorityClassName == "" || pod.Spec.PriorityClassName != "" || s.Client == nil {
+		return nil
+	}
+
+	priorityClass := &schedulingv1.PriorityClass{}
+	if err := s.Client.Get(ctx, client.ObjectKey{Name: s.PriorityClassName}, priorityClass); err != nil {
+		return []string{"unable to set priority class " + s.PriorityClassName + ": " + err.Error()}
+	}
+
+	priority := priorityClass.Value
+
+	pod.Spec.PriorityClassName = priorityClass.Name
+	pod.Spec.Priority = &priority
+	pod.Spec.PreemptionPolicy = priorityClass.PreemptionPolicy
+
+	return nil
+}
+
+// disableTokenAutomount sets automountServiceAccountToken to false unless the
+// pod sets it explicitly. The ServiceAccount admission plugin has added the token
+// volume before webhooks are called, so the volume and its mounts are removed too.
+func disableTokenAutomount(pod *corev1.Pod) {
+	if pod.Spec.AutomountServiceAccountToken != nil {
+		return
+	}
+
+	automount := false
+	pod.Spec.AutomountServiceAccountToken = &automount
+
+	volumes := make([]corev1.Volume, 0, len(pod.Spec.Volumes))
+	removed := make(map[string]bool)
+
+	for _, volume := range pod.Spec.Volumes {
+		if strings.HasPrefix(volume.Name, tokenVolumePrefix) && volume.Projected != nil {
+			removed[volume.Name] = true
+			continue
+		}
+
+		volumes = append(volumes, volume)
+	}
+
+	if len(removed) == 0 {
+		return
+	}
+
+	pod.Spec.Volumes = volumes
+
+	for i := range pod.Spec.InitContainers {
+		removeVolumeMounts(&pod.Spec.InitContainers[i], removed)
+	}
+
+	for i := range pod.Spec.Containers {
+		removeVolumeMounts(&pod.Spec.Containers[i], removed)
+	}
+}
+
+// removeVolumeMounts removes the token mounts of the volumes.
+func removeVolumeMounts(container *corev1.Container, volumes map[string]bool) {
+	mounts := make([]corev1.VolumeMount, 0, len(container.VolumeMounts))
+
+	for _, mount := range container.VolumeMounts {
+		if !volumes[mount.Name] || mount.MountPath != tokenMountPath {
+			mounts = append(mounts, mount)
+		}
+	}
+
+	container.VolumeMounts = mounts
+}
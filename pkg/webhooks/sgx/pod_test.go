@@ -0,0 +1,1198 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestScrapeAnnotations(t *testing.T) {
+	scrapeAnnotations := map[string]string{
+		"prometheus.io/scrape": "true",
+		"prometheus.io/port":   "8080",
+	}
+
+	tcases := []struct {
+		annotations map[string]string
+		expected    map[string]string
+		name        string
+		container   corev1.Container
+	}{
+		{
+			name:      "SGX pod without annotations",
+			container: newTestContainer("test", "1Mi"),
+			expected: map[string]string{
+				"prometheus.io/scrape": "true",
+				"prometheus.io/port":   "8080",
+			},
+		},
+		{
+			name: "SGX pod with existing scrape annotations",
+			annotations: map[string]string{
+				"prometheus.io/scrape": "false",
+			},
+			container: newTestContainer("test", "1Mi"),
+			expected: map[string]string{
+				"prometheus.io/scrape": "false",
+				"prometheus.io/port":   "8080",
+			},
+		},
+		{
+			name:      "non-SGX pod",
+			container: newTestContainer("test", ""),
+			expected: map[string]string{
+				"prometheus.io/scrape": "",
+				"prometheus.io/port":   "",
+			},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.ScrapeAnnotations = scrapeAnnotations
+
+			pod, _ := mutateTestPod(t, mutator, newTestPod(tc.annotations, tc.container))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			for key, value := range tc.expected {
+				if pod.Annotations[key] != value {
+					t.Errorf("expected annotation %s=%q, got %q", key, value, pod.Annotations[key])
+				}
+			}
+		})
+	}
+}
+
+func countVolumeMounts(container *corev1.Container, mountPath string) int {
+	count := 0
+
+	for _, vm := range container.VolumeMounts {
+		if vm.MountPath == mountPath {
+			count++
+		}
+	}
+
+	return count
+}
+
+func findEnv(container *corev1.Container, name string) (string, int) {
+	value, count := "", 0
+
+	for _, env := range container.Env {
+		if env.Name == name {
+			value = env.Value
+			count++
+		}
+	}
+
+	return value, count
+}
+
+func findVolume(pod *corev1.Pod, name string) (*corev1.Volume, int) {
+	var (
+		volume *corev1.Volume
+		count  int
+	)
+
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == name {
+			volume = &pod.Spec.Volumes[i]
+			count++
+		}
+	}
+
+	return volume, count
+}
+
+func TestEnclaveLogDir(t *testing.T) {
+	mutator := newTestMutator(t)
+	annotations := map[string]string{logDirAnnotation: "/var/log/enclave"}
+
+	pod, _ := mutateTestPod(t, mutator, newTestPod(annotations, newTestContainer("sgx", "1Mi"), newTestContainer("other", "")))
+	if pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	// Running the mutated pod through the webhook again must not add duplicates.
+	pod, _ = mutateTestPod(t, mutator, pod)
+	if pod == nil {
+		t.Fatal("mutated pod was not admitted")
+	}
+
+	if volume, count := findVolume(pod, enclaveLogVolumeName); count != 1 || volume.EmptyDir == nil {
+		t.Errorf("expected one emptyDir volume %s, got %d", enclaveLogVolumeName, count)
+	}
+
+	sgxContainer, otherContainer := &pod.Spec.Containers[0], &pod.Spec.Containers[1]
+
+	if count := countVolumeMounts(sgxContainer, "/var/log/enclave"); count != 1 {
+		t.Errorf("expected one log directory mount, got %d", count)
+	}
+
+	if value, count := findEnv(sgxContainer, enclaveLogDirEnv); count != 1 || value != "/var/log/enclave" {
+		t.Errorf("expected one %s=/var/log/enclave env, got %d with value %q", enclaveLogDirEnv, count, value)
+	}
+
+	if countVolumeMounts(otherContainer, "/var/log/enclave") != 0 {
+		t.Error("log directory mounted to a non-SGX container")
+	}
+
+	if _, count := findEnv(otherContainer, enclaveLogDirEnv); count != 0 {
+		t.Error("log directory env set to a non-SGX container")
+	}
+}
+
+func TestInvalidEnclaveLogDir(t *testing.T) {
+	annotations := map[string]string{logDirAnnotation: "var/log/../enclave"}
+
+	pod, resp := mutateTestPod(t, newTestMutator(t), newTestPod(annotations, newTestContainer("sgx", "1Mi")))
+	if pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	if len(resp.Warnings) != 1 {
+		t.Errorf("expected a warning, got %v", resp.Warnings)
+	}
+
+	if _, count := findVolume(pod, enclaveLogVolumeName); count != 0 {
+		t.Error("log volume added for an invalid path")
+	}
+}
+
+func TestHostAliases(t *testing.T) {
+	tcases := []struct {
+		name     string
+		existing []corev1.HostAlias
+		expected []corev1.HostAlias
+	}{
+		{
+			name: "no existing host aliases",
+			expected: []corev1.HostAlias{
+				{IP: "10.0.0.10", Hostnames: []string{"pccs.example.com"}},
+			},
+		},
+		{
+			name: "existing alias for the same IP",
+			existing: []corev1.HostAlias{
+				{IP: "10.0.0.10", Hostnames: []string{"other.example.com"}},
+			},
+			expected: []corev1.HostAlias{
+				{IP: "10.0.0.10", Hostnames: []string{"other.example.com", "pccs.example.com"}},
+			},
+		},
+		{
+			name: "existing alias for the same hostname",
+			existing: []corev1.HostAlias{
+				{IP: "192.168.0.1", Hostnames: []string{"pccs.example.com"}},
+			},
+			expected: []corev1.HostAlias{
+				{IP: "192.168.0.1", Hostnames: []string{"pccs.example.com"}},
+			},
+		},
+		{
+			name: "existing unrelated alias",
+			existing: []corev1.HostAlias{
+				{IP: "192.168.0.1", Hostnames: []string{"other.example.com"}},
+			},
+			expected: []corev1.HostAlias{
+				{IP: "192.168.0.1", Hostnames: []string{"other.example.com"}},
+				{IP: "10.0.0.10", Hostnames: []string{"pccs.example.com"}},
+			},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.HostAliases = map[string]string{"pccs.example.com": "10.0.0.10"}
+
+			testPod := newTestPod(nil, newTestContainer("test", "1Mi"))
+			testPod.Spec.HostAliases = tc.existing
+
+			pod, _ := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if !reflect.DeepEqual(pod.Spec.HostAliases, tc.expected) {
+				t.Errorf("expected host aliases %v, got %v", tc.expected, pod.Spec.HostAliases)
+			}
+		})
+	}
+}
+
+func TestPriorityClass(t *testing.T) {
+	preemptNever := corev1.PreemptNever
+	enclaveClass := &schedulingv1.PriorityClass{
+		ObjectMeta:       metav1.ObjectMeta{Name: "sgx-enclaves"},
+		Value:            1000,
+		PreemptionPolicy: &preemptNever,
+	}
+	testNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-ns"}}
+
+	tcases := []struct {
+		name               string
+		configuredClass    string
+		userClass          string
+		expectedClass      string
+		container          corev1.Container
+		expectedPriority   int32
+		expectedWarning    bool
+		expectPreemptNever bool
+	}{
+		{
+			name:      "disabled",
+			container: newTestContainer("sgx", "1Mi"),
+		},
+		{
+			name:               "SGX pod without priority class",
+			configuredClass:    "sgx-enclaves",
+			container:          newTestContainer("sgx", "1Mi"),
+			expectedClass:      "sgx-enclaves",
+			expectedPriority:   1000,
+			expectPreemptNever: true,
+		},
+		{
+			name:            "SGX pod with priority class",
+			configuredClass: "sgx-enclaves",
+			userClass:       "best-effort",
+			container:       newTestContainer("sgx", "1Mi"),
+			expectedClass:   "best-effort",
+		},
+		{
+			name:            "non-SGX pod",
+			configuredClass: "sgx-enclaves",
+			container:       newTestContainer("other", ""),
+		},
+		{
+			name:            "non-existing priority class",
+			configuredClass: "missing",
+			container:       newTestContainer("sgx", "1Mi"),
+			expectedWarning: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.Client = fake.NewClientBuilder().WithObjects(enclaveClass, testNamespace).Build()
+			mutator.PriorityClassName = tc.configuredClass
+
+			testPod := newTestPod(nil, tc.container)
+			testPod.Spec.PriorityClassName = tc.userClass
+
+			pod, resp := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if hasWarning := len(resp.Warnings) > 0; hasWarning != tc.expectedWarning {
+				t.Errorf("expected warning %v, got %v", tc.expectedWarning, resp.Warnings)
+			}
+
+			if pod.Spec.PriorityClassName != tc.expectedClass {
+				t.Errorf("expected priority class %q, got %q", tc.expectedClass, pod.Spec.PriorityClassName)
+			}
+
+			if tc.expectedPriority == 0 {
+				return
+			}
+
+			if pod.Spec.Priority == nil || *pod.Spec.Priority != tc.expectedPriority {
+				t.Errorf("expected priority %d, got %v", tc.expectedPriority, pod.Spec.Priority)
+			}
+
+			if tc.expectPreemptNever && (pod.Spec.PreemptionPolicy == nil || *pod.Spec.PreemptionPolicy != corev1.PreemptNever) {
+				t.Errorf("expected preemption policy %s, got %v", corev1.PreemptNever, pod.Spec.PreemptionPolicy)
+			}
+		})
+	}
+}
+
+func TestDisableTokenAutomount(t *testing.T) {
+	enabled, disabled := true, false
+
+	tcases := []struct {
+		userSetting      *bool
+		expectedSetting  *bool
+		name             string
+		container        corev1.Container
+		disableAutomount bool
+		expectedVolume   bool
+	}{
+		{
+			name:           "disabled",
+			container:      newTestContainer("sgx", "1Mi"),
+			expectedVolume: true,
+		},
+		{
+			name:             "SGX pod without setting",
+			container:        newTestContainer("sgx", "1Mi"),
+			disableAutomount: true,
+			expectedSetting:  &disabled,
+		},
+		{
+			name:             "SGX pod with automount enabled",
+			container:        newTestContainer("sgx", "1Mi"),
+			disableAutomount: true,
+			userSetting:      &enabled,
+			expectedSetting:  &enabled,
+			expectedVolume:   true,
+		},
+		{
+			name:             "non-SGX pod",
+			container:        newTestContainer("other", ""),
+			disableAutomount: true,
+			expectedVolume:   true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.DisableTokenAutomount = tc.disableAutomount
+
+			// The token volume is added by the ServiceAccount admission plugin before the webhook.
+			tc.container.VolumeMounts = append(tc.container.VolumeMounts, corev1.VolumeMount{
+				Name:      tokenVolumePrefix + "abcde",
+				MountPath: tokenMountPath,
+				ReadOnly:  true,
+			})
+
+			testPod := newTestPod(nil, tc.container)
+			testPod.Spec.AutomountServiceAccountToken = tc.userSetting
+			testPod.Spec.Volumes = []corev1.Volume{{
+				Name: tokenVolumePrefix + "abcde",
+				VolumeSource: corev1.VolumeSource{
+					Projected: &corev1.ProjectedVolumeSource{},
+				},
+			}}
+
+			pod, _ := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if !reflect.DeepEqual(pod.Spec.AutomountServiceAccountToken, tc.expectedSetting) {
+				t.Errorf("expected automountServiceAccountToken %v, got %v", tc.expectedSetting, pod.Spec.AutomountServiceAccountToken)
+			}
+
+			_, volumeCount := findVolume(pod, tokenVolumePrefix+"abcde")
+			mountCount := countVolumeMounts(&pod.Spec.Containers[0], tokenMountPath)
+
+			if hasVolume := volumeCount == 1 && mountCount == 1; hasVolume != tc.expectedVolume {
+				t.Errorf("expected token volume %v, got %d volumes and %d mounts", tc.expectedVolume, volumeCount, mountCount)
+			}
+		})
+	}
+}
+
+func TestDNSConfig(t *testing.T) {
+	userConfig := &corev1.PodDNSConfig{Nameservers: []string{"192.168.0.53"}}
+	webhookConfig := &corev1.PodDNSConfig{
+		Nameservers: []string{"10.0.0.53"},
+		Searches:    []string{"pccs.example.com"},
+	}
+
+	tcases := []struct {
+		userConfig *corev1.PodDNSConfig
+		expected   *corev1.PodDNSConfig
+		name       string
+		container  corev1.Container
+	}{
+		{
+			name:      "SGX pod without DNS config",
+			container: newTestContainer("sgx", "1Mi"),
+			expected:  webhookConfig,
+		},
+		{
+			name:       "SGX pod with DNS config",
+			container:  newTestContainer("sgx", "1Mi"),
+			userConfig: userConfig,
+			expected:   userConfig,
+		},
+		{
+			name:      "non-SGX pod",
+			container: newTestContainer("other", ""),
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.DNSNameservers = webhookConfig.Nameservers
+			mutator.DNSSearches = webhookConfig.Searches
+
+			testPod := newTestPod(nil, tc.container)
+			testPod.Spec.DNSConfig = tc.userConfig
+
+			pod, _ := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if !reflect.DeepEqual(pod.Spec.DNSConfig, tc.expected) {
+				t.Errorf("expected DNS config %+v, got %+v", tc.expected, pod.Spec.DNSConfig)
+			}
+		})
+	}
+}
+
+func TestReadinessGate(t *testing.T) {
+	const attested = corev1.PodConditionType("sgx.intel.com/attested")
+
+	tcases := []struct {
+		name          string
+		readinessGate string
+		userGates     []corev1.PodReadinessGate
+		container     corev1.Container
+		expectedGates int
+	}{
+		{
+			name:      "disabled",
+			container: newTestContainer("sgx", "1Mi"),
+		},
+		{
+			name:          "SGX pod",
+			readinessGate: string(attested),
+			container:     newTestContainer("sgx", "1Mi"),
+			expectedGates: 1,
+		},
+		{
+			name:          "SGX pod with the gate",
+			readinessGate: string(attested),
+			container:     newTestContainer("sgx", "1Mi"),
+			userGates:     []corev1.PodReadinessGate{{ConditionType: attested}},
+			expectedGates: 1,
+		},
+		{
+			name:          "non-SGX pod",
+			readinessGate: string(attested),
+			container:     newTestContainer("other", ""),
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.ReadinessGate = tc.readinessGate
+
+			testPod := newTestPod(nil, tc.container)
+			testPod.Spec.ReadinessGates = tc.userGates
+
+			pod, _ := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if len(pod.Spec.ReadinessGates) != tc.expectedGates {
+				t.Fatalf("expected %d readiness gates, got %v", tc.expectedGates, pod.Spec.ReadinessGates)
+			}
+
+			if tc.expectedGates > 0 && pod.Spec.ReadinessGates[0].ConditionType != attested {
+				t.Errorf("unexpected readiness gate %v", pod.Spec.ReadinessGates[0])
+			}
+		})
+	}
+}
+
+func TestNodeSelector(t *testing.T) {
+	const capable = "sgx.intel.com/capable"
+
+	tcases := []struct {
+		userSelector     map[string]string
+		nodeSelector     map[string]string
+		expectedSelector map[string]string
+		name             string
+		container        corev1.Container
+		expectedWarning  bool
+	}{
+		{
+			name:      "disabled",
+			container: newTestContainer("sgx", "1Mi"),
+		},
+		{
+			name:             "SGX pod",
+			nodeSelector:     map[string]string{capable: "true"},
+			container:        newTestContainer("sgx", "1Mi"),
+			expectedSelector: map[string]string{capable: "true"},
+		},
+		{
+			name:             "SGX pod with other labels",
+			nodeSelector:     map[string]string{capable: "true"},
+			userSelector:     map[string]string{"zone": "a"},
+			container:        newTestContainer("sgx", "1Mi"),
+			expectedSelector: map[string]string{capable: "true", "zone": "a"},
+		},
+		{
+			name:             "SGX pod selecting the label",
+			nodeSelector:     map[string]string{capable: "true"},
+			userSelector:     map[string]string{capable: "false"},
+			container:        newTestContainer("sgx", "1Mi"),
+			expectedSelector: map[string]string{capable: "false"},
+			expectedWarning:  true,
+		},
+		{
+			name:         "non-SGX pod",
+			nodeSelector: map[string]string{capable: "true"},
+			container:    newTestContainer("other", ""),
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.NodeSelector = tc.nodeSelector
+
+			testPod := newTestPod(nil, tc.container)
+			testPod.Spec.NodeSelector = tc.userSelector
+
+			pod, resp := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			// Pods submitted again are left as they are.
+			again, againResp := mutateTestPod(t, mutator, pod.DeepCopy())
+			if again == nil || len(againResp.Patches) != 0 {
+				t.Errorf("pod submitted again was mutated: %v", againResp.Patches)
+			}
+
+			expected := tc.expectedSelector
+			if expected == nil {
+				expected = tc.userSelector
+			}
+
+			if !reflect.DeepEqual(pod.Spec.NodeSelector, expected) {
+				t.Errorf("expected node selector %v, got %v", expected, pod.Spec.NodeSelector)
+			}
+
+			if hasWarning := len(resp.Warnings) > 0; hasWarning != tc.expectedWarning {
+				t.Errorf("expected warning %v, got %v", tc.expectedWarning, resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestNodeClassAnnotation(t *testing.T) {
+	const nodeClass = "sgx.intel.com/node-class"
+
+	nodeSelector := map[string]string{"sgx.intel.com/capable": "true", "sgx.intel.com/tier": "gold"}
+
+	tcases := []struct {
+		userSelector    map[string]string
+		userAnnotations map[string]string
+		podLabels       map[string]string
+		name            string
+		annotation      string
+		expectedClass   string
+		container       corev1.Container
+	}{
+		{
+			name:      "disabled",
+			container: newTestContainer("sgx", "1Mi"),
+		},
+		{
+			name:          "SGX pod",
+			annotation:    nodeClass,
+			container:     newTestContainer("sgx", "1Mi"),
+			expectedClass: "sgx.intel.com/capable=true,sgx.intel.com/tier=gold",
+		},
+		{
+			name:          "SGX pod selecting a label",
+			annotation:    nodeClass,
+			userSelector:  map[string]string{"sgx.intel.com/tier": "silver"},
+			container:     newTestContainer("sgx", "1Mi"),
+			expectedClass: "sgx.intel.com/capable=true",
+		},
+		{
+			name:         "SGX pod selecting all labels",
+			annotation:   nodeClass,
+			userSelector: map[string]string{"sgx.intel.com/capable": "true", "sgx.intel.com/tier": "silver"},
+			container:    newTestContainer("sgx", "1Mi"),
+		},
+		{
+			name:            "forged annotation",
+			annotation:      nodeClass,
+			userAnnotations: map[string]string{nodeClass: "sgx.intel.com/tier=platinum"},
+			container:       newTestContainer("sgx", "1Mi"),
+			expectedClass:   "sgx.intel.com/capable=true,sgx.intel.com/tier=gold",
+		},
+		{
+			name:            "forged annotation selecting all labels",
+			annotation:      nodeClass,
+			userSelector:    nodeSelector,
+			userAnnotations: map[string]string{nodeClass: "sgx.intel.com/tier=platinum"},
+			container:       newTestContainer("sgx", "1Mi"),
+		},
+		{
+			name:       "non-SGX pod",
+			annotation: nodeClass,
+			container:  newTestContainer("other", ""),
+		},
+		{
+			name:            "non-SGX pod with a forged annotation",
+			annotation:      nodeClass,
+			userAnnotations: map[string]string{nodeClass: "sgx.intel.com/tier=platinum"},
+			container:       newTestContainer("other", ""),
+		},
+		{
+			name:            "opted out pod with a forged annotation",
+			annotation:      nodeClass,
+			userAnnotations: map[string]string{nodeClass: "sgx.intel.com/tier=platinum"},
+			podLabels:       map[string]string{"sgx.intel.com/mutate": "false"},
+			container:       newTestContainer("sgx", "1Mi"),
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.NodeSelector = nodeSelector
+			mutator.NodeClassAnnotation = tc.annotation
+			mutator.OptOutSelector = "sgx.intel.com/mutate=false"
+
+			testPod := newTestPod(tc.userAnnotations, tc.container)
+			testPod.Labels = tc.podLabels
+			testPod.Spec.NodeSelector = tc.userSelector
+
+			pod, _ := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if class := pod.Annotations[nodeClass]; class != tc.expectedClass {
+				t.Errorf("expected node class %q, got %q", tc.expectedClass, class)
+			}
+
+			// Opted out pods are admitted as is but for the annotation.
+			if tc.podLabels != nil && len(pod.Spec.NodeSelector) > 0 {
+				t.Errorf("the opted out pod was mutated, it selects %v", pod.Spec.NodeSelector)
+			}
+
+			if tc.expectedClass == "" {
+				return
+			}
+
+			// The annotation matches the labels the pod selects.
+			for _, entry := range strings.Split(tc.expectedClass, ",") {
+				label := strings.SplitN(entry, "=", 2)
+
+				if value := pod.Spec.NodeSelector[label[0]]; value != label[1] {
+					t.Errorf("node class has %s but the pod selects %s=%s", entry, label[0], value)
+				}
+			}
+		})
+	}
+}
+
+func TestTolerations(t *testing.T) {
+	sgxToleration := corev1.Toleration{
+		Key:      "sgx.intel.com/sgx",
+		Operator: corev1.TolerationOpEqual,
+		Value:    "true",
+		Effect:   corev1.TaintEffectNoSchedule,
+	}
+
+	tcases := []struct {
+		name                string
+		tolerations         []string
+		userTolerations     []corev1.Toleration
+		container           corev1.Container
+		expectedTolerations []corev1.Toleration
+	}{
+		{
+			name:      "disabled",
+			container: newTestContainer("sgx", "1Mi"),
+		},
+		{
+			name:                "SGX pod",
+			tolerations:         []string{"sgx.intel.com/sgx=true:NoSchedule", "sgx.intel.com/maintenance"},
+			container:           newTestContainer("sgx", "1Mi"),
+			expectedTolerations: []corev1.Toleration{sgxToleration, {Key: "sgx.intel.com/maintenance", Operator: corev1.TolerationOpExists}},
+		},
+		{
+			name:                "SGX pod with the toleration",
+			tolerations:         []string{"sgx.intel.com/sgx=true:NoSchedule"},
+			userTolerations:     []corev1.Toleration{sgxToleration},
+			container:           newTestContainer("sgx", "1Mi"),
+			expectedTolerations: []corev1.Toleration{sgxToleration},
+		},
+		{
+			name:                "SGX pod tolerating the taint",
+			tolerations:         []string{"sgx.intel.com/sgx=true:NoSchedule"},
+			userTolerations:     []corev1.Toleration{{Key: "sgx.intel.com/sgx", Operator: corev1.TolerationOpExists}},
+			container:           newTestContainer("sgx", "1Mi"),
+			expectedTolerations: []corev1.Toleration{{Key: "sgx.intel.com/sgx", Operator: corev1.TolerationOpExists}},
+		},
+		{
+			name:        "non-SGX pod",
+			tolerations: []string{"sgx.intel.com/sgx=true:NoSchedule"},
+			container:   newTestContainer("other", ""),
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.Tolerations = tc.tolerations
+
+			testPod := newTestPod(nil, tc.container)
+			testPod.Spec.Tolerations = tc.userTolerations
+
+			pod, _ := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			// Pods submitted again are left as they are.
+			again, againResp := mutateTestPod(t, mutator, pod.DeepCopy())
+			if again == nil || len(againResp.Patches) != 0 {
+				t.Errorf("pod submitted again was mutated: %v", againResp.Patches)
+			}
+
+			if !reflect.DeepEqual(pod.Spec.Tolerations, tc.expectedTolerations) {
+				t.Errorf("expected tolerations %+v, got %+v", tc.expectedTolerations, pod.Spec.Tolerations)
+			}
+		})
+	}
+}
+
+func TestParseToleration(t *testing.T) {
+	for _, value := range []string{"sgx", "sgx=true", "sgx:NoExecute", "example.com/sgx=true:PreferNoSchedule"} {
+		if _, err := parseToleration(value); err != nil {
+			t.Errorf("unexpected error for %q: %+v", value, err)
+		}
+	}
+
+	for _, value := range []string{"", "=true", "sgx=true:Never", "sgx=not valid:NoSchedule", "sgx/a/b"} {
+		if _, err := parseToleration(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestThreadHints(t *testing.T) {
+	tcases := []struct {
+		name          string
+		cpuLimit      string
+		userValue     string
+		expectedValue string
+	}{
+		{
+			name:          "integral CPU limit",
+			cpuLimit:      "4",
+			expectedValue: "4",
+		},
+		{
+			name:          "integral CPU limit in millicores",
+			cpuLimit:      "2000m",
+			expectedValue: "2",
+		},
+		{
+			name:     "fractional CPU limit",
+			cpuLimit: "1500m",
+		},
+		{
+			name: "no CPU limit",
+		},
+		{
+			name:          "value set by the user",
+			cpuLimit:      "4",
+			userValue:     "2",
+			expectedValue: "2",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.ThreadsEnv = "ENCLAVE_THREADS"
+
+			container := newTestContainer("sgx", "1Mi")
+			if tc.cpuLimit != "" {
+				container.Resources.Limits[corev1.ResourceCPU] = resource.MustParse(tc.cpuLimit)
+			}
+
+			if tc.userValue != "" {
+				container.Env = []corev1.EnvVar{{Name: "ENCLAVE_THREADS", Value: tc.userValue}}
+			}
+
+			pod, _ := mutateTestPod(t, mutator, newTestPod(nil, container))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			value, count := findEnv(&pod.Spec.Containers[0], "ENCLAVE_THREADS")
+
+			if tc.expectedValue == "" && count != 0 {
+				t.Errorf("unexpected ENCLAVE_THREADS=%s", value)
+			}
+
+			if tc.expectedValue != "" && (count != 1 || value != tc.expectedValue) {
+				t.Errorf("expected one ENCLAVE_THREADS=%s env, got %d with value %q", tc.expectedValue, count, value)
+			}
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	const hashAnnotation = "sgx.intel.com/webhook-config"
+
+	hashOf := func(config MutatorConfig) string {
+		t.Helper()
+
+		mutator := newTestMutator(t)
+		mutator.MutatorConfig = config
+		mutator.ConfigHashAnnotation = hashAnnotation
+
+		pod, _ := mutateTestPod(t, mutator, newTestPod(nil, newTestContainer("sgx", "1Mi")))
+		if pod == nil {
+			t.Fatal("pod was not admitted")
+		}
+
+		hash, ok := pod.Annotations[hashAnnotation]
+		if !ok || hash == "" {
+			t.Fatalf("config hash annotation is not set: %v", pod.Annotations)
+		}
+
+		return hash
+	}
+
+	config := MutatorConfig{
+		ScrapeAnnotations: map[string]string{"prometheus.io/scrape": "true", "prometheus.io/port": "8080"},
+		ThreadsEnv:        "ENCLAVE_THREADS",
+	}
+	hash := hashOf(config)
+
+	same := MutatorConfig{
+		ScrapeAnnotations: map[string]string{"prometheus.io/port": "8080", "prometheus.io/scrape": "true"},
+		ThreadsEnv:        "ENCLAVE_THREADS",
+	}
+	if sameHash := hashOf(same); sameHash != hash {
+		t.Errorf("equal configs got different hashes %s and %s", hash, sameHash)
+	}
+
+	changed := same
+	changed.ThreadsEnv = "THREADS"
+
+	if changedHash := hashOf(changed); changedHash == hash {
+		t.Errorf("changed config got the same hash %s", hash)
+	}
+
+	// Non-SGX pods are not stamped.
+	mutator := newTestMutator(t)
+	mutator.ConfigHashAnnotation = hashAnnotation
+
+	pod, _ := mutateTestPod(t, mutator, newTestPod(nil, newTestContainer("other", "")))
+	if pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	if _, ok := pod.Annotations[hashAnnotation]; ok {
+		t.Errorf("non-SGX pod got the config hash annotation")
+	}
+}
+
+func TestSysctls(t *testing.T) {
+	tcases := []struct {
+		name             string
+		allowed          []string
+		requested        string
+		podSysctls       []corev1.Sysctl
+		expectedSysctls  []corev1.Sysctl
+		expectedWarnings int
+	}{
+		{
+			name:      "disabled",
+			requested: "net.core.somaxconn=1024",
+		},
+		{
+			name:            "allowed sysctls",
+			allowed:         []string{"net.core.somaxconn", "net.ipv4.tcp_rmem"},
+			requested:       "net.ipv4.tcp_rmem=4096 87380 6291456, net.core.somaxconn=1024",
+			expectedSysctls: []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "1024"}, {Name: "net.ipv4.tcp_rmem", Value: "4096 87380 6291456"}},
+		},
+		{
+			name:             "not allowed sysctl",
+			allowed:          []string{"net.core.somaxconn"},
+			requested:        "net.core.somaxconn=1024,kernel.shmmax=1000000",
+			expectedSysctls:  []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "1024"}},
+			expectedWarnings: 1,
+		},
+		{
+			name:             "malformed sysctl",
+			allowed:          []string{"net.core.somaxconn"},
+			requested:        "net.core.somaxconn",
+			expectedSysctls:  []corev1.Sysctl{},
+			expectedWarnings: 1,
+		},
+		{
+			name:            "sysctl set by the pod",
+			allowed:         []string{"net.core.somaxconn", "net.ipv4.tcp_rmem"},
+			requested:       "net.core.somaxconn=1024,net.ipv4.tcp_rmem=4096 87380 6291456,net.core.somaxconn=2048",
+			podSysctls:      []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "512"}},
+			expectedSysctls: []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "512"}, {Name: "net.ipv4.tcp_rmem", Value: "4096 87380 6291456"}},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.AllowedSysctls = tc.allowed
+
+			testPod := newTestPod(map[string]string{sysctlsAnnotation: tc.requested}, newTestContainer("sgx", "1Mi"))
+			if tc.podSysctls != nil {
+				testPod.Spec.SecurityContext = &corev1.PodSecurityContext{Sysctls: tc.podSysctls}
+			}
+
+			pod, resp := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			var sysctls []corev1.Sysctl
+			if pod.Spec.SecurityContext != nil {
+				sysctls = pod.Spec.SecurityContext.Sysctls
+			}
+
+			if len(sysctls) != len(tc.expectedSysctls) {
+				t.Fatalf("expected sysctls %v, got %v", tc.expectedSysctls, sysctls)
+			}
+
+			for i := range sysctls {
+				if sysctls[i] != tc.expectedSysctls[i] {
+					t.Errorf("expected sysctls %v, got %v", tc.expectedSysctls, sysctls)
+				}
+			}
+
+			if len(resp.Warnings) != tc.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", tc.expectedWarnings, resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestCoreDumpCollector(t *testing.T) {
+	tcases := []struct {
+		annotations       map[string]string
+		name              string
+		image             string
+		containers        []corev1.Container
+		expectedSidecar   bool
+		expectedWarning   bool
+		expectedDumpMount bool
+	}{
+		{
+			name:              "annotated SGX pod",
+			annotations:       map[string]string{coreDumpsAnnotation: "true"},
+			image:             "collector:latest",
+			containers:        []corev1.Container{newTestContainer("sgx", "1Mi"), newTestContainer("other", "")},
+			expectedSidecar:   true,
+			expectedDumpMount: true,
+		},
+		{
+			name:       "no annotation",
+			image:      "collector:latest",
+			containers: []corev1.Container{newTestContainer("sgx", "1Mi")},
+		},
+		{
+			name:        "disabled by annotation",
+			annotations: map[string]string{coreDumpsAnnotation: "false"},
+			image:       "collector:latest",
+			containers:  []corev1.Container{newTestContainer("sgx", "1Mi")},
+		},
+		{
+			name:        "non-SGX pod",
+			annotations: map[string]string{coreDumpsAnnotation: "true"},
+			image:       "collector:latest",
+			containers:  []corev1.Container{newTestContainer("other", "")},
+		},
+		{
+			name:            "invalid annotation",
+			annotations:     map[string]string{coreDumpsAnnotation: "always"},
+			image:           "collector:latest",
+			containers:      []corev1.Container{newTestContainer("sgx", "1Mi")},
+			expectedWarning: true,
+		},
+		{
+			name:            "no collector image",
+			annotations:     map[string]string{coreDumpsAnnotation: "true"},
+			containers:      []corev1.Container{newTestContainer("sgx", "1Mi")},
+			expectedWarning: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.CoreDumpCollectorImage = tc.image
+			mutator.CoreDumpCollectorArgs = []string{"--upload", "s3://dumps"}
+			mutator.CoreDumpDir = "/var/crash/enclave"
+
+			pod, resp := mutateTestPod(t, mutator, newTestPod(tc.annotations, tc.containers...))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if hasWarning := len(resp.Warnings) > 0; hasWarning != tc.expectedWarning {
+				t.Errorf("expected warning %v, got %v", tc.expectedWarning, resp.Warnings)
+			}
+
+			// Running the mutated pod through the webhook again must not add a second sidecar.
+			pod, _ = mutateTestPod(t, mutator, pod)
+			if pod == nil {
+				t.Fatal("mutated pod was not admitted")
+			}
+
+			var sidecars []corev1.Container
+
+			for _, container := range pod.Spec.Containers {
+				if container.Name == coreDumpCollectorName {
+					sidecars = append(sidecars, container)
+				}
+			}
+
+			if !tc.expectedSidecar {
+				if len(sidecars) != 0 {
+					t.Errorf("unexpected sidecars %v", sidecars)
+				}
+
+				if _, count := findVolume(pod, coreDumpVolumeName); count != 0 {
+					t.Error("unexpected core dump volume")
+				}
+
+				return
+			}
+
+			if len(sidecars) != 1 {
+				t.Fatalf("expected one sidecar, got %d", len(sidecars))
+			}
+
+			sidecar := &sidecars[0]
+			if sidecar.Image != tc.image || !reflect.DeepEqual(sidecar.Args, mutator.CoreDumpCollectorArgs) {
+				t.Errorf("unexpected sidecar image %q and args %v", sidecar.Image, sidecar.Args)
+			}
+
+			if volume, count := findVolume(pod, coreDumpVolumeName); count != 1 || volume.EmptyDir == nil {
+				t.Errorf("expected one emptyDir volume %s, got %d", coreDumpVolumeName, count)
+			}
+
+			for _, container := range []*corev1.Container{&pod.Spec.Containers[0], sidecar} {
+				if count := countVolumeMounts(container, "/var/crash/enclave"); count != 1 {
+					t.Errorf("expected one core dump mount in %s, got %d", container.Name, count)
+				}
+
+				if value, count := findEnv(container, coreDumpDirEnv); count != 1 || value != "/var/crash/enclave" {
+					t.Errorf("expected one %s=/var/crash/enclave env in %s, got %d with value %q", coreDumpDirEnv, container.Name, count, value)
+				}
+			}
+
+			if countVolumeMounts(&pod.Spec.Containers[1], "/var/crash/enclave") != 0 {
+				t.Error("core dump volume mounted to a non-SGX container")
+			}
+		})
+	}
+}
+
+func TestShmGroup(t *testing.T) {
+	mutator := newTestMutator(t)
+	annotations := map[string]string{shmGroupAnnotation: " Pipeline-1"}
+
+	pod, _ := mutateTestPod(t, mutator, newTestPod(annotations,
+		newTestContainer("producer", "1Mi"), newTestContainer("consumer", "1Mi"), newTestContainer("other", "")))
+	if pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	// Running the mutated pod through the webhook again must not add duplicates.
+	pod, _ = mutateTestPod(t, mutator, pod)
+	if pod == nil {
+		t.Fatal("mutated pod was not admitted")
+	}
+
+	if pod.Annotations[shmGroupAnnotation] != "pipeline-1" {
+		t.Errorf("expected %s annotation pipeline-1, got %q", shmGroupAnnotation, pod.Annotations[shmGroupAnnotation])
+	}
+
+	volume, count := findVolume(pod, "sgx-shm-pipeline-1")
+	if count != 1 || volume.EmptyDir == nil || volume.EmptyDir.Medium != corev1.StorageMediumMemory {
+		t.Fatalf("expected one memory backed emptyDir volume sgx-shm-pipeline-1, got %d", count)
+	}
+
+	// The containers of the group share the volume.
+	for i := range pod.Spec.Containers[:2] {
+		container := &pod.Spec.Containers[i]
+		mounts := 0
+
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == volume.Name && mount.MountPath == "/run/sgx/shm/pipeline-1" {
+				mounts++
+			}
+		}
+
+		if mounts != 1 {
+			t.Errorf("container %s: expected one mount of %s, got %d", container.Name, volume.Name, mounts)
+		}
+
+		if value, count := findEnv(container, "SGX_SHM_GROUP"); count != 1 || value != "pipeline-1" {
+			t.Errorf("container %s: expected one SGX_SHM_GROUP=pipeline-1 env, got %d with value %q", container.Name, count, value)
+		}
+
+		if value, count := findEnv(container, shmDirEnv); count != 1 || value != "/run/sgx/shm/pipeline-1" {
+			t.Errorf("container %s: expected one %s=/run/sgx/shm/pipeline-1 env, got %d with value %q", container.Name, shmDirEnv, count, value)
+		}
+	}
+
+	if countVolumeMounts(&pod.Spec.Containers[2], "/run/sgx/shm/pipeline-1") != 0 {
+		t.Error("shared memory mounted to a non-SGX container")
+	}
+}
+
+func TestInvalidShmGroup(t *testing.T) {
+	for _, group := range []string{"../etc", "pipeline_1", strings.Repeat("a", maxShmGroupLength+1)} {
+		annotations := map[string]string{shmGroupAnnotation: group}
+
+		pod, resp := mutateTestPod(t, newTestMutator(t), newTestPod(annotations, newTestContainer("sgx", "1Mi")))
+		if pod == nil {
+			t.Fatal("pod was not admitted")
+		}
+
+		if len(resp.Warnings) != 1 {
+			t.Errorf("%q: expected a warning, got %v", group, resp.Warnings)
+		}
+
+		for _, volume := range pod.Spec.Volumes {
+			if strings.HasPrefix(volume.Name, shmVolumePrefix) {
+				t.Errorf("%q: shared memory volume %s added for an invalid group", group, volume.Name)
+			}
+		}
+
+		if resp := validateTestPod(t, newTestValidator(t), newTestPod(annotations, newTestContainer("sgx", "1Mi"))); resp.Allowed {
+			t.Errorf("%q: pod with an invalid group was not denied", group)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// provisionJustificationAnnotation tells why the pod needs access to the SGX
+// provisioning key. It's recorded with the decisions of pods granted
+// sgx.intel.com/provision for auditing.
+const provisionJustificationAnnotation = namespace + "/provision-justification"
+
+// provisionOnlyAnnotation is a comma separated list of the containers which
+// get sgx.intel.com/provision without requesting EPC, e.g. attestation helpers
+// proxying quotes for other pods but running no enclave of their own.
+const provisionOnlyAnnotation = namespace + "/provision-only"
+
+// provisionOnlyContainers returns the names listed in the
+// sgx.intel.com/provision-only annotation.
+func provisionOnlyContainers(pod *corev1.Pod) map[string]bool {
+	names := make(map[string]bool)
+
+	for _, name := range strings.Split(pod.Annotations[provisionOnlyAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// grantProvision adds sgx.intel.com/provision to the container.
+func grantProvision(container *corev1.Container) {
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = corev1.ResourceList{}
+	}
+
+	container.Resources.Limits[corev1.ResourceName(provision)] = resource.MustParse("1")
+	container.Resources.Requests[corev1.ResourceName(provision)] = resource.MustParse("1")
+}
+
+// provisionContainers returns the names of the containers of the pod which
+// have sgx.intel.com/provision.
+func provisionContainers(pod *corev1.Pod) []string {
+	names := make([]string, 0)
+
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			if _, ok := container.Resources.Limits[provision]; ok {
+				names = append(names, container.Name)
+			}
+		}
+	}
+
+	return names
+}
+
+// provisionJustification returns the justification of the provisioning key
+// access of the pod, empty if it has none.
+func provisionJustification(pod *corev1.Pod) string {
+	return strings.TrimSpace(pod.Annotations[provisionJustificationAnnotation])
+}
+
+// validateProvisionJustification returns an error if the pod has access to
+// the provisioning key without a justification.
+func validateProvisionJustification(pod *corev1.Pod) error {
+	if names := provisionContainers(pod); len(names) > 0 && provisionJustification(pod) == "" {
+		return errors.Errorf("containers %v are granted %s without a %s annotation",
+			names, provision, provisionJustificationAnnotation)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	runtimeAnnotation = namespace + "/runtime"
+	// runtimeEnvSeparator separates the runtime and the environment variable
+	// name in the keys of MutatorConfig.RuntimeEnvs.
+	runtimeEnvSeparator = "."
+)
+
+// splitRuntimeEnv splits a runtime.NAME key to the runtime and the variable name.
+func splitRuntimeEnv(key string) (string, string, error) {
+	parts := strings.SplitN(key, runtimeEnvSeparator, 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.Errorf("invalid runtime environment variable %q, expected runtime.NAME", key)
+	}
+
+	if errs := validation.IsEnvVarName(parts[1]); len(errs) > 0 {
+		return "", "", errors.Errorf("invalid environment variable name %q for runtime %s: %v", parts[1], parts[0], errs)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// validateRuntimeEnvs checks that the keys are of the form runtime.NAME.
+func validateRuntimeEnvs(envs map[string]string) error {
+	for key := range envs {
+		if _, _, err := splitRuntimeEnv(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addRuntimeEnvs adds the environment variables configured for the enclave
+// runtime named in the sgx.intel.com/runtime annotation, e.g. gramine, to the
+// SGX containers. Variables the containers set already are kept.
+func (s *Mutator) addRuntimeEnvs(pod *corev1.Pod, sgxContainers []*corev1.Container) []string {
+	runtime, ok := pod.Annotations[runtimeAnnotation]
+	if !ok {
+		return nil
+	}
+
+	envs := make(map[string]string)
+	names := make([]string, 0)
+
+	for key, value := range s.RuntimeEnvs {
+		if envRuntime, name, err := splitRuntimeEnv(key); err == nil && envRuntime == runtime {
+			envs[name] = value
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return []string{"unknown enclave runtime " + runtime + " in " + runtimeAnnotation}
+	}
+
+	sort.Strings(names)
+
+	for _, container := range sgxContainers {
+		for _, name := range names {
+			addEnvIfNotExists(container, name, envs[name])
+		}
+	}
+
+	return nil
+}
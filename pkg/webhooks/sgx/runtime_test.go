@@ -0,0 +1,95 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRuntimeEnvs(t *testing.T) {
+	runtimeEnvs := map[string]string{
+		"gramine.SGX":                 "1",
+		"gramine.GRAMINE_LOG_LEVEL":   "error",
+		"occlum.OCCLUM_LOG_LEVEL":     "info",
+		"occlum.OCCLUM_RELEASE_BUILD": "1",
+	}
+
+	tcases := []struct {
+		expectedEnvs    map[string]string
+		name            string
+		runtime         string
+		expectedWarning bool
+	}{
+		{
+			name:    "known runtime",
+			runtime: "gramine",
+			expectedEnvs: map[string]string{
+				"SGX":               "1",
+				"GRAMINE_LOG_LEVEL": "debug",
+				"OCCLUM_LOG_LEVEL":  "",
+			},
+		},
+		{
+			name:            "unknown runtime",
+			runtime:         "ego",
+			expectedWarning: true,
+			expectedEnvs: map[string]string{
+				"SGX":               "",
+				"GRAMINE_LOG_LEVEL": "debug",
+			},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.RuntimeEnvs = runtimeEnvs
+
+			container := newTestContainer("sgx", "1Mi")
+			container.Env = []corev1.EnvVar{{Name: "GRAMINE_LOG_LEVEL", Value: "debug"}}
+
+			pod, resp := mutateTestPod(t, mutator, newTestPod(map[string]string{runtimeAnnotation: tc.runtime}, container))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			warned := false
+
+			for _, warning := range resp.Warnings {
+				if strings.Contains(warning, runtimeAnnotation) {
+					warned = true
+				}
+			}
+
+			if warned != tc.expectedWarning {
+				t.Errorf("expected warning %v, got %v", tc.expectedWarning, resp.Warnings)
+			}
+
+			for name, expected := range tc.expectedEnvs {
+				value, count := findEnv(&pod.Spec.Containers[0], name)
+				if expected == "" && count != 0 {
+					t.Errorf("unexpected env %s=%s", name, value)
+				}
+
+				if expected != "" && (count != 1 || value != expected) {
+					t.Errorf("expected one %s=%s env, got %d with value %q", name, expected, count, value)
+				}
+			}
+		})
+	}
+}
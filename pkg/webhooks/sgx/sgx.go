@@ -17,9 +17,14 @@ package sgx
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -28,11 +33,23 @@ import (
 )
 
 // +kubebuilder:webhook:path=/pods-sgx,mutating=true,failurePolicy=ignore,groups="",resources=pods,verbs=create;update,versions=v1,name=sgx.mutator.webhooks.intel.com,sideEffects=None,admissionReviewVersions=v1
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=scheduling.k8s.io,resources=priorityclasses,verbs=get;list;watch
 
 // Mutator annotates Pods.
 type Mutator struct {
-	Client  client.Client
-	decoder *admission.Decoder
+	Client client.Client
+	// Log receives the mutation decisions at debug level (V(1)) and the
+	// errors. Nothing is logged if it's unset.
+	Log logr.Logger
+	// DecisionSink archives the admission decisions of SGX pods, nil if disabled.
+	DecisionSink *DecisionSink
+	decoder      *admission.Decoder
+	MutatorConfig
+	// DryRun admits the pods as they are, with warnings describing the
+	// mutations instead, for observing the impact of the webhook before
+	// enforcing it.
+	DryRun bool
 }
 
 const (
@@ -40,31 +57,110 @@ const (
 	encl                     = namespace + "/enclave"
 	epc                      = namespace + "/epc"
 	provision                = namespace + "/provision"
+	epcClassAnnotation       = namespace + "/epc-class"
+	epcPageSizeAnnotation    = namespace + "/epc-page-size"
 	quoteProvAnnotation      = namespace + "/quote-provider"
+	aesmdContainerAnnotation = namespace + "/aesmd-container"
 	aesmdQuoteProvKey        = "aesmd"
 	aesmdSocketDirectoryPath = "/var/run/aesmd"
 	aesmdSocketName          = "aesmd-socket"
+	aesmAddrEnv              = "SGX_AESM_ADDR"
+	// diskMedium selects the default medium of the node for the aesmd
+	// socket emptyDir volume.
+	diskMedium = "Disk"
+	// epcPageBytes is the size of the EPC pages the enclave memory is
+	// allocated in.
+	epcPageBytes = 4096
 )
 
-func createAesmdVolumeIfNotExists(needsAesmd bool, epcUserCount int32, aesmdPresent bool, pod *corev1.Pod) *corev1.Volume {
+// aesmdSocketDir returns the directory of the aesmd socket, which is
+// /var/run/aesmd unless configured otherwise.
+func aesmdSocketDir(dir string) string {
+	if dir == "" {
+		return aesmdSocketDirectoryPath
+	}
+
+	return dir
+}
+
+// aesmAddr returns the value of SGX_AESM_ADDR, which is "1" unless
+// configured otherwise.
+func aesmAddr(value string) string {
+	if value == "" {
+		return "1"
+	}
+
+	return value
+}
+
+// aesmdContainerName returns the name of the aesmd sidecar container, which
+// is "aesmd" unless configured otherwise.
+func aesmdContainerName(name string) string {
+	if name == "" {
+		return aesmdQuoteProvKey
+	}
+
+	return name
+}
+
+// epcResourceNames returns the resource names accepted as EPC requests:
+// sgx.intel.com/epc and the configured alternative names.
+func epcResourceNames(names []string) []corev1.ResourceName {
+	resourceNames := []corev1.ResourceName{epc}
+
+	for _, name := range names {
+		if name != epc {
+			resourceNames = append(resourceNames, corev1.ResourceName(name))
+		}
+	}
+
+	return resourceNames
+}
+
+// podAesmdContainerName returns the name of the aesmd sidecar container of the
+// pod. The sgx.intel.com/aesmd-container annotation names it in pods whose
+// container names are templated, e.g. by Helm charts, otherwise it's the
+// configured name.
+func podAesmdContainerName(pod *corev1.Pod, name string) string {
+	if annotated := strings.TrimSpace(pod.Annotations[aesmdContainerAnnotation]); annotated != "" {
+		return annotated
+	}
+
+	return aesmdContainerName(name)
+}
+
+// aesmdSocketMedium returns the medium of the aesmd socket emptyDir volume,
+// which is memory unless configured otherwise.
+func aesmdSocketMedium(medium string) corev1.StorageMedium {
+	if medium == diskMedium {
+		return corev1.StorageMediumDefault
+	}
+
+	return corev1.StorageMediumMemory
+}
+
+// createAesmdVolumeIfNotExists returns the aesmd socket volume to add to the
+// pod, nil if the pod doesn't need one or has it already. A volume of the pod
+// with the name but another source is kept, which the returned warning tells.
+func createAesmdVolumeIfNotExists(needsAesmd bool, epcUserCount int32, aesmdPresent bool, socketDir string, medium corev1.StorageMedium, pod *corev1.Pod) (*corev1.Volume, string) {
 	var vol *corev1.Volume
 
 	switch {
 	case epcUserCount == 0:
 		// none of the containers in this pod request SGX resourced.
-		return nil
+		return nil, ""
 	case !needsAesmd:
 		// the pod does not specify sgx.intel.com/quote-provider: aesmd
-		return nil
+		return nil, ""
 	case aesmdPresent && epcUserCount >= 2:
-		// aesmd sidecar: the pod has a container named aesmd and >=1 _other_ containers requesting
+		// aesmd sidecar: the pod has the aesmd container and >=1 _other_ containers requesting
 		// SGX resources. aesmd socket path is provided as an emptydir volume within the pod and
 		// mounted by all (SGX) containers.
 		vol = &corev1.Volume{
 			Name: aesmdSocketName,
 			VolumeSource: corev1.VolumeSource{
 				EmptyDir: &corev1.EmptyDirVolumeSource{
-					Medium: corev1.StorageMediumMemory,
+					Medium: medium,
 				},
 			},
 		}
@@ -77,7 +173,7 @@ func createAesmdVolumeIfNotExists(needsAesmd bool, epcUserCount int32, aesmdPres
 			Name: aesmdSocketName,
 			VolumeSource: corev1.VolumeSource{
 				HostPath: &corev1.HostPathVolumeSource{
-					Path: aesmdSocketDirectoryPath,
+					Path: socketDir,
 					Type: &dirOrCreate,
 				},
 			},
@@ -85,15 +181,96 @@ func createAesmdVolumeIfNotExists(needsAesmd bool, epcUserCount int32, aesmdPres
 	}
 
 	// Do not return a new Volume if it already exists in the Pod spec
-	if pod.Spec.Volumes != nil {
-		for _, existingVolume := range pod.Spec.Volumes {
-			if existingVolume.Name == vol.Name {
-				return nil
-			}
+	for _, existingVolume := range pod.Spec.Volumes {
+		if existingVolume.Name != vol.Name {
+			continue
+		}
+
+		if !equality.Semantic.DeepEqual(existingVolume.VolumeSource, vol.VolumeSource) {
+			return nil, fmt.Sprintf("the pod has a %s volume of another source, which is kept: the aesmd socket may not be shared as expected", vol.Name)
+		}
+
+		return nil, ""
+	}
+
+	return vol, ""
+}
+
+// canonicalEpc returns the canonical representation of an EPC size given in bytes.
+// The canonical form is a BinarySI quantity which uses the largest binary suffix
+// that represents the value exactly (e.g., 64M, 64000000 and 62500Ki all become
+// "62500Ki" whereas 64Mi and 67108864 both become "64Mi"). The EPC sizes of the
+// mutated pods are whole pages, so they always have a binary suffix, e.g. a
+// request of 1G, rounded up to 1000001536 bytes, becomes "976564Ki".
+func canonicalEpc(size int64) *resource.Quantity {
+	return resource.NewQuantity(size, resource.BinarySI)
+}
+
+// roundUpToEpcPage returns the EPC size rounded up to whole EPC pages, and
+// whether it was page aligned already.
+func roundUpToEpcPage(size int64) (int64, bool) {
+	if remainder := size % epcPageBytes; remainder != 0 {
+		return size + epcPageBytes - remainder, false
+	}
+
+	return size, true
+}
+
+// normalizeEpcRequest rewrites the container's EPC limits and requests to their
+// canonical form. The numeric byte value is kept intact.
+func normalizeEpcRequest(container *corev1.Container, name corev1.ResourceName, size int64) {
+	for _, resources := range []corev1.ResourceList{container.Resources.Limits, container.Resources.Requests} {
+		if _, ok := resources[name]; ok {
+			resources[name] = *canonicalEpc(size)
 		}
 	}
+}
+
+// annotateEpc sets the total EPC size of the pod, the EPC page size and the
+// size class of the pod to the pod annotations. Pods not requesting EPC are left untouched.
+func (s *Mutator) annotateEpc(pod *corev1.Pod, totalEpc int64) {
+	if totalEpc == 0 {
+		return
+	}
+
+	// The total is computed from the containers every time, so a value set
+	// earlier, e.g. when the mutated pod is submitted again, is overwritten.
+	pod.Annotations[epc] = canonicalEpc(totalEpc).String()
+
+	if s.EpcPageSize != "" {
+		pageSize := resource.MustParse(s.EpcPageSize)
+		pod.Annotations[epcPageSizeAnnotation] = canonicalEpc(pageSize.Value()).String()
+	}
+
+	if len(s.EpcClasses) == 0 {
+		return
+	}
 
-	return vol
+	// The class is always derived from the EPC size, a class set by the user is dropped.
+	delete(pod.Annotations, epcClassAnnotation)
+
+	if class, ok := s.epcClass(totalEpc); ok {
+		pod.Annotations[epcClassAnnotation] = class
+	}
+}
+
+// epcClass returns the configured class with the largest minimum EPC size
+// not exceeding the total EPC size of a pod.
+func (s *Mutator) epcClass(totalEpc int64) (string, bool) {
+	class, classMin := "", int64(-1)
+
+	for name, value := range s.EpcClasses {
+		minSize, err := resource.ParseQuantity(value)
+		if err != nil {
+			continue
+		}
+
+		if size := minSize.Value(); size <= totalEpc && size > classMin {
+			class, classMin = name, size
+		}
+	}
+
+	return class, classMin >= 0
 }
 
 func warnWrongResources(resources map[string]int64) []string {
@@ -124,6 +301,16 @@ func volumeMountExists(path string, container *corev1.Container) bool {
 	return false
 }
 
+func envVarExists(name string, container *corev1.Container) bool {
+	for _, env := range container.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 func createNewVolumeMounts(container *corev1.Container, volumeMount *corev1.VolumeMount) []corev1.VolumeMount {
 	if container.VolumeMounts == nil {
 		return []corev1.VolumeMount{*volumeMount}
@@ -132,122 +319,560 @@ func createNewVolumeMounts(container *corev1.Container, volumeMount *corev1.Volu
 	return append(container.VolumeMounts, *volumeMount)
 }
 
-// Handle implements controller-runtimes's admission.Handler inteface.
-func (s *Mutator) Handle(ctx context.Context, req admission.Request) admission.Response {
-	pod := &corev1.Pod{}
+// sgxContainerMutation injects the SGX resources and the quote generation
+// settings into the containers of a pod and collects their EPC usage.
+type sgxContainerMutation struct {
+	// providers are the names of the containers getting sgx.intel.com/provision:
+	// the in-process quote providers, or the aesmd sidecar in the aesmd mode.
+	providers map[string]bool
+	aesmdName string
+	// socketDir is the directory of the aesmd socket in the containers and,
+	// with the aesmd DaemonSet, on the host.
+	socketDir string
+	aesmAddr  string
+	warnings  map[string][]string
+	totalEpc  int64
+	// epcUserCount is the number of containers requesting SGX resources.
+	epcUserCount int32
+	aesmdMode    bool
+	aesmdPresent bool
+	// aesmdVolume is the aesmd socket volume added to the pod, if any.
+	aesmdVolume *corev1.Volume
+	// provisionOnly are the names of the containers getting only
+	// sgx.intel.com/provision when they don't request EPC.
+	provisionOnly map[string]bool
+	// epcNames are the resource names accepted as EPC requests.
+	epcNames []corev1.ResourceName
+	// defaultEpc is the EPC size requested for containers requesting only
+	// sgx.intel.com/enclave, zero to only warn about them.
+	defaultEpc int64
+}
 
-	if err := s.decoder.Decode(req, pod); err != nil {
-		return admission.Errored(http.StatusBadRequest, err)
+func newSgxContainerMutation(quoteProviders []string, aesmdName, socketDir, aesmAddr string) *sgxContainerMutation {
+	m := &sgxContainerMutation{
+		providers: make(map[string]bool, len(quoteProviders)),
+		aesmdName: aesmdName,
+		socketDir: socketDir,
+		aesmAddr:  aesmAddr,
+		warnings:  make(map[string][]string),
+		epcNames:  []corev1.ResourceName{epc},
 	}
 
-	totalEpc := int64(0)
-	epcUserCount := int32(0)
-	aesmdPresent := bool(false)
-	warnings := make([]string, 0)
+	for _, provider := range quoteProviders {
+		// In the aesmd mode the annotation names the mode and the aesmd sidecar,
+		// if any, is the quote provider container.
+		if provider == aesmdQuoteProvKey {
+			m.aesmdMode = true
+			provider = aesmdName
+		}
 
-	if pod.Annotations == nil {
-		pod.Annotations = make(map[string]string)
+		m.providers[provider] = true
 	}
 
-	quoteProvider := pod.Annotations[quoteProvAnnotation]
+	return m
+}
 
-	for idx, container := range pod.Spec.Containers {
-		requestedResources, err := containers.GetRequestedResources(container, namespace)
-		if err != nil {
-			return admission.Errored(http.StatusInternalServerError, err)
+// warnUnknownProviders returns warnings about the quote providers named in the
+// annotation which are not containers of the pod, as they get no
+// sgx.intel.com/provision. The warnings list the containers of the pod.
+func warnUnknownProviders(pod *corev1.Pod, quoteProviders []string) []string {
+	names := make(map[string]bool, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	containerNames := make([]string, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			names[container.Name] = true
+			containerNames = append(containerNames, container.Name)
 		}
+	}
 
-		warnings = append(warnings, warnWrongResources(requestedResources)...)
+	warnings := make([]string, 0)
 
-		// the container has no sgx.intel.com/epc
-		epcSize, ok := requestedResources[epc]
-		if !ok {
-			continue
+	for _, provider := range quoteProviders {
+		if provider != aesmdQuoteProvKey && !names[provider] {
+			warnings = append(warnings, quoteProvAnnotation+" names "+provider+
+				" which is not a container of the pod, no container gets "+provision+
+				" for it (containers: "+strings.Join(containerNames, ", ")+")")
 		}
+	}
 
-		totalEpc += epcSize
+	return warnings
+}
 
-		// Quote Generation Modes:
-		//
-		// in-process: A container has its own quote provider library library: In this mode,
-		// the container needs a handle to /dev/sgx/provision (sgx.intel.com/provision resource).
-		// out-of-process: A container uses Intel aesmd. In this mode, the container must talk to
-		// aesmd over /var/run/aesmd/aesm.sock. aesmd can run either as a side-car or a DaemonSet
-		//
-		// Mode selection: The mode selection is done by setting sgx.intel.com/quote-provider annotation
-		// to a value that specifies the container name. If the annotation matches the container requesting
-		// SGX EPC resources, the webhook adds both /dev/sgx/provision and /dev/sgx/enclave resource requests.
-		// Without sgx.intel.com/quote-provider annotation set, the container is not able to generate quotes
-		// for its enclaves. When pods set sgx.intel.com/quote-provider: "aesmd", Intel aesmd specific volume
-		// mounts are added. In both DaemonSet and sidecar deployment scenarios for aesmd, its container name
-		// must be set to "aesmd" (TODO: make it configurable?).
+// isSgxResource tells if the resource is an sgx.intel.com resource or one of
+// the accepted EPC resource names.
+func isSgxResource(name corev1.ResourceName, epcNames []corev1.ResourceName) bool {
+	if strings.HasPrefix(string(name), namespace) {
+		return true
+	}
 
-		if quoteProvider == container.Name {
-			container.Resources.Limits[corev1.ResourceName(provision)] = resource.MustParse("1")
-			container.Resources.Requests[corev1.ResourceName(provision)] = resource.MustParse("1")
+	for _, epcName := range epcNames {
+		if name == epcName {
+			return true
 		}
+	}
 
-		container.Resources.Limits[corev1.ResourceName(encl)] = resource.MustParse("1")
-		container.Resources.Requests[corev1.ResourceName(encl)] = resource.MustParse("1")
+	return false
+}
 
-		// we count how many containers within the pod request SGX resources. If the container
-		// count is >= 1 and one of them is named aesmdQuoteProvKey, 'aesmd sidecar' deployment
-		// assumed.
-		epcUserCount++
-
-		switch quoteProvider {
-		// container mutate logic for Intel aesmd users
-		case aesmdQuoteProvKey:
-			// Check if we already have a VolumeMount for this path -- let's not add it if it's there.
-			// This needs to be an external function because of the linting complexity check. We lose
-			// one "if" this way.
-			if !volumeMountExists(aesmdSocketDirectoryPath, &pod.Spec.Containers[idx]) {
-				vms := createNewVolumeMounts(&pod.Spec.Containers[idx],
-					&corev1.VolumeMount{
-						Name:      aesmdSocketName,
-						MountPath: aesmdSocketDirectoryPath,
-					})
-				container.VolumeMounts = vms
+// defaultSgxResources sets the SGX resources set only in the limits or only
+// in the requests of the container to the other one too, as the API server
+// does for extended resources, so that both resource maps exist before the
+// SGX resources are injected. Pods not defaulted by the API server, e.g. the
+// ones given to Mutate, may have only one of them.
+func defaultSgxResources(container *corev1.Container, epcNames []corev1.ResourceName) {
+	resources := &container.Resources
+
+	for name, quantity := range resources.Limits {
+		if _, ok := resources.Requests[name]; !ok && isSgxResource(name, epcNames) {
+			if resources.Requests == nil {
+				resources.Requests = corev1.ResourceList{}
 			}
 
-			if container.Name == aesmdQuoteProvKey {
-				aesmdPresent = true
+			resources.Requests[name] = quantity.DeepCopy()
+		}
+	}
+
+	for name, quantity := range resources.Requests {
+		if _, ok := resources.Limits[name]; !ok && isSgxResource(name, epcNames) {
+			if resources.Limits == nil {
+				resources.Limits = corev1.ResourceList{}
 			}
 
-			if container.Env == nil {
-				container.Env = make([]corev1.EnvVar, 0)
+			resources.Limits[name] = quantity.DeepCopy()
+		}
+	}
+}
+
+// requestedEpc returns the EPC sizes the container requests, keyed by the
+// accepted EPC resource names.
+func (m *sgxContainerMutation) requestedEpc(container *corev1.Container, requestedResources map[string]int64) (map[corev1.ResourceName]int64, error) {
+	sizes := make(map[corev1.ResourceName]int64)
+
+	for _, name := range m.epcNames {
+		size, ok := requestedResources[string(name)]
+
+		// Only the sgx.intel.com resources are in requestedResources.
+		if !strings.HasPrefix(string(name), namespace) {
+			resources, err := containers.GetRequestedResources(*container, string(name))
+			if err != nil {
+				return nil, err
 			}
 
-			// this sets SGX_AESM_ADDR for aesmd itself too but it's harmless
-			container.Env = append(container.Env,
-				corev1.EnvVar{
-					Name:  "SGX_AESM_ADDR",
-					Value: "1",
+			size, ok = resources[string(name)]
+		}
+
+		if ok {
+			sizes[name] = size
+		}
+	}
+
+	return sizes, nil
+}
+
+// mutate injects the SGX resources into the container if it requests EPC,
+// which is told by the returned bool.
+func (m *sgxContainerMutation) mutate(container *corev1.Container) (bool, error) {
+	defaultSgxResources(container, m.epcNames)
+
+	requestedResources, err := containers.GetRequestedResources(*container, namespace)
+	if err != nil {
+		return false, err
+	}
+
+	epcSizes, err := m.requestedEpc(container, requestedResources)
+	if err != nil {
+		return false, err
+	}
+
+	requestsEpc := len(epcSizes) > 0
+
+	// Old manifests requesting sgx.intel.com/enclave directly get the default
+	// EPC and are mutated as if they had requested it.
+	if _, ok := requestedResources[encl]; ok && !requestsEpc && m.defaultEpc > 0 {
+		container.Resources.Limits[epc] = *canonicalEpc(m.defaultEpc)
+		container.Resources.Requests[epc] = *canonicalEpc(m.defaultEpc)
+		epcSizes[epc] = m.defaultEpc
+		requestsEpc = true
+
+		m.warnings[defaultEpcWarning] = append(m.warnings[defaultEpcWarning],
+			fmt.Sprintf("container %s requests %s without %s, converted to a request of %s %s",
+				container.Name, encl, epc, canonicalEpc(m.defaultEpc), epc))
+	}
+
+	// Provision-only containers get sgx.intel.com/provision without the
+	// enclave resource. They don't count as SGX containers.
+	if !requestsEpc && m.provisionOnly[container.Name] {
+		// It's the webhook's own when the pod is submitted again.
+		delete(requestedResources, provision)
+		grantProvision(container)
+	}
+
+	// The enclave resource of containers requesting EPC is the webhook's
+	// own when the pod is submitted again. Other values are normalized.
+	enclSize, enclSet := requestedResources[encl]
+	if requestsEpc && enclSet {
+		delete(requestedResources, encl)
+
+		if enclSize != 1 {
+			m.warnings[directResourceWarning] = append(m.warnings[directResourceWarning],
+				fmt.Sprintf("container %s sets %s to %d, normalized to 1", container.Name, encl, enclSize))
+		}
+	}
+
+	// So is sgx.intel.com/provision of the quote providers requesting EPC,
+	// i.e. the in-process providers and the aesmd sidecar.
+	if requestsEpc && m.providers[container.Name] {
+		delete(requestedResources, provision)
+	}
+
+	m.warnings[directResourceWarning] = append(m.warnings[directResourceWarning], warnWrongResources(requestedResources)...)
+
+	// the container has no sgx.intel.com/epc
+	if !requestsEpc {
+		return false, nil
+	}
+
+	// The EPC requested under all the accepted names adds to the total.
+	for _, name := range m.epcNames {
+		epcSize, ok := epcSizes[name]
+		if !ok {
+			continue
+		}
+
+		if rounded, aligned := roundUpToEpcPage(epcSize); !aligned {
+			m.warnings[unalignedEpcWarning] = append(m.warnings[unalignedEpcWarning],
+				fmt.Sprintf("container %s requests %d bytes of %s, rounded up to whole %d byte pages: %s",
+					container.Name, epcSize, name, epcPageBytes, canonicalEpc(rounded)))
+			epcSize = rounded
+		}
+
+		normalizeEpcRequest(container, name, epcSize)
+
+		m.totalEpc += epcSize
+	}
+
+	// Quote Generation Modes:
+	//
+	// in-process: A container has its own quote provider library library: In this mode,
+	// the container needs a handle to /dev/sgx/provision (sgx.intel.com/provision resource).
+	// out-of-process: A container uses Intel aesmd. In this mode, the container must talk to
+	// aesmd over /var/run/aesmd/aesm.sock. aesmd can run either as a side-car or a DaemonSet
+	//
+	// Mode selection: The mode selection is done by setting sgx.intel.com/quote-provider annotation
+	// to a comma separated list of container names. If the annotation names the container requesting
+	// SGX EPC resources, the webhook adds both /dev/sgx/provision and /dev/sgx/enclave resource requests.
+	// Without sgx.intel.com/quote-provider annotation set, the container is not able to generate quotes
+	// for its enclaves. When pods set sgx.intel.com/quote-provider: "aesmd", Intel aesmd specific volume
+	// mounts are added. In the sidecar deployment scenario for aesmd, its container is the one named in
+	// the sgx.intel.com/aesmd-container annotation, or AesmdContainerName ("aesmd" by default).
+
+	if m.providers[container.Name] {
+		grantProvision(container)
+	}
+
+	if !enclSet || enclSize != 1 {
+		container.Resources.Limits[corev1.ResourceName(encl)] = resource.MustParse("1")
+		container.Resources.Requests[corev1.ResourceName(encl)] = resource.MustParse("1")
+	}
+
+	// we count how many containers within the pod request SGX resources. If the container
+	// count is >= 1 and one of them is named aesmdName, 'aesmd sidecar' deployment
+	// assumed.
+	m.epcUserCount++
+
+	// container mutate logic for Intel aesmd users
+	if m.aesmdMode {
+		// Check if we already have a VolumeMount for this path -- let's not add it if it's there.
+		if !volumeMountExists(m.socketDir, container) {
+			container.VolumeMounts = createNewVolumeMounts(container,
+				&corev1.VolumeMount{
+					Name:      aesmdSocketName,
+					MountPath: m.socketDir,
 				})
 		}
 
-		pod.Spec.Containers[idx] = container
+		// this sets SGX_AESM_ADDR for aesmd itself too but it's harmless. It's
+		// only added once so that pods submitted again are left unchanged,
+		// and a value set by the user is kept.
+		if envVarExists(aesmAddrEnv, container) {
+			m.warnUserAesmAddr(container)
+		} else {
+			addEnvIfNotExists(container, aesmAddrEnv, m.aesmAddr)
+		}
+	}
+
+	return true, nil
+}
+
+// logger returns the logger of the pod of the request.
+func (s *Mutator) logger(req admission.Request, pod *corev1.Pod) logr.Logger {
+	if s.Log.GetSink() == nil {
+		return logr.Discard()
+	}
+
+	name := req.Name
+	if name == "" {
+		name = pod.Name
+	}
+
+	if name == "" {
+		name = pod.GenerateName
+	}
+
+	return s.Log.WithValues("pod", req.Namespace+"/"+name)
+}
+
+// sgxResources returns the SGX resource limits of the container as
+// key-value pairs for logging.
+func sgxResources(container *corev1.Container) []interface{} {
+	keysAndValues := []interface{}{"container", container.Name}
+
+	for _, name := range []corev1.ResourceName{epc, encl, provision} {
+		if quantity, ok := container.Resources.Limits[name]; ok {
+			keysAndValues = append(keysAndValues, string(name), quantity.String())
+		}
+	}
+
+	return keysAndValues
+}
+
+// quoteGenerationDeployment tells how the quote generation of the pod is
+// deployed: in-process, with an aesmd sidecar or with the aesmd DaemonSet.
+func quoteGenerationDeployment(m *sgxContainerMutation) string {
+	switch {
+	case !m.aesmdMode:
+		return inProcessMode
+	case m.aesmdPresent && m.epcUserCount >= 2:
+		return "aesmd sidecar"
+	default:
+		return "aesmd DaemonSet"
+	}
+}
+
+// warnUserAesmAddr warns about a SGX_AESM_ADDR the user has set to another
+// value than the webhook would.
+func (m *sgxContainerMutation) warnUserAesmAddr(container *corev1.Container) {
+	for _, env := range container.Env {
+		if env.Name == aesmAddrEnv && (env.Value != m.aesmAddr || env.ValueFrom != nil) {
+			m.warnings[userEnvWarning] = append(m.warnings[userEnvWarning],
+				"container "+container.Name+" sets "+aesmAddrEnv+", keeping it instead of "+m.aesmAddr)
+			return
+		}
+	}
+}
+
+// MutateOptions are the settings of Mutate.
+type MutateOptions struct {
+	// Client reads the annotations of the pod's namespace, e.g. the namespace
+	// defaults of the forwarded annotations. Nil skips them.
+	Client client.Client
+	// Namespace of the pod, the namespace in the pod metadata if empty.
+	Namespace string
+	MutatorConfig
+}
+
+// Mutate applies the SGX mutations to the pod in place, i.e. the changes the
+// Mutator webhook makes to the pods it admits, and returns the warnings about
+// the pod. Other components can use it to apply the mutations without the
+// admission plumbing, so the warnings are not counted in the webhook metrics.
+func Mutate(ctx context.Context, pod *corev1.Pod, opts MutateOptions) ([]string, error) {
+	if err := opts.MutatorConfig.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid configuration")
+	}
+
+	ns := opts.Namespace
+	if ns == "" {
+		ns = pod.Namespace
 	}
 
-	if vol := createAesmdVolumeIfNotExists(quoteProvider == aesmdQuoteProvKey, epcUserCount, aesmdPresent, pod); vol != nil {
+	s := &Mutator{Client: opts.Client, MutatorConfig: opts.MutatorConfig}
+
+	_, warnings, err := s.mutatePod(ctx, ns, pod, logr.Discard(), keepWarnings)
+
+	return warnings, err
+}
+
+// mutatePod applies the SGX mutations to the pod of namespace ns in place.
+// It returns the container mutation for the metrics and logs of Handle. The
+// warnings are passed through count by their type.
+func (s *Mutator) mutatePod(ctx context.Context, ns string, pod *corev1.Pod, log logr.Logger,
+	count func(string, []string) []string) (*sgxContainerMutation, []string, error) {
+	warnings := make([]string, 0)
+	sgxContainers := make([]*corev1.Container, 0)
+
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+
+	providers := quoteProviders(pod)
+	m := newSgxContainerMutation(providers, podAesmdContainerName(pod, s.AesmdContainerName), aesmdSocketDir(s.AesmdSocketDir), aesmAddr(s.AesmAddr))
+	m.provisionOnly = provisionOnlyContainers(pod)
+	m.epcNames = epcResourceNames(s.EpcResourceNames)
+
+	if s.DefaultEpc != "" {
+		defaultEpc := resource.MustParse(s.DefaultEpc)
+		m.defaultEpc = defaultEpc.Value()
+	}
+
+	// Init containers get the same resources and mounts, e.g. for sealing
+	// secrets into an enclave before the application starts, but the aesmd
+	// sidecar can't be one.
+	for idx := range pod.Spec.InitContainers {
+		container := &pod.Spec.InitContainers[idx]
+
+		isSgx, err := m.mutate(container)
+		if err != nil {
+			log.Error(err, "Unable to mutate the init container", "container", container.Name)
+			return nil, nil, err
+		}
+
+		if isSgx {
+			log.V(1).Info("Mutated the init container", sgxResources(container)...)
+		}
+	}
+
+	for idx := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[idx]
+
+		isSgx, err := m.mutate(container)
+		if err != nil {
+			log.Error(err, "Unable to mutate the container", "container", container.Name)
+			return nil, nil, err
+		}
+
+		if !isSgx {
+			continue
+		}
+
+		log.V(1).Info("Mutated the container", sgxResources(container)...)
+
+		if m.aesmdMode && container.Name == m.aesmdName {
+			m.aesmdPresent = true
+		}
+
+		sgxContainers = append(sgxContainers, container)
+	}
+
+	for _, warningType := range []string{directResourceWarning, defaultEpcWarning, unalignedEpcWarning, userEnvWarning} {
+		warnings = append(warnings, count(warningType, m.warnings[warningType])...)
+	}
+
+	warnings = append(warnings, count(unknownQuoteProviderWarning, warnUnknownProviders(pod, providers))...)
+
+	if err := validateProvisionJustification(pod); err != nil {
+		warnings = append(warnings, count(provisionJustificationWarning, []string{err.Error()})...)
+	}
+
+	var volumeWarning string
+
+	m.aesmdVolume, volumeWarning = createAesmdVolumeIfNotExists(m.aesmdMode, m.epcUserCount, m.aesmdPresent, m.socketDir, aesmdSocketMedium(s.AesmdSocketMedium), pod)
+	if volumeWarning != "" {
+		warnings = append(warnings, count(aesmdVolumeWarning, []string{volumeWarning})...)
+	}
+
+	if m.aesmdVolume != nil && m.aesmdVolume.HostPath != nil {
+		warnings = append(warnings, count(aesmdVolumeWarning, s.checkAesmdDaemonSet(ctx, pod))...)
+	}
+
+	if m.aesmdVolume != nil {
 		if pod.Spec.Volumes == nil {
 			pod.Spec.Volumes = make([]corev1.Volume, 0)
 		}
 
-		pod.Spec.Volumes = append(pod.Spec.Volumes, *vol)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, *m.aesmdVolume)
 	}
 
-	if totalEpc != 0 {
-		quantity := resource.NewQuantity(totalEpc, resource.BinarySI)
-		pod.Annotations["sgx.intel.com/epc"] = quantity.String()
+	if m.epcUserCount > 0 {
+		warnings = append(warnings, count(podSettingsWarning, s.mutateSgxPod(ctx, ns, pod, sgxContainers))...)
+	}
+
+	s.annotateEpc(pod, m.totalEpc)
+
+	return m, warnings, nil
+}
+
+// Handle implements controller-runtimes's admission.Handler inteface.
+func (s *Mutator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+
+	if err := s.decoder.Decode(req, pod); err != nil {
+		s.logger(req, pod).Error(err, "Unable to decode the pod")
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	log := s.logger(req, pod)
+	log.V(1).Info("Decoded the pod", "operation", req.Operation,
+		"initContainers", len(pod.Spec.InitContainers), "containers", len(pod.Spec.Containers),
+		"quoteProvider", pod.Annotations[quoteProvAnnotation])
+
+	// A forged node class annotation is removed from opted out pods too.
+	forged := s.removeNodeClass(pod)
+
+	optedOut, warnings := s.optedOut(ctx, req.Namespace, pod)
+	if optedOut {
+		log.V(1).Info("Admitted the opted out pod as is", "selector", s.OptOutSelector)
+		return s.admitOptedOut(req, pod, forged, log)
+	}
+
+	warnings = append(warnings, forged...)
+
+	m, mutationWarnings, err := s.mutatePod(ctx, req.Namespace, pod, log, countWarnings)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	warnings = append(warnings, mutationWarnings...)
+
+	if m.epcUserCount > 0 {
+		// Dry-run pods are not mutated.
+		if !s.DryRun {
+			recordMutation(pod, m.totalEpc, m.aesmdVolume)
+		}
+
+		log.V(1).Info("Mutated the SGX pod", "quoteGeneration", quoteGenerationDeployment(m),
+			"sgxContainers", m.epcUserCount, "totalEpc", m.totalEpc, "warnings", len(warnings))
+	}
+
+	marshaledPod, err := json.Marshal(pod)
+	if err != nil {
+		log.Error(err, "Unable to marshal the mutated pod")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	resp := admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod).WithWarnings(warnings...)
+
+	if s.DryRun {
+		resp = dryRunResponse(resp, log)
+	}
+
+	if s.DecisionSink != nil && m.epcUserCount > 0 {
+		s.DecisionSink.Record(newDecisionRecord("mutating", req, pod, resp))
+	}
+
+	return resp
+}
+
+// admitOptedOut admits an opted out pod as is, but for the forged node class
+// annotation removed from it.
+func (s *Mutator) admitOptedOut(req admission.Request, pod *corev1.Pod, forged []string, log logr.Logger) admission.Response {
+	if len(forged) == 0 {
+		return admission.Allowed("opted out of SGX mutations")
 	}
 
 	marshaledPod, err := json.Marshal(pod)
 	if err != nil {
+		log.Error(err, "Unable to marshal the opted out pod")
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
 
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod).WithWarnings(warnings...)
+	resp := admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod).WithWarnings(forged...)
+
+	if s.DryRun {
+		resp = dryRunResponse(resp, log)
+	}
+
+	return resp
 }
 
 // InjectDecoder implements controller-runtime's admission.DecoderInjector interface.
@@ -0,0 +1,1719 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newTestMutator(t *testing.T) *Mutator {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("unable to create scheme: %+v", err)
+	}
+
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatalf("unable to create decoder: %+v", err)
+	}
+
+	mutator := &Mutator{}
+	if err := mutator.InjectDecoder(decoder); err != nil {
+		t.Fatalf("unable to inject decoder: %+v", err)
+	}
+
+	return mutator
+}
+
+func newTestPod(annotations map[string]string, containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "test-ns",
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: containers,
+		},
+	}
+}
+
+func newTestContainer(name, epcSize string) corev1.Container {
+	container := corev1.Container{
+		Name: name,
+		Resources: corev1.ResourceRequirements{
+			Limits:   corev1.ResourceList{},
+			Requests: corev1.ResourceList{},
+		},
+	}
+
+	if epcSize != "" {
+		container.Resources.Limits[epc] = resource.MustParse(epcSize)
+		container.Resources.Requests[epc] = resource.MustParse(epcSize)
+	}
+
+	return container
+}
+
+// mutateTestPod runs the pod through the mutator and returns the patched pod.
+func mutateTestPod(t *testing.T, mutator *Mutator, pod *corev1.Pod) (*corev1.Pod, admission.Response) {
+	t.Helper()
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("unable to marshal pod: %+v", err)
+	}
+
+	resp := mutator.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Namespace: pod.Namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+
+	if !resp.Allowed {
+		return nil, resp
+	}
+
+	patched := raw
+
+	if len(resp.Patches) > 0 {
+		patchData, err := json.Marshal(resp.Patches)
+		if err != nil {
+			t.Fatalf("unable to marshal patches: %+v", err)
+		}
+
+		patch, err := jsonpatch.DecodePatch(patchData)
+		if err != nil {
+			t.Fatalf("unable to decode patch: %+v", err)
+		}
+
+		if patched, err = patch.Apply(raw); err != nil {
+			t.Fatalf("unable to apply patch: %+v", err)
+		}
+	}
+
+	mutated := &corev1.Pod{}
+	if err := json.Unmarshal(patched, mutated); err != nil {
+		t.Fatalf("unable to unmarshal patched pod: %+v", err)
+	}
+
+	return mutated, resp
+}
+
+func TestEpcNormalization(t *testing.T) {
+	tcases := []struct {
+		name               string
+		expectedAnnotation string
+		epcSizes           []string
+		expectedWarnings   int
+	}{
+		{
+			name:               "binary suffix",
+			epcSizes:           []string{"64Mi"},
+			expectedAnnotation: "64Mi",
+		},
+		{
+			name:               "plain bytes",
+			epcSizes:           []string{"67108864"},
+			expectedAnnotation: "64Mi",
+		},
+		{
+			name:               "mixed binary suffix and plain bytes",
+			epcSizes:           []string{"32Mi", "33554432"},
+			expectedAnnotation: "64Mi",
+		},
+		{
+			name:               "page aligned decimal suffix",
+			epcSizes:           []string{"64M"},
+			expectedAnnotation: "62500Ki",
+		},
+		{
+			name:               "mixed decimal and binary suffixes",
+			epcSizes:           []string{"64M", "62500Ki"},
+			expectedAnnotation: "125000Ki",
+		},
+		{
+			name:               "mixed binary suffixes",
+			epcSizes:           []string{"1Ti", "1024Gi"},
+			expectedAnnotation: "2Ti",
+		},
+		{
+			name:               "decimal gigabyte",
+			epcSizes:           []string{"1G"},
+			expectedAnnotation: "976564Ki",
+			expectedWarnings:   1,
+		},
+		{
+			name:               "binary gigabyte",
+			epcSizes:           []string{"1Gi"},
+			expectedAnnotation: "1Gi",
+		},
+		{
+			name:               "unaligned bytes",
+			epcSizes:           []string{"4097"},
+			expectedAnnotation: "8Ki",
+			expectedWarnings:   1,
+		},
+		{
+			name:               "unaligned decimal suffixes",
+			epcSizes:           []string{"32M", "1Mi"},
+			expectedAnnotation: "32276Ki",
+			expectedWarnings:   1,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			containers := make([]corev1.Container, 0, len(tc.epcSizes))
+			for i, size := range tc.epcSizes {
+				containers = append(containers, newTestContainer(fmt.Sprintf("container%d", i), size))
+			}
+
+			pod, resp := mutateTestPod(t, newTestMutator(t), newTestPod(nil, containers...))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if value := pod.Annotations[epc]; value != tc.expectedAnnotation {
+				t.Errorf("expected annotation %q, got %q", tc.expectedAnnotation, value)
+			}
+
+			if len(resp.Warnings) != tc.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", tc.expectedWarnings, resp.Warnings)
+			}
+
+			for i, container := range pod.Spec.Containers {
+				original := resource.MustParse(tc.epcSizes[i])
+				limit := container.Resources.Limits[epc]
+				request := container.Resources.Requests[epc]
+
+				// The value is kept, only rounded up to whole pages.
+				expected, _ := roundUpToEpcPage(original.Value())
+				if limit.Value() != expected || request.Value() != expected || expected-original.Value() >= epcPageBytes {
+					t.Errorf("container %s: EPC value changed from %s to %s/%s", container.Name, original.String(), limit.String(), request.String())
+				}
+
+				if limit.String() != canonicalEpc(expected).String() {
+					t.Errorf("container %s: EPC limit %s is not in canonical form", container.Name, limit.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRoundUpToEpcPage(t *testing.T) {
+	for size, expected := range map[int64]int64{4096: 4096, 4097: 8192, 1: 4096, 1000000000: 1000001536} {
+		rounded, aligned := roundUpToEpcPage(size)
+		if rounded != expected || aligned != (size == expected) {
+			t.Errorf("%d: expected %d (aligned %v), got %d (aligned %v)", size, expected, size == expected, rounded, aligned)
+		}
+	}
+}
+
+func TestEpcClass(t *testing.T) {
+	tcases := []struct {
+		annotations   map[string]string
+		name          string
+		expectedClass string
+		epcSizes      []string
+	}{
+		{
+			name:          "below the smallest minimum",
+			epcSizes:      []string{"512Ki"},
+			expectedClass: "",
+		},
+		{
+			name:          "small",
+			epcSizes:      []string{"1Mi"},
+			expectedClass: "small",
+		},
+		{
+			name:          "medium total of several containers",
+			epcSizes:      []string{"32Mi", "32Mi"},
+			expectedClass: "medium",
+		},
+		{
+			name:          "large",
+			epcSizes:      []string{"2Gi"},
+			expectedClass: "large",
+		},
+		{
+			name:          "class set by the user",
+			annotations:   map[string]string{epcClassAnnotation: "small"},
+			epcSizes:      []string{"1Gi"},
+			expectedClass: "large",
+		},
+		{
+			name:          "class set by the user below the smallest minimum",
+			annotations:   map[string]string{epcClassAnnotation: "large"},
+			epcSizes:      []string{"4Ki"},
+			expectedClass: "",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.EpcClasses = map[string]string{
+				"small":  "1Mi",
+				"medium": "64Mi",
+				"large":  "1Gi",
+			}
+
+			containers := make([]corev1.Container, 0, len(tc.epcSizes))
+			for i, size := range tc.epcSizes {
+				containers = append(containers, newTestContainer(fmt.Sprintf("container%d", i), size))
+			}
+
+			pod, _ := mutateTestPod(t, mutator, newTestPod(tc.annotations, containers...))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if class := pod.Annotations[epcClassAnnotation]; class != tc.expectedClass {
+				t.Errorf("expected class %q, got %q", tc.expectedClass, class)
+			}
+		})
+	}
+}
+
+func TestEpcPageSize(t *testing.T) {
+	tcases := []struct {
+		name             string
+		pageSize         string
+		epcSize          string
+		expectedPageSize string
+	}{
+		{
+			name:             "configured page size",
+			pageSize:         "4096",
+			epcSize:          "1Mi",
+			expectedPageSize: "4Ki",
+		},
+		{
+			name:    "disabled",
+			epcSize: "1Mi",
+		},
+		{
+			name:     "non-SGX pod",
+			pageSize: "4Ki",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.EpcPageSize = tc.pageSize
+
+			pod, _ := mutateTestPod(t, mutator, newTestPod(nil, newTestContainer("test", tc.epcSize)))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if pageSize := pod.Annotations[epcPageSizeAnnotation]; pageSize != tc.expectedPageSize {
+				t.Errorf("expected page size annotation %q, got %q", tc.expectedPageSize, pageSize)
+			}
+		})
+	}
+}
+
+func TestAesmdContainerName(t *testing.T) {
+	tcases := []struct {
+		name                string
+		aesmdName           string
+		annotatedName       string
+		expectedProvisioned string
+		containers          []string
+		expectedEmptyDir    bool
+	}{
+		{
+			name:                "default sidecar name",
+			containers:          []string{"app", "aesmd"},
+			expectedProvisioned: "aesmd",
+			expectedEmptyDir:    true,
+		},
+		{
+			name:                "configured sidecar name",
+			aesmdName:           "sgx-aesmd",
+			containers:          []string{"app", "sgx-aesmd"},
+			expectedProvisioned: "sgx-aesmd",
+			expectedEmptyDir:    true,
+		},
+		{
+			name:       "default sidecar name with a configured name",
+			aesmdName:  "sgx-aesmd",
+			containers: []string{"app", "aesmd"},
+		},
+		{
+			name:       "DaemonSet with a configured name",
+			aesmdName:  "sgx-aesmd",
+			containers: []string{"app"},
+		},
+		{
+			name:                "annotated sidecar name",
+			annotatedName:       "release-1-quote-service",
+			containers:          []string{"app", "release-1-quote-service"},
+			expectedProvisioned: "release-1-quote-service",
+			expectedEmptyDir:    true,
+		},
+		{
+			name:                "annotated sidecar name with a configured name",
+			aesmdName:           "sgx-aesmd",
+			annotatedName:       "release-1-quote-service",
+			containers:          []string{"app", "sgx-aesmd", "release-1-quote-service"},
+			expectedProvisioned: "release-1-quote-service",
+			expectedEmptyDir:    true,
+		},
+		{
+			name:          "default sidecar name with an annotated name",
+			annotatedName: "release-1-quote-service",
+			containers:    []string{"app", "aesmd"},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			containers := make([]corev1.Container, 0, len(tc.containers))
+			for _, name := range tc.containers {
+				containers = append(containers, newTestContainer(name, "1Mi"))
+			}
+
+			mutator := newTestMutator(t)
+			mutator.AesmdContainerName = tc.aesmdName
+
+			annotations := map[string]string{quoteProvAnnotation: aesmdQuoteProvKey}
+			if tc.annotatedName != "" {
+				annotations[aesmdContainerAnnotation] = tc.annotatedName
+			}
+
+			pod, _ := mutateTestPod(t, mutator, newTestPod(annotations, containers...))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			volume, count := findVolume(pod, aesmdSocketName)
+			if count != 1 {
+				t.Fatalf("expected one %s volume, got %d", aesmdSocketName, count)
+			}
+
+			if isEmptyDir := volume.EmptyDir != nil; isEmptyDir != tc.expectedEmptyDir {
+				t.Errorf("expected emptyDir %v, got volume %+v", tc.expectedEmptyDir, volume.VolumeSource)
+			}
+
+			if !tc.expectedEmptyDir && volume.HostPath == nil {
+				t.Errorf("expected a hostPath volume, got %+v", volume.VolumeSource)
+			}
+
+			for i := range pod.Spec.Containers {
+				container := &pod.Spec.Containers[i]
+
+				_, provisioned := container.Resources.Limits[provision]
+				if expected := container.Name == tc.expectedProvisioned; provisioned != expected {
+					t.Errorf("container %s: expected %s %v, got %v", container.Name, provision, expected, provisioned)
+				}
+
+				if countVolumeMounts(container, aesmdSocketDirectoryPath) != 1 {
+					t.Errorf("container %s: expected the aesmd socket directory mounted", container.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestAesmdSocketDir(t *testing.T) {
+	tcases := []struct {
+		name             string
+		socketDir        string
+		expectedDir      string
+		containers       []corev1.Container
+		expectedHostPath bool
+	}{
+		{
+			name:             "default directory with the aesmd DaemonSet",
+			containers:       []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedDir:      "/var/run/aesmd",
+			expectedHostPath: true,
+		},
+		{
+			name:             "relocated directory with the aesmd DaemonSet",
+			socketDir:        "/run/aesmd",
+			containers:       []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedDir:      "/run/aesmd",
+			expectedHostPath: true,
+		},
+		{
+			name:        "relocated directory with the aesmd sidecar",
+			socketDir:   "/run/aesmd",
+			containers:  []corev1.Container{newTestContainer("app", "1Mi"), newTestContainer("aesmd", "1Mi")},
+			expectedDir: "/run/aesmd",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.AesmdSocketDir = tc.socketDir
+
+			pod, _ := mutateTestPod(t, mutator, newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey}, tc.containers...))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			volume, count := findVolume(pod, aesmdSocketName)
+			if count != 1 {
+				t.Fatalf("expected 1 aesmd volume, got %d", count)
+			}
+
+			if tc.expectedHostPath {
+				if volume.HostPath == nil || volume.HostPath.Path != tc.expectedDir {
+					t.Errorf("expected a hostPath volume of %s, got %+v", tc.expectedDir, volume.VolumeSource)
+				}
+			} else if volume.EmptyDir == nil {
+				t.Errorf("expected an emptyDir volume, got %+v", volume.VolumeSource)
+			}
+
+			for i := range pod.Spec.Containers {
+				container := &pod.Spec.Containers[i]
+
+				if count := countVolumeMounts(container, tc.expectedDir); count != 1 {
+					t.Errorf("container %s: expected 1 mount at %s, got %d", container.Name, tc.expectedDir, count)
+				}
+
+				if value, _ := findEnv(container, "SGX_AESM_ADDR"); value != "1" {
+					t.Errorf("container %s: expected SGX_AESM_ADDR=1, got %q", container.Name, value)
+				}
+			}
+		})
+	}
+}
+
+func TestAesmdSocketMedium(t *testing.T) {
+	hostPathSocket := corev1.Volume{
+		Name: aesmdSocketName,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: "/var/run/aesmd"},
+		},
+	}
+
+	tcases := []struct {
+		name            string
+		medium          string
+		volumes         []corev1.Volume
+		expectedMedium  corev1.StorageMedium
+		expectedWarning bool
+		expectedSource  bool
+	}{
+		{
+			name:           "default medium",
+			expectedMedium: corev1.StorageMediumMemory,
+		},
+		{
+			name:           "memory medium",
+			medium:         "Memory",
+			expectedMedium: corev1.StorageMediumMemory,
+		},
+		{
+			name:           "disk medium",
+			medium:         diskMedium,
+			expectedMedium: corev1.StorageMediumDefault,
+		},
+		{
+			name:            "conflicting volume",
+			volumes:         []corev1.Volume{hostPathSocket},
+			expectedWarning: true,
+			expectedSource:  true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.AesmdSocketMedium = tc.medium
+
+			testPod := newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey},
+				newTestContainer("app", "1Mi"), newTestContainer("aesmd", "1Mi"))
+			testPod.Spec.Volumes = tc.volumes
+
+			pod, resp := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			volume, count := findVolume(pod, aesmdSocketName)
+			if count != 1 {
+				t.Fatalf("expected one %s volume, got %d", aesmdSocketName, count)
+			}
+
+			if tc.expectedSource {
+				if volume.HostPath == nil || volume.EmptyDir != nil {
+					t.Errorf("expected the volume of the pod kept, got %+v", volume.VolumeSource)
+				}
+			} else if volume.EmptyDir == nil || volume.EmptyDir.Medium != tc.expectedMedium {
+				t.Errorf("expected an emptyDir of medium %q, got %+v", tc.expectedMedium, volume.VolumeSource)
+			}
+
+			warnedVolume := func(warnings []string) bool {
+				for _, warning := range warnings {
+					if strings.Contains(warning, aesmdSocketName+" volume") {
+						return true
+					}
+				}
+
+				return false
+			}
+
+			if warned := warnedVolume(resp.Warnings); warned != tc.expectedWarning {
+				t.Errorf("expected warning %v, got %v", tc.expectedWarning, resp.Warnings)
+			}
+
+			// The volume added by the webhook is not warned about when the pod
+			// is mutated again.
+			if _, resp := mutateTestPod(t, mutator, pod); warnedVolume(resp.Warnings) != tc.expectedWarning {
+				t.Errorf("expected warning %v on reinvocation, got %v", tc.expectedWarning, resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestAesmAddr(t *testing.T) {
+	tcases := []struct {
+		name            string
+		aesmAddr        string
+		userEnv         string
+		expectedValue   string
+		expectedWarning bool
+	}{
+		{
+			name:          "default",
+			expectedValue: "1",
+		},
+		{
+			name:          "socket path",
+			aesmAddr:      "/var/run/aesmd/aesm.sock",
+			expectedValue: "/var/run/aesmd/aesm.sock",
+		},
+		{
+			name:            "set by the user",
+			aesmAddr:        "/var/run/aesmd/aesm.sock",
+			userEnv:         "/tmp/aesm.sock",
+			expectedValue:   "/tmp/aesm.sock",
+			expectedWarning: true,
+		},
+		{
+			name:          "set by the user to the same value",
+			userEnv:       "1",
+			expectedValue: "1",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.AesmAddr = tc.aesmAddr
+
+			container := newTestContainer("app", "1Mi")
+			if tc.userEnv != "" {
+				container.Env = []corev1.EnvVar{{Name: "SGX_AESM_ADDR", Value: tc.userEnv}}
+			}
+
+			pod, resp := mutateTestPod(t, mutator, newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey}, container))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if value, count := findEnv(&pod.Spec.Containers[0], "SGX_AESM_ADDR"); count != 1 || value != tc.expectedValue {
+				t.Errorf("expected one SGX_AESM_ADDR=%s env, got %d with value %q", tc.expectedValue, count, value)
+			}
+
+			warned := false
+			for _, warning := range resp.Warnings {
+				warned = warned || strings.Contains(warning, "SGX_AESM_ADDR")
+			}
+
+			if warned != tc.expectedWarning {
+				t.Errorf("expected SGX_AESM_ADDR warning %v, got %v", tc.expectedWarning, resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestEnvVarExists(t *testing.T) {
+	container := newTestContainer("app", "1Mi")
+
+	if envVarExists("SGX_AESM_ADDR", &container) {
+		t.Error("env found in a container without envs")
+	}
+
+	container.Env = []corev1.EnvVar{{Name: "OTHER", Value: "1"}, {Name: "SGX_AESM_ADDR", Value: "/tmp/aesm.sock"}}
+
+	if !envVarExists("SGX_AESM_ADDR", &container) {
+		t.Error("env set in the container not found")
+	}
+
+	if envVarExists("SGX_AESM", &container) {
+		t.Error("env not set in the container found")
+	}
+}
+
+func TestUnknownQuoteProviderWarning(t *testing.T) {
+	testPod := newTestPod(map[string]string{quoteProvAnnotation: "my-typo"},
+		newTestContainer("app", "1Mi"), newTestContainer("sidecar", ""))
+	testPod.Spec.InitContainers = []corev1.Container{newTestContainer("init", "")}
+
+	pod, resp := mutateTestPod(t, newTestMutator(t), testPod)
+	if pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	expected := "sgx.intel.com/quote-provider names my-typo which is not a container of the pod, " +
+		"no container gets sgx.intel.com/provision for it (containers: init, app, sidecar)"
+
+	if !reflect.DeepEqual(resp.Warnings, []string{expected}) {
+		t.Errorf("expected warning %q, got %v", expected, resp.Warnings)
+	}
+
+	if _, ok := pod.Spec.Containers[0].Resources.Limits[provision]; ok {
+		t.Errorf("container app got %s", provision)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	client := fake.NewClientBuilder().WithObjects(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "other-ns",
+			Annotations: map[string]string{attestationAudienceAnnotation: "https://verifier.example.com"},
+		},
+	}).Build()
+
+	t.Run("SGX pod", func(t *testing.T) {
+		pod := newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey},
+			newTestContainer("app", "1Mi"), newTestContainer("plain", ""))
+
+		warnings, err := Mutate(context.Background(), pod, MutateOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if len(warnings) != 0 {
+			t.Errorf("unexpected warnings %v", warnings)
+		}
+
+		if _, ok := pod.Spec.Containers[0].Resources.Limits[encl]; !ok {
+			t.Error("expected the app container to get sgx.intel.com/enclave")
+		}
+
+		if len(pod.Spec.Containers[1].Resources.Limits) != 0 {
+			t.Errorf("expected the plain container to be kept, got %v", pod.Spec.Containers[1].Resources.Limits)
+		}
+
+		if value, _ := findEnv(&pod.Spec.Containers[0], aesmAddrEnv); value != "1" {
+			t.Errorf("expected %s=1, got %q", aesmAddrEnv, value)
+		}
+
+		if volume, _ := findVolume(pod, aesmdSocketName); volume == nil {
+			t.Error("expected the aesmd socket volume")
+		}
+
+		if value := pod.Annotations[epc]; value != "1Mi" {
+			t.Errorf("expected total EPC 1Mi, got %q", value)
+		}
+	})
+
+	t.Run("namespace annotations", func(t *testing.T) {
+		pod := newTestPod(nil, newTestContainer("app", "1Mi"))
+
+		if _, err := Mutate(context.Background(), pod, MutateOptions{Client: client, Namespace: "other-ns"}); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if value, _ := findEnv(&pod.Spec.Containers[0], "SGX_ATTESTATION_AUDIENCE"); value != "https://verifier.example.com" {
+			t.Errorf("expected the namespace attestation audience, got %q", value)
+		}
+	})
+
+	t.Run("configuration", func(t *testing.T) {
+		pod := newTestPod(nil, newTestContainer("app", "1Mi"))
+
+		if _, err := Mutate(context.Background(), pod, MutateOptions{MutatorConfig: MutatorConfig{EpcPageSize: "4Ki"}}); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if value := pod.Annotations[epcPageSizeAnnotation]; value != "4Ki" {
+			t.Errorf("expected EPC page size 4Ki, got %q", value)
+		}
+	})
+
+	t.Run("non-SGX pod", func(t *testing.T) {
+		pod := newTestPod(map[string]string{}, newTestContainer("plain", ""))
+		original := pod.DeepCopy()
+
+		if _, err := Mutate(context.Background(), pod, MutateOptions{}); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if !reflect.DeepEqual(pod, original) {
+			t.Errorf("expected the pod to be kept, got %+v", pod)
+		}
+	})
+
+	t.Run("overcommitted resource", func(t *testing.T) {
+		container := newTestContainer("app", "1Mi")
+		container.Resources.Requests[epc] = resource.MustParse("2Mi")
+
+		if _, err := Mutate(context.Background(), newTestPod(nil, container), MutateOptions{}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		for _, config := range []MutatorConfig{{EpcPageSize: "4Kb"}, {DefaultEpc: "64Mib"}} {
+			pod := newTestPod(nil, newTestContainer("app", "1Mi"))
+			original := pod.DeepCopy()
+
+			if _, err := Mutate(context.Background(), pod, MutateOptions{MutatorConfig: config}); err == nil {
+				t.Errorf("expected an error for %+v", config)
+			}
+
+			if !reflect.DeepEqual(pod, original) {
+				t.Errorf("expected the pod to be kept for %+v, got %+v", config, pod)
+			}
+		}
+	})
+
+	t.Run("uncounted warnings", func(t *testing.T) {
+		counted := testutil.ToFloat64(mutationWarnings.WithLabelValues(directResourceWarning))
+		pod := newTestPod(nil, withResource(newTestContainer("app", "1Mi"), encl, "2"))
+
+		warnings, err := Mutate(context.Background(), pod, MutateOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if len(warnings) != 1 {
+			t.Errorf("expected a warning, got %v", warnings)
+		}
+
+		if delta := testutil.ToFloat64(mutationWarnings.WithLabelValues(directResourceWarning)) - counted; delta != 0 {
+			t.Errorf("expected the webhook metrics to be kept, got %v more warnings", delta)
+		}
+	})
+
+	t.Run("same as the webhook", func(t *testing.T) {
+		pod := newTestPod(map[string]string{quoteProvAnnotation: "app"},
+			newTestContainer("init", "1Mi"), newTestContainer("app", "2Mi"))
+		pod.Spec.InitContainers = pod.Spec.Containers[:1]
+		pod.Spec.Containers = pod.Spec.Containers[1:]
+
+		admitted, resp := mutateTestPod(t, newTestMutator(t), pod.DeepCopy())
+		if admitted == nil {
+			t.Fatal("pod was not admitted")
+		}
+
+		warnings, err := Mutate(context.Background(), pod, MutateOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		// The quantities differ in their cached strings, compare the pods as JSON.
+		expected, _ := json.Marshal(admitted)
+		if mutated, _ := json.Marshal(pod); string(mutated) != string(expected) {
+			t.Errorf("expected the admitted pod %s, got %s", expected, mutated)
+		}
+
+		if len(warnings) != len(resp.Warnings) {
+			t.Errorf("expected warnings %v, got %v", resp.Warnings, warnings)
+		}
+	})
+}
+
+func TestProvisionOnly(t *testing.T) {
+	tcases := []struct {
+		name        string
+		containers  []corev1.Container
+		expectedEpc string
+	}{
+		{
+			name:        "attestation helper with an SGX container",
+			containers:  []corev1.Container{newTestContainer("app", "1Mi"), newTestContainer("helper", "")},
+			expectedEpc: "1Mi",
+		},
+		{
+			name:       "attestation helper only",
+			containers: []corev1.Container{newTestContainer("helper", ""), newTestContainer("other", "")},
+		},
+		{
+			name:       "attestation helper without resource maps",
+			containers: []corev1.Container{{Name: "helper"}},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			annotations := map[string]string{
+				provisionOnlyAnnotation:          " helper",
+				provisionJustificationAnnotation: "quote proxy",
+			}
+
+			pod, resp := mutateTestPod(t, mutator, newTestPod(annotations, tc.containers...))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if len(resp.Warnings) != 0 {
+				t.Errorf("unexpected warnings %v", resp.Warnings)
+			}
+
+			for _, container := range pod.Spec.Containers {
+				resources := container.Resources
+				_, hasProvision := resources.Limits[provision]
+
+				if container.Name == "helper" {
+					if len(resources.Limits) != 1 || len(resources.Requests) != 1 || !hasProvision || resources.Requests[provision] != resource.MustParse("1") {
+						t.Errorf("expected the helper to get only %s, got %v and %v", provision, resources.Limits, resources.Requests)
+					}
+				} else if container.Name == "other" && len(resources.Limits) != 0 {
+					t.Errorf("expected no resources for %s, got %v", container.Name, resources.Limits)
+				}
+			}
+
+			if value := pod.Annotations[epc]; value != tc.expectedEpc {
+				t.Errorf("expected total EPC %q, got %q", tc.expectedEpc, value)
+			}
+
+			if resp := validateTestPod(t, newTestValidator(t), pod); !resp.Allowed {
+				t.Errorf("expected the mutated pod to be allowed, got %v", resp.Result)
+			}
+
+			again, resp := mutateTestPod(t, mutator, pod.DeepCopy())
+			if again == nil || len(resp.Patches) > 0 {
+				t.Errorf("expected the mutated pod to be kept, got %v", resp.Patches)
+			}
+
+			for _, warning := range resp.Warnings {
+				if strings.HasPrefix(warning, provision) {
+					t.Errorf("unexpected warning %q for the mutated pod", warning)
+				}
+			}
+		})
+	}
+
+	// Containers not listed can't request sgx.intel.com/provision without EPC.
+	container := newTestContainer("other", "")
+	container.Resources.Limits[provision] = resource.MustParse("1")
+	container.Resources.Requests[provision] = resource.MustParse("1")
+
+	pod := newTestPod(map[string]string{provisionOnlyAnnotation: "helper"}, container)
+	if resp := validateTestPod(t, newTestValidator(t), pod); resp.Allowed {
+		t.Error("expected a direct provision request to be denied")
+	}
+}
+
+func TestOneSidedResources(t *testing.T) {
+	tcases := []struct {
+		name     string
+		limits   bool
+		requests bool
+	}{
+		{
+			name:     "only requests",
+			requests: true,
+		},
+		{
+			name:   "only limits",
+			limits: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			container := corev1.Container{Name: "app"}
+			resources := corev1.ResourceList{epc: resource.MustParse("1Mi")}
+
+			if tc.limits {
+				container.Resources.Limits = resources
+			}
+
+			if tc.requests {
+				container.Resources.Requests = resources
+			}
+
+			pod, resp := mutateTestPod(t, newTestMutator(t), newTestPod(map[string]string{quoteProvAnnotation: "app"}, container))
+			if pod == nil {
+				t.Fatalf("pod was not admitted: %v", resp.Result)
+			}
+
+			mutated := pod.Spec.Containers[0].Resources
+
+			for _, name := range []corev1.ResourceName{epc, encl, provision} {
+				limit, inLimits := mutated.Limits[name]
+				request, inRequests := mutated.Requests[name]
+
+				if !inLimits || !inRequests || limit.Cmp(request) != 0 {
+					t.Errorf("expected equal %s limit and request, got %v and %v", name, mutated.Limits, mutated.Requests)
+				}
+			}
+		})
+	}
+}
+
+func TestPresetEnclave(t *testing.T) {
+	tcases := []struct {
+		name            string
+		enclave         string
+		epc             string
+		expectedWarning string
+		expectedPatched bool
+	}{
+		{
+			name:    "already set enclave",
+			enclave: "1",
+			epc:     "1Mi",
+		},
+		{
+			name:            "wrong enclave size",
+			enclave:         "2",
+			epc:             "1Mi",
+			expectedWarning: "container app sets " + encl + " to 2, normalized to 1",
+			expectedPatched: true,
+		},
+		{
+			name:            "enclave without EPC",
+			enclave:         "1",
+			expectedWarning: encl + " should not be used in Pod spec directly",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod, resp := mutateTestPod(t, newTestMutator(t),
+				newTestPod(nil, withResource(newTestContainer("app", tc.epc), encl, tc.enclave)))
+			if pod == nil {
+				t.Fatalf("pod was not admitted: %v", resp.Result)
+			}
+
+			warned := map[string]bool{}
+			for _, warning := range resp.Warnings {
+				warned[warning] = true
+			}
+
+			for _, warning := range []string{
+				encl + " should not be used in Pod spec directly",
+				"container app sets " + encl + " to " + tc.enclave + ", normalized to 1",
+			} {
+				if warned[warning] != (warning == tc.expectedWarning) {
+					t.Errorf("unexpected warnings %v", resp.Warnings)
+				}
+			}
+
+			patched := false
+
+			for _, patch := range resp.Patches {
+				if strings.Contains(patch.Path, "sgx.intel.com~1enclave") {
+					patched = true
+				}
+			}
+
+			if patched != tc.expectedPatched {
+				t.Errorf("expected %s patched %v, got %v", encl, tc.expectedPatched, resp.Patches)
+			}
+
+			if limit := pod.Spec.Containers[0].Resources.Limits[encl]; limit.Value() != 1 && tc.epc != "" {
+				t.Errorf("expected %s limit 1, got %s", encl, limit.String())
+			}
+		})
+	}
+}
+
+func TestDefaultEpc(t *testing.T) {
+	directWarning := encl + " should not be used in Pod spec directly"
+	convertedWarning := "container app requests " + encl + " without " + epc + ", converted to a request of 64Mi " + epc
+
+	tcases := []struct {
+		name            string
+		defaultEpc      string
+		container       corev1.Container
+		expectedEpc     string
+		expectedWarning string
+	}{
+		{
+			name:            "disabled",
+			container:       withResource(newTestContainer("app", ""), encl, "1"),
+			expectedWarning: directWarning,
+		},
+		{
+			name:            "direct enclave request",
+			defaultEpc:      "64Mi",
+			container:       withResource(newTestContainer("app", ""), encl, "1"),
+			expectedEpc:     "64Mi",
+			expectedWarning: convertedWarning,
+		},
+		{
+			name:        "EPC request",
+			defaultEpc:  "64Mi",
+			container:   withResource(newTestContainer("app", "1Mi"), encl, "1"),
+			expectedEpc: "1Mi",
+		},
+		{
+			name:       "non-SGX container",
+			defaultEpc: "64Mi",
+			container:  newTestContainer("app", ""),
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.DefaultEpc = tc.defaultEpc
+
+			pod, resp := mutateTestPod(t, mutator, newTestPod(nil, tc.container))
+			if pod == nil {
+				t.Fatalf("pod was not admitted: %v", resp.Result)
+			}
+
+			if pod.Annotations[epc] != tc.expectedEpc {
+				t.Errorf("expected %s annotation %q, got %q", epc, tc.expectedEpc, pod.Annotations[epc])
+			}
+
+			resources := pod.Spec.Containers[0].Resources
+			if limit, ok := resources.Limits[epc]; tc.expectedEpc != "" && (!ok || limit.String() != tc.expectedEpc) {
+				t.Errorf("expected %s limit %s, got %v", epc, tc.expectedEpc, resources.Limits)
+			}
+
+			if tc.expectedEpc != "" {
+				if limit := resources.Limits[encl]; limit.Value() != 1 {
+					t.Errorf("expected %s limit 1, got %v", encl, resources.Limits)
+				}
+			}
+
+			warned := map[string]bool{}
+			for _, warning := range resp.Warnings {
+				warned[warning] = true
+			}
+
+			for _, warning := range []string{directWarning, convertedWarning} {
+				if warned[warning] != (warning == tc.expectedWarning) {
+					t.Errorf("unexpected warnings %v", resp.Warnings)
+				}
+			}
+		})
+	}
+}
+
+func TestEpcResourceNames(t *testing.T) {
+	const alternative = corev1.ResourceName("sgx.example.com/epc")
+
+	withAlternativeEpc := func(name, size string) corev1.Container {
+		container := newTestContainer(name, "")
+		container.Resources.Limits[alternative] = resource.MustParse(size)
+		container.Resources.Requests[alternative] = resource.MustParse(size)
+
+		return container
+	}
+
+	tcases := []struct {
+		name            string
+		epcNames        []string
+		containers      []corev1.Container
+		expectedEpc     string
+		expectedMutated []string
+		expectedRounded bool
+	}{
+		{
+			name:        "alternative name not accepted",
+			containers:  []corev1.Container{withAlternativeEpc("app", "1Mi")},
+			expectedEpc: "",
+		},
+		{
+			name:            "alternative name",
+			epcNames:        []string{string(alternative)},
+			containers:      []corev1.Container{withAlternativeEpc("app", "1Mi")},
+			expectedEpc:     "1Mi",
+			expectedMutated: []string{"app"},
+		},
+		{
+			name:            "both names",
+			epcNames:        []string{string(alternative)},
+			containers:      []corev1.Container{newTestContainer("app", "1Mi"), withAlternativeEpc("helper", "2Mi")},
+			expectedEpc:     "3Mi",
+			expectedMutated: []string{"app", "helper"},
+		},
+		{
+			name:            "unaligned alternative request",
+			epcNames:        []string{string(alternative)},
+			containers:      []corev1.Container{withAlternativeEpc("app", "1000")},
+			expectedEpc:     "4Ki",
+			expectedMutated: []string{"app"},
+			expectedRounded: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.EpcResourceNames = tc.epcNames
+
+			pod, resp := mutateTestPod(t, mutator, newTestPod(map[string]string{quoteProvAnnotation: "app,helper"}, tc.containers...))
+			if pod == nil {
+				t.Fatalf("pod was not admitted: %v", resp.Result)
+			}
+
+			if value := pod.Annotations[epc]; value != tc.expectedEpc {
+				t.Errorf("expected %s annotation %q, got %q", epc, tc.expectedEpc, value)
+			}
+
+			rounded := false
+
+			for _, warning := range resp.Warnings {
+				if strings.Contains(warning, "rounded up") {
+					rounded = true
+				}
+			}
+
+			if rounded != tc.expectedRounded {
+				t.Errorf("expected rounding warning %v, got %v", tc.expectedRounded, resp.Warnings)
+			}
+
+			mutated := map[string]bool{}
+			for _, name := range tc.expectedMutated {
+				mutated[name] = true
+			}
+
+			for i := range pod.Spec.Containers {
+				container := &pod.Spec.Containers[i]
+
+				for _, name := range []corev1.ResourceName{encl, provision} {
+					if _, ok := container.Resources.Limits[name]; ok != mutated[container.Name] {
+						t.Errorf("container %s: expected %s %v, got %v", container.Name, name, mutated[container.Name], ok)
+					}
+				}
+
+				// The alternative requests are kept under their name.
+				if quantity, ok := container.Resources.Limits[alternative]; ok {
+					if _, ok := container.Resources.Limits[epc]; ok {
+						t.Errorf("container %s: unexpected %s with %s", container.Name, epc, alternative)
+					}
+
+					if quantity.Value()%epcPageBytes != 0 && mutated[container.Name] {
+						t.Errorf("container %s: %s %s is not rounded up to whole pages", container.Name, alternative, quantity.String())
+					}
+				}
+			}
+
+			validator := newTestValidator(t)
+			validator.EpcResourceNames = tc.epcNames
+
+			if resp := validateTestPod(t, validator, pod); !resp.Allowed {
+				t.Errorf("the mutated pod was denied: %v", resp.Result)
+			}
+		})
+	}
+}
+
+func TestOptOut(t *testing.T) {
+	tcases := []struct {
+		nsLabels      map[string]string
+		podLabels     map[string]string
+		name          string
+		selector      string
+		expectMutated bool
+	}{
+		{
+			name:          "no selector",
+			podLabels:     map[string]string{"sgx.intel.com/mutate": "false"},
+			expectMutated: true,
+		},
+		{
+			name:          "no label",
+			selector:      "sgx.intel.com/mutate=false",
+			expectMutated: true,
+		},
+		{
+			name:      "opted out pod",
+			selector:  "sgx.intel.com/mutate=false",
+			podLabels: map[string]string{"sgx.intel.com/mutate": "false"},
+		},
+		{
+			name:     "opted out namespace",
+			selector: "sgx.intel.com/mutate=false",
+			nsLabels: map[string]string{"sgx.intel.com/mutate": "false"},
+		},
+		{
+			name:          "opted in pod",
+			selector:      "sgx.intel.com/mutate=false",
+			podLabels:     map[string]string{"sgx.intel.com/mutate": "true"},
+			expectMutated: true,
+		},
+		{
+			name:      "opt-in selector without a label",
+			selector:  "sgx.intel.com/mutate!=true",
+			podLabels: map[string]string{"app": "test"},
+		},
+		{
+			name:          "opt-in selector with an opted in namespace",
+			selector:      "sgx.intel.com/mutate!=true",
+			nsLabels:      map[string]string{"sgx.intel.com/mutate": "true"},
+			podLabels:     map[string]string{"sgx.intel.com/mutate": "true"},
+			expectMutated: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+			mutator.OptOutSelector = tc.selector
+			mutator.Client = fake.NewClientBuilder().WithObjects(&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "test-ns",
+					Labels: tc.nsLabels,
+				},
+			}).Build()
+
+			testPod := newTestPod(nil, newTestContainer("sgx", "1Mi"))
+			testPod.Labels = tc.podLabels
+
+			pod, resp := mutateTestPod(t, mutator, testPod)
+			if pod == nil {
+				t.Fatalf("pod was not admitted: %v", resp.Result)
+			}
+
+			_, mutated := pod.Spec.Containers[0].Resources.Limits[encl]
+			if mutated != tc.expectMutated {
+				t.Errorf("expected mutated %v, got %v", tc.expectMutated, mutated)
+			}
+
+			if !tc.expectMutated && len(resp.Patches) > 0 {
+				t.Errorf("expected no patches, got %v", resp.Patches)
+			}
+		})
+	}
+}
+
+func TestInitContainers(t *testing.T) {
+	tcases := []struct {
+		name           string
+		quoteProvider  string
+		expectedEpc    string
+		initContainers []corev1.Container
+		containers     []corev1.Container
+		expectedVolume bool
+	}{
+		{
+			name:           "init container only",
+			quoteProvider:  aesmdQuoteProvKey,
+			initContainers: []corev1.Container{newTestContainer("seal", "1Mi")},
+			containers:     []corev1.Container{newTestContainer("app", "")},
+			expectedEpc:    "1Mi",
+			expectedVolume: true,
+		},
+		{
+			name:           "mixed pod",
+			quoteProvider:  aesmdQuoteProvKey,
+			initContainers: []corev1.Container{newTestContainer("seal", "2Mi"), newTestContainer("setup", "")},
+			containers:     []corev1.Container{newTestContainer("app", "4Mi")},
+			expectedEpc:    "6Mi",
+			expectedVolume: true,
+		},
+		{
+			name:           "in-process init container",
+			quoteProvider:  "seal",
+			initContainers: []corev1.Container{newTestContainer("seal", "1Mi")},
+			containers:     []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedEpc:    "2Mi",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testPod := newTestPod(map[string]string{quoteProvAnnotation: tc.quoteProvider}, tc.containers...)
+			testPod.Spec.InitContainers = tc.initContainers
+
+			pod, _ := mutateTestPod(t, newTestMutator(t), testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if value := pod.Annotations[epc]; value != tc.expectedEpc {
+				t.Errorf("expected %s annotation %q, got %q", epc, tc.expectedEpc, value)
+			}
+
+			if _, count := findVolume(pod, aesmdSocketName); (count == 1) != tc.expectedVolume {
+				t.Errorf("expected aesmd volume %v, got %d", tc.expectedVolume, count)
+			}
+
+			all := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+			for i := range all {
+				container := &all[i]
+
+				_, usesSgx := container.Resources.Limits[epc]
+				_, hasEnclave := container.Resources.Limits[encl]
+				_, hasProvision := container.Resources.Limits[provision]
+
+				if hasEnclave != usesSgx {
+					t.Errorf("container %s: expected %s %v, got %v", container.Name, encl, usesSgx, hasEnclave)
+				}
+
+				if expected := container.Name == tc.quoteProvider; hasProvision != expected {
+					t.Errorf("container %s: expected %s %v, got %v", container.Name, provision, expected, hasProvision)
+				}
+
+				mounted := countVolumeMounts(container, aesmdSocketDirectoryPath) == 1
+				if expected := usesSgx && tc.expectedVolume; mounted != expected {
+					t.Errorf("container %s: expected aesmd socket mount %v, got %v", container.Name, expected, mounted)
+				}
+			}
+		})
+	}
+}
+
+func TestEphemeralContainers(t *testing.T) {
+	testPod := newTestPod(map[string]string{quoteProvAnnotation: aesmdQuoteProvKey}, newTestContainer("app", "1Mi"))
+	testPod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+				Name:  "debugger",
+				Image: "busybox",
+			},
+			TargetContainerName: "app",
+		},
+	}
+
+	pod, _ := mutateTestPod(t, newTestMutator(t), testPod)
+	if pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	if len(pod.Spec.EphemeralContainers) != 1 {
+		t.Fatalf("expected 1 ephemeral container, got %d", len(pod.Spec.EphemeralContainers))
+	}
+
+	// Kubernetes rejects ephemeral containers with resources, so they must be
+	// left as they are.
+	debugger := pod.Spec.EphemeralContainers[0]
+	if len(debugger.Resources.Limits) != 0 || len(debugger.Resources.Requests) != 0 {
+		t.Errorf("expected no resources for the ephemeral container, got %v", debugger.Resources)
+	}
+
+	if len(debugger.VolumeMounts) != 0 || len(debugger.Env) != 0 {
+		t.Errorf("expected the ephemeral container to be left untouched, got %+v", debugger)
+	}
+
+	if value := pod.Annotations[epc]; value != "1Mi" {
+		t.Errorf("expected %s annotation %q, got %q", epc, "1Mi", value)
+	}
+}
+
+func TestReinvocation(t *testing.T) {
+	tcases := []struct {
+		name          string
+		quoteProvider string
+		containers    []corev1.Container
+	}{
+		{
+			name:          "aesmd DaemonSet",
+			quoteProvider: aesmdQuoteProvKey,
+			containers:    []corev1.Container{newTestContainer("app", "1Mi"), newTestContainer("sidecar", "4Mi")},
+		},
+		{
+			name:          "aesmd sidecar",
+			quoteProvider: aesmdQuoteProvKey,
+			containers:    []corev1.Container{newTestContainer("app", "1Mi"), newTestContainer("aesmd", "1Mi")},
+		},
+		{
+			name:          "in-process",
+			quoteProvider: "app",
+			containers:    []corev1.Container{newTestContainer("app", "1048576"), newTestContainer("other", "")},
+		},
+		{
+			name:          "in-process providers with aesmd",
+			quoteProvider: "app1,aesmd,app2",
+			containers:    []corev1.Container{newTestContainer("app1", "1Mi"), newTestContainer("app2", "1Mi"), newTestContainer("app3", "1Mi")},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			mutator := newTestMutator(t)
+
+			pod, _ := mutateTestPod(t, mutator, newTestPod(map[string]string{
+				quoteProvAnnotation:              tc.quoteProvider,
+				provisionJustificationAnnotation: "remote attestation",
+			}, tc.containers...))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			// Submitting the mutated pod again, e.g. when a controller
+			// re-applies it, must not change it.
+			again, resp := mutateTestPod(t, mutator, pod.DeepCopy())
+			if again == nil {
+				t.Fatal("mutated pod was not admitted")
+			}
+
+			if len(resp.Patches) > 0 {
+				t.Errorf("expected no patches for the mutated pod, got %v", resp.Patches)
+			}
+
+			if len(resp.Warnings) > 0 {
+				t.Errorf("expected no warnings for the mutated pod, got %v", resp.Warnings)
+			}
+
+			if again.Annotations[epc] != pod.Annotations[epc] {
+				t.Errorf("expected %s annotation %q, got %q", epc, pod.Annotations[epc], again.Annotations[epc])
+			}
+
+			// A stale total is overwritten, never added to.
+			stale := pod.DeepCopy()
+			stale.Annotations[epc] = "100Mi"
+
+			if overwritten, _ := mutateTestPod(t, mutator, stale); overwritten.Annotations[epc] != pod.Annotations[epc] {
+				t.Errorf("expected stale %s annotation to be overwritten with %q, got %q", epc, pod.Annotations[epc], overwritten.Annotations[epc])
+			}
+
+			for i := range pod.Spec.Containers {
+				if !reflect.DeepEqual(again.Spec.Containers[i].Resources, pod.Spec.Containers[i].Resources) {
+					t.Errorf("container %s: expected resources %v, got %v", pod.Spec.Containers[i].Name,
+						pod.Spec.Containers[i].Resources, again.Spec.Containers[i].Resources)
+				}
+			}
+		})
+	}
+}
+
+func TestQuoteProviderList(t *testing.T) {
+	tcases := []struct {
+		name               string
+		quoteProvider      string
+		expectedProviders  []string
+		expectedWarnings   int
+		expectedAesmdMount bool
+	}{
+		{
+			name:              "two in-process providers",
+			quoteProvider:     "app1, app2",
+			expectedProviders: []string{"app1", "app2"},
+		},
+		{
+			name:               "in-process providers with aesmd",
+			quoteProvider:      "app1,aesmd,app2",
+			expectedProviders:  []string{"app1", "app2"},
+			expectedAesmdMount: true,
+		},
+		{
+			name:              "unknown provider",
+			quoteProvider:     "app1,app9",
+			expectedProviders: []string{"app1"},
+			expectedWarnings:  1,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testPod := newTestPod(map[string]string{
+				quoteProvAnnotation:              tc.quoteProvider,
+				provisionJustificationAnnotation: "remote attestation",
+			}, newTestContainer("app1", "1Mi"), newTestContainer("app2", "1Mi"), newTestContainer("app3", "1Mi"))
+
+			pod, resp := mutateTestPod(t, newTestMutator(t), testPod)
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if len(resp.Warnings) != tc.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", tc.expectedWarnings, resp.Warnings)
+			}
+
+			providers := make([]string, 0)
+
+			for i := range pod.Spec.Containers {
+				container := &pod.Spec.Containers[i]
+
+				if _, ok := container.Resources.Limits[provision]; ok {
+					providers = append(providers, container.Name)
+				}
+
+				_, count := findEnv(container, "SGX_AESM_ADDR")
+				hasAesmdEnv := count == 1
+				mounted := countVolumeMounts(container, aesmdSocketDirectoryPath) == 1
+
+				if hasAesmdEnv != tc.expectedAesmdMount || mounted != tc.expectedAesmdMount {
+					t.Errorf("container %s: expected aesmd settings %v, got env %v and mount %v",
+						container.Name, tc.expectedAesmdMount, hasAesmdEnv, mounted)
+				}
+			}
+
+			if !reflect.DeepEqual(providers, tc.expectedProviders) {
+				t.Errorf("expected %s for %v, got %v", provision, tc.expectedProviders, providers)
+			}
+
+			// The Validator accepts the pods the Mutator has admitted.
+			if resp := validateTestPod(t, newTestValidator(t), pod); !resp.Allowed {
+				t.Errorf("mutated pod was denied: %v", resp.Result)
+			}
+		})
+	}
+}
+
+func TestMutatorLogging(t *testing.T) {
+	tcases := []struct {
+		name          string
+		quoteProvider string
+		containers    []corev1.Container
+		expected      []string
+	}{
+		{
+			name:          "in-process",
+			quoteProvider: "app",
+			containers:    []corev1.Container{newTestContainer("app", "1Mi")},
+			expected: []string{
+				`"msg"="Decoded the pod"`,
+				`"quoteProvider"="app"`,
+				`"msg"="Mutated the container"`,
+				`"container"="app"`,
+				`"sgx.intel.com/provision"="1"`,
+				`"quoteGeneration"="in-process"`,
+				`"totalEpc"=1048576`,
+			},
+		},
+		{
+			name:          "aesmd sidecar",
+			quoteProvider: "aesmd",
+			containers:    []corev1.Container{newTestContainer("app", "1Mi"), newTestContainer("aesmd", "1Mi")},
+			expected:      []string{`"quoteGeneration"="aesmd sidecar"`, `"totalEpc"=2097152`},
+		},
+		{
+			name:          "aesmd DaemonSet",
+			quoteProvider: "aesmd",
+			containers:    []corev1.Container{newTestContainer("app", "1Mi")},
+			expected:      []string{`"quoteGeneration"="aesmd DaemonSet"`},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := []string{}
+
+			mutator := newTestMutator(t)
+			mutator.Log = funcr.New(func(prefix, args string) {
+				lines = append(lines, args)
+			}, funcr.Options{Verbosity: 1})
+
+			if pod, _ := mutateTestPod(t, mutator, newTestPod(map[string]string{quoteProvAnnotation: tc.quoteProvider}, tc.containers...)); pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			output := strings.Join(lines, "\n")
+
+			for _, field := range append(tc.expected, `"pod"="test-ns/test-pod"`) {
+				if !strings.Contains(output, field) {
+					t.Errorf("%s is missing from the log:\n%s", field, output)
+				}
+			}
+		})
+	}
+
+	// Nothing is logged at the info level.
+	lines := 0
+
+	mutator := newTestMutator(t)
+	mutator.Log = funcr.New(func(prefix, args string) { lines++ }, funcr.Options{})
+
+	if pod, _ := mutateTestPod(t, mutator, newTestPod(map[string]string{quoteProvAnnotation: "app"}, newTestContainer("app", "1Mi"))); pod == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	if lines != 0 {
+		t.Errorf("expected no info level logs, got %d lines", lines)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	pod := newTestPod(map[string]string{quoteProvAnnotation: "app"}, newTestContainer("app", "1Mi"))
+
+	_, enforced := mutateTestPod(t, newTestMutator(t), pod.DeepCopy())
+	if len(enforced.Patches) == 0 {
+		t.Fatal("expected patches without the dry run")
+	}
+
+	mutator := newTestMutator(t)
+	mutator.DryRun = true
+
+	mutated, resp := mutateTestPod(t, mutator, pod.DeepCopy())
+	if mutated == nil {
+		t.Fatal("pod was not admitted")
+	}
+
+	if len(resp.Patches) != 0 || resp.Patch != nil {
+		t.Errorf("expected no patches in the dry run, got %v", resp.Patches)
+	}
+
+	if !reflect.DeepEqual(mutated.Spec, pod.Spec) || !reflect.DeepEqual(mutated.Annotations, pod.Annotations) {
+		t.Errorf("expected the pod unchanged, got %+v", mutated)
+	}
+
+	described := []string{}
+
+	for _, warning := range resp.Warnings {
+		if strings.HasPrefix(warning, dryRunWarningPrefix) {
+			described = append(described, warning)
+		}
+	}
+
+	if len(described) != len(enforced.Patches) {
+		t.Fatalf("expected %d mutations described, got %v", len(enforced.Patches), described)
+	}
+
+	// The patches are not in a fixed order.
+	expected := make(map[string]bool, len(enforced.Patches))
+	for _, patch := range enforced.Patches {
+		expected[patch.Operation+" "+patch.Path] = true
+	}
+
+	for _, warning := range described {
+		fields := strings.SplitN(strings.TrimPrefix(warning, dryRunWarningPrefix), " ", 3)
+		if len(fields) < 2 || !expected[fields[0]+" "+fields[1]] {
+			t.Errorf("unexpected warning %q", warning)
+		}
+	}
+
+	// The warnings of the mutations are kept.
+	if len(resp.Warnings)-len(described) != len(enforced.Warnings) {
+		t.Errorf("expected the warnings %v, got %v", enforced.Warnings, resp.Warnings)
+	}
+}
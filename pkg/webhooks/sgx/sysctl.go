@@ -0,0 +1,102 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const sysctlsAnnotation = namespace + "/sysctls"
+
+// namespacedSysctlPrefixes are the prefixes of the sysctls isolated by the
+// kernel namespaces of a pod, which kubelet lets pods set.
+var namespacedSysctlPrefixes = []string{
+	"kernel.shm",
+	"kernel.msg",
+	"kernel.sem",
+	"fs.mqueue.",
+	"net.",
+}
+
+// validateAllowedSysctls checks that only namespaced sysctls are allowed, as
+// the others would affect the whole node.
+func validateAllowedSysctls(sysctls []string) error {
+	for _, name := range sysctls {
+		namespaced := false
+
+		for _, prefix := range namespacedSysctlPrefixes {
+			namespaced = namespaced || strings.HasPrefix(name, prefix)
+		}
+
+		if !namespaced || strings.ContainsAny(name, " =,") {
+			return errors.Errorf("sysctl %q is not a namespaced sysctl", name)
+		}
+	}
+
+	return nil
+}
+
+// addSysctls adds the sysctls requested in the sgx.intel.com/sysctls annotation,
+// e.g. net.core.somaxconn=1024, to the pod security context. Only the allowed
+// sysctls are added, the others are skipped with a warning. Sysctls the pod
+// sets already are kept.
+func (s *Mutator) addSysctls(pod *corev1.Pod) []string {
+	requested, ok := pod.Annotations[sysctlsAnnotation]
+	if !ok || len(s.AllowedSysctls) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool, len(s.AllowedSysctls))
+	for _, name := range s.AllowedSysctls {
+		allowed[name] = true
+	}
+
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+
+	existing := make(map[string]bool)
+	for _, sysctl := range pod.Spec.SecurityContext.Sysctls {
+		existing[sysctl.Name] = true
+	}
+
+	warnings := make([]string, 0)
+	sysctls := make([]corev1.Sysctl, 0)
+
+	for _, entry := range strings.Split(requested, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+
+		switch {
+		case len(parts) != 2 || name == "":
+			warnings = append(warnings, "invalid sysctl "+entry+" in "+sysctlsAnnotation+", expected name=value")
+		case !allowed[name]:
+			warnings = append(warnings, "sysctl "+name+" in "+sysctlsAnnotation+" is not allowed")
+		case !existing[name]:
+			existing[name] = true
+			sysctls = append(sysctls, corev1.Sysctl{Name: name, Value: strings.TrimSpace(parts[1])})
+		}
+	}
+
+	sort.Slice(sysctls, func(i, j int) bool { return sysctls[i].Name < sysctls[j].Name })
+
+	pod.Spec.SecurityContext.Sysctls = append(pod.Spec.SecurityContext.Sysctls, sysctls...)
+
+	return warnings
+}
@@ -0,0 +1,324 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/pods-sgx-validate,mutating=false,failurePolicy=ignore,groups="",resources=pods,verbs=create;update,versions=v1,name=sgx.validator.webhooks.intel.com,sideEffects=None,admissionReviewVersions=v1
+
+// Validator rejects Pods with contradicting or malformed SGX settings.
+type Validator struct {
+	Client client.Client
+	// DecisionSink archives the admission decisions of SGX pods, nil if disabled.
+	DecisionSink *DecisionSink
+	decoder      *admission.Decoder
+	nodeEpc      nodeEpcCache
+	// RejectUnschedulableEpc rejects pods requesting more EPC than the
+	// largest node has.
+	RejectUnschedulableEpc bool
+	// AesmdContainerName is the name of the aesmd sidecar container of pods
+	// not naming it in the sgx.intel.com/aesmd-container annotation, "aesmd"
+	// if empty.
+	AesmdContainerName string
+	// RequireProvisionJustification rejects pods granted sgx.intel.com/provision
+	// without the sgx.intel.com/provision-justification annotation, which the
+	// Mutator only warns about.
+	RequireProvisionJustification bool
+	// AllowedMrenclaves are the enclave measurements pods may set in the
+	// sgx.intel.com/mrenclave annotation, any if empty. See NormalizeMrenclaves.
+	AllowedMrenclaves []string
+	// AllowedLaunchPolicies are the launch control policies pods may set in
+	// the sgx.intel.com/launch-policy annotation, any if empty. See
+	// ValidateLaunchPolicies.
+	AllowedLaunchPolicies []string
+	// EpcResourceNames are the resource names accepted as EPC requests
+	// besides sgx.intel.com/epc, as configured for the Mutator.
+	EpcResourceNames []string
+	// ProductionNamespaceSelector is a label selector, e.g.
+	// environment=production, of the namespaces in which pods with debug
+	// enclaves are rejected. Empty allows them everywhere.
+	ProductionNamespaceSelector string
+}
+
+// ValidateLaunchPolicies returns an error if one of the launch control policy
+// references isn't valid.
+func ValidateLaunchPolicies(policies []string) error {
+	for _, policy := range policies {
+		if err := validatePolicyRef(policy); err != nil {
+			return errors.Wrap(err, "invalid launch control policy")
+		}
+	}
+
+	return nil
+}
+
+// NormalizeMrenclaves returns the lowercased measurements, or an error if one
+// of them isn't a hex encoded enclave measurement.
+func NormalizeMrenclaves(measurements []string) ([]string, error) {
+	normalized := make([]string, 0, len(measurements))
+
+	for _, measurement := range measurements {
+		measurement = normalizeName(measurement)
+
+		if err := validateMrenclave(measurement); err != nil {
+			return nil, err
+		}
+
+		normalized = append(normalized, measurement)
+	}
+
+	return normalized, nil
+}
+
+// validateMrenclaveAllowed rejects pods whose sgx.intel.com/mrenclave
+// annotation isn't one of the allowed measurements. Pods without the
+// annotation are not checked.
+func validateMrenclaveAllowed(pod *corev1.Pod, allowed []string) error {
+	value, ok := pod.Annotations[mrenclaveAnnotation]
+	if !ok || len(allowed) == 0 {
+		return nil
+	}
+
+	value = normalizeName(value)
+
+	for _, measurement := range allowed {
+		if value == measurement {
+			return nil
+		}
+	}
+
+	return errors.Errorf("enclave measurement %s of %s is not allowed", value, mrenclaveAnnotation)
+}
+
+// validateLaunchPolicyAllowed rejects pods whose sgx.intel.com/launch-policy
+// annotation isn't one of the allowed launch control policies. Pods without
+// the annotation are not checked.
+func validateLaunchPolicyAllowed(pod *corev1.Pod, allowed []string) error {
+	value, ok := pod.Annotations[launchPolicyAnnotation]
+	if !ok || len(allowed) == 0 {
+		return nil
+	}
+
+	value = strings.TrimSpace(value)
+
+	for _, policy := range allowed {
+		if value == policy {
+			return nil
+		}
+	}
+
+	return errors.Errorf("launch control policy %s of %s is not allowed", value, launchPolicyAnnotation)
+}
+
+// quoteProviders returns the entries of the comma separated
+// sgx.intel.com/quote-provider annotation.
+func quoteProviders(pod *corev1.Pod) []string {
+	providers := make([]string, 0)
+
+	for _, provider := range strings.Split(pod.Annotations[quoteProvAnnotation], ",") {
+		if provider = strings.TrimSpace(provider); provider != "" {
+			providers = append(providers, provider)
+		}
+	}
+
+	return providers
+}
+
+// validateQuoteGenerationMode rejects pods mixing the out-of-process (aesmd) and
+// in-process quote generation modes. sgx.intel.com/quote-provider may list
+// "aesmd" together with in-process quote providers, which generate their quotes
+// themselves while the other containers use aesmd. The modes conflict when
+// sgx.intel.com/quote-provider names "aesmd" and a container other than the
+// listed providers and the aesmd sidecar, named aesmdName, requests
+// sgx.intel.com/provision, which is only needed in-process. Init containers are
+// checked too.
+func validateQuoteGenerationMode(pod *corev1.Pod, aesmdName string) error {
+	aesmdMode := false
+	inProcess := make(map[string]bool)
+
+	for _, provider := range quoteProviders(pod) {
+		if provider == aesmdQuoteProvKey {
+			aesmdMode = true
+		} else {
+			inProcess[provider] = true
+		}
+	}
+
+	if !aesmdMode {
+		return nil
+	}
+
+	provisionOnly := provisionOnlyContainers(pod)
+
+	// Init containers get the same quote generation settings as the
+	// containers, but none of them is the aesmd sidecar.
+	for _, container := range pod.Spec.InitContainers {
+		if inProcess[container.Name] || provisionOnly[container.Name] {
+			continue
+		}
+
+		if _, ok := container.Resources.Limits[provision]; ok {
+			return errors.Errorf("init container %q requests %s for in-process quote generation but is not listed in %s next to %q",
+				container.Name, provision, quoteProvAnnotation, aesmdQuoteProvKey)
+		}
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name == aesmdName || inProcess[container.Name] || provisionOnly[container.Name] {
+			continue
+		}
+
+		if _, ok := container.Resources.Limits[provision]; ok {
+			return errors.Errorf("container %q requests %s for in-process quote generation but is not listed in %s next to %q",
+				container.Name, provision, quoteProvAnnotation, aesmdQuoteProvKey)
+		}
+	}
+
+	return nil
+}
+
+// validateSgxResources rejects pods with malformed EPC requests or which
+// request the SGX resources added by the Mutator themselves. The Validator
+// sees the mutated pod, so only sgx.intel.com/enclave of containers not
+// requesting EPC and sgx.intel.com/provision of containers other than the
+// quote providers and the provision-only containers can tell a direct
+// request apart.
+func validateSgxResources(pod *corev1.Pod, aesmdName string, epcNames []corev1.ResourceName) error {
+	provisionOnly := provisionOnlyContainers(pod)
+	providers := make(map[string]bool)
+
+	for _, provider := range quoteProviders(pod) {
+		if provider == aesmdQuoteProvKey {
+			provider = aesmdName
+		}
+
+		providers[provider] = true
+	}
+
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			requestsEpc := false
+
+			for _, name := range epcNames {
+				size, ok := container.Resources.Limits[name]
+				if !ok {
+					continue
+				}
+
+				if size.Sign() <= 0 || size.MilliValue()%1000 != 0 {
+					return errors.Errorf("container %q requests %s of %s, expected a positive number of bytes",
+						container.Name, size.String(), name)
+				}
+
+				requestsEpc = true
+			}
+
+			if _, ok := container.Resources.Limits[encl]; ok && !requestsEpc {
+				return errors.Errorf("container %q requests %s directly, request %s instead",
+					container.Name, encl, epc)
+			}
+
+			granted := (requestsEpc && providers[container.Name]) || (!requestsEpc && provisionOnly[container.Name])
+
+			if _, ok := container.Resources.Limits[provision]; ok && !granted {
+				return errors.Errorf("container %q requests %s directly, name it in %s instead",
+					container.Name, provision, quoteProvAnnotation)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Handle implements controller-runtimes's admission.Handler inteface.
+func (v *Validator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+
+	if err := v.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	resp := v.validate(ctx, req.Namespace, pod)
+
+	if v.DecisionSink != nil && podEpc(pod, epcResourceNames(v.EpcResourceNames)) > 0 {
+		v.DecisionSink.Record(newDecisionRecord("validating", req, pod, resp))
+	}
+
+	return resp
+}
+
+// validate runs the validations of the pod of namespace ns.
+func (v *Validator) validate(ctx context.Context, ns string, pod *corev1.Pod) admission.Response {
+	if err := validateQuoteGenerationMode(pod, podAesmdContainerName(pod, v.AesmdContainerName)); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	if err := validateSgxResources(pod, podAesmdContainerName(pod, v.AesmdContainerName), epcResourceNames(v.EpcResourceNames)); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	if v.RequireProvisionJustification {
+		if err := validateProvisionJustification(pod); err != nil {
+			return admission.Denied(err.Error())
+		}
+	}
+
+	if err := validateForwardedAnnotations(pod); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	if err := validateMrenclaveAllowed(pod, v.AllowedMrenclaves); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	if err := validateLaunchPolicyAllowed(pod, v.AllowedLaunchPolicies); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	if err := v.validateEnclaveDebug(ctx, ns, pod); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	epcNames := epcResourceNames(v.EpcResourceNames)
+
+	if v.RejectUnschedulableEpc && podEpc(pod, epcNames) > 0 {
+		largest, err := v.nodeEpc.get(ctx, v.Client)
+		if err != nil {
+			return admission.Allowed("").WithWarnings("unable to check the EPC capacity of the nodes: " + err.Error())
+		}
+
+		if err := validateEpcCapacity(pod, epcNames, largest); err != nil {
+			return admission.Denied(err.Error())
+		}
+	}
+
+	return admission.Allowed("")
+}
+
+// InjectDecoder implements controller-runtime's admission.DecoderInjector interface.
+// A decoder will be automatically injected.
+func (v *Validator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
@@ -0,0 +1,391 @@
+// Copyright 2022 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sgx
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newTestValidator(t *testing.T) *Validator {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("unable to create scheme: %+v", err)
+	}
+
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatalf("unable to create decoder: %+v", err)
+	}
+
+	validator := &Validator{}
+	if err := validator.InjectDecoder(decoder); err != nil {
+		t.Fatalf("unable to inject decoder: %+v", err)
+	}
+
+	return validator
+}
+
+func validateTestPod(t *testing.T, validator *Validator, pod *corev1.Pod) admission.Response {
+	t.Helper()
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("unable to marshal pod: %+v", err)
+	}
+
+	return validator.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Namespace: pod.Namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+}
+
+func withProvision(container corev1.Container) corev1.Container {
+	container.Resources.Limits[provision] = resource.MustParse("1")
+	container.Resources.Requests[provision] = resource.MustParse("1")
+
+	return container
+}
+
+func TestValidateQuoteGenerationMode(t *testing.T) {
+	tcases := []struct {
+		name            string
+		quoteProvider   string
+		aesmdName       string
+		annotatedName   string
+		expectedReason  string
+		initContainers  []corev1.Container
+		containers      []corev1.Container
+		expectedAllowed bool
+	}{
+		{
+			name:            "no quote provider",
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedAllowed: true,
+		},
+		{
+			name:            "in-process only",
+			quoteProvider:   "app",
+			containers:      []corev1.Container{withProvision(newTestContainer("app", "1Mi"))},
+			expectedAllowed: true,
+		},
+		{
+			name:            "aesmd DaemonSet only",
+			quoteProvider:   "aesmd",
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedAllowed: true,
+		},
+		{
+			name:          "aesmd sidecar only",
+			quoteProvider: "aesmd",
+			containers: []corev1.Container{
+				newTestContainer("app", "1Mi"),
+				withProvision(newTestContainer("aesmd", "1Mi")),
+			},
+			expectedAllowed: true,
+		},
+		{
+			name:          "renamed aesmd sidecar",
+			quoteProvider: "aesmd",
+			aesmdName:     "sgx-aesmd",
+			containers: []corev1.Container{
+				newTestContainer("app", "1Mi"),
+				withProvision(newTestContainer("sgx-aesmd", "1Mi")),
+			},
+			expectedAllowed: true,
+		},
+		{
+			name:          "default aesmd name with a renamed sidecar",
+			quoteProvider: "aesmd",
+			aesmdName:     "sgx-aesmd",
+			containers: []corev1.Container{
+				newTestContainer("app", "1Mi"),
+				withProvision(newTestContainer("aesmd", "1Mi")),
+			},
+			expectedAllowed: false,
+		},
+		{
+			name:          "annotated aesmd sidecar",
+			quoteProvider: "aesmd",
+			annotatedName: "release-1-quote-service",
+			containers: []corev1.Container{
+				newTestContainer("app", "1Mi"),
+				withProvision(newTestContainer("release-1-quote-service", "1Mi")),
+			},
+			expectedAllowed: true,
+		},
+		{
+			name:          "default aesmd name with an annotated sidecar",
+			quoteProvider: "aesmd",
+			annotatedName: "release-1-quote-service",
+			containers: []corev1.Container{
+				newTestContainer("app", "1Mi"),
+				withProvision(newTestContainer("aesmd", "1Mi")),
+			},
+			expectedAllowed: false,
+		},
+		{
+			name:          "aesmd listed with in-process providers",
+			quoteProvider: "app1,aesmd,app2",
+			containers: []corev1.Container{
+				withProvision(newTestContainer("app1", "1Mi")),
+				withProvision(newTestContainer("app2", "1Mi")),
+				newTestContainer("app3", "1Mi"),
+			},
+			expectedAllowed: true,
+		},
+		{
+			name:          "aesmd listed with an in-process provider and another container requesting provision",
+			quoteProvider: "aesmd,app1",
+			containers: []corev1.Container{
+				withProvision(newTestContainer("app1", "1Mi")),
+				withProvision(newTestContainer("app2", "1Mi")),
+			},
+			expectedAllowed: false,
+		},
+		{
+			name:          "aesmd with a container requesting provision",
+			quoteProvider: "aesmd",
+			containers: []corev1.Container{
+				withProvision(newTestContainer("app", "1Mi")),
+			},
+			expectedAllowed: false,
+		},
+		{
+			name:            "aesmd with an init container requesting provision",
+			quoteProvider:   "aesmd",
+			initContainers:  []corev1.Container{withProvision(newTestContainer("init", "1Mi"))},
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedReason:  `init container "init" requests sgx.intel.com/provision`,
+			expectedAllowed: false,
+		},
+		{
+			name:            "aesmd with an init container named like the sidecar requesting provision",
+			quoteProvider:   "aesmd",
+			initContainers:  []corev1.Container{withProvision(newTestContainer("aesmd", "1Mi"))},
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedReason:  `init container "aesmd" requests sgx.intel.com/provision`,
+			expectedAllowed: false,
+		},
+		{
+			name:            "aesmd listed with an in-process init container",
+			quoteProvider:   "aesmd,init",
+			initContainers:  []corev1.Container{withProvision(newTestContainer("init", "1Mi"))},
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			expectedAllowed: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tc.quoteProvider != "" {
+				annotations[quoteProvAnnotation] = tc.quoteProvider
+			}
+
+			if tc.annotatedName != "" {
+				annotations[aesmdContainerAnnotation] = tc.annotatedName
+			}
+
+			validator := newTestValidator(t)
+			validator.AesmdContainerName = tc.aesmdName
+
+			pod := newTestPod(annotations, tc.containers...)
+			pod.Spec.InitContainers = tc.initContainers
+
+			resp := validateTestPod(t, validator, pod)
+			if resp.Allowed != tc.expectedAllowed {
+				t.Errorf("expected allowed=%v, got %v: %v", tc.expectedAllowed, resp.Allowed, resp.Result)
+			}
+
+			if tc.expectedReason != "" && (resp.Result == nil || !strings.Contains(string(resp.Result.Reason), tc.expectedReason)) {
+				t.Errorf("expected the reason to contain %q, got %v", tc.expectedReason, resp.Result)
+			}
+
+			if !resp.Allowed && (resp.Result == nil || resp.Result.Reason == "") {
+				t.Error("denied without an explanation")
+			}
+		})
+	}
+}
+
+func withResource(container corev1.Container, name corev1.ResourceName, quantity string) corev1.Container {
+	container.Resources.Limits[name] = resource.MustParse(quantity)
+	container.Resources.Requests[name] = resource.MustParse(quantity)
+
+	return container
+}
+
+func TestValidateSgxResources(t *testing.T) {
+	tcases := []struct {
+		name            string
+		quoteProvider   string
+		containers      []corev1.Container
+		initContainers  []corev1.Container
+		expectedAllowed bool
+	}{
+		{
+			name:            "EPC request",
+			containers:      []corev1.Container{newTestContainer("app", "10Mi")},
+			expectedAllowed: true,
+		},
+		{
+			name:            "zero EPC request",
+			containers:      []corev1.Container{newTestContainer("app", "0")},
+			expectedAllowed: false,
+		},
+		{
+			name:            "fractional EPC request",
+			containers:      []corev1.Container{newTestContainer("app", "1500m")},
+			expectedAllowed: false,
+		},
+		{
+			name:            "zero EPC request of an init container",
+			containers:      []corev1.Container{newTestContainer("app", "1Mi")},
+			initContainers:  []corev1.Container{newTestContainer("init", "0")},
+			expectedAllowed: false,
+		},
+		{
+			name:            "enclave requested directly",
+			containers:      []corev1.Container{withResource(newTestContainer("app", ""), encl, "1")},
+			expectedAllowed: false,
+		},
+		{
+			name:            "provision requested directly",
+			containers:      []corev1.Container{withProvision(newTestContainer("app", "1Mi"))},
+			expectedAllowed: false,
+		},
+		{
+			name:            "provision requested by a quote provider without EPC",
+			quoteProvider:   "app",
+			containers:      []corev1.Container{withProvision(newTestContainer("app", ""))},
+			expectedAllowed: false,
+		},
+		{
+			name:          "mutated quote providers",
+			quoteProvider: "app",
+			containers: []corev1.Container{
+				withResource(withProvision(newTestContainer("app", "1Mi")), encl, "1"),
+				withResource(newTestContainer("other", "1Mi"), encl, "1"),
+			},
+			expectedAllowed: true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tc.quoteProvider != "" {
+				annotations[quoteProvAnnotation] = tc.quoteProvider
+			}
+
+			pod := newTestPod(annotations, tc.containers...)
+			pod.Spec.InitContainers = tc.initContainers
+
+			resp := validateTestPod(t, newTestValidator(t), pod)
+			if resp.Allowed != tc.expectedAllowed {
+				t.Errorf("expected allowed=%v, got %v: %v", tc.expectedAllowed, resp.Allowed, resp.Result)
+			}
+
+			if !resp.Allowed && (resp.Result == nil || resp.Result.Reason == "") {
+				t.Error("denied without an explanation")
+			}
+		})
+	}
+}
+
+func TestProvisionJustification(t *testing.T) {
+	tcases := []struct {
+		name             string
+		justification    string
+		strict           bool
+		expectedAllowed  bool
+		expectedWarnings int
+	}{
+		{
+			name:             "justified",
+			justification:    "remote attestation",
+			expectedAllowed:  true,
+			expectedWarnings: 0,
+		},
+		{
+			name:             "unjustified",
+			expectedAllowed:  true,
+			expectedWarnings: 1,
+		},
+		{
+			name:             "blank justification",
+			justification:    "  ",
+			expectedAllowed:  true,
+			expectedWarnings: 1,
+		},
+		{
+			name:             "justified in strict mode",
+			justification:    "remote attestation",
+			strict:           true,
+			expectedAllowed:  true,
+			expectedWarnings: 0,
+		},
+		{
+			name:             "unjustified in strict mode",
+			strict:           true,
+			expectedAllowed:  false,
+			expectedWarnings: 1,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{quoteProvAnnotation: "app"}
+			if tc.justification != "" {
+				annotations[provisionJustificationAnnotation] = tc.justification
+			}
+
+			pod, mresp := mutateTestPod(t, newTestMutator(t), newTestPod(annotations, newTestContainer("app", "1Mi")))
+			if pod == nil {
+				t.Fatal("pod was not admitted")
+			}
+
+			if len(mresp.Warnings) != tc.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", tc.expectedWarnings, mresp.Warnings)
+			}
+
+			validator := newTestValidator(t)
+			validator.RequireProvisionJustification = tc.strict
+
+			resp := validateTestPod(t, validator, pod)
+			if resp.Allowed != tc.expectedAllowed {
+				t.Errorf("expected allowed=%v, got %v: %v", tc.expectedAllowed, resp.Allowed, resp.Result)
+			}
+
+			if !resp.Allowed && (resp.Result == nil || !strings.Contains(string(resp.Result.Reason), provisionJustificationAnnotation)) {
+				t.Errorf("denial doesn't name the %s annotation: %v", provisionJustificationAnnotation, resp.Result)
+			}
+		})
+	}
+}